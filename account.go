@@ -0,0 +1,582 @@
+package newsletter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+const (
+	// DefaultMagicLinkTTL is how long a magic link signs in
+	DefaultMagicLinkTTL = 15 * time.Minute
+	// DefaultSessionTTL is how long a session lasts
+	DefaultSessionTTL = 30 * 24 * time.Hour
+	// SessionCookie is the cookie of the sessions of the subscribers
+	SessionCookie = "newsletter_session"
+	// DefaultLoginLimit is the number of magic links an email can ask for within LoginWindow
+	DefaultLoginLimit = 5
+	// DefaultLoginIPLimit is the number of magic links a client IP can ask for within LoginWindow
+	DefaultLoginIPLimit = 20
+	// LoginWindow is the period the login limits count the magic links over
+	LoginWindow = time.Hour
+)
+
+// Purposes of the tokens signed by Accounts, so a token of one cannot be used as the other
+const (
+	purposeLogin   = "login"
+	purposeSession = "session"
+	purposeErase   = "erase"
+)
+
+// AccountStorage is the storage of the subscriptions managed by their subscribers
+type AccountStorage interface {
+	Storage
+	UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	DeleteNewsletter(ctx context.Context, userEmail string) error
+}
+
+// Accounts lets the subscribers manage their subscription, signed in by magic links sent to their email.
+// The links and the sessions are signed tokens, nothing is stored: changing the secret signs everyone out, and
+// signing out only clears the cookie, a copy of the session stays valid until it expires.
+type Accounts struct {
+	Storage AccountStorage
+	Email   Email
+	Secret  string
+	// BaseURL is the URL the HTTP server is reachable at, that the magic links point to. It is configured rather
+	// than taken from the requests, so a forged Host cannot send the links of the subscribers elsewhere.
+	BaseURL string
+	// LinkTTL is how long a magic link signs in, DefaultMagicLinkTTL when zero
+	LinkTTL time.Duration
+	// SessionTTL is how long a session lasts, DefaultSessionTTL when zero
+	SessionTTL time.Duration
+	// Privacy exports and erases the data of the subscribers
+	Privacy *Privacy
+	// LoginLimit and LoginIPLimit are the number of magic links an email and a client IP can ask for within
+	// LoginWindow, no limit when zero. The IP is the remote address of the connection.
+	LoginLimit   int
+	LoginIPLimit int
+
+	now    func() time.Time
+	logins rateLimiter
+}
+
+// NewAccounts returns the Accounts of the subscriptions of s, with the default TTLs
+func NewAccounts(s AccountStorage, e Email, secret, baseURL string) *Accounts {
+	return &Accounts{
+		Storage:      s,
+		Email:        e,
+		Secret:       secret,
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		LinkTTL:      DefaultMagicLinkTTL,
+		SessionTTL:   DefaultSessionTTL,
+		Privacy:      NewPrivacy(s, e),
+		LoginLimit:   DefaultLoginLimit,
+		LoginIPLimit: DefaultLoginIPLimit,
+		now:          time.Now,
+	}
+}
+
+// rateLimiter counts the events of every key in fixed windows
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+// rateLimiterSweep is the number of keys above which the expired windows are dropped
+const rateLimiterSweep = 10000
+
+// allow counts an event of key at now, reporting whether it is within the limit of the window of period.
+// A limit less than or equal to zero allows everything.
+func (l *rateLimiter) allow(key string, limit int, period time.Duration, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.windows == nil {
+		l.windows = map[string]rateWindow{}
+	}
+	if len(l.windows) > rateLimiterSweep {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= period {
+				delete(l.windows, k)
+			}
+		}
+	}
+	w := l.windows[key]
+	if now.Sub(w.start) >= period {
+		w = rateWindow{start: now}
+	}
+	w.n++
+	l.windows[key] = w
+	return w.n <= limit
+}
+
+// SendMagicLink emails the subscriber a link that signs in, returning mongodb.ErrNotFound when the email has no
+// subscription.
+func (a *Accounts) SendMagicLink(ctx context.Context, userEmail string) error {
+	if _, err := a.Storage.Subscription(ctx, userEmail); err != nil {
+		return err
+	}
+
+	ttl := a.LinkTTL
+	if ttl <= 0 {
+		ttl = DefaultMagicLinkTTL
+	}
+	token := a.sign(purposeLogin, userEmail, a.now().Add(ttl))
+	link := a.BaseURL + "/account/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nOpen this link, valid for %s, to manage your newsletter:\n\n%s\n\n"+
+		"If you did not ask for it, ignore this email.", userEmail, ttl, link)
+	if err := a.Email.Send([]string{userEmail}, body); err != nil {
+		return fmt.Errorf("error sending magic link: %v", err)
+	}
+	return nil
+}
+
+// SendErasureLink emails the subscriber a link to confirm the erasure of its data, so the erasure needs both a
+// session and the mailbox.
+func (a *Accounts) SendErasureLink(userEmail string) error {
+	ttl := a.LinkTTL
+	if ttl <= 0 {
+		ttl = DefaultMagicLinkTTL
+	}
+	token := a.sign(purposeErase, userEmail, a.now().Add(ttl))
+	link := a.BaseURL + "/account/erase/confirm?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nOpen this link, valid for %s, to confirm the erasure of your subscription and of "+
+		"everything the newsletter stored about you:\n\n%s\n\nThe erasure cannot be undone. If you did not ask for it, "+
+		"ignore this email.", userEmail, ttl, link)
+	if err := a.Email.Send([]string{userEmail}, body); err != nil {
+		return fmt.Errorf("error sending erasure link: %v", err)
+	}
+	return nil
+}
+
+// sign returns a token of the purpose for the user, valid until expires. The token is the user and the expiry,
+// followed by their signature.
+func (a *Accounts) sign(purpose, userEmail string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userEmail)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + a.signature(purpose, payload)
+}
+
+func (a *Accounts) signature(purpose, payload string) string {
+	mac := hmac.New(sha256.New, []byte(a.Secret))
+	mac.Write([]byte(purpose + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the user of a token of sign, checking its purpose, signature and expiry
+func (a *Accounts) verify(purpose, token string) (string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", errors.New("malformed token")
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(a.signature(purpose, payload))) {
+		return "", errors.New("invalid token")
+	}
+
+	encoded, expiry, _ := strings.Cut(payload, ".")
+	email, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	if !a.now().Before(time.Unix(expires, 0)) {
+		return "", errors.New("expired token")
+	}
+	return string(email), nil
+}
+
+// Account is a subscription as its subscriber sees and edits it
+type Account struct {
+	Email string   `json:"email"`
+	URLs  []string `json:"urls"`
+	// Cadence is daily, weekly, or empty to be notified as soon as there are changes
+	Cadence string `json:"cadence"`
+	// Channels are written as type:address, the email of the subscriber when empty
+	Channels []string `json:"channels"`
+}
+
+// accountOf returns the account of the subscription
+func accountOf(n mongodb.Newsletter) Account {
+	acc := Account{Email: n.UserEmail, URLs: n.URLs, Cadence: n.Cadence, Channels: []string{}}
+	if acc.URLs == nil {
+		acc.URLs = []string{}
+	}
+	for _, ch := range n.Channels {
+		acc.Channels = append(acc.Channels, ch.Type+":"+ch.Address)
+	}
+	return acc
+}
+
+// findChannel returns the channel of channels with the type and the address of ch, with its secret
+func findChannel(channels []mongodb.Channel, ch mongodb.Channel) (mongodb.Channel, bool) {
+	for _, c := range channels {
+		if c.Type == ch.Type && c.Address == ch.Address {
+			return c, true
+		}
+	}
+	return ch, false
+}
+
+// selfService reports whether the subscriber of email may add ch without an operator: their own email, that they
+// proved to own by signing in, or a webhook hosted by Slack or Discord. The other addresses would let anyone send
+// the newsletter to others, or the requests of the newsletter to any host.
+func selfService(ch mongodb.Channel, email string) bool {
+	u, err := url.Parse(ch.Address)
+	switch ch.Type {
+	case ChannelEmail:
+		return strings.EqualFold(ch.Address, email)
+	case ChannelSlack:
+		return err == nil && u.Scheme == "https" && u.Host == "hooks.slack.com"
+	case ChannelDiscord:
+		return err == nil && u.Scheme == "https" && (u.Host == "discord.com" || u.Host == "discordapp.com") &&
+			strings.HasPrefix(u.Path, "/api/webhooks/")
+	}
+	return false
+}
+
+// apply returns the subscription n edited by the account, keeping the filters of the URLs that are kept. The channels
+// it adds are limited to those of selfService, the channels of n are kept as they are, with their secrets.
+func (acc Account) apply(n mongodb.Newsletter) (mongodb.Newsletter, error) {
+	var urls []string
+	for _, u := range acc.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return n, fmt.Errorf("invalid URL %q", u)
+		}
+		if !contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return n, errors.New("a subscription needs at least one URL")
+	}
+	if _, err := CadenceInterval(acc.Cadence); err != nil {
+		return n, err
+	}
+	var channels []mongodb.Channel
+	for _, v := range acc.Channels {
+		ch, err := ParseChannel(v)
+		if err != nil {
+			return n, err
+		}
+		// The channels kept keep their secret, the receivers of their webhooks know it.
+		kept, ok := findChannel(n.Channels, ch)
+		if !ok && !selfService(ch, n.UserEmail) {
+			return n, fmt.Errorf("channel %q can only be added by an operator, the subscribers can add their "+
+				"own email and Slack or Discord webhooks", v)
+		}
+		channels = append(channels, kept)
+	}
+
+	var filters []mongodb.Filter
+	for _, f := range n.Filters {
+		if f.URL == "" || contains(urls, f.URL) {
+			filters = append(filters, f)
+		}
+	}
+	n.URLs, n.Cadence, n.Channels, n.Filters = urls, acc.Cadence, channels, filters
+	return n, nil
+}
+
+// session returns the user signed in by the session cookie of the request
+func (a *Accounts) session(r *http.Request) (string, bool) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", false
+	}
+	email, err := a.verify(purposeSession, c.Value)
+	return email, err == nil
+}
+
+// setSession signs the user in with a session cookie
+func (a *Accounts) setSession(w http.ResponseWriter, userEmail string) {
+	ttl := a.SessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	expires := a.now().Add(ttl)
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    a.sign(purposeSession, userEmail, expires),
+		Path:     "/account",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.BaseURL, "https://"),
+		// Lax keeps the cookie out of the requests other sites send to the API, but in the navigation of the link.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// AccountHandler serves the management of the subscriptions by their subscribers, mounted on /account and /account/:
+//
+//	POST /account/login           emails a magic link to the email of the form or of the JSON {"email"}
+//	GET  /account/verify?token=   signs in with the token of a magic link and redirects to /account
+//	GET  /account                 the Account of the session as JSON
+//	PUT  /account                 replaces the URLs, cadence and channels by those of the JSON Account
+//	POST /account/logout          clears the session cookie
+//	GET  /account/export          everything stored about the subscriber of the session as a DataExport
+//	POST /account/erase           emails a link to confirm the erasure of the data of the subscriber of the session
+//	GET  /account/erase/confirm   a form to confirm the erasure with the token of the link
+//	POST /account/erase/confirm   erases the data of the subscriber of the token of the form and signs out
+//
+// The login answers the same whether the email has a subscription or not, so it does not reveal the subscribers,
+// and answers 429 beyond the login limits, so it cannot flood a mailbox.
+// The link of the erasure opens a form rather than erasing, so the clients that open the links of the emails
+// ahead of their reader do not erase.
+func AccountHandler(a *Accounts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.Trim(r.URL.Path, "/") {
+		case "account/login":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			a.login(w, r)
+		case "account/verify":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			email, err := a.verify(purposeLogin, r.URL.Query().Get("token"))
+			if err != nil {
+				http.Error(w, "the link is invalid or expired, ask for a new one", http.StatusUnauthorized)
+				return
+			}
+			a.setSession(w, email)
+			http.Redirect(w, r, "/account", http.StatusSeeOther)
+		case "account/logout":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			clearSession(w)
+			w.WriteHeader(http.StatusNoContent)
+		case "account/export":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			email, ok := a.session(r)
+			if !ok {
+				http.Error(w, "sign in first", http.StatusUnauthorized)
+				return
+			}
+			a.export(w, r, email)
+		case "account/erase":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			email, ok := a.session(r)
+			if !ok {
+				http.Error(w, "sign in first", http.StatusUnauthorized)
+				return
+			}
+			if err := a.SendErasureLink(email); err != nil {
+				slog.ErrorContext(r.Context(), "error sending erasure link", "user", email, "error", err)
+				http.Error(w, "error sending erasure link", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case "account/erase/confirm":
+			switch r.Method {
+			case http.MethodGet:
+				token := r.URL.Query().Get("token")
+				if _, err := a.verify(purposeErase, token); err != nil {
+					http.Error(w, "the link is invalid or expired, ask for a new one", http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				fmt.Fprintf(w, eraseForm, html.EscapeString(token))
+			case http.MethodPost:
+				a.erase(w, r)
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodPost)
+			}
+		case "account":
+			email, ok := a.session(r)
+			if !ok {
+				http.Error(w, "sign in first", http.StatusUnauthorized)
+				return
+			}
+			switch r.Method {
+			case http.MethodGet:
+				a.get(w, r, email)
+			case http.MethodPut:
+				a.put(w, r, email)
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodPut)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// eraseForm confirms the erasure of the token it is formatted with
+const eraseForm = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Erase your data</title></head>
+<body>
+<form method="post" action="/account/erase/confirm">
+<p>Erase your subscription and everything the newsletter stored about you? It cannot be undone.</p>
+<input type="hidden" name="token" value="%s">
+<button type="submit">Erase my data</button>
+</form>
+</body>
+</html>
+`
+
+// clearSession signs out
+func clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/account", MaxAge: -1, HttpOnly: true})
+}
+
+func (a *Accounts) export(w http.ResponseWriter, r *http.Request, email string) {
+	export, err := a.Privacy.Export(r.Context(), email)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(w, "nothing stored about "+email, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error exporting data", "error", err)
+		http.Error(w, "error exporting data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="newsletter-data.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+func (a *Accounts) erase(w http.ResponseWriter, r *http.Request) {
+	email, err := a.verify(purposeErase, r.PostFormValue("token"))
+	if err != nil {
+		http.Error(w, "the link is invalid or expired, ask for a new one", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = a.Privacy.Erase(mongodb.WithActor(r.Context(), "subscriber:"+email), email)
+	switch {
+	case errors.Is(err, ErrNotConfirmed):
+		slog.ErrorContext(r.Context(), "error confirming erasure", "error", err)
+	case err != nil && !errors.Is(err, mongodb.ErrNotFound):
+		// A second click on the link finds nothing left, which is what was asked, so it is not an error.
+		slog.ErrorContext(r.Context(), "error erasing data", "error", err)
+		http.Error(w, "error erasing data", http.StatusInternalServerError)
+		return
+	}
+	clearSession(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Your data was erased.")
+}
+
+func (a *Accounts) login(w http.ResponseWriter, r *http.Request) {
+	email := r.PostFormValue("email")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		email = body.Email
+	}
+	email = strings.TrimSpace(email)
+	if !strings.Contains(email, "@") {
+		http.Error(w, fmt.Sprintf("invalid email address %q", email), http.StatusBadRequest)
+		return
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	now := a.now()
+	if !a.logins.allow("ip:"+ip, a.LoginIPLimit, LoginWindow, now) ||
+		!a.logins.allow("email:"+strings.ToLower(email), a.LoginLimit, LoginWindow, now) {
+		slog.WarnContext(r.Context(), "magic link asked beyond the login limits", "user", email, "remote_addr", r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(LoginWindow.Seconds())))
+		http.Error(w, "too many magic links asked, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	err = a.SendMagicLink(r.Context(), email)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		slog.InfoContext(r.Context(), "magic link asked without subscription", "user", email)
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "error sending magic link", "user", email, "error", err)
+		http.Error(w, "error sending magic link", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *Accounts) get(w http.ResponseWriter, r *http.Request, email string) {
+	n, err := a.Storage.Subscription(r.Context(), email)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(w, "subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting subscription", "error", err)
+		http.Error(w, "error getting subscription", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, accountOf(n))
+}
+
+func (a *Accounts) put(w http.ResponseWriter, r *http.Request, email string) {
+	var acc Account
+	if err := json.NewDecoder(r.Body).Decode(&acc); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	n, err := a.Storage.Subscription(r.Context(), email)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(w, "subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting subscription", "error", err)
+		http.Error(w, "error getting subscription", http.StatusInternalServerError)
+		return
+	}
+	n, err = acc.apply(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.Storage.UpdateNewsletter(mongodb.WithActor(r.Context(), "subscriber:"+email), n); err != nil {
+		slog.ErrorContext(r.Context(), "error updating subscription", "error", err)
+		http.Error(w, "error updating subscription", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, accountOf(n))
+}
@@ -0,0 +1,283 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+func TestAccounts_Tokens(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewAccounts(memory.NewStorage(), &MailClientRecorder{}, "s3cret", "https://nl.test")
+	a.now = func() time.Time { return now }
+
+	token := a.sign(purposeLogin, "j.doe@gmail.com", now.Add(time.Minute))
+	if email, err := a.verify(purposeLogin, token); err != nil || email != "j.doe@gmail.com" {
+		t.Fatalf("expected j.doe@gmail.com, got %q (%v)", email, err)
+	}
+
+	other := NewAccounts(memory.NewStorage(), &MailClientRecorder{}, "other", "https://nl.test")
+	other.now = a.now
+	tests := []struct {
+		name  string
+		a     *Accounts
+		token string
+	}{
+		{"session", a, a.sign(purposeSession, "j.doe@gmail.com", now.Add(time.Minute))},
+		{"expired", a, a.sign(purposeLogin, "j.doe@gmail.com", now)},
+		{"other secret", other, token},
+		{"tampered", a, strings.Replace(token, ".", "x.", 1)},
+		{"malformed", a, "token"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.a.verify(purposeLogin, tt.token); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestAccountHandler(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	n := mongodb.Newsletter{
+		UserEmail: "j@gmail.com",
+		URLs:      []string{FakeURL, "https://other.test"},
+		Filters:   []mongodb.Filter{{URL: "https://other.test", Include: []string{"go"}}, {Exclude: []string{"hiring"}}},
+	}
+	if err := s.SaveNewsletter(ctx, n); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+
+	e := &MailClientRecorder{}
+	mux := http.NewServeMux()
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+	a := NewAccounts(s, e, "s3cret", svr.URL)
+	mux.Handle("/account", AccountHandler(a))
+	mux.Handle("/account/", AccountHandler(a))
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	for _, email := range []string{"j@gmail.com", "k@gmail.com"} {
+		resp, err := client.PostForm(svr.URL+"/account/login", url.Values{"email": {email}})
+		if err != nil {
+			t.Fatal("error logging in", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("%s: expected status 202, got %d", email, resp.StatusCode)
+		}
+	}
+	if len(e.sent) != 1 {
+		t.Fatalf("expected a magic link to the subscriber only, got %v", e.sent)
+	}
+	link := regexp.MustCompile(`https?://\S+/account/verify\?token=\S+`).FindString(e.sent["j@gmail.com"])
+	if link == "" {
+		t.Fatalf("expected a magic link, got %q", e.sent["j@gmail.com"])
+	}
+
+	if resp, err := client.Get(svr.URL + "/account"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 before signing in, got %v (%v)", resp, err)
+	}
+
+	// The link signs in and redirects to the account.
+	resp, err := client.Get(link)
+	if err != nil {
+		t.Fatal("error following the magic link", err)
+	}
+	var acc Account
+	if err := json.NewDecoder(resp.Body).Decode(&acc); err != nil {
+		t.Fatal("error decoding account", err)
+	}
+	_ = resp.Body.Close()
+	want := Account{Email: "j@gmail.com", URLs: n.URLs, Channels: []string{}}
+	if !reflect.DeepEqual(acc, want) {
+		t.Fatalf("expected %+v, got %+v", want, acc)
+	}
+
+	acc.URLs = []string{FakeURL}
+	acc.Cadence = CadenceWeekly
+	acc.Channels = []string{"email:j@gmail.com", "slack:https://hooks.slack.com/services/T0/B0/X"}
+	body, _ := json.Marshal(acc)
+	req, _ := http.NewRequest(http.MethodPut, svr.URL+"/account", strings.NewReader(string(body)))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal("error updating account", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	got, _ := s.Subscription(ctx, "j@gmail.com")
+	want2 := mongodb.Newsletter{
+		UserEmail: "j@gmail.com",
+		URLs:      []string{FakeURL},
+		Channels: []mongodb.Channel{
+			{Type: ChannelEmail, Address: "j@gmail.com"},
+			{Type: ChannelSlack, Address: "https://hooks.slack.com/services/T0/B0/X"},
+		},
+		Filters: []mongodb.Filter{{Exclude: []string{"hiring"}}},
+		Cadence: CadenceWeekly,
+	}
+	if !reflect.DeepEqual(got, want2) {
+		t.Fatalf("expected %+v, got %+v", want2, got)
+	}
+	if entries, _ := s.AuditLog(ctx, mongodb.AuditQuery{Actor: "subscriber:j@gmail.com"}); len(entries) != 1 {
+		t.Fatalf("expected the change audited as made by the subscriber, got %+v", entries)
+	}
+
+	for _, invalid := range []string{
+		`{"urls": []}`,
+		`{"urls": ["ftp://x.test"]}`,
+		`{"urls": ["https://x.test"], "cadence": "hourly"}`,
+		`{"urls": ["https://x.test"], "channels": ["sms:1"]}`,
+		`{"urls": ["https://x.test"], "channels": ["email:k@gmail.com"]}`,
+		`{"urls": ["https://x.test"], "channels": ["telegram:-1001"]}`,
+		`{"urls": ["https://x.test"], "channels": ["webhook:https://x.test/hook"]}`,
+		`{"urls": ["https://x.test"], "channels": ["slack:http://127.0.0.1/services/T0"]}`,
+		`{"urls": ["https://x.test"], "channels": ["discord:https://discord.com/channels/1"]}`,
+		`not json`,
+	} {
+		req, _ := http.NewRequest(http.MethodPut, svr.URL+"/account", strings.NewReader(invalid))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal("error updating account", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", invalid, resp.StatusCode)
+		}
+	}
+
+	resp, err = client.Post(svr.URL+"/account/logout", "", nil)
+	if err != nil {
+		t.Fatal("error logging out", err)
+	}
+	_ = resp.Body.Close()
+	if resp, err := client.Get(svr.URL + "/account"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 after signing out, got %v (%v)", resp, err)
+	}
+
+	if resp, err := client.Get(svr.URL + "/account/verify?token=x"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 for an invalid link, got %v (%v)", resp, err)
+	}
+}
+
+func TestAccountHandler_LoginLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewAccounts(memory.NewStorage(), &MailClientRecorder{}, "s3cret", "https://nl.test")
+	a.now = func() time.Time { return now }
+	a.LoginLimit, a.LoginIPLimit = 2, 3
+	h := AccountHandler(a)
+
+	login := func(email, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/account/login", strings.NewReader(url.Values{"email": {email}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		email, remoteAddr string
+		want              int
+	}{
+		{"j@gmail.com", "192.0.2.1:1000", http.StatusAccepted},
+		{"J@gmail.com", "192.0.2.1:1001", http.StatusAccepted},
+		// The email is over its limit, whatever its case.
+		{"j@gmail.com", "192.0.2.1:1002", http.StatusTooManyRequests},
+		// And the IP over its own, whatever the email.
+		{"k@gmail.com", "192.0.2.1:1003", http.StatusTooManyRequests},
+		{"k@gmail.com", "192.0.2.2:1000", http.StatusAccepted},
+	}
+	for i, tt := range tests {
+		if got := login(tt.email, tt.remoteAddr); got != tt.want {
+			t.Errorf("%d: %s from %s: got status %d, want %d", i, tt.email, tt.remoteAddr, got, tt.want)
+		}
+	}
+
+	now = now.Add(LoginWindow)
+	if got := login("j@gmail.com", "192.0.2.1:1000"); got != http.StatusAccepted {
+		t.Fatalf("expected the limits to reset after the window, got status %d", got)
+	}
+}
+
+func TestEmailTrigger_Cadence(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	if err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}, Cadence: CadenceDaily}); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+
+	// The page changed a few hours ago, and the last crawl found no change.
+	now := time.Now().UTC()
+	err := s.SavePage(ctx, []mongodb.Page{
+		{URL: FakeURL, Content: "first", IsMostRecent: true, ScrapeDatetime: now.Add(-3 * time.Hour)},
+		{URL: FakeURL, Content: "first", IsMostRecent: false, ScrapeDatetime: now.Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatal("error saving pages", err)
+	}
+
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !strings.Contains(e.sent["j@gmail.com"], FakeURL) {
+		t.Fatalf("expected the digest of the change, got %v", e.sent)
+	}
+
+	// The next digest waits for a day, whatever changes.
+	if err := s.SavePage(ctx, []mongodb.Page{{URL: FakeURL, Content: "second", IsMostRecent: true, ScrapeDatetime: now}}); err != nil {
+		t.Fatal("error saving page", err)
+	}
+	e.sent = nil
+	if err := EmailTrigger(ctx, s, e, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(e.sent) != 0 {
+		t.Fatalf("expected no email before a day, got %v", e.sent)
+	}
+}
+
+func TestAccount_ApplyKeepsChannels(t *testing.T) {
+	// The channels added by an operator are kept, even those the subscriber could not add.
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL},
+		Channels: []mongodb.Channel{{Type: ChannelTelegram, Address: "-1001"}}}
+	acc := accountOf(n)
+	got, err := acc.apply(n)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !reflect.DeepEqual(got.Channels, n.Channels) {
+		t.Fatalf("expected %v, got %v", n.Channels, got.Channels)
+	}
+
+	// The webhook channels kept keep their secret, that their receivers know.
+	n.Channels = append(n.Channels, mongodb.Channel{Type: ChannelWebhook, Address: "https://j.test/hook", Secret: "s3cret"})
+	got, err = accountOf(n).apply(n)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !reflect.DeepEqual(got.Channels, n.Channels) {
+		t.Fatalf("expected %v, got %v", n.Channels, got.Channels)
+	}
+
+	acc.Channels = append(acc.Channels, "telegram:-1002")
+	if _, err := acc.apply(n); err == nil {
+		t.Fatal("expected an error adding a telegram channel")
+	}
+}
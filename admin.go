@@ -0,0 +1,199 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// AdminStorage is the storage of the engineers and the subscribers managed by the operators
+type AdminStorage interface {
+	Storage
+	SaveEngineer(ctx context.Context, e mongodb.Engineer) error
+	DeleteEngineer(ctx context.Context, url string) error
+	SaveNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	DeleteNewsletter(ctx context.Context, userEmail string) error
+}
+
+// engineerJSON is an engineer served by AdminHandler
+type engineerJSON struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	// Schedule is an interval or a cron expression, the adaptive schedule when empty
+	Schedule string `json:"schedule"`
+}
+
+// AdminHandler serves the management of the engineers and the subscribers, mounted on /admin/:
+//
+//	GET    /admin/engineers               lists the engineers
+//	POST   /admin/engineers               adds or updates the engineer of the JSON {"name", "description", "url", "schedule"}
+//	DELETE /admin/engineers?url=          removes an engineer
+//	GET    /admin/subscribers             lists the subscriptions as Accounts
+//	POST   /admin/subscribers             subscribes, or updates the subscription of, the JSON Account
+//	DELETE /admin/subscribers?email=      unsubscribes an email
+//
+// It is meant to be protected by APIKeys.Protect.
+func AdminHandler(s AdminStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.Trim(r.URL.Path, "/") {
+		case "admin/engineers":
+			switch r.Method {
+			case http.MethodGet:
+				listEngineers(w, r, s)
+			case http.MethodPost:
+				saveEngineer(w, r, s)
+			case http.MethodDelete:
+				deleteEngineer(w, r, s)
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+			}
+		case "admin/subscribers":
+			switch r.Method {
+			case http.MethodGet:
+				listSubscribers(w, r, s)
+			case http.MethodPost:
+				saveSubscriber(w, r, s)
+			case http.MethodDelete:
+				deleteSubscriber(w, r, s)
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func listEngineers(w http.ResponseWriter, r *http.Request, s AdminStorage) {
+	engineers, err := s.Engineers(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting engineers", "error", err)
+		http.Error(w, "error getting engineers", http.StatusInternalServerError)
+		return
+	}
+	list := make([]engineerJSON, len(engineers))
+	for i, e := range engineers {
+		list[i] = engineerJSON{Name: e.Name, Description: e.Description, URL: e.URL, Schedule: e.Schedule}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func saveEngineer(w http.ResponseWriter, r *http.Request, s AdminStorage) {
+	var e engineerJSON
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&e); err != nil {
+		http.Error(w, "invalid engineer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(e.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		http.Error(w, "invalid URL "+e.URL, http.StatusBadRequest)
+		return
+	}
+	if e.Schedule != "" {
+		if _, err := ParseSchedule(e.Schedule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := s.SaveEngineer(r.Context(), mongodb.Engineer{Name: e.Name, Description: e.Description, URL: e.URL, Schedule: e.Schedule})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error saving engineer", "error", err)
+		http.Error(w, "error saving engineer", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func deleteEngineer(w http.ResponseWriter, r *http.Request, s AdminStorage) {
+	err := s.DeleteEngineer(r.Context(), r.URL.Query().Get("url"))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(w, "engineer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error deleting engineer", "error", err)
+		http.Error(w, "error deleting engineer", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listSubscribers(w http.ResponseWriter, r *http.Request, s AdminStorage) {
+	newsletters, err := s.Newsletter(r.Context(), "", 0)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting subscribers", "error", err)
+		http.Error(w, "error getting subscribers", http.StatusInternalServerError)
+		return
+	}
+	list := make([]Account, len(newsletters))
+	for i, n := range newsletters {
+		list[i] = accountOf(n)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func saveSubscriber(w http.ResponseWriter, r *http.Request, s AdminStorage) {
+	var acc Account
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&acc); err != nil {
+		http.Error(w, "invalid subscriber: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	acc.Email = strings.TrimSpace(acc.Email)
+	if !strings.Contains(acc.Email, "@") {
+		http.Error(w, "invalid email address "+acc.Email, http.StatusBadRequest)
+		return
+	}
+
+	n, err := s.Subscription(r.Context(), acc.Email)
+	exists := err == nil
+	if err != nil && !errors.Is(err, mongodb.ErrNotFound) {
+		slog.ErrorContext(r.Context(), "error getting subscription", "error", err)
+		http.Error(w, "error getting subscription", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		n = mongodb.Newsletter{UserEmail: acc.Email}
+	}
+	n, err = acc.apply(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if exists {
+		err = s.UpdateNewsletter(r.Context(), n)
+	} else {
+		err = s.SaveNewsletter(r.Context(), n)
+		status = http.StatusCreated
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error saving subscription", "error", err)
+		http.Error(w, "error saving subscription", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, accountOf(n))
+}
+
+func deleteSubscriber(w http.ResponseWriter, r *http.Request, s AdminStorage) {
+	err := s.DeleteNewsletter(r.Context(), r.URL.Query().Get("email"))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(w, "subscriber not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error deleting subscriber", "error", err)
+		http.Error(w, "error deleting subscriber", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package newsletter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	if err := s.SaveNewsletter(ctx, mongodb.Newsletter{
+		UserEmail: "j@gmail.com",
+		URLs:      []string{FakeURL},
+		Filters:   []mongodb.Filter{{Include: []string{"go"}}},
+	}); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	svr := httptest.NewServer(AdminHandler(s))
+	defer svr.Close()
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/admin/engineers", `{"name": "Mary", "url": "https://mary.test", "schedule": "6h"}`, http.StatusOK},
+		{http.MethodPost, "/admin/engineers", `{"name": "Bob", "url": "bob.test"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/engineers", `{"url": "https://bob.test", "schedule": "sometimes"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/admin/engineers?url=" + url.QueryEscape("https://missing.test"), "", http.StatusNotFound},
+		{http.MethodPost, "/admin/subscribers", `{"email": "k@gmail.com", "urls": ["https://mary.test"], "cadence": "daily"}`, http.StatusCreated},
+		{http.MethodPost, "/admin/subscribers", `{"email": "j@gmail.com", "urls": ["https://mary.test", "` + FakeURL + `"]}`, http.StatusOK},
+		{http.MethodPost, "/admin/subscribers", `{"email": "x", "urls": ["https://mary.test"]}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/subscribers", `{"email": "x@gmail.com", "urls": []}`, http.StatusBadRequest},
+		{http.MethodDelete, "/admin/subscribers?email=missing@gmail.com", "", http.StatusNotFound},
+		{http.MethodPut, "/admin/subscribers", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/other", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s %s: got status %d, want %d", tt.method, tt.path, tt.body, resp.StatusCode, tt.want)
+		}
+	}
+
+	engineers, _ := s.Engineers(ctx)
+	if len(engineers) != 1 || engineers[0].Schedule != "6h" {
+		t.Fatalf("expected the engineer of Mary, got %+v", engineers)
+	}
+	// The update keeps the filters of the subscriber.
+	got, _ := s.Subscription(ctx, "j@gmail.com")
+	want := mongodb.Newsletter{
+		UserEmail: "j@gmail.com",
+		URLs:      []string{"https://mary.test", FakeURL},
+		Filters:   []mongodb.Filter{{Include: []string{"go"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, svr.URL+"/admin/subscribers?email=k@gmail.com", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("error deleting subscriber", err)
+	}
+	_ = resp.Body.Close()
+	if _, err := s.Subscription(ctx, "k@gmail.com"); err != mongodb.ErrNotFound {
+		t.Fatalf("expected the subscriber to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package newsletter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Roles of the API keys, each one granting what the previous ones grant
+const (
+	// RoleReadOnly reads the engineers, the subscribers, the webhooks and the pages
+	RoleReadOnly = "read-only"
+	// RoleEditor also changes them
+	RoleEditor = "editor"
+	// RoleAdmin also issues and revokes the API keys
+	RoleAdmin = "admin"
+)
+
+// Roles are the roles of the API keys, from the least to the most privileged
+var Roles = []string{RoleReadOnly, RoleEditor, RoleAdmin}
+
+// apiKeyPrefix starts every API key, so a leaked key is easy to recognize
+const apiKeyPrefix = "nl_"
+
+// ErrInvalidKey is returned for the API keys that are unknown or revoked
+var ErrInvalidKey = errors.New("invalid API key")
+
+// APIKeyStorage is the storage of the API keys and their usage
+type APIKeyStorage interface {
+	SaveAPIKey(ctx context.Context, k mongodb.APIKey) error
+	APIKeys(ctx context.Context) ([]mongodb.APIKey, error)
+	APIKeyByHash(ctx context.Context, hash string) (mongodb.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	SaveKeyUsage(ctx context.Context, u mongodb.KeyUsage) error
+	KeyUsage(ctx context.Context, keyID string, limit int) ([]mongodb.KeyUsage, error)
+}
+
+// APIKeys issues the API keys of the admin routes, and protects the routes by the roles of the keys.
+// Only the hashes of the keys are stored, a key is only known when it is issued.
+type APIKeys struct {
+	Storage APIKeyStorage
+
+	now func() time.Time
+}
+
+// NewAPIKeys returns the APIKeys of s
+func NewAPIKeys(s APIKeyStorage) *APIKeys {
+	return &APIKeys{Storage: s, now: time.Now}
+}
+
+// hashKey returns the hash of a key as stored. The keys are random, so a plain hash is enough to keep them secret.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// roleRank returns the rank of a role in Roles, -1 for an unknown role
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidateRole checks that the role is one of Roles
+func ValidateRole(role string) error {
+	if roleRank(role) < 0 {
+		return fmt.Errorf("invalid role %q, must be one of %s", role, strings.Join(Roles, ", "))
+	}
+	return nil
+}
+
+// Issue issues a key of the role, returning it along with its record. The key cannot be recovered afterwards.
+func (k *APIKeys) Issue(ctx context.Context, name, role string) (mongodb.APIKey, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return mongodb.APIKey{}, "", errors.New("an API key needs a name")
+	}
+	if err := ValidateRole(role); err != nil {
+		return mongodb.APIKey{}, "", err
+	}
+
+	key := apiKeyPrefix + randomID(32)
+	record := mongodb.APIKey{
+		ID:        randomID(8),
+		Name:      name,
+		Role:      role,
+		Hash:      hashKey(key),
+		CreatedAt: k.now().UTC().Truncate(time.Millisecond),
+	}
+	if err := k.Storage.SaveAPIKey(ctx, record); err != nil {
+		return mongodb.APIKey{}, "", err
+	}
+	return record, key, nil
+}
+
+// Revoke revokes the key of the ID, returning mongodb.ErrNotFound when there is none
+func (k *APIKeys) Revoke(ctx context.Context, id string) error {
+	return k.Storage.RevokeAPIKey(ctx, id, k.now().UTC().Truncate(time.Millisecond))
+}
+
+// Authenticate returns the record of the key, ErrInvalidKey when it is unknown or revoked
+func (k *APIKeys) Authenticate(ctx context.Context, key string) (mongodb.APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return mongodb.APIKey{}, ErrInvalidKey
+	}
+	record, err := k.Storage.APIKeyByHash(ctx, hashKey(key))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return mongodb.APIKey{}, ErrInvalidKey
+	}
+	if err != nil {
+		return mongodb.APIKey{}, err
+	}
+	if !record.RevokedAt.IsZero() {
+		return mongodb.APIKey{}, ErrInvalidKey
+	}
+	return record, nil
+}
+
+// statusRecorder keeps the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Protect returns h served only to the requests with the API key of a role at least read for the GET and HEAD
+// requests, and at least write for the others. The key is sent as "Authorization: Bearer <key>".
+// Every request of a valid key is recorded in its usage, the denied ones too, and its changes are audited as made by
+// key:<id>.
+func (k *APIKeys) Protect(read, write string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "an API key is required", http.StatusUnauthorized)
+			return
+		}
+		record, err := k.Authenticate(r.Context(), strings.TrimSpace(key))
+		if errors.Is(err, ErrInvalidKey) {
+			slog.WarnContext(r.Context(), "request with an invalid API key", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error authenticating API key", "error", err)
+			http.Error(w, "error authenticating API key", http.StatusInternalServerError)
+			return
+		}
+
+		need := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = read
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		if roleRank(record.Role) < roleRank(need) {
+			http.Error(rec, fmt.Sprintf("the %s role is required", need), http.StatusForbidden)
+		} else {
+			// The changes made by the request are audited as made by the key.
+			h.ServeHTTP(rec, r.WithContext(mongodb.WithActor(r.Context(), "key:"+record.ID)))
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// The audit is recorded even when the client goes away before the end of the response.
+		u := mongodb.KeyUsage{
+			KeyID:      record.ID,
+			At:         k.now().UTC().Truncate(time.Millisecond),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rec.status,
+			RemoteAddr: r.RemoteAddr,
+		}
+		if err := k.Storage.SaveKeyUsage(context.WithoutCancel(r.Context()), u); err != nil {
+			slog.ErrorContext(r.Context(), "error saving key usage", "key", record.ID, "error", err)
+		}
+	})
+}
+
+// apiKeyJSON is an API key served by APIKeyHandler. The key is only served when it is issued.
+type apiKeyJSON struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newAPIKeyJSON(k mongodb.APIKey) apiKeyJSON {
+	resp := apiKeyJSON{ID: k.ID, Name: k.Name, Role: k.Role, CreatedAt: k.CreatedAt}
+	if !k.RevokedAt.IsZero() {
+		resp.RevokedAt = &k.RevokedAt
+	}
+	return resp
+}
+
+// keyUsageJSON is a request of an API key served by APIKeyHandler
+type keyUsageJSON struct {
+	KeyID      string    `json:"key_id"`
+	At         time.Time `json:"at"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// APIKeyHandler serves the management of the API keys, mounted on /admin/keys and /admin/keys/:
+//
+//	GET    /admin/keys              lists the API keys
+//	POST   /admin/keys              issues a key from {"name", "role"}
+//	DELETE /admin/keys/{id}         revokes a key
+//	GET    /admin/keys/{id}/usage   lists the latest requests of a key, up to the limit query
+//	GET    /admin/keys/usage        lists the latest requests of all the keys, up to the limit query
+//
+// It is meant to be protected by Protect with the admin role.
+func APIKeyHandler(k *APIKeys) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "":
+			switch r.Method {
+			case http.MethodGet:
+				k.list(w, r)
+			case http.MethodPost:
+				k.issue(w, r)
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodPost)
+			}
+		case path == "usage":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			k.usage(w, r, "")
+		case len(parts) == 2 && parts[1] == "usage":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			k.usage(w, r, parts[0])
+		case len(parts) == 1:
+			if r.Method != http.MethodDelete {
+				methodNotAllowed(w, http.MethodDelete)
+				return
+			}
+			k.revoke(w, r, parts[0])
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (k *APIKeys) list(w http.ResponseWriter, r *http.Request) {
+	keys, err := k.Storage.APIKeys(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting API keys", "error", err)
+		http.Error(w, "error getting API keys", http.StatusInternalServerError)
+		return
+	}
+	list := make([]apiKeyJSON, len(keys))
+	for i, key := range keys {
+		list[i] = newAPIKeyJSON(key)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (k *APIKeys) issue(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid API key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	record, key, err := k.Issue(r.Context(), req.Name, req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := newAPIKeyJSON(record)
+	resp.Key = key
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (k *APIKeys) revoke(w http.ResponseWriter, r *http.Request, id string) {
+	err := k.Revoke(r.Context(), id)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error revoking API key", "error", err)
+		http.Error(w, "error revoking API key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (k *APIKeys) usage(w http.ResponseWriter, r *http.Request, id string) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit "+v, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	usage, err := k.Storage.KeyUsage(r.Context(), id, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting key usage", "error", err)
+		http.Error(w, "error getting key usage", http.StatusInternalServerError)
+		return
+	}
+	list := make([]keyUsageJSON, len(usage))
+	for i, u := range usage {
+		list[i] = keyUsageJSON(u)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,176 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/perebaj/newsletter/memory"
+)
+
+func TestAPIKeys_Issue(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	k := NewAPIKeys(s)
+
+	record, key, err := k.Issue(ctx, "ci", RoleEditor)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) || strings.Contains(record.Hash, key) || record.Hash != hashKey(key) {
+		t.Fatalf("expected only the hash of the key to be kept, got %+v", record)
+	}
+	if got, err := k.Authenticate(ctx, key); err != nil || got.ID != record.ID {
+		t.Fatalf("expected key %s, got %+v (%v)", record.ID, got, err)
+	}
+
+	if err := k.Revoke(ctx, record.ID); err != nil {
+		t.Fatal("error revoking key", err)
+	}
+	for _, invalid := range []string{key, apiKeyPrefix + "unknown", "other"} {
+		if _, err := k.Authenticate(ctx, invalid); err != ErrInvalidKey {
+			t.Errorf("%s: expected ErrInvalidKey, got %v", invalid, err)
+		}
+	}
+
+	for _, tt := range []struct{ name, role string }{{"", RoleAdmin}, {"ci", "root"}} {
+		if _, _, err := k.Issue(ctx, tt.name, tt.role); err == nil {
+			t.Errorf("%+v: expected error", tt)
+		}
+	}
+}
+
+func TestAPIKeys_Protect(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	k := NewAPIKeys(s)
+
+	keys := map[string]string{}
+	for _, role := range Roles {
+		_, key, err := k.Issue(ctx, role, role)
+		if err != nil {
+			t.Fatal("error issuing key", err)
+		}
+		keys[role] = key
+	}
+	revoked, revokedKey, _ := k.Issue(ctx, "revoked", RoleAdmin)
+	if err := k.Revoke(ctx, revoked.ID); err != nil {
+		t.Fatal("error revoking key", err)
+	}
+
+	svr := httptest.NewServer(k.Protect(RoleReadOnly, RoleEditor, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	defer svr.Close()
+
+	tests := []struct {
+		method, key string
+		want        int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "nl_unknown", http.StatusUnauthorized},
+		{http.MethodGet, revokedKey, http.StatusUnauthorized},
+		{http.MethodGet, keys[RoleReadOnly], http.StatusNoContent},
+		{http.MethodPost, keys[RoleReadOnly], http.StatusForbidden},
+		{http.MethodPost, keys[RoleEditor], http.StatusNoContent},
+		{http.MethodDelete, keys[RoleAdmin], http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+"/webhooks", nil)
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s with %q: got status %d, want %d", tt.method, tt.key, resp.StatusCode, tt.want)
+		}
+	}
+
+	// Only the requests of valid keys are audited, the denied one too.
+	usage, err := s.KeyUsage(ctx, "", 0)
+	if err != nil {
+		t.Fatal("error getting key usage", err)
+	}
+	if len(usage) != 4 {
+		t.Fatalf("expected 4 requests audited, got %+v", usage)
+	}
+	if u := usage[len(usage)-2]; u.Method != http.MethodPost || u.Path != "/webhooks" || u.Status != http.StatusForbidden || u.RemoteAddr == "" {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+}
+
+func TestAPIKeyHandler(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	k := NewAPIKeys(s)
+	_, admin, err := k.Issue(ctx, "ops", RoleAdmin)
+	if err != nil {
+		t.Fatal("error issuing key", err)
+	}
+	svr := httptest.NewServer(k.Protect(RoleAdmin, RoleAdmin, APIKeyHandler(k)))
+	defer svr.Close()
+
+	do := func(method, path, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, svr.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal("error decoding response", err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var issued apiKeyJSON
+	if status := do(http.MethodPost, "/admin/keys", `{"name": "ci", "role": "read-only"}`, &issued); status != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", status)
+	}
+	if _, err := k.Authenticate(ctx, issued.Key); err != nil {
+		t.Fatalf("expected the issued key to be valid, got %v", err)
+	}
+
+	if status := do(http.MethodDelete, "/admin/keys/"+issued.ID, "", nil); status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	var list []apiKeyJSON
+	do(http.MethodGet, "/admin/keys", "", &list)
+	for _, got := range list {
+		if got.Key != "" || (got.ID == issued.ID) != (got.RevokedAt != nil) {
+			t.Fatalf("expected the issued key revoked, without the keys themselves, got %+v", list)
+		}
+	}
+
+	var usage []keyUsageJSON
+	do(http.MethodGet, "/admin/keys/usage?limit=2", "", &usage)
+	if len(usage) != 2 || usage[0].Method != http.MethodGet {
+		t.Fatalf("expected the latest requests, got %+v", usage)
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/admin/keys", `{"name": "ci", "role": "root"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/admin/keys/missing", "", http.StatusNotFound},
+		{http.MethodGet, "/admin/keys/" + issued.ID + "/usage?limit=0", "", http.StatusBadRequest},
+		{http.MethodPut, "/admin/keys", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/keys/a/b/c", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.body, nil); got != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+const (
+	// DefaultAuditLimit is the number of entries of the audit log listed when the query has no limit
+	DefaultAuditLimit = 50
+	// MaxAuditLimit bounds the limit of the audit queries of AuditHandler
+	MaxAuditLimit = 1000
+)
+
+// AuditStorage is the storage of the audit log of the changes
+type AuditStorage interface {
+	AuditLog(ctx context.Context, q mongodb.AuditQuery) ([]mongodb.AuditEntry, error)
+}
+
+// AuditEntryJSON is an entry of the audit log as JSON, its snapshots as relaxed extended JSON
+type AuditEntryJSON struct {
+	ID     string          `json:"id"`
+	At     time.Time       `json:"at"`
+	Actor  string          `json:"actor"`
+	Action string          `json:"action"`
+	Target string          `json:"target"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// NewAuditEntryJSON returns the JSON of the entry
+func NewAuditEntryJSON(e mongodb.AuditEntry) (AuditEntryJSON, error) {
+	resp := AuditEntryJSON{ID: e.ID, At: e.At, Actor: e.Actor, Action: e.Action, Target: e.Target}
+	var err error
+	if resp.Before, err = mongodb.SnapshotJSON(e.Before); err != nil {
+		return resp, err
+	}
+	if resp.After, err = mongodb.SnapshotJSON(e.After); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// ParseAuditQuery returns the query of the actor, action, target, from, to and limit parameters. The times are dates
+// or RFC 3339 times, to includes its day, and the limit defaults to DefaultAuditLimit.
+func ParseAuditQuery(v url.Values) (mongodb.AuditQuery, error) {
+	q := mongodb.AuditQuery{Actor: v.Get("actor"), Action: v.Get("action"), Target: v.Get("target"), Limit: DefaultAuditLimit}
+
+	var err error
+	if q.From, err = parseSearchTime(v.Get("from"), false); err != nil {
+		return q, err
+	}
+	if q.To, err = parseSearchTime(v.Get("to"), true); err != nil {
+		return q, err
+	}
+	if l := v.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit <= 0 || q.Limit > MaxAuditLimit {
+			return q, fmt.Errorf("invalid limit %q, expected a number between 1 and %d", l, MaxAuditLimit)
+		}
+	}
+	return q, nil
+}
+
+// AuditHandler serves the audit log, newest first, mounted on /admin/audit:
+//
+//	GET /admin/audit?actor=<actor>&action=<action>&target=<target>&from=<time>&to=<time>&limit=<n>
+//
+// It is meant to be protected by APIKeys.Protect with the admin role.
+func AuditHandler(s AuditStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		q, err := ParseAuditQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, err := s.AuditLog(r.Context(), q)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error getting audit log", "error", err)
+			http.Error(w, "error getting audit log", http.StatusInternalServerError)
+			return
+		}
+		list := make([]AuditEntryJSON, len(entries))
+		for i, e := range entries {
+			if list[i], err = NewAuditEntryJSON(e); err != nil {
+				slog.ErrorContext(r.Context(), "error encoding audit log", "error", err)
+				http.Error(w, "error encoding audit log", http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+}
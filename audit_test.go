@@ -0,0 +1,97 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+func TestAuditHandler(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	k := NewAPIKeys(s)
+	editor, editorKey, err := k.Issue(ctx, "ci", RoleEditor)
+	if err != nil {
+		t.Fatal("error issuing key", err)
+	}
+	_, adminKey, err := k.Issue(ctx, "ops", RoleAdmin)
+	if err != nil {
+		t.Fatal("error issuing key", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", k.Protect(RoleReadOnly, RoleEditor, AdminHandler(s)))
+	mux.Handle("/admin/audit", k.Protect(RoleAdmin, RoleAdmin, AuditHandler(s)))
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	do := func(method, path, key, body string) *http.Response {
+		req, _ := http.NewRequest(method, svr.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/admin/subscribers", editorKey, `{"email": "j@gmail.com", "urls": ["`+FakeURL+`"]}`)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+
+	// The editor cannot read the audit log.
+	resp = do(http.MethodGet, "/admin/audit", editorKey, "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, "/admin/audit?target=j@gmail.com", adminKey, "")
+	var entries []AuditEntryJSON
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal("error decoding audit log", err)
+	}
+	_ = resp.Body.Close()
+	if len(entries) != 1 || entries[0].Actor != "key:"+editor.ID || entries[0].Action != mongodb.ActionNewsletterSave {
+		t.Fatalf("expected the subscription made by the editor key, got %+v", entries)
+	}
+	var after struct {
+		UserEmail string   `json:"user_email"`
+		URLs      []string `json:"urls"`
+	}
+	if err := json.Unmarshal(entries[0].After, &after); err != nil || after.UserEmail != "j@gmail.com" || entries[0].Before != nil {
+		t.Fatalf("expected the snapshot of the subscription, got %s (%v)", entries[0].After, err)
+	}
+
+	// The keys issued outside of a request are audited as made by the system.
+	resp = do(http.MethodGet, "/admin/audit?action=apikey.save&actor=system", adminKey, "")
+	entries = nil
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal("error decoding audit log", err)
+	}
+	_ = resp.Body.Close()
+	if len(entries) != 2 {
+		t.Fatalf("expected the keys issued, got %+v", entries)
+	}
+	for _, e := range entries {
+		if strings.Contains(string(e.After), editor.Hash) {
+			t.Fatalf("expected the snapshot without the hash of the key, got %s", e.After)
+		}
+	}
+
+	for _, path := range []string{"/admin/audit?limit=0", "/admin/audit?from=yesterday"} {
+		resp = do(http.MethodGet, path, adminKey, "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package newsletter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/notify"
+)
+
+// Channel types of the newsletters
+const (
+	ChannelEmail    = "email"
+	ChannelSlack    = "slack"
+	ChannelDiscord  = "discord"
+	ChannelTelegram = "telegram"
+	ChannelMatrix   = "matrix"
+	ChannelWebhook  = "webhook"
+)
+
+// ChannelTypes are the known channel types
+var ChannelTypes = []string{ChannelEmail, ChannelSlack, ChannelDiscord, ChannelTelegram, ChannelMatrix, ChannelWebhook}
+
+// ParseChannel parses a channel written as type:address, e.g. "telegram:-1001" or
+// "slack:https://hooks.slack.com/services/...", checking that the address fits the type. A webhook channel gets a new
+// secret, that signs its requests and is only known to its receiver.
+func ParseChannel(s string) (mongodb.Channel, error) {
+	typ, address, ok := strings.Cut(s, ":")
+	if !ok || address == "" {
+		return mongodb.Channel{}, fmt.Errorf("invalid channel %q, expected type:address", s)
+	}
+	ch := mongodb.Channel{Type: typ, Address: address}
+	if err := ValidateChannel(ch); err != nil {
+		return ch, err
+	}
+	if ch.Type == ChannelWebhook {
+		ch.Secret = randomID(32)
+	}
+	return ch, nil
+}
+
+// ValidateChannel checks that the channel type is known and its address fits the type
+func ValidateChannel(ch mongodb.Channel) error {
+	switch ch.Type {
+	case ChannelEmail:
+		if !strings.Contains(ch.Address, "@") {
+			return fmt.Errorf("invalid email address %q", ch.Address)
+		}
+	case ChannelSlack, ChannelDiscord, ChannelWebhook:
+		u, err := url.Parse(ch.Address)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid %s webhook URL %q", ch.Type, ch.Address)
+		}
+	case ChannelTelegram, ChannelMatrix:
+		if strings.TrimSpace(ch.Address) == "" {
+			return fmt.Errorf("empty %s address", ch.Type)
+		}
+	default:
+		return fmt.Errorf("unknown channel type %q, expected one of %s", ch.Type, strings.Join(ChannelTypes, ", "))
+	}
+	return nil
+}
+
+// emailNotifier delivers the notifications of the email channel through an Email
+type emailNotifier struct {
+	e Email
+}
+
+func (n emailNotifier) Notify(_ context.Context, to string, m notify.Message) error {
+	return n.e.Send([]string{to}, m.Body)
+}
@@ -0,0 +1,219 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/metrics"
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/notify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseChannel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    mongodb.Channel
+		wantErr bool
+	}{
+		{in: "email:j@gmail.com", want: mongodb.Channel{Type: "email", Address: "j@gmail.com"}},
+		{in: "slack:https://hooks.slack.com/services/T0/B0/X", want: mongodb.Channel{Type: "slack", Address: "https://hooks.slack.com/services/T0/B0/X"}},
+		{in: "telegram:-1001", want: mongodb.Channel{Type: "telegram", Address: "-1001"}},
+		{in: "matrix:!room:matrix.org", want: mongodb.Channel{Type: "matrix", Address: "!room:matrix.org"}},
+		{in: "webhook:http://localhost:8080/hook", want: mongodb.Channel{Type: "webhook", Address: "http://localhost:8080/hook"}},
+		{in: "webhook:https://j.test/hook", want: mongodb.Channel{Type: "webhook", Address: "https://j.test/hook"}},
+		{in: "email:j", wantErr: true},
+		{in: "discord:not a url", wantErr: true},
+		{in: "telegram:", wantErr: true},
+		{in: "sms:+5511999999999", wantErr: true},
+		{in: "slack", wantErr: true},
+	}
+
+	secrets := map[string]bool{}
+	for _, tt := range tests {
+		got, err := ParseChannel(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tt.in, got)
+			}
+			continue
+		}
+		// Every webhook channel gets its own secret.
+		if got.Type == ChannelWebhook {
+			if len(got.Secret) != 64 || secrets[got.Secret] {
+				t.Errorf("%s: expected a new secret, got %q", tt.in, got.Secret)
+			}
+			secrets[got.Secret] = true
+			got.Secret = ""
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%v)", tt.in, tt.want, got, err)
+		}
+	}
+}
+
+// newChannelStorage returns a storage where j@gmail.com has a pending newsletter delivered to the channels.
+func newChannelStorage(ctx context.Context, t *testing.T, channels ...mongodb.Channel) *memory.Storage {
+	s := memory.NewStorage()
+	if err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}, Channels: channels}); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	err := s.SavePage(ctx, []mongodb.Page{{URL: FakeURL, Content: "Hello, World!", IsMostRecent: true, ScrapeDatetime: time.Now().UTC()}})
+	if err != nil {
+		t.Fatal("error saving pages", err)
+	}
+	return s
+}
+
+func TestEmailTrigger_Channels(t *testing.T) {
+	ctx := context.Background()
+
+	payloads := make(chan map[string]string, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error("error decoding payload", err)
+		}
+		payloads <- p
+	}))
+	defer svr.Close()
+
+	s := newChannelStorage(ctx, t,
+		mongodb.Channel{Type: ChannelEmail, Address: "team@gmail.com"},
+		mongodb.Channel{Type: ChannelSlack, Address: svr.URL},
+	)
+	e := &MailClientRecorder{}
+	opts := EmailOptions{Notifiers: map[string]notify.Notifier{ChannelSlack: notify.Slack{Client: svr.Client()}}}
+	if err := EmailTrigger(ctx, s, e, opts); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The channels replace the email of the user.
+	if len(e.sent) != 1 || !strings.Contains(e.sent["team@gmail.com"], FakeURL) {
+		t.Fatalf("expected a single email to team@gmail.com, got %v", e.sent)
+	}
+	if p := <-payloads; !strings.Contains(p["text"], FakeURL) {
+		t.Fatalf("expected the slack message to mention %s, got %v", FakeURL, p)
+	}
+}
+
+func TestEmailTrigger_WebhookChannelSecret(t *testing.T) {
+	ctx := context.Background()
+
+	secrets := map[string]string{"/j": "s3cret-j", "/k": "s3cret-k"}
+	verified := make(chan string, 3)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error("error reading body", err)
+		}
+		if err := notify.Verify(secrets[r.URL.Path], r, body, time.Minute); err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+		}
+		verified <- r.URL.Path
+	}))
+	defer svr.Close()
+
+	// Every channel is signed with its own secret, and the channels without one are not delivered.
+	s := newChannelStorage(ctx, t,
+		mongodb.Channel{Type: ChannelWebhook, Address: svr.URL + "/j", Secret: secrets["/j"]},
+		mongodb.Channel{Type: ChannelWebhook, Address: svr.URL + "/k", Secret: secrets["/k"]},
+		mongodb.Channel{Type: ChannelWebhook, Address: svr.URL + "/unsigned"},
+	)
+	opts := EmailOptions{Notifiers: map[string]notify.Notifier{ChannelWebhook: notify.Webhook{Client: svr.Client()}}}
+	failed := testutil.ToFloat64(metrics.EmailsFailed)
+	if err := EmailTrigger(ctx, s, &MailClientRecorder{}, opts); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	close(verified)
+	got := map[string]bool{}
+	for path := range verified {
+		got[path] = true
+	}
+	if len(got) != 2 || !got["/j"] || !got["/k"] {
+		t.Fatalf("expected both signed channels to be delivered, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.EmailsFailed) - failed; got != 1 {
+		t.Errorf("got %v emails failed, want 1 for the channel without a secret", got)
+	}
+}
+
+func TestEmailTrigger_UnknownChannel(t *testing.T) {
+	ctx := context.Background()
+	s := newChannelStorage(ctx, t,
+		mongodb.Channel{Type: ChannelEmail, Address: "j@gmail.com"},
+		mongodb.Channel{Type: ChannelTelegram, Address: "-1001"},
+	)
+	failed := testutil.ToFloat64(metrics.EmailsFailed)
+
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// Without a Telegram notifier, the email is still sent but the newsletter counts as failed.
+	if len(e.sent) != 1 {
+		t.Fatalf("expected the email to be sent, got %v", e.sent)
+	}
+	if got := testutil.ToFloat64(metrics.EmailsFailed) - failed; got != 1 {
+		t.Errorf("got %v emails failed, want 1", got)
+	}
+}
+
+func TestEmailTrigger_PartialFailure(t *testing.T) {
+	ctx := context.Background()
+	s := newChannelStorage(ctx, t,
+		mongodb.Channel{Type: ChannelEmail, Address: "j@gmail.com"},
+		mongodb.Channel{Type: ChannelTelegram, Address: "-1001"},
+	)
+	opts := EmailOptions{Leaser: s, Owner: "a", Interval: time.Hour}
+
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, opts); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(e.sent) != 1 {
+		t.Fatalf("expected the email to be sent, got %v", e.sent)
+	}
+
+	// The email got the newsletter, so it is held despite the failed Telegram channel.
+	e = &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, opts); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(e.sent) != 0 {
+		t.Fatalf("expected no duplicate email, got %v", e.sent)
+	}
+}
+
+func TestEmailTrigger_DryRunChannels(t *testing.T) {
+	ctx := context.Background()
+	s := newChannelStorage(ctx, t, mongodb.Channel{Type: ChannelSlack, Address: "http://slack.test"})
+
+	notified := false
+	opts := EmailOptions{DryRun: true, Notifiers: map[string]notify.Notifier{
+		ChannelSlack: notify.NotifierFunc(func(context.Context, string, notify.Message) error {
+			notified = true
+			return nil
+		}),
+	}}
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, opts); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if notified {
+		t.Fatal("expected the dry run not to notify the channels")
+	}
+	if _, ok := e.sent["j@gmail.com"]; !ok {
+		t.Fatalf("expected the email of the user to be rendered, got %v", e.sent)
+	}
+}
@@ -0,0 +1,918 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/perebaj/newsletter"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// errUsage is returned when a command is called with invalid arguments
+var errUsage = errors.New("invalid usage")
+
+// cli is the state shared by the commands
+type cli struct {
+	cfg     Config
+	storage storage
+	in      io.Reader
+	out     io.Writer
+}
+
+// command runs with the arguments that follow its name
+type command func(ctx context.Context, c *cli, args []string) error
+
+var commands = map[string]command{
+	"serve":   serve,
+	"migrate": migrate,
+	"crawl": subcommands("crawl", map[string]command{
+		"once": crawlOnce,
+	}),
+	"send":    send,
+	"preview": preview,
+	"engineers": subcommands("engineers", map[string]command{
+		"add":  addEngineer,
+		"list": listEngineers,
+		"rm":   removeEngineer,
+	}),
+	"subscribers": subcommands("subscribers", map[string]command{
+		"add":    addSubscriber,
+		"list":   listSubscribers,
+		"rm":     removeSubscriber,
+		"filter": filterSubscriber,
+	}),
+	"pages": subcommands("pages", map[string]command{
+		"history": pageHistory,
+	}),
+	"webhooks": subcommands("webhooks", map[string]command{
+		"add":        addWebhook,
+		"list":       listWebhooks,
+		"rm":         removeWebhook,
+		"deliveries": listDeliveries,
+		"replay":     replayDelivery,
+	}),
+	"feeds": subcommands("feeds", map[string]command{
+		"url": feedURL,
+	}),
+	"opml": subcommands("opml", map[string]command{
+		"import": importOPML,
+		"export": exportOPML,
+	}),
+	"search": search,
+	"keys": subcommands("keys", map[string]command{
+		"add":    addAPIKey,
+		"list":   listAPIKeys,
+		"revoke": revokeAPIKey,
+		"usage":  keyUsage,
+	}),
+	"audit": audit,
+	"privacy": subcommands("privacy", map[string]command{
+		"export": exportData,
+		"erase":  eraseData,
+	}),
+}
+
+func usage(out io.Writer) {
+	fmt.Fprint(out, `usage: newsletter [global flags] <command> [flags] [args]
+
+commands:
+  serve                                     run the crawler and the emails (default)
+  migrate                                   apply the pending migrations
+  crawl once <url>                          crawl an URL right away
+  send [--dry-run] [--out-dir dir]          send the emails of the newsletters with new articles
+  preview [--addr addr]                     serve the pending emails at /preview, without sending them
+  engineers add [flags] <url>               add or update an engineer
+  engineers list                            list the engineers and their crawl schedule
+  engineers rm <url>                        remove an engineer
+  subscribers add [flags] <email> <url>...  subscribe an email to URLs
+  subscribers list                          list the subscribers
+  subscribers rm <email>                    unsubscribe an email
+  subscribers filter [flags] <email>        set the keywords the changes of the URLs must have
+  pages history [--limit n] <url>           list the scraped versions of an URL
+  webhooks add [flags] <email> <endpoint>   register a webhook for the changes of the pages
+  webhooks list                             list the webhooks
+  webhooks rm <id>                          remove a webhook and its deliveries
+  webhooks deliveries [--limit n] <id>      list the latest deliveries of a webhook
+  webhooks replay <delivery id>             send a delivery again
+  feeds url [--base url] <email>            print the URL of the Atom feed of a subscriber
+  opml import <email> [file]                subscribe an email to the sources of an OPML file
+  opml export [--feeds url] <email>         print the sources of a subscriber as OPML
+  search [flags] <words>...                 search the scraped versions of the pages
+  keys add --role role <name>               issue an API key of the admin routes
+  keys list                                 list the API keys
+  keys revoke <id>                          revoke an API key
+  keys usage [--limit n] [id]               list the latest requests of an API key, of all when missing
+  audit [flags]                             list the latest changes of the engineers, subscribers and keys
+  privacy export <email>                    print everything stored about an email as JSON
+  privacy erase [flags] <email>             erase everything stored about an email
+
+Run newsletter -h for the global flags and newsletter <command> -h for the flags of a command.
+`)
+}
+
+// subcommands returns a command that dispatches to the subcommand named by its first argument.
+func subcommands(name string, subs map[string]command) command {
+	return func(ctx context.Context, c *cli, args []string) error {
+		if len(args) > 0 {
+			if sub, ok := subs[args[0]]; ok {
+				return sub(ctx, c, args[1:])
+			}
+		}
+
+		names := make([]string, 0, len(subs))
+		for n := range subs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(c.out, "usage: newsletter %s %s\n", name, strings.Join(names, "|"))
+		return fmt.Errorf("%w: %s needs one of %s", errUsage, name, strings.Join(names, ", "))
+	}
+}
+
+// flagSet returns the flag set of the command name, whose positional arguments are described by argsUsage.
+func (c *cli) flagSet(name, argsUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.out)
+	fs.Usage = func() {
+		fmt.Fprintf(c.out, "usage: newsletter %s [flags] %s\n", name, argsUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of args, requiring at least n positional arguments.
+func parse(fs *flag.FlagSet, args []string, n int) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() < n {
+		fs.Usage()
+		return fmt.Errorf("%w: %s needs %d argument(s)", errUsage, fs.Name(), n)
+	}
+	return nil
+}
+
+func migrate(_ context.Context, c *cli, args []string) error {
+	if err := parse(c.flagSet("migrate", ""), args, 0); err != nil {
+		return err
+	}
+	// The migrations are applied before every command.
+	slog.Info("migrations applied successfully")
+	return nil
+}
+
+func crawlOnce(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("crawl once", "<url>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	crawler := newsletter.NewCrawler(1, c.cfg.Crawler.Interval)
+	crawler.Scheduler = c.cfg.scheduler()
+	if webhooks, err := c.webhooks(); err == nil {
+		crawler.OnChange = webhooks.PageChanged
+	}
+	page, err := crawler.CrawlOnce(ctx, c.storage, fs.Arg(0), newsletter.Fetch)
+	if err != nil {
+		return err
+	}
+
+	state := "unchanged"
+	if page.IsMostRecent {
+		state = "changed"
+	}
+	fmt.Fprintf(c.out, "%s %s (%d bytes)\n", page.URL, state, len(page.Content))
+	return nil
+}
+
+func send(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("send", "")
+	dryRun := fs.Bool("dry-run", false, "write the emails to the output instead of sending them, without touching the delivery state")
+	outDir := fs.String("out-dir", "", "with --dry-run, write every email to a .eml file in this directory")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		var e newsletter.Email = &newsletter.WriterEmail{W: c.out}
+		if *outDir != "" {
+			e = newsletter.DirEmail{Dir: *outDir}
+		}
+		return newsletter.EmailTrigger(ctx, c.storage, e, newsletter.EmailOptions{BatchSize: c.cfg.Email.BatchSize, DryRun: true})
+	}
+
+	// Leasing the newsletters keeps the running instances from sending the same emails again.
+	opts := newsletter.EmailOptions{
+		BatchSize: c.cfg.Email.BatchSize,
+		LeaseTTL:  c.cfg.Crawler.LeaseTTL,
+		Interval:  c.cfg.Email.Interval * 9 / 10,
+		Notifiers: c.cfg.notifiers(),
+	}
+	if leaser, ok := c.storage.(newsletter.Leaser); ok {
+		opts.Leaser, opts.Owner = leaser, newsletter.InstanceID()
+	}
+	return newsletter.EmailTrigger(ctx, c.storage, newsletter.NewMailClient(c.cfg.emailConfig()), opts)
+}
+
+// preview serves the emails of every subscriber, so it requires the API keys when they are configured and is only
+// served on a loopback address without them.
+func preview(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("preview", "")
+	addr := fs.String("addr", "localhost:8080", "address of the preview server")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	h := newsletter.PreviewHandler(c.storage)
+	if c.cfg.HTTP.APIKeys {
+		keys, err := c.apiKeys()
+		if err != nil {
+			return err
+		}
+		h = keys.Protect(newsletter.RoleReadOnly, newsletter.RoleEditor, h)
+	} else if !isLoopback(*addr) {
+		return fmt.Errorf("%w: %s is not a loopback address, serving the preview on it requires http.api_keys", errUsage, *addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/preview", h)
+	return c.listenAndServe(ctx, *addr, mux)
+}
+
+// isLoopback reports whether addr only listens on the loopback interface, an empty host listening on all of them
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func addEngineer(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("engineers add", "<url>")
+	name := fs.String("name", "", "name of the engineer")
+	description := fs.String("description", "", "description of the engineer")
+	schedule := fs.String("schedule", "", `how often the URL is crawled, an interval ("6h") or a cron expression ("0 8 * * *")`)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	if *schedule != "" {
+		if _, err := newsletter.ParseSchedule(*schedule); err != nil {
+			return fmt.Errorf("%w: %v", errUsage, err)
+		}
+	}
+
+	return c.storage.SaveEngineer(ctx, mongodb.Engineer{
+		Name:        *name,
+		Description: *description,
+		URL:         fs.Arg(0),
+		Schedule:    *schedule,
+	})
+}
+
+func listEngineers(ctx context.Context, c *cli, args []string) error {
+	if err := parse(c.flagSet("engineers list", ""), args, 0); err != nil {
+		return err
+	}
+
+	status, err := c.cfg.scheduler().Status(ctx, c.storage)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tNAME\tSCHEDULE\tINTERVAL\tLAST RUN\tNEXT RUN")
+	for _, s := range status {
+		schedule := s.Engineer.Schedule
+		if schedule == "" {
+			schedule = "adaptive"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\n", s.Engineer.URL, s.Engineer.Name, schedule, s.Interval,
+			formatTime(s.LastRun), formatTime(s.NextRun))
+	}
+	return w.Flush()
+}
+
+func removeEngineer(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("engineers rm", "<url>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	err := c.storage.DeleteEngineer(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("engineer %s not found", fs.Arg(0))
+	}
+	return err
+}
+
+func addSubscriber(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("subscribers add", "<email> <url>...")
+	var channels []mongodb.Channel
+	fs.Func("channel", "deliver the newsletter to type:address instead of the email, repeatable, e.g. "+
+		"slack:https://hooks.slack.com/services/... or telegram:<chat id>", func(v string) error {
+		ch, err := newsletter.ParseChannel(v)
+		if err != nil {
+			return err
+		}
+		channels = append(channels, ch)
+		return nil
+	})
+	cadence := fs.String("cadence", "", "send a daily or weekly digest instead of every change")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	if _, err := newsletter.CadenceInterval(*cadence); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	err := c.storage.SaveNewsletter(ctx, mongodb.Newsletter{
+		UserEmail: fs.Arg(0),
+		URLs:      fs.Args()[1:],
+		Channels:  channels,
+		Cadence:   *cadence,
+	})
+	if err != nil {
+		return err
+	}
+	// The secrets are only shown here, their receivers need them to check the signatures.
+	for _, ch := range channels {
+		if ch.Secret != "" {
+			fmt.Fprintf(c.out, "secret of %s:%s: %s\n", ch.Type, ch.Address, ch.Secret)
+		}
+	}
+	return nil
+}
+
+func listSubscribers(ctx context.Context, c *cli, args []string) error {
+	if err := parse(c.flagSet("subscribers list", ""), args, 0); err != nil {
+		return err
+	}
+
+	newsletters, err := c.storage.Newsletter(ctx, "", 0)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tURLS\tCHANNELS\tFILTERS")
+	for _, n := range newsletters {
+		channels := "email"
+		if len(n.Channels) > 0 {
+			types := make([]string, 0, len(n.Channels))
+			for _, ch := range n.Channels {
+				types = append(types, ch.Type)
+			}
+			channels = strings.Join(types, " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", n.UserEmail, strings.Join(n.URLs, " "), channels, len(n.Filters))
+	}
+	return w.Flush()
+}
+
+func removeSubscriber(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("subscribers rm", "<email>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	err := c.storage.DeleteNewsletter(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("subscriber %s not found", fs.Arg(0))
+	}
+	return err
+}
+
+func filterSubscriber(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("subscribers filter", "<email>")
+	var f mongodb.Filter
+	fs.StringVar(&f.URL, "url", "", "filter the changes of this URL only, all the URLs of the subscriber when missing")
+	fs.Func("include", "notify only the changes with one of these keywords, repeatable, /expression/ for a regular expression", func(v string) error {
+		f.Include = append(f.Include, v)
+		return nil
+	})
+	fs.Func("exclude", "never notify the changes with this keyword, repeatable, /expression/ for a regular expression", func(v string) error {
+		f.Exclude = append(f.Exclude, v)
+		return nil
+	})
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	n, err := c.storage.Subscription(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("subscriber %s not found", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	// Without keywords, the filter of the URL is removed.
+	n, err = newsletter.SetFilter(n, f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	return c.storage.UpdateNewsletter(ctx, n)
+}
+
+func pageHistory(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("pages history", "<url>")
+	limit := fs.Int("limit", 20, "maximum number of versions, 0 lists all")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	pages, err := c.storage.PageHistory(ctx, fs.Arg(0), *limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCRAPED AT\tCHANGED\tMD5\tBYTES")
+	for _, p := range pages {
+		fmt.Fprintf(w, "%s\t%v\t%x\t%d\n", formatTime(p.ScrapeDatetime), p.IsMostRecent, p.HashMD5, len(p.Content))
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// webhooks returns the webhooks of the storage, an error when it does not keep them.
+func (c *cli) webhooks() (*newsletter.Webhooks, error) {
+	s, ok := c.storage.(newsletter.WebhookStorage)
+	if !ok {
+		return nil, fmt.Errorf("the %s storage does not support webhooks", c.cfg.Storage.Type)
+	}
+	w := newsletter.NewWebhooks(s)
+	w.MaxAttempts = c.cfg.Webhooks.MaxAttempts
+	w.Backoff = c.cfg.Webhooks.Backoff
+	w.AllowPrivateHosts = c.cfg.Webhooks.AllowPrivateHosts
+	return w, nil
+}
+
+func addWebhook(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("webhooks add", "<email> <endpoint>")
+	var urls []string
+	fs.Func("url", "send only the changes of this page, repeatable, all the pages when missing", func(v string) error {
+		urls = append(urls, v)
+		return nil
+	})
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+
+	webhooks, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	wh, err := webhooks.Register(ctx, fs.Arg(0), fs.Arg(1), urls)
+	if err != nil {
+		return err
+	}
+	// The secret is only shown here, the receiver needs it to verify the signatures.
+	fmt.Fprintf(c.out, "id: %s\nsecret: %s\n", wh.ID, wh.Secret)
+	return nil
+}
+
+func listWebhooks(ctx context.Context, c *cli, args []string) error {
+	if err := parse(c.flagSet("webhooks list", ""), args, 0); err != nil {
+		return err
+	}
+
+	webhooks, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	list, err := webhooks.Storage.Webhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tENDPOINT\tURLS")
+	for _, wh := range list {
+		urls := "all"
+		if len(wh.URLs) > 0 {
+			urls = strings.Join(wh.URLs, " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", wh.ID, wh.UserEmail, wh.Endpoint, urls)
+	}
+	return w.Flush()
+}
+
+func removeWebhook(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("webhooks rm", "<id>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	webhooks, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	err = webhooks.Storage.DeleteWebhook(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("webhook %s not found", fs.Arg(0))
+	}
+	return err
+}
+
+func listDeliveries(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("webhooks deliveries", "<id>")
+	limit := fs.Int("limit", 20, "maximum number of deliveries, 0 lists all")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	webhooks, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	deliveries, err := webhooks.Storage.Deliveries(ctx, fs.Arg(0), *limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEVENT\tSTATUS\tATTEMPTS\tCREATED AT\tLAST ERROR")
+	for _, d := range deliveries {
+		lastErr := "-"
+		if n := len(d.Attempts); n > 0 && d.Attempts[n-1].Error != "" {
+			lastErr = d.Attempts[n-1].Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", d.ID, d.Event, d.Status, len(d.Attempts),
+			formatTime(d.CreatedAt), lastErr)
+	}
+	return w.Flush()
+}
+
+func replayDelivery(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("webhooks replay", "<delivery id>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	webhooks, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	d, err := webhooks.Replay(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("delivery %s not found", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	if last := d.Attempts[len(d.Attempts)-1]; last.Error != "" {
+		return fmt.Errorf("error replaying delivery %s: %s", d.ID, last.Error)
+	}
+	fmt.Fprintf(c.out, "delivery %s %s\n", d.ID, d.Status)
+	return nil
+}
+
+func feedURL(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("feeds url", "<email>")
+	base := fs.String("base", "", "URL the HTTP server is reachable at, e.g. https://newsletter.example.com")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	if c.cfg.Feeds.Secret == "" {
+		return errors.New("the feeds of the subscribers are disabled without feeds.secret")
+	}
+	email := fs.Arg(0)
+	_, err := c.storage.Subscription(ctx, email)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("subscriber %s not found", email)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s/feeds/subscriptions/%s\n", strings.TrimSuffix(*base, "/"), newsletter.FeedToken(c.cfg.Feeds.Secret, email))
+	return nil
+}
+
+func importOPML(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("opml import", "<email> [file]")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	email := fs.Arg(0)
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("%w: invalid email address %q", errUsage, email)
+	}
+	// The document is read from the standard input without file, or with "-".
+	r := c.in
+	if path := fs.Arg(1); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening OPML file: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		r = f
+	}
+
+	sources, err := newsletter.ParseOPML(r)
+	if err != nil {
+		return err
+	}
+	res, err := newsletter.ImportOPML(ctx, c.storage, email, sources)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%d sources, %d new engineers, %d URLs subscribed\n", len(sources), res.Engineers, res.URLs)
+	return nil
+}
+
+func exportOPML(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("opml export", "<email>")
+	feeds := fs.String("feeds", "", "URL the HTTP server is reachable at, to link every source to its Atom feed")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	doc, err := newsletter.ExportOPML(ctx, c.storage, fs.Arg(0), *feeds)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("subscriber %s not found", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	return newsletter.WriteOPML(c.out, doc)
+}
+
+func search(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("search", "<words>...")
+	engineer := fs.String("engineer", "", "search only the page of this engineer, by URL or name")
+	from := fs.String("from", "", "search only the versions scraped since this date or RFC 3339 time")
+	to := fs.String("to", "", "search only the versions scraped until this date or RFC 3339 time")
+	limit := fs.Int("limit", newsletter.DefaultSearchLimit, "maximum number of results")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	s, ok := c.storage.(newsletter.SearchStorage)
+	if !ok {
+		return fmt.Errorf("the %s storage does not support search", c.cfg.Storage.Type)
+	}
+	q, err := newsletter.ParseSearchQuery(url.Values{
+		"q":        {strings.Join(fs.Args(), " ")},
+		"engineer": {*engineer},
+		"from":     {*from},
+		"to":       {*to},
+		"limit":    {strconv.Itoa(*limit)},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	results, err := newsletter.Search(ctx, s, q)
+	if err != nil {
+		return err
+	}
+
+	// The snippets are HTML, the matches are shown between asterisks.
+	text := strings.NewReplacer("<mark>", "*", "</mark>", "*")
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCRAPED AT\tENGINEER\tURL\tSNIPPET")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", formatTime(r.ScrapedAt), r.Engineer.Name, r.URL,
+			html.UnescapeString(text.Replace(r.Snippet)))
+	}
+	return w.Flush()
+}
+
+// apiKeys returns the API keys of the storage, an error when it does not keep them.
+func (c *cli) apiKeys() (*newsletter.APIKeys, error) {
+	s, ok := c.storage.(newsletter.APIKeyStorage)
+	if !ok {
+		return nil, fmt.Errorf("the %s storage does not support API keys", c.cfg.Storage.Type)
+	}
+	return newsletter.NewAPIKeys(s), nil
+}
+
+func addAPIKey(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("keys add", "<name>")
+	role := fs.String("role", newsletter.RoleReadOnly, "role of the key, one of "+strings.Join(newsletter.Roles, ", "))
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if err := newsletter.ValidateRole(*role); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	keys, err := c.apiKeys()
+	if err != nil {
+		return err
+	}
+	record, key, err := keys.Issue(ctx, fs.Arg(0), *role)
+	if err != nil {
+		return err
+	}
+	// Only the hash is stored, the key cannot be shown again.
+	fmt.Fprintf(c.out, "id: %s\nkey: %s\n", record.ID, key)
+	return nil
+}
+
+func listAPIKeys(ctx context.Context, c *cli, args []string) error {
+	if err := parse(c.flagSet("keys list", ""), args, 0); err != nil {
+		return err
+	}
+
+	keys, err := c.apiKeys()
+	if err != nil {
+		return err
+	}
+	list, err := keys.Storage.APIKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tROLE\tCREATED AT\tREVOKED AT")
+	for _, k := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Role, formatTime(k.CreatedAt), formatTime(k.RevokedAt))
+	}
+	return w.Flush()
+}
+
+func revokeAPIKey(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("keys revoke", "<id>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	keys, err := c.apiKeys()
+	if err != nil {
+		return err
+	}
+	err = keys.Revoke(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("API key %s not found", fs.Arg(0))
+	}
+	return err
+}
+
+func keyUsage(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("keys usage", "[id]")
+	limit := fs.Int("limit", 20, "maximum number of requests, 0 lists all")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	keys, err := c.apiKeys()
+	if err != nil {
+		return err
+	}
+	usage, err := keys.Storage.KeyUsage(ctx, fs.Arg(0), *limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tKEY\tMETHOD\tPATH\tSTATUS\tREMOTE ADDR")
+	for _, u := range usage {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", formatTime(u.At), u.KeyID, u.Method, u.Path, u.Status, u.RemoteAddr)
+	}
+	return w.Flush()
+}
+
+func audit(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("audit", "")
+	actor := fs.String("actor", "", "list only the changes of this actor, e.g. key:<id>, subscriber:<email>, cli:<user> or system")
+	action := fs.String("action", "", "list only the changes of this action, e.g. newsletter.update")
+	target := fs.String("target", "", "list only the changes of this URL, email or ID")
+	from := fs.String("from", "", "list only the changes since this date or RFC 3339 time")
+	to := fs.String("to", "", "list only the changes until this date or RFC 3339 time")
+	limit := fs.Int("limit", newsletter.DefaultAuditLimit, "maximum number of changes")
+	asJSON := fs.Bool("json", false, "print the changes as JSON lines, with their snapshots")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	s, ok := c.storage.(newsletter.AuditStorage)
+	if !ok {
+		return fmt.Errorf("the %s storage does not support the audit log", c.cfg.Storage.Type)
+	}
+	q, err := newsletter.ParseAuditQuery(url.Values{
+		"actor":  {*actor},
+		"action": {*action},
+		"target": {*target},
+		"from":   {*from},
+		"to":     {*to},
+		"limit":  {strconv.Itoa(*limit)},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	entries, err := s.AuditLog(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(c.out)
+		for _, e := range entries {
+			v, err := newsletter.NewAuditEntryJSON(e)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(v); err != nil {
+				return fmt.Errorf("error encoding audit entry: %v", err)
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tACTOR\tACTION\tTARGET")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", formatTime(e.At), e.Actor, e.Action, e.Target)
+	}
+	return w.Flush()
+}
+
+func exportData(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("privacy export", "<email>")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	export, err := newsletter.NewPrivacy(c.storage, nil).Export(ctx, fs.Arg(0))
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("nothing stored about %s", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		return fmt.Errorf("error encoding export: %v", err)
+	}
+	return nil
+}
+
+func eraseData(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("privacy erase", "<email>")
+	yes := fs.Bool("yes", false, "erase without asking to type the email to confirm")
+	notify := fs.Bool("notify", true, "email the subscriber once the data is erased")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	email := fs.Arg(0)
+
+	if !*yes {
+		fmt.Fprintf(c.out, "This erases everything stored about %s and cannot be undone. Type the email to confirm: ", email)
+		line, _ := bufio.NewReader(c.in).ReadString('\n')
+		if strings.TrimSpace(line) != email {
+			fmt.Fprintln(c.out)
+			return errors.New("erasure not confirmed")
+		}
+	}
+	var mail newsletter.Email
+	if *notify {
+		mail = newsletter.NewMailClient(c.cfg.emailConfig())
+	}
+	erasure, err := newsletter.NewPrivacy(c.storage, mail).Erase(ctx, email)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("nothing stored about %s", email)
+	}
+	if err != nil && !errors.Is(err, newsletter.ErrNotConfirmed) {
+		return err
+	}
+	fmt.Fprintf(c.out, "subscription erased: %t\nwebhooks erased: %d\naudit entries anonymized: %d\n",
+		erasure.Subscription, erasure.Webhooks, erasure.AuditEntries)
+	return err
+}
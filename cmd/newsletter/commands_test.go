@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/perebaj/newsletter"
+	"github.com/perebaj/newsletter/sqlite"
+)
+
+func newTestConfig(t *testing.T) Config {
+	cfg := defaultConfig()
+	cfg.Storage.Type = "sqlite"
+	cfg.Storage.SQLite = sqlite.Config{Path: filepath.Join(t.TempDir(), "newsletter.db")}
+	return cfg
+}
+
+func runCommand(t *testing.T, cfg Config, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := run(context.Background(), cfg, args, &out); err != nil {
+		t.Fatalf("newsletter %s: %v\n%s", strings.Join(args, " "), err, out.String())
+	}
+	return out.String()
+}
+
+func TestEngineersCommands(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	runCommand(t, cfg, "engineers", "add", "--name", "John", "--schedule", "6h", "https://www.1.com")
+	runCommand(t, cfg, "engineers", "add", "https://www.2.com")
+
+	out := runCommand(t, cfg, "engineers", "list")
+	if !strings.Contains(out, "https://www.1.com  John") || !strings.Contains(out, "6h") ||
+		!strings.Contains(out, "https://www.2.com") || !strings.Contains(out, "adaptive") {
+		t.Fatalf("unexpected engineers list:\n%s", out)
+	}
+
+	runCommand(t, cfg, "engineers", "rm", "https://www.1.com")
+	if out := runCommand(t, cfg, "engineers", "list"); strings.Contains(out, "https://www.1.com") {
+		t.Fatalf("expected the engineer to be removed:\n%s", out)
+	}
+
+	err := run(context.Background(), cfg, []string{"engineers", "rm", "https://www.1.com"}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected error removing a missing engineer")
+	}
+	err = run(context.Background(), cfg, []string{"engineers", "add", "--schedule", "every day", "https://www.3.com"}, &bytes.Buffer{})
+	if !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error for an invalid schedule, got %v", err)
+	}
+}
+
+func TestSubscribersCommands(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	runCommand(t, cfg, "subscribers", "add", "j@gmail.com", "https://www.1.com", "https://www.2.com")
+	out := runCommand(t, cfg, "subscribers", "list")
+	if !strings.Contains(out, "j@gmail.com  https://www.1.com https://www.2.com") {
+		t.Fatalf("unexpected subscribers list:\n%s", out)
+	}
+
+	runCommand(t, cfg, "subscribers", "rm", "j@gmail.com")
+	if out := runCommand(t, cfg, "subscribers", "list"); strings.Contains(out, "j@gmail.com") {
+		t.Fatalf("expected the subscriber to be removed:\n%s", out)
+	}
+
+	err := run(context.Background(), cfg, []string{"subscribers", "add", "j@gmail.com"}, &bytes.Buffer{})
+	if !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error without urls, got %v", err)
+	}
+
+	runCommand(t, cfg, "subscribers", "add", "--channel", "telegram:-1001", "--channel", "email:team@gmail.com",
+		"k@gmail.com", "https://www.1.com")
+	if out := runCommand(t, cfg, "subscribers", "list"); !strings.Contains(out, "telegram email") {
+		t.Fatalf("expected the channels of the subscriber:\n%s", out)
+	}
+
+	// The secret of a webhook channel is printed once, when it is set.
+	out = runCommand(t, cfg, "subscribers", "add", "--channel", "webhook:https://l.test/hook", "l@gmail.com", "https://www.1.com")
+	if !regexp.MustCompile(`^secret of webhook:https://l.test/hook: [0-9a-f]{64}\n$`).MatchString(out) {
+		t.Fatalf("expected the secret of the webhook channel, got %q", out)
+	}
+	if out := runCommand(t, cfg, "subscribers", "list"); strings.Contains(out, "secret") {
+		t.Fatalf("expected the secret to be shown once:\n%s", out)
+	}
+
+	err = run(context.Background(), cfg, []string{"subscribers", "add", "--channel", "sms:123", "l@gmail.com", "https://www.1.com"}, &bytes.Buffer{})
+	if !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error for an unknown channel, got %v", err)
+	}
+	err = run(context.Background(), cfg, []string{"subscribers", "add", "--cadence", "hourly", "l@gmail.com", "https://www.1.com"}, &bytes.Buffer{})
+	if !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error for an unknown cadence, got %v", err)
+	}
+
+	runCommand(t, cfg, "subscribers", "filter", "--url", "https://www.1.com", "--include", "go", "--exclude", "/hiring/", "k@gmail.com")
+	if out := runCommand(t, cfg, "subscribers", "list"); !strings.Contains(out, "telegram email  1") {
+		t.Fatalf("expected the filter of the subscriber:\n%s", out)
+	}
+	runCommand(t, cfg, "subscribers", "filter", "--url", "https://www.1.com", "k@gmail.com")
+	if out := runCommand(t, cfg, "subscribers", "list"); !strings.Contains(out, "telegram email  0") {
+		t.Fatalf("expected the filter to be removed:\n%s", out)
+	}
+	for _, args := range [][]string{
+		{"--url", "https://www.2.com", "--include", "go", "k@gmail.com"},
+		{"--include", "/(/", "k@gmail.com"},
+	} {
+		err = run(context.Background(), cfg, append([]string{"subscribers", "filter"}, args...), &bytes.Buffer{})
+		if !errors.Is(err, errUsage) {
+			t.Fatalf("%v: expected usage error, got %v", args, err)
+		}
+	}
+	if err := run(context.Background(), cfg, []string{"subscribers", "filter", "--include", "go", "z@gmail.com"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error for a missing subscriber")
+	}
+}
+
+func TestCrawlAndSendCommands(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	content := "first version"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+
+	if out := runCommand(t, cfg, "crawl", "once", ts.URL); !strings.Contains(out, "changed") {
+		t.Fatalf("expected the first crawl to change, got %s", out)
+	}
+	if out := runCommand(t, cfg, "crawl", "once", ts.URL); !strings.Contains(out, "unchanged") {
+		t.Fatalf("expected the second crawl to be unchanged, got %s", out)
+	}
+
+	out := runCommand(t, cfg, "pages", "history", ts.URL)
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 {
+		t.Fatalf("expected a header and 2 versions, got:\n%s", out)
+	}
+
+	content = "second version"
+	runCommand(t, cfg, "crawl", "once", ts.URL)
+	runCommand(t, cfg, "subscribers", "add", "j@gmail.com", ts.URL)
+
+	out = runCommand(t, cfg, "send", "--dry-run")
+	if !strings.Contains(out, "To: j@gmail.com") || !strings.Contains(out, ts.URL) {
+		t.Fatalf("unexpected dry run:\n%s", out)
+	}
+
+	dir := t.TempDir()
+	runCommand(t, cfg, "send", "--dry-run", "--out-dir", dir)
+	if _, err := os.Stat(filepath.Join(dir, "j@gmail.com.eml")); err != nil {
+		t.Fatal("expected the email file", err)
+	}
+}
+
+func TestPreviewCommand_Addr(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	for _, addr := range []string{":8080", "0.0.0.0:8080", "10.0.0.1:8080", "[::]:8080", "8080"} {
+		err := run(context.Background(), cfg, []string{"preview", "--addr", addr}, &bytes.Buffer{})
+		if !errors.Is(err, errUsage) {
+			t.Errorf("%s: expected usage error serving the preview without API keys, got %v", addr, err)
+		}
+	}
+
+	// With the keys, the preview is protected on any address, and the sqlite storage does not support them.
+	cfg.HTTP.APIKeys = true
+	err := run(context.Background(), cfg, []string{"preview", "--addr", ":8080"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "does not support API keys") {
+		t.Fatalf("expected the preview to require the API keys, got %v", err)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.168.0.1:8080", false},
+		{"example.com:8080", false},
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopback(tt.addr); got != tt.want {
+			t.Errorf("isLoopback(%q) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWebhooksCommands_Unsupported(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	err := run(context.Background(), cfg, []string{"webhooks", "add", "j@gmail.com", "https://hooks.test"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "does not support webhooks") {
+		t.Fatalf("expected the sqlite storage to refuse webhooks, got %v", err)
+	}
+}
+
+func TestSearchCommand_Unsupported(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	err := run(context.Background(), cfg, []string{"search", "go"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "does not support search") {
+		t.Fatalf("expected the sqlite storage to refuse search, got %v", err)
+	}
+	if err := run(context.Background(), cfg, []string{"search"}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error without words, got %v", err)
+	}
+}
+
+func TestKeysCommands_Unsupported(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	err := run(context.Background(), cfg, []string{"keys", "add", "--role", newsletter.RoleEditor, "ci"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "does not support API keys") {
+		t.Fatalf("expected the sqlite storage to refuse API keys, got %v", err)
+	}
+	if err := run(context.Background(), cfg, []string{"keys", "add", "--role", "root", "ci"}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error for an unknown role, got %v", err)
+	}
+}
+
+func TestAuditCommand_Unsupported(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	err := run(context.Background(), cfg, []string{"audit", "--actor", "system"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "does not support the audit log") {
+		t.Fatalf("expected the sqlite storage to refuse the audit log, got %v", err)
+	}
+}
+
+func TestPrivacyCommands(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	runCommand(t, cfg, "subscribers", "add", "j@gmail.com", "https://www.1.com")
+	out := runCommand(t, cfg, "privacy", "export", "j@gmail.com")
+	var export struct {
+		Email        string `json:"email"`
+		Subscription struct {
+			URLs []string `json:"urls"`
+		} `json:"subscription"`
+	}
+	if err := json.Unmarshal([]byte(out), &export); err != nil || export.Email != "j@gmail.com" ||
+		len(export.Subscription.URLs) != 1 {
+		t.Fatalf("expected the export of the subscription, got %s (%v)", out, err)
+	}
+
+	// The erasure asks to type the email, and the tests have no input.
+	err := run(context.Background(), cfg, []string{"privacy", "erase", "--notify=false", "j@gmail.com"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "not confirmed") {
+		t.Fatalf("expected the erasure to need a confirmation, got %v", err)
+	}
+
+	out = runCommand(t, cfg, "privacy", "erase", "--yes", "--notify=false", "j@gmail.com")
+	if !strings.Contains(out, "subscription erased: true") {
+		t.Fatalf("expected the subscription erased, got %s", out)
+	}
+	for _, args := range [][]string{{"privacy", "export", "j@gmail.com"}, {"privacy", "erase", "--yes", "j@gmail.com"}} {
+		err := run(context.Background(), cfg, args, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), "nothing stored") {
+			t.Errorf("%v: expected nothing stored, got %v", args, err)
+		}
+	}
+}
+
+func TestFeedsCommands(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Feeds.Secret = "s3cret"
+
+	runCommand(t, cfg, "subscribers", "add", "j@gmail.com", "https://www.1.com")
+	out := runCommand(t, cfg, "feeds", "url", "--base", "https://nl.test/", "j@gmail.com")
+	want := "https://nl.test/feeds/subscriptions/" + newsletter.FeedToken("s3cret", "j@gmail.com")
+	if strings.TrimSpace(out) != want {
+		t.Fatalf("expected %s, got %s", want, out)
+	}
+
+	if err := run(context.Background(), cfg, []string{"feeds", "url", "k@gmail.com"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error for a missing subscriber")
+	}
+	cfg.Feeds.Secret = ""
+	if err := run(context.Background(), cfg, []string{"feeds", "url", "j@gmail.com"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error without secret")
+	}
+}
+
+func TestOPMLCommands(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	path := filepath.Join(t.TempDir(), "feeds.opml")
+	opml := `<opml version="2.0"><body><outline text="Tech">
+		<outline text="John" xmlUrl="https://www.1.com/feed" htmlUrl="https://www.1.com"/>
+		<outline text="Mary" xmlUrl="https://www.2.com/feed"/>
+	</outline></body></opml>`
+	if err := os.WriteFile(path, []byte(opml), 0o644); err != nil {
+		t.Fatal("error writing OPML", err)
+	}
+
+	runCommand(t, cfg, "engineers", "add", "--name", "Johnny", "https://www.1.com")
+	if out := runCommand(t, cfg, "opml", "import", "j@gmail.com", path); !strings.Contains(out, "2 sources, 1 new engineers, 2 URLs") {
+		t.Fatalf("unexpected import:\n%s", out)
+	}
+	if out := runCommand(t, cfg, "subscribers", "list"); !strings.Contains(out, "j@gmail.com  https://www.1.com https://www.2.com/feed") {
+		t.Fatalf("expected the subscription of the sources:\n%s", out)
+	}
+
+	out := runCommand(t, cfg, "opml", "export", "--feeds", "https://nl.test", "j@gmail.com")
+	if !strings.Contains(out, `text="Johnny"`) || !strings.Contains(out, `xmlUrl="https://nl.test/feeds/engineers?url=https%3A%2F%2Fwww.1.com"`) {
+		t.Fatalf("unexpected export:\n%s", out)
+	}
+
+	if err := run(context.Background(), cfg, []string{"opml", "export", "k@gmail.com"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error exporting a missing subscriber")
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	var out bytes.Buffer
+	if err := run(context.Background(), cfg, []string{"unknown"}, &out); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "usage: newsletter") {
+		t.Fatalf("expected the usage, got %s", out.String())
+	}
+
+	if err := run(context.Background(), cfg, []string{"engineers"}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error without subcommand, got %v", err)
+	}
+	if err := run(context.Background(), cfg, []string{"pages", "history", "-h"}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("expected help without error, got %v", err)
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/perebaj/newsletter"
+	"github.com/perebaj/newsletter/notify"
+	"github.com/perebaj/newsletter/sqlite"
+	"github.com/perebaj/newsletter/tracing"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the struct that contains the configuration for the service.
+type Config struct {
+	Log       LogConfig       `yaml:"log"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Crawler   CrawlerConfig   `yaml:"crawler"`
+	Email     EmailConfig     `yaml:"email"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	Retention RetentionConfig `yaml:"retention"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Notify    NotifyConfig    `yaml:"notify"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks"`
+	Feeds     FeedsConfig     `yaml:"feeds"`
+	Accounts  AccountsConfig  `yaml:"accounts"`
+}
+
+// LogConfig is the configuration of the logs
+type LogConfig struct {
+	// Level is DEBUG, INFO, WARN or ERROR
+	Level string `yaml:"level"`
+	// Type is json or text
+	Type string `yaml:"type"`
+}
+
+// StorageConfig selects and configures the storage backend
+type StorageConfig struct {
+	// Type is mongodb or sqlite
+	Type    string        `yaml:"type"`
+	MongoDB MongoConfig   `yaml:"mongodb"`
+	SQLite  sqlite.Config `yaml:"sqlite"`
+}
+
+// MongoConfig is the configuration of the MongoDB storage
+type MongoConfig struct {
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+// CrawlerConfig is the configuration of the crawler
+type CrawlerConfig struct {
+	// Workers is the number of concurrent fetches
+	Workers int `yaml:"workers"`
+	// Interval is the pace between each check for due URLs and the interval of the engineers without schedule
+	Interval time.Duration `yaml:"interval"`
+	// ShutdownGracePeriod is the time in-flight fetches and pending saves have to finish on shutdown
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+	// LeaseTTL is how long the crawl and email leases last without heartbeat
+	LeaseTTL time.Duration `yaml:"lease_ttl"`
+	// Adaptive learns the interval of the engineers without schedule from the changes of their pages, between
+	// MinInterval and MaxInterval
+	Adaptive    bool          `yaml:"adaptive"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+}
+
+// EmailConfig is the configuration of the emails
+type EmailConfig struct {
+	// Interval is the pace between each round of emails
+	Interval  time.Duration `yaml:"interval"`
+	BatchSize int           `yaml:"batch_size"`
+	SMTP      SMTPConfig    `yaml:"smtp"`
+}
+
+// SMTPConfig locates and authenticates in the SMTP server
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HTTPConfig is the configuration of the HTTP server started by serve
+type HTTPConfig struct {
+	// Addr is the address of the server, empty disables it
+	Addr string `yaml:"addr"`
+	// Preview serves the pending emails at /preview. It and the other admin routes require APIKeys.
+	Preview           bool          `yaml:"preview"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	// HealthTimeout bounds every check of /healthz and /readyz
+	HealthTimeout time.Duration `yaml:"health_timeout"`
+	// Webhooks serves the management of the webhooks at /webhooks
+	Webhooks bool `yaml:"webhooks"`
+	// Feeds serves the Atom feeds at /feeds
+	Feeds bool `yaml:"feeds"`
+	// OPML serves the import and export of the sources of the subscribers at /opml
+	OPML bool `yaml:"opml"`
+	// Search serves the search of the scraped pages at /search
+	Search bool `yaml:"search"`
+	// Accounts serves the management of the subscriptions by their subscribers at /account
+	Accounts bool `yaml:"accounts"`
+	// APIKeys requires an API key on the admin routes, and serves the management of the engineers, the subscribers
+	// and the keys at /admin
+	APIKeys bool `yaml:"api_keys"`
+}
+
+// RetentionConfig is how long the data is kept
+type RetentionConfig struct {
+	// Pages is how long the versions of the pages are kept, the last version of every URL is always kept.
+	// Zero keeps all the versions.
+	Pages time.Duration `yaml:"pages"`
+	// Interval is the pace between each deletion of the expired data
+	Interval time.Duration `yaml:"interval"`
+}
+
+// TracingConfig is the configuration of the OpenTelemetry spans
+type TracingConfig struct {
+	// Exporter is otlp, stdout or none
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the URL of the OTLP/HTTP collector, the OTEL_EXPORTER_OTLP_ENDPOINT env var when empty
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the fraction of the traces that are recorded
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// NotifyConfig is the configuration of the channels other than email. Slack and Discord need none, their
+// webhook URLs are the addresses of the channels, and the webhook channels are signed with their own secret.
+type NotifyConfig struct {
+	Telegram struct {
+		// Token is the token of the bot that sends the messages
+		Token string `yaml:"token"`
+	} `yaml:"telegram"`
+	Matrix struct {
+		// Homeserver is the URL of the homeserver of the user that sends the messages
+		Homeserver string `yaml:"homeserver"`
+		// Token is the access token of the user
+		Token string `yaml:"token"`
+	} `yaml:"matrix"`
+	// AllowPrivateHosts lets the slack, discord and webhook channels post to loopback, private and link-local hosts
+	AllowPrivateHosts bool `yaml:"allow_private_hosts"`
+}
+
+// WebhooksConfig is the configuration of the delivery of the change events to the webhooks of the subscribers
+type WebhooksConfig struct {
+	// Interval is the pace between each check for pending deliveries
+	Interval time.Duration `yaml:"interval"`
+	// MaxAttempts is the number of requests sent before a delivery fails
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the delay before the first retry, doubled on every retry
+	Backoff time.Duration `yaml:"backoff"`
+	// AllowPrivateHosts lets the webhooks be registered and delivered on loopback, private and link-local hosts
+	AllowPrivateHosts bool `yaml:"allow_private_hosts"`
+}
+
+// FeedsConfig is the configuration of the Atom feeds
+type FeedsConfig struct {
+	// Secret signs the tokens of the feeds of the subscribers, that are disabled without it
+	Secret string `yaml:"secret"`
+}
+
+// AccountsConfig is the configuration of the management of the subscriptions by their subscribers
+type AccountsConfig struct {
+	// Secret signs the magic links and the sessions, changing it signs every subscriber out
+	Secret string `yaml:"secret"`
+	// BaseURL is the URL the HTTP server is reachable at, that the magic links point to
+	BaseURL string `yaml:"base_url"`
+	// LinkTTL is how long a magic link signs in
+	LinkTTL time.Duration `yaml:"link_ttl"`
+	// SessionTTL is how long a session lasts
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// LoginLimit is the number of magic links an email can ask for in an hour, no limit when zero
+	LoginLimit int `yaml:"login_limit"`
+	// LoginIPLimit is the number of magic links a client IP can ask for in an hour, no limit when zero
+	LoginIPLimit int `yaml:"login_ip_limit"`
+}
+
+// defaultConfig returns the configuration used for the settings missing in the file, env vars and flags.
+func defaultConfig() Config {
+	return Config{
+		Log: LogConfig{Level: "INFO", Type: "json"},
+		Storage: StorageConfig{
+			Type:    "mongodb",
+			MongoDB: MongoConfig{Database: "newsletter"},
+			SQLite:  sqlite.Config{Path: "newsletter.db"},
+		},
+		Crawler: CrawlerConfig{
+			Workers:             5,
+			Interval:            10 * time.Second,
+			ShutdownGracePeriod: newsletter.DefaultGracePeriod,
+			LeaseTTL:            newsletter.DefaultLeaseTTL,
+			Adaptive:            true,
+			MinInterval:         10 * time.Second,
+			MaxInterval:         24 * time.Hour,
+		},
+		Email: EmailConfig{
+			Interval:  50 * time.Second,
+			BatchSize: newsletter.DefaultEmailBatchSize,
+			SMTP:      SMTPConfig{Host: newsletter.SMTPServer, Port: newsletter.SMTPPort},
+		},
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ShutdownTimeout:   5 * time.Second,
+			HealthTimeout:     2 * time.Second,
+		},
+		Retention: RetentionConfig{Interval: time.Hour},
+		Tracing:   TracingConfig{Exporter: "none", SampleRatio: 1},
+		Webhooks: WebhooksConfig{
+			Interval:    10 * time.Second,
+			MaxAttempts: newsletter.DefaultWebhookAttempts,
+			Backoff:     newsletter.DefaultWebhookBackoff,
+		},
+		Accounts: AccountsConfig{
+			LinkTTL:      newsletter.DefaultMagicLinkTTL,
+			SessionTTL:   newsletter.DefaultSessionTTL,
+			LoginLimit:   newsletter.DefaultLoginLimit,
+			LoginIPLimit: newsletter.DefaultLoginIPLimit,
+		},
+	}
+}
+
+// setting is a configuration value that can be overridden by an env var and a flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(cfg *Config, v string) error
+}
+
+func stringSetting(field func(cfg *Config) *string) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		*field(cfg) = v
+		return nil
+	}
+}
+
+func intSetting(field func(cfg *Config) *int) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func durationSetting(field func(cfg *Config) *time.Duration) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+func floatSetting(field func(cfg *Config) *float64) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*field(cfg) = f
+		return nil
+	}
+}
+
+func boolSetting(field func(cfg *Config) *bool) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+// settings are applied in order, the env vars over the config file and the flags over the env vars.
+// The SMTP password and the other secrets have no flag, so they do not show up in the process list.
+var settings = []setting{
+	{"LOG_LEVEL", "log-level", "level of the logs: DEBUG, INFO, WARN or ERROR",
+		stringSetting(func(cfg *Config) *string { return &cfg.Log.Level })},
+	{"LOG_TYPE", "log-type", "format of the logs: json or text",
+		stringSetting(func(cfg *Config) *string { return &cfg.Log.Type })},
+	{"NL_STORAGE", "storage", "storage backend: mongodb or sqlite",
+		stringSetting(func(cfg *Config) *string { return &cfg.Storage.Type })},
+	{"NL_MONGO_URI", "mongo-uri", "URI of the MongoDB server",
+		stringSetting(func(cfg *Config) *string { return &cfg.Storage.MongoDB.URI })},
+	{"NL_MONGO_DATABASE", "mongo-database", "name of the MongoDB database",
+		stringSetting(func(cfg *Config) *string { return &cfg.Storage.MongoDB.Database })},
+	{"NL_SQLITE_PATH", "sqlite-path", "path of the SQLite database file",
+		stringSetting(func(cfg *Config) *string { return &cfg.Storage.SQLite.Path })},
+	{"NL_CRAWLER_WORKERS", "crawler-workers", "number of concurrent fetches",
+		intSetting(func(cfg *Config) *int { return &cfg.Crawler.Workers })},
+	{"NL_CRAWLER_INTERVAL", "crawler-interval", "pace between each check for due URLs",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Crawler.Interval })},
+	{"NL_SHUTDOWN_GRACE_PERIOD", "shutdown-grace-period", "time in-flight fetches and pending saves have to finish on shutdown",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Crawler.ShutdownGracePeriod })},
+	{"NL_LEASE_TTL", "lease-ttl", "how long the job leases last without heartbeat",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Crawler.LeaseTTL })},
+	{"NL_CRAWLER_ADAPTIVE", "crawler-adaptive", "learn the interval of the engineers without schedule from their changes",
+		boolSetting(func(cfg *Config) *bool { return &cfg.Crawler.Adaptive })},
+	{"NL_CRAWLER_MIN_INTERVAL", "crawler-min-interval", "shortest learned interval",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Crawler.MinInterval })},
+	{"NL_CRAWLER_MAX_INTERVAL", "crawler-max-interval", "longest learned interval",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Crawler.MaxInterval })},
+	{"NL_EMAIL_INTERVAL", "email-interval", "pace between each round of emails",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Email.Interval })},
+	{"NL_EMAIL_BATCH_SIZE", "email-batch-size", "number of newsletters loaded at once",
+		intSetting(func(cfg *Config) *int { return &cfg.Email.BatchSize })},
+	{"NL_SMTP_HOST", "smtp-host", "host of the SMTP server",
+		stringSetting(func(cfg *Config) *string { return &cfg.Email.SMTP.Host })},
+	{"NL_SMTP_PORT", "smtp-port", "port of the SMTP server",
+		intSetting(func(cfg *Config) *int { return &cfg.Email.SMTP.Port })},
+	{"NL_EMAIL_USERNAME", "smtp-username", "user of the SMTP server",
+		stringSetting(func(cfg *Config) *string { return &cfg.Email.SMTP.Username })},
+	{"NL_EMAIL_PASSWORD", "", "",
+		stringSetting(func(cfg *Config) *string { return &cfg.Email.SMTP.Password })},
+	{"NL_HTTP_ADDR", "http-addr", "address of the HTTP server, empty disables it",
+		stringSetting(func(cfg *Config) *string { return &cfg.HTTP.Addr })},
+	{"NL_HTTP_PREVIEW", "http-preview", "serve the pending emails at /preview",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.Preview })},
+	{"NL_HTTP_WEBHOOKS", "http-webhooks", "serve the management of the webhooks at /webhooks",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.Webhooks })},
+	{"NL_HTTP_FEEDS", "http-feeds", "serve the Atom feeds at /feeds",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.Feeds })},
+	{"NL_HTTP_OPML", "http-opml", "serve the OPML import and export at /opml",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.OPML })},
+	{"NL_HTTP_SEARCH", "http-search", "serve the search of the scraped pages at /search",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.Search })},
+	{"NL_HTTP_ACCOUNTS", "http-accounts", "serve the management of the subscriptions by their subscribers at /account",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.Accounts })},
+	{"NL_HTTP_API_KEYS", "http-api-keys", "require an API key on the admin routes and serve /admin",
+		boolSetting(func(cfg *Config) *bool { return &cfg.HTTP.APIKeys })},
+	{"NL_PAGE_RETENTION", "page-retention", "how long the versions of the pages are kept, 0 keeps all",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Retention.Pages })},
+	{"NL_TRACING_EXPORTER", "tracing-exporter", "exporter of the traces: otlp, stdout or none",
+		stringSetting(func(cfg *Config) *string { return &cfg.Tracing.Exporter })},
+	{"NL_OTLP_ENDPOINT", "otlp-endpoint", "URL of the OTLP/HTTP collector of the traces",
+		stringSetting(func(cfg *Config) *string { return &cfg.Tracing.Endpoint })},
+	{"NL_TRACING_SAMPLE_RATIO", "tracing-sample-ratio", "fraction of the traces that are recorded, between 0 and 1",
+		floatSetting(func(cfg *Config) *float64 { return &cfg.Tracing.SampleRatio })},
+	{"NL_TELEGRAM_TOKEN", "", "",
+		stringSetting(func(cfg *Config) *string { return &cfg.Notify.Telegram.Token })},
+	{"NL_MATRIX_HOMESERVER", "matrix-homeserver", "URL of the Matrix homeserver that sends the messages",
+		stringSetting(func(cfg *Config) *string { return &cfg.Notify.Matrix.Homeserver })},
+	{"NL_MATRIX_TOKEN", "", "",
+		stringSetting(func(cfg *Config) *string { return &cfg.Notify.Matrix.Token })},
+	{"NL_NOTIFY_ALLOW_PRIVATE_HOSTS", "notify-allow-private-hosts", "let the slack, discord and webhook channels post to loopback, private and link-local hosts",
+		boolSetting(func(cfg *Config) *bool { return &cfg.Notify.AllowPrivateHosts })},
+	{"NL_WEBHOOKS_INTERVAL", "webhooks-interval", "pace between each check for pending webhook deliveries",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.Webhooks.Interval })},
+	{"NL_WEBHOOKS_MAX_ATTEMPTS", "webhooks-max-attempts", "number of requests sent before a webhook delivery fails",
+		intSetting(func(cfg *Config) *int { return &cfg.Webhooks.MaxAttempts })},
+	{"NL_WEBHOOKS_ALLOW_PRIVATE_HOSTS", "webhooks-allow-private-hosts", "let the webhooks be registered and delivered on loopback, private and link-local hosts",
+		boolSetting(func(cfg *Config) *bool { return &cfg.Webhooks.AllowPrivateHosts })},
+	{"NL_FEEDS_SECRET", "", "",
+		stringSetting(func(cfg *Config) *string { return &cfg.Feeds.Secret })},
+	{"NL_ACCOUNTS_SECRET", "", "",
+		stringSetting(func(cfg *Config) *string { return &cfg.Accounts.Secret })},
+	{"NL_ACCOUNTS_BASE_URL", "accounts-base-url", "URL the HTTP server is reachable at, that the magic links point to",
+		stringSetting(func(cfg *Config) *string { return &cfg.Accounts.BaseURL })},
+}
+
+// loadConfig builds the configuration from the defaults, the config file, the env vars and the global flags of args,
+// in increasing precedence, and validates it. It returns the arguments that follow the global flags.
+func loadConfig(args []string, lookupEnv func(string) (string, bool), out io.Writer) (Config, []string, error) {
+	fs := flag.NewFlagSet("newsletter", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		usage(out)
+		fmt.Fprintln(out, "\nglobal flags:")
+		fs.PrintDefaults()
+	}
+
+	path, _ := lookupEnv("NL_CONFIG")
+	fs.StringVar(&path, "config", path, "path of the YAML config file (env NL_CONFIG)")
+
+	type flagValue struct {
+		s setting
+		v string
+	}
+	var flags []flagValue
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		s := s
+		fs.Func(s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(v string) error {
+			flags = append(flags, flagValue{s, v})
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return Config{}, nil, err
+		}
+		return Config{}, nil, fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	cfg := defaultConfig()
+	if path != "" {
+		if err := readConfigFile(path, &cfg); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		v, ok := lookupEnv(s.env)
+		if !ok || v == "" {
+			continue
+		}
+		if err := s.set(&cfg, v); err != nil {
+			return cfg, nil, fmt.Errorf("env %s: %v", s.env, err)
+		}
+	}
+	for _, f := range flags {
+		if err := f.s.set(&cfg, f.v); err != nil {
+			return cfg, nil, fmt.Errorf("flag -%s: %v", f.s.flag, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readConfigFile decodes the YAML file at path into cfg, rejecting unknown fields.
+func readConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting of the configuration.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{field}, args...)...))
+		}
+	}
+
+	check(oneOf(c.Log.Level, "DEBUG", "INFO", "WARN", "ERROR"), "log.level",
+		"must be DEBUG, INFO, WARN or ERROR, got %q", c.Log.Level)
+	check(oneOf(c.Log.Type, "json", "text"), "log.type", "must be json or text, got %q", c.Log.Type)
+
+	check(oneOf(c.Storage.Type, "mongodb", "sqlite"), "storage.type",
+		"must be mongodb or sqlite, got %q", c.Storage.Type)
+	if c.Storage.Type == "mongodb" {
+		check(c.Storage.MongoDB.URI != "", "storage.mongodb.uri", "is required")
+		check(c.Storage.MongoDB.Database != "", "storage.mongodb.database", "is required")
+	}
+	if c.Storage.Type == "sqlite" {
+		check(c.Storage.SQLite.Path != "", "storage.sqlite.path", "is required")
+	}
+
+	check(c.Crawler.Workers > 0, "crawler.workers", "must be positive, got %d", c.Crawler.Workers)
+	check(c.Crawler.Interval > 0, "crawler.interval", "must be positive, got %v", c.Crawler.Interval)
+	check(c.Crawler.ShutdownGracePeriod >= 0, "crawler.shutdown_grace_period",
+		"must not be negative, got %v", c.Crawler.ShutdownGracePeriod)
+	check(c.Crawler.LeaseTTL >= time.Second, "crawler.lease_ttl",
+		"must be at least 1s, got %v", c.Crawler.LeaseTTL)
+	check(c.Crawler.MinInterval > 0, "crawler.min_interval", "must be positive, got %v", c.Crawler.MinInterval)
+	check(c.Crawler.MaxInterval >= c.Crawler.MinInterval, "crawler.max_interval",
+		"must not be less than crawler.min_interval, got %v", c.Crawler.MaxInterval)
+
+	check(c.Email.Interval > 0, "email.interval", "must be positive, got %v", c.Email.Interval)
+	check(c.Email.BatchSize > 0, "email.batch_size", "must be positive, got %d", c.Email.BatchSize)
+	check(c.Email.SMTP.Host != "", "email.smtp.host", "is required")
+	check(c.Email.SMTP.Port > 0 && c.Email.SMTP.Port < 65536, "email.smtp.port",
+		"must be between 1 and 65535, got %d", c.Email.SMTP.Port)
+
+	if c.HTTP.Addr != "" {
+		_, _, err := net.SplitHostPort(c.HTTP.Addr)
+		check(err == nil, "http.addr", "must be host:port, got %q", c.HTTP.Addr)
+	}
+	check(c.HTTP.ReadHeaderTimeout > 0, "http.read_header_timeout",
+		"must be positive, got %v", c.HTTP.ReadHeaderTimeout)
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout", "must be positive, got %v", c.HTTP.ShutdownTimeout)
+	check(c.HTTP.HealthTimeout > 0, "http.health_timeout", "must be positive, got %v", c.HTTP.HealthTimeout)
+	// The admin routes manage every subscriber, they are never served to anyone that reaches them.
+	if c.HTTP.Addr != "" && (c.HTTP.Preview || c.HTTP.Webhooks || c.HTTP.OPML || c.HTTP.Search) {
+		check(c.HTTP.APIKeys, "http.api_keys", "is required to serve /preview, /webhooks, /opml and /search")
+	}
+
+	check(c.Retention.Pages >= 0, "retention.pages", "must not be negative, got %v", c.Retention.Pages)
+	check(c.Retention.Interval > 0, "retention.interval", "must be positive, got %v", c.Retention.Interval)
+
+	check(oneOf(c.Tracing.Exporter, "otlp", "stdout", "none"), "tracing.exporter",
+		"must be otlp, stdout or none, got %q", c.Tracing.Exporter)
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio",
+		"must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+
+	if c.Notify.Matrix.Homeserver != "" {
+		u, err := url.Parse(c.Notify.Matrix.Homeserver)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http"), "notify.matrix.homeserver",
+			"must be an http(s) URL, got %q", c.Notify.Matrix.Homeserver)
+	}
+	check((c.Notify.Matrix.Homeserver == "") == (c.Notify.Matrix.Token == ""), "notify.matrix",
+		"homeserver and token must be set together")
+
+	check(c.Webhooks.Interval > 0, "webhooks.interval", "must be positive, got %v", c.Webhooks.Interval)
+	check(c.Webhooks.MaxAttempts > 0, "webhooks.max_attempts", "must be positive, got %d", c.Webhooks.MaxAttempts)
+	check(c.Webhooks.Backoff > 0, "webhooks.backoff", "must be positive, got %v", c.Webhooks.Backoff)
+
+	if c.HTTP.Accounts {
+		check(c.Accounts.Secret != "", "accounts.secret", "is required to serve the accounts")
+		u, err := url.Parse(c.Accounts.BaseURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "accounts.base_url",
+			"must be an http(s) URL to serve the accounts, got %q", c.Accounts.BaseURL)
+	}
+	check(c.Accounts.LinkTTL > 0, "accounts.link_ttl", "must be positive, got %v", c.Accounts.LinkTTL)
+	check(c.Accounts.SessionTTL > 0, "accounts.session_ttl", "must be positive, got %v", c.Accounts.SessionTTL)
+	check(c.Accounts.LoginLimit >= 0, "accounts.login_limit", "must not be negative, got %d", c.Accounts.LoginLimit)
+	check(c.Accounts.LoginIPLimit >= 0, "accounts.login_ip_limit", "must not be negative, got %d", c.Accounts.LoginIPLimit)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// scheduler returns the scheduler of the crawls
+func (c Config) scheduler() *newsletter.Scheduler {
+	s := newsletter.NewScheduler(c.Crawler.Interval)
+	s.Adaptive = c.Crawler.Adaptive
+	s.MinInterval = c.Crawler.MinInterval
+	s.MaxInterval = c.Crawler.MaxInterval
+	return s
+}
+
+// emailConfig returns the configuration of the mail client
+func (c Config) emailConfig() newsletter.EmailConfig {
+	return newsletter.EmailConfig{
+		Username: c.Email.SMTP.Username,
+		Password: c.Email.SMTP.Password,
+		Host:     c.Email.SMTP.Host,
+		Port:     c.Email.SMTP.Port,
+	}
+}
+
+// notifiers returns the notifiers of the channels other than email. The channels that need a configuration
+// missing in c have no notifier, and their newsletters fail to be delivered. The channels whose addresses are URLs
+// only post to public hosts, unless c allows the private ones.
+func (c Config) notifiers() map[string]notify.Notifier {
+	var hooks *http.Client
+	if c.Notify.AllowPrivateHosts {
+		hooks = notify.NewClient(true)
+	}
+	notifiers := map[string]notify.Notifier{
+		newsletter.ChannelSlack:   notify.Slack{Client: hooks},
+		newsletter.ChannelDiscord: notify.Discord{Client: hooks},
+		// The webhook channels are signed with their own secret.
+		newsletter.ChannelWebhook: notify.Webhook{Client: hooks},
+	}
+	if c.Notify.Telegram.Token != "" {
+		notifiers[newsletter.ChannelTelegram] = notify.Telegram{Token: c.Notify.Telegram.Token}
+	}
+	if c.Notify.Matrix.Token != "" {
+		notifiers[newsletter.ChannelMatrix] = notify.Matrix{Homeserver: c.Notify.Matrix.Homeserver, Token: c.Notify.Matrix.Token}
+	}
+	return notifiers
+}
+
+// tracingConfig returns the configuration of the span export
+func (c Config) tracingConfig() tracing.Config {
+	return tracing.Config{
+		Exporter:    c.Tracing.Exporter,
+		Endpoint:    c.Tracing.Endpoint,
+		SampleRatio: c.Tracing.SampleRatio,
+	}
+}
+
+func oneOf(v string, values ...string) bool {
+	for _, want := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
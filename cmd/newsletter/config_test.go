@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "newsletter.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal("error writing config", err)
+	}
+	return path
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeConfig(t, `
+log:
+  level: DEBUG
+storage:
+  type: sqlite
+  sqlite:
+    path: file.db
+crawler:
+  workers: 2
+  interval: 1m
+email:
+  interval: 5m
+  smtp:
+    host: smtp.example.com
+    port: 2525
+retention:
+  pages: 720h
+`)
+
+	vars := map[string]string{
+		"NL_CONFIG":          path,
+		"NL_CRAWLER_WORKERS": "3",
+		"NL_EMAIL_PASSWORD":  "secret",
+	}
+	cfg, args, err := loadConfig([]string{"--crawler-workers", "4", "engineers", "list"}, env(vars), &bytes.Buffer{})
+	if err != nil {
+		t.Fatal("error loading config", err)
+	}
+
+	if cfg.Log.Level != "DEBUG" || cfg.Log.Type != "json" {
+		t.Errorf("expected the file level and the default type, got %v", cfg.Log)
+	}
+	if cfg.Storage.Type != "sqlite" || cfg.Storage.SQLite.Path != "file.db" {
+		t.Errorf("expected the file storage, got %v", cfg.Storage)
+	}
+	if cfg.Crawler.Workers != 4 || cfg.Crawler.Interval != time.Minute {
+		t.Errorf("expected the flag workers and the file interval, got %v", cfg.Crawler)
+	}
+	if cfg.Email.Interval != 5*time.Minute || cfg.Email.SMTP.Host != "smtp.example.com" ||
+		cfg.Email.SMTP.Port != 2525 || cfg.Email.SMTP.Password != "secret" {
+		t.Errorf("unexpected email config %v", cfg.Email)
+	}
+	if cfg.Retention.Pages != 720*time.Hour || cfg.Retention.Interval != time.Hour {
+		t.Errorf("unexpected retention config %v", cfg.Retention)
+	}
+	if strings.Join(args, " ") != "engineers list" {
+		t.Errorf("got args %v", args)
+	}
+
+	// The env vars override the file when there is no flag.
+	cfg, _, err = loadConfig(nil, env(vars), &bytes.Buffer{})
+	if err != nil {
+		t.Fatal("error loading config", err)
+	}
+	if cfg.Crawler.Workers != 3 {
+		t.Errorf("expected the env workers, got %d", cfg.Crawler.Workers)
+	}
+}
+
+func TestLoadConfig_Validation(t *testing.T) {
+	path := writeConfig(t, `
+log:
+  level: TRACE
+crawler:
+  workers: 0
+email:
+  smtp:
+    port: 70000
+http:
+  addr: localhost
+  accounts: true
+  preview: true
+`)
+
+	_, _, err := loadConfig([]string{"--config", path}, env(nil), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	// Every invalid setting is reported at once.
+	for _, want := range []string{"log.level", "storage.mongodb.uri", "crawler.workers", "email.smtp.port", "http.addr",
+		"accounts.secret", "accounts.base_url", "http.api_keys"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s in %q", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	path := writeConfig(t, "crawler:\n  worker: 2\n")
+	if _, _, err := loadConfig([]string{"--config", path}, env(nil), &bytes.Buffer{}); err == nil ||
+		!strings.Contains(err.Error(), "worker") {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+
+	vars := map[string]string{"NL_MONGO_URI": "mongodb://localhost", "NL_CRAWLER_INTERVAL": "often"}
+	if _, _, err := loadConfig(nil, env(vars), &bytes.Buffer{}); err == nil ||
+		!strings.Contains(err.Error(), "NL_CRAWLER_INTERVAL") {
+		t.Errorf("expected env error, got %v", err)
+	}
+
+	if _, _, err := loadConfig([]string{"--unknown"}, env(vars), &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Errorf("expected usage error, got %v", err)
+	}
+	if _, _, err := loadConfig([]string{"-h"}, env(vars), &bytes.Buffer{}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("expected help, got %v", err)
+	}
+
+	if _, _, err := loadConfig([]string{"--config", "missing.yaml"}, env(nil), &bytes.Buffer{}); err == nil {
+		t.Error("expected error opening a missing config file")
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Storage.MongoDB.URI = "mongodb://localhost:27017"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("expected the default config to be valid", err)
+	}
+}
+
+func TestLoadConfig_Example(t *testing.T) {
+	cfg, _, err := loadConfig([]string{"--config", "../../config.example.yaml"}, env(nil), &bytes.Buffer{})
+	if err != nil {
+		t.Fatal("error loading the example config", err)
+	}
+
+	want := defaultConfig()
+	want.Storage.MongoDB.URI = "mongodb://localhost:27017"
+	if cfg != want {
+		t.Fatalf("expected the example to match the defaults, got %+v", cfg)
+	}
+}
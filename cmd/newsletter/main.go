@@ -3,104 +3,151 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"os/user"
 	"syscall"
 	"time"
 
 	"github.com/perebaj/newsletter"
 	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/sqlite"
+	"github.com/perebaj/newsletter/tracing"
 )
 
-// Config is the struct that contains the configuration for the service.
-type Config struct {
-	LogLevel string
-	LogType  string
-	Mongo    mongodb.Config
-	Email    newsletter.EmailConfig
+// storage is the set of operations the service needs from a storage backend.
+type storage interface {
+	newsletter.Storage
+	SaveEngineer(ctx context.Context, e mongodb.Engineer) error
+	DeleteEngineer(ctx context.Context, url string) error
+	SaveNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	DeleteNewsletter(ctx context.Context, userEmail string) error
+	DeletePagesBefore(ctx context.Context, before time.Time) (int64, error)
+	Migrate(ctx context.Context) error
+	Ping(ctx context.Context) error
 }
 
 func main() {
-
-	cfg := Config{
-		LogLevel: getEnvWithDefault("LOG_LEVEL", ""),
-		LogType:  getEnvWithDefault("LOG_TYPE", ""),
-		Mongo: mongodb.Config{
-			URI: getEnvWithDefault("NL_MONGO_URI", ""),
-		},
-		Email: newsletter.EmailConfig{
-			Password: getEnvWithDefault("NL_EMAIL_PASSWORD", ""),
-			Username: getEnvWithDefault("NL_EMAIL_USERNAME", ""),
-		},
+	cfg, args, err := loadConfig(os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
 	if err := setUpLog(cfg); err != nil {
-		slog.Error("error setting up log", "error", err)
-		signalCh <- syscall.SIGTERM
+		fmt.Fprintln(os.Stderr, "error setting up log:", err)
+		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	client, err := mongodb.OpenDB(ctx, cfg.Mongo)
+	err = run(ctx, cfg, args, os.Stdout)
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	}
 	if err != nil {
-		slog.Error("error connecting to MongoDB", "error", err)
-		signalCh <- syscall.SIGTERM
+		slog.Error("command failed", "error", err)
+		os.Exit(1)
 	}
+}
 
-	slog.Info("connected successfully to MongoDB instance")
+// cliActor returns the actor of the changes made by the commands, cli:<user>
+func cliActor() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return "cli:" + u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return "cli:" + name
+	}
+	return "cli"
+}
 
-	storage := mongodb.NewNLStorage(client, "newsletter")
+// run opens the storage, applies the pending migrations and runs the command of args, serve when args is empty.
+func run(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
 
-	err = storage.SaveEngineer(ctx, mongodb.Engineer{
-		Name:        "Paul Graham",
-		URL:         "http://www.paulgraham.com/articles.html",
-		Description: "Paul Graham is an English-born computer scientist, entrepreneur, venture capitalist, author, and essayist. He is best known for his work on Lisp, his former startup Viaweb (later renamed \"Yahoo! Store\"), co-founding the influential startup accelerator and seed capital firm Y Combinator, his blog, and Hacker News.",
-	})
-	if err != nil {
-		slog.Error("error saving engineer", "error", err)
-		signalCh <- syscall.SIGTERM
+	cmd, ok := commands[name]
+	if !ok {
+		usage(out)
+		if name == "help" || name == "-h" || name == "--help" {
+			return nil
+		}
+		return fmt.Errorf("%w: unknown command %q", errUsage, name)
 	}
 
-	err = storage.SaveEngineer(ctx, mongodb.Engineer{
-		Name:        "Joel Spolsky",
-		URL:         "https://www.joelonsoftware.com/",
-		Description: "Joel Spolsky is a software engineer and writer. He is the author of Joel on Software, a blog on software development, and the creator of the project management software Trello. He has previously worked as a programmer, software designer, and software consultant.",
-	})
+	// The spans of the stdout exporter go to stderr, along with the logs, to keep the output of the commands clean.
+	shutdownTracing, err := tracing.Setup(ctx, cfg.tracingConfig(), os.Stderr)
 	if err != nil {
-		slog.Error("error saving engineer", "error", err)
-		signalCh <- syscall.SIGTERM
+		return fmt.Errorf("error setting up tracing: %v", err)
 	}
+	defer func() {
+		if err := shutdownTracing(context.WithoutCancel(ctx)); err != nil {
+			slog.Error("error flushing traces", "error", err)
+		}
+	}()
 
-	crawler := newsletter.NewCrawler(5, time.Duration(10)*time.Second, signalCh)
+	storage, err := openStorage(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error opening %s storage: %v", cfg.Storage.Type, err)
+	}
+	slog.Info("connected successfully to storage", "storage", cfg.Storage.Type)
 
-	go func() {
-		crawler.Run(ctx, storage, newsletter.Fetch)
-	}()
+	if err := storage.Migrate(ctx); err != nil {
+		return fmt.Errorf("error applying migrations: %v", err)
+	}
 
-	mail := newsletter.NewMailClient(cfg.Email)
+	// The changes of the commands are audited as made by the user running them, those of the service by the system.
+	if name != "serve" {
+		ctx = mongodb.WithActor(ctx, cliActor())
+	}
+	err = cmd(ctx, &cli{cfg: cfg, storage: storage, in: os.Stdin, out: out}, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
 
-	go func() {
-		for range time.Tick(time.Duration(50) * time.Second) {
-			err := newsletter.EmailTrigger(ctx, storage, mail)
-			if err != nil {
-				slog.Error("error sending email", "error", err)
-				signalCh <- syscall.SIGTERM
-			}
+// openStorage connects to the storage backend selected in the configuration.
+func openStorage(ctx context.Context, cfg Config) (storage, error) {
+	switch cfg.Storage.Type {
+	case "mongodb":
+		client, err := mongodb.OpenDB(ctx, mongodb.Config{URI: cfg.Storage.MongoDB.URI})
+		if err != nil {
+			return nil, err
 		}
-	}()
-
-	<-signalCh
+		return mongodb.NewNLStorage(client, cfg.Storage.MongoDB.Database), nil
+	case "sqlite":
+		db, err := sqlite.OpenDB(ctx, cfg.Storage.SQLite)
+		if err != nil {
+			return nil, err
+		}
+		return sqlite.NewStorage(db), nil
+	default:
+		return nil, fmt.Errorf("invalid storage: %s", cfg.Storage.Type)
+	}
 }
 
 // setUpLog initialize the logger.
 func setUpLog(cfg Config) error {
 	var level slog.Level
-	switch cfg.LogLevel {
+	switch cfg.Log.Level {
 	case "INFO":
 		level = slog.LevelInfo
 	case "DEBUG":
@@ -110,30 +157,23 @@ func setUpLog(cfg Config) error {
 	case "ERROR":
 		level = slog.LevelError
 	default:
-		return fmt.Errorf("invalid log level: %s", cfg.LogLevel)
+		return fmt.Errorf("invalid log level: %s", cfg.Log.Level)
 	}
 
-	var logger *slog.Logger
-	if cfg.LogType == "json" {
-		logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	var handler slog.Handler
+	if cfg.Log.Type == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 			Level: level,
-		}))
-	} else if cfg.LogType == "text" {
-		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		})
+	} else if cfg.Log.Type == "text" {
+		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			Level: level,
-		}))
+		})
 	} else {
-		return fmt.Errorf("invalid log type: %s", cfg.LogType)
+		return fmt.Errorf("invalid log type: %s", cfg.Log.Type)
 	}
 
-	slog.SetDefault(logger)
+	// The records logged within a span carry its trace and span IDs.
+	slog.SetDefault(slog.New(tracing.NewLogHandler(handler)))
 	return nil
 }
-
-func getEnvWithDefault(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	return value
-}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/perebaj/newsletter"
+	"github.com/perebaj/newsletter/metrics"
+	"github.com/perebaj/newsletter/mongodb"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultEngineers are saved when the service starts without any engineer.
+var defaultEngineers = []mongodb.Engineer{
+	{
+		Name:        "Paul Graham",
+		URL:         "http://www.paulgraham.com/articles.html",
+		Description: "Paul Graham is an English-born computer scientist, entrepreneur, venture capitalist, author, and essayist. He is best known for his work on Lisp, his former startup Viaweb (later renamed \"Yahoo! Store\"), co-founding the influential startup accelerator and seed capital firm Y Combinator, his blog, and Hacker News.",
+	},
+	{
+		Name:        "Joel Spolsky",
+		URL:         "https://www.joelonsoftware.com/",
+		Description: "Joel Spolsky is a software engineer and writer. He is the author of Joel on Software, a blog on software development, and the creator of the project management software Trello. He has previously worked as a programmer, software designer, and software consultant.",
+	},
+}
+
+// serve runs the crawler and the email loop until ctx is cancelled.
+func serve(ctx context.Context, c *cli, args []string) error {
+	if err := parse(c.flagSet("serve", ""), args, 0); err != nil {
+		return err
+	}
+
+	storage := c.storage
+	engineers, err := storage.Engineers(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting engineers: %v", err)
+	}
+	// Engineers removed by the operators must not come back on restart, so the defaults only seed an empty storage.
+	if len(engineers) == 0 {
+		for _, e := range defaultEngineers {
+			if err := storage.SaveEngineer(ctx, e); err != nil {
+				return fmt.Errorf("error saving engineer: %v", err)
+			}
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	cfg := c.cfg
+
+	crawler := newsletter.NewCrawler(cfg.Crawler.Workers, cfg.Crawler.Interval)
+	crawler.GracePeriod = cfg.Crawler.ShutdownGracePeriod
+	crawler.LeaseTTL = cfg.Crawler.LeaseTTL
+	crawler.Scheduler = cfg.scheduler()
+
+	// Holding a sent newsletter for most of the interval keeps the other instances from sending it again.
+	emailOpts := newsletter.EmailOptions{
+		BatchSize: cfg.Email.BatchSize,
+		LeaseTTL:  cfg.Crawler.LeaseTTL,
+		Interval:  cfg.Email.Interval * 9 / 10,
+		Notifiers: cfg.notifiers(),
+	}
+
+	// Storages that lease jobs let any number of instances share the crawl and the emails.
+	owner := newsletter.InstanceID()
+	if leaser, ok := storage.(newsletter.Leaser); ok {
+		slog.Info("sharing jobs with other instances", "owner", owner)
+		crawler.Leaser, crawler.Owner = leaser, owner
+		emailOpts.Leaser, emailOpts.Owner = leaser, owner
+	}
+
+	// Storages that keep webhooks deliver the changes of the pages to the subscribers as they are found.
+	webhooks, err := c.webhooks()
+	if err != nil && cfg.HTTP.Addr != "" && cfg.HTTP.Webhooks {
+		return err
+	}
+	searcher, searchable := storage.(newsletter.SearchStorage)
+	if !searchable && cfg.HTTP.Addr != "" && cfg.HTTP.Search {
+		return fmt.Errorf("the %s storage does not support search", cfg.Storage.Type)
+	}
+	var keys *newsletter.APIKeys
+	if cfg.HTTP.Addr != "" && cfg.HTTP.APIKeys {
+		if keys, err = c.apiKeys(); err != nil {
+			return err
+		}
+	}
+	if webhooks != nil {
+		crawler.OnChange = webhooks.PageChanged
+		g.Go(func() error {
+			return c.singleton(gctx, "webhooks", owner, func(ctx context.Context) error {
+				return every(ctx, cfg.Webhooks.Interval, func() error {
+					err := webhooks.DeliverPending(ctx)
+					if err != nil && ctx.Err() == nil {
+						return fmt.Errorf("error delivering webhooks: %v", err)
+					}
+					return nil
+				})
+			})
+		})
+	}
+
+	g.Go(func() error {
+		return crawler.Run(gctx, storage, newsletter.Fetch)
+	})
+
+	mail := newsletter.NewMailClient(cfg.emailConfig())
+
+	// Only the leader runs the email loop, the heartbeat is meaningless on the other instances.
+	var emailBeat newsletter.Heartbeat
+	var emailLeading atomic.Bool
+	g.Go(func() error {
+		return c.singleton(gctx, "email", owner, func(ctx context.Context) error {
+			emailLeading.Store(true)
+			defer emailLeading.Store(false)
+			emailBeat.Beat()
+			return every(ctx, cfg.Email.Interval, func() error {
+				emailBeat.Beat()
+				err := newsletter.EmailTrigger(ctx, storage, mail, emailOpts)
+				if err != nil && ctx.Err() == nil {
+					return fmt.Errorf("error sending email: %v", err)
+				}
+				return nil
+			})
+		})
+	})
+
+	if cfg.Retention.Pages > 0 {
+		g.Go(func() error {
+			return c.singleton(gctx, "retention", owner, func(ctx context.Context) error {
+				return every(ctx, cfg.Retention.Interval, func() error {
+					deleted, err := storage.DeletePagesBefore(ctx, time.Now().Add(-cfg.Retention.Pages))
+					if err != nil {
+						if ctx.Err() != nil {
+							return nil
+						}
+						return fmt.Errorf("error deleting expired pages: %v", err)
+					}
+					slog.Info("expired pages deleted", "pages", deleted)
+					return nil
+				})
+			})
+		})
+	}
+
+	if cfg.HTTP.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+
+		// A loop is stale once it missed a few ticks in a row.
+		crawlerFresh := newsletter.FreshnessCheck(crawler.LastTick, 3*cfg.Crawler.Interval)
+		emailFresh := newsletter.FreshnessCheck(emailBeat.Last, 3*cfg.Email.Interval)
+		loops := []newsletter.HealthCheck{
+			{Name: "crawler", Check: crawlerFresh},
+			{Name: "email", Check: func(ctx context.Context) error {
+				if !emailLeading.Load() {
+					return nil
+				}
+				return emailFresh(ctx)
+			}},
+		}
+		// Liveness only checks the loops of the process, restarting it does not fix its dependencies.
+		mux.Handle("/healthz", newsletter.HealthHandler(cfg.HTTP.HealthTimeout, loops...))
+		mux.Handle("/readyz", newsletter.HealthHandler(cfg.HTTP.HealthTimeout, append([]newsletter.HealthCheck{
+			{Name: "storage", Check: storage.Ping},
+			{Name: "smtp", Check: mail.Ping},
+		}, loops...)...))
+
+		// The admin routes need a read-only key to read and an editor key to change, Validate requires the keys to
+		// serve them.
+		admin := func(h http.Handler) http.Handler {
+			return keys.Protect(newsletter.RoleReadOnly, newsletter.RoleEditor, h)
+		}
+		if cfg.HTTP.Preview {
+			mux.Handle("/preview", admin(newsletter.PreviewHandler(storage)))
+		}
+		if cfg.HTTP.Webhooks {
+			mux.Handle("/webhooks", admin(newsletter.WebhookHandler(webhooks)))
+			mux.Handle("/webhooks/", admin(newsletter.WebhookHandler(webhooks)))
+		}
+		if cfg.HTTP.Feeds {
+			mux.Handle("/feeds/", newsletter.FeedHandler(storage, cfg.Feeds.Secret))
+		}
+		if cfg.HTTP.OPML {
+			mux.Handle("/opml", admin(newsletter.OPMLHandler(storage, cfg.HTTP.Feeds)))
+		}
+		if cfg.HTTP.Accounts {
+			accounts := newsletter.NewAccounts(storage, mail, cfg.Accounts.Secret, cfg.Accounts.BaseURL)
+			accounts.LinkTTL = cfg.Accounts.LinkTTL
+			accounts.SessionTTL = cfg.Accounts.SessionTTL
+			accounts.LoginLimit = cfg.Accounts.LoginLimit
+			accounts.LoginIPLimit = cfg.Accounts.LoginIPLimit
+			mux.Handle("/account", newsletter.AccountHandler(accounts))
+			mux.Handle("/account/", newsletter.AccountHandler(accounts))
+		}
+		if cfg.HTTP.Search {
+			mux.Handle("/search", admin(newsletter.SearchHandler(searcher)))
+			mux.Handle("/search/", admin(newsletter.SearchHandler(searcher)))
+		}
+		if keys != nil {
+			mux.Handle("/admin/", admin(newsletter.AdminHandler(storage)))
+			keyHandler := keys.Protect(newsletter.RoleAdmin, newsletter.RoleAdmin, newsletter.APIKeyHandler(keys))
+			mux.Handle("/admin/keys", keyHandler)
+			mux.Handle("/admin/keys/", keyHandler)
+			if auditor, ok := storage.(newsletter.AuditStorage); ok {
+				mux.Handle("/admin/audit", keys.Protect(newsletter.RoleAdmin, newsletter.RoleAdmin, newsletter.AuditHandler(auditor)))
+			}
+			privacy := newsletter.NewPrivacy(storage, mail)
+			mux.Handle("/admin/privacy/", keys.Protect(newsletter.RoleAdmin, newsletter.RoleAdmin, newsletter.PrivacyHandler(privacy)))
+		}
+		g.Go(func() error {
+			return c.listenAndServe(gctx, cfg.HTTP.Addr, mux)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("service stopped: %v", err)
+	}
+	slog.Info("service stopped gracefully")
+	return nil
+}
+
+// singleton runs f on a single instance. Storages that elect a leader run it on the leader only, the other
+// instances wait to take over.
+func (c *cli) singleton(ctx context.Context, name, holder string, f func(ctx context.Context) error) error {
+	elector, ok := c.storage.(newsletter.Elector)
+	if !ok {
+		return f(ctx)
+	}
+	election := newsletter.NewLeaderElection(elector, name, holder)
+	election.TTL = c.cfg.Crawler.LeaseTTL
+	election.RetryInterval = c.cfg.Crawler.LeaseTTL / 3
+	return election.Run(ctx, f)
+}
+
+// listenAndServe serves h on addr until ctx is cancelled, then shuts the server down.
+func (c *cli) listenAndServe(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: c.cfg.HTTP.ReadHeaderTimeout}
+
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.cfg.HTTP.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("error shutting down the HTTP server", "error", err)
+		}
+	})
+	defer stop()
+
+	slog.Info("serving HTTP", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving HTTP: %v", err)
+	}
+	return nil
+}
+
+// every runs f on every tick of d until ctx is cancelled or f fails.
+func every(ctx context.Context, d time.Duration, f func() error) error {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := f(); err != nil {
+			return err
+		}
+	}
+}
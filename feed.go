@@ -0,0 +1,319 @@
+package newsletter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+const (
+	// DefaultFeedEntries is the number of entries of a feed
+	DefaultFeedEntries = 50
+	atomNamespace      = "http://www.w3.org/2005/Atom"
+)
+
+// Feed is an Atom feed of the changes of the pages
+type Feed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Links   []FeedLink  `xml:"link"`
+	Author  *FeedAuthor `xml:"author,omitempty"`
+	Entries []FeedEntry `xml:"entry"`
+}
+
+// FeedLink is a link of a feed or entry
+type FeedLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// FeedAuthor is the engineer of the pages of a feed
+type FeedAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+// FeedEntry is a new version of a page
+type FeedEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Link    FeedLink    `xml:"link"`
+	Author  *FeedAuthor `xml:"author,omitempty"`
+	Content FeedContent `xml:"content"`
+}
+
+// FeedContent is the HTML summary of an entry
+type FeedContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// engineerOf returns the engineer of the URL, one named after the URL when there is none.
+func engineerOf(engineers []mongodb.Engineer, url string) (mongodb.Engineer, bool) {
+	for _, e := range engineers {
+		if e.URL == url {
+			return e, true
+		}
+	}
+	return mongodb.Engineer{Name: url, URL: url}, false
+}
+
+// feedEngineer returns the engineer of the URL, one named after the URL when there is none.
+func feedEngineer(ctx context.Context, s Storage, url string) (mongodb.Engineer, bool, error) {
+	e, err := s.Engineer(ctx, url)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return mongodb.Engineer{Name: url, URL: url}, false, nil
+	}
+	if err != nil {
+		return mongodb.Engineer{}, false, fmt.Errorf("error getting engineer: %v", err)
+	}
+	return e, true, nil
+}
+
+// pageEntries returns up to limit entries of the changes of the page of the engineer, the newest first.
+// The first version of the page is an entry too, without articles.
+func pageEntries(ctx context.Context, s Storage, e mongodb.Engineer, limit int) ([]FeedEntry, error) {
+	// The version before the oldest entry is read too, to find what the entry changed. The unchanged versions
+	// in between have its content, so the changes are enough.
+	changes, err := s.PageChanges(ctx, e.URL, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	author := &FeedAuthor{Name: e.Name, URI: e.URL}
+	var entries []FeedEntry
+	for i, p := range changes {
+		if len(entries) == limit {
+			break
+		}
+
+		var ev ChangeEvent
+		if i+1 < len(changes) {
+			ev = NewChangeEvent(e, changes[i+1], p)
+		} else {
+			ev.NewHash = hex.EncodeToString(p.HashMD5[:])
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "<p>%d new articles, %d lines added and %d removed.</p>", len(ev.Articles), ev.Diff.AddedLines,
+			ev.Diff.RemovedLines)
+		if len(ev.Articles) > 0 {
+			b.WriteString("<ul>")
+			for _, a := range ev.Articles {
+				fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString(a), html.EscapeString(a))
+			}
+			b.WriteString("</ul>")
+		}
+
+		entries = append(entries, FeedEntry{
+			ID:      fmt.Sprintf("urn:newsletter:%x:%s:%d", md5.Sum([]byte(p.URL)), ev.NewHash, p.ScrapeDatetime.Unix()),
+			Title:   fmt.Sprintf("New version of %s", e.Name),
+			Updated: p.ScrapeDatetime.UTC(),
+			Link:    FeedLink{Rel: "alternate", Href: p.URL},
+			Author:  author,
+			Content: FeedContent{Type: "html", Body: b.String()},
+		})
+	}
+	return entries, nil
+}
+
+// newFeed returns the feed of the entries, updated when its newest entry was.
+func newFeed(id, title, self string, author *FeedAuthor, entries []FeedEntry) Feed {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Updated.After(entries[j].Updated) })
+	f := Feed{
+		Xmlns:   atomNamespace,
+		ID:      id,
+		Title:   title,
+		Updated: time.Now().UTC().Truncate(time.Second),
+		Author:  author,
+		Entries: entries,
+	}
+	if self != "" {
+		f.Links = append(f.Links, FeedLink{Rel: "self", Href: self})
+	}
+	if len(entries) > 0 {
+		f.Updated = entries[0].Updated
+	}
+	return f
+}
+
+// EngineerFeed returns the feed of the changes of the page of the engineer of the URL, up to limit entries.
+// It returns mongodb.ErrNotFound when there is no such engineer.
+func EngineerFeed(ctx context.Context, s Storage, url, self string, limit int) (Feed, error) {
+	e, ok, err := feedEngineer(ctx, s, url)
+	if err != nil {
+		return Feed{}, err
+	}
+	if !ok {
+		return Feed{}, mongodb.ErrNotFound
+	}
+
+	entries, err := pageEntries(ctx, s, e, limit)
+	if err != nil {
+		return Feed{}, fmt.Errorf("error getting page history: %v", err)
+	}
+	author := &FeedAuthor{Name: e.Name, URI: e.URL}
+	return newFeed("urn:newsletter:engineer:"+e.URL, e.Name, self, author, entries), nil
+}
+
+// SubscriptionFeed returns the feed of the changes of the pages the user subscribed to, up to limit entries.
+// It returns mongodb.ErrNotFound when the user has no subscription.
+func SubscriptionFeed(ctx context.Context, s Storage, userEmail, self string, limit int) (Feed, error) {
+	n, err := s.Subscription(ctx, userEmail)
+	if err != nil {
+		return Feed{}, err
+	}
+
+	var entries []FeedEntry
+	for _, url := range n.URLs {
+		e, _, err := feedEngineer(ctx, s, url)
+		if err != nil {
+			return Feed{}, err
+		}
+		pe, err := pageEntries(ctx, s, e, limit)
+		if err != nil {
+			return Feed{}, fmt.Errorf("error getting page history: %v", err)
+		}
+		entries = append(entries, pe...)
+	}
+
+	f := newFeed("urn:newsletter:subscription:"+userEmail, "Newsletter of "+userEmail, self, nil, entries)
+	if len(f.Entries) > limit {
+		f.Entries = f.Entries[:limit]
+	}
+	return f, nil
+}
+
+// FeedToken returns the token of the feed of the user, signed by secret. Anyone with the token reads the feed,
+// and changing the secret revokes the tokens of all the users.
+func FeedToken(secret, userEmail string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(userEmail)) + "." + feedSignature(secret, userEmail)
+}
+
+func feedSignature(secret, userEmail string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(userEmail))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseFeedToken returns the user of a token of FeedToken signed by secret
+func ParseFeedToken(secret, token string) (string, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errors.New("malformed feed token")
+	}
+	email, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("malformed feed token")
+	}
+	if !hmac.Equal([]byte(signature), []byte(feedSignature(secret, string(email)))) {
+		return "", errors.New("invalid feed token")
+	}
+	return string(email), nil
+}
+
+// FeedHandler serves the Atom feeds, mounted on /feeds/:
+//
+//	GET /feeds/engineers?url=<url>      the changes of the page of an engineer
+//	GET /feeds/subscriptions/<token>    the changes of the pages of a subscriber, with the token of FeedToken
+//
+// The subscription feeds are disabled without secret.
+func FeedHandler(s Storage, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		self := requestURL(r)
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/feeds"), "/")
+		var feed Feed
+		var err error
+		switch {
+		case path == "engineers":
+			feed, err = EngineerFeed(r.Context(), s, r.URL.Query().Get("url"), self, DefaultFeedEntries)
+		case strings.HasPrefix(path, "subscriptions/") && secret != "":
+			email, tokenErr := ParseFeedToken(secret, strings.TrimPrefix(path, "subscriptions/"))
+			if tokenErr != nil {
+				http.NotFound(w, r)
+				return
+			}
+			feed, err = SubscriptionFeed(r.Context(), s, email, self, DefaultFeedEntries)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, mongodb.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error building feed", "error", err)
+			http.Error(w, "error building feed", http.StatusInternalServerError)
+			return
+		}
+
+		var b bytes.Buffer
+		b.WriteString(xml.Header)
+		enc := xml.NewEncoder(&b)
+		enc.Indent("", "  ")
+		if err := enc.Encode(feed); err != nil {
+			slog.ErrorContext(r.Context(), "error encoding feed", "error", err)
+			http.Error(w, "error encoding feed", http.StatusInternalServerError)
+			return
+		}
+
+		// The feed only changes with its entries, so the readers polling it are answered 304 Not Modified until a
+		// page changes.
+		var modified time.Time
+		if len(feed.Entries) > 0 {
+			modified = feed.Entries[0].Updated
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Header().Set("ETag", feedETag(feed))
+		http.ServeContent(w, r, "", modified, bytes.NewReader(b.Bytes()))
+	})
+}
+
+// feedETag returns the entity tag of the feed, that changes with its entries
+func feedETag(f Feed) string {
+	h := md5.New()
+	h.Write([]byte(f.ID))
+	for _, e := range f.Entries {
+		h.Write([]byte("\n" + e.ID))
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
+// requestURL returns the absolute URL of the request
+func requestURL(r *http.Request) string {
+	return requestBase(r) + r.URL.RequestURI()
+}
+
+// requestBase returns the scheme and host the request was sent to
+func requestBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
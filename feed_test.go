@@ -0,0 +1,154 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// newFeedStorage returns a storage where FakeURL, of the engineer John, changed once after its first version and
+// j@gmail.com subscribed to it.
+func newFeedStorage(ctx context.Context, t *testing.T) *memory.Storage {
+	s := memory.NewStorage()
+	if err := s.SaveEngineer(ctx, mongodb.Engineer{Name: "John", URL: FakeURL}); err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+	if err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}}); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []struct {
+		content string
+		changed bool
+	}{
+		{`<a href="/first">First</a>`, true},
+		{`<a href="/first">First</a>`, false},
+		{`<a href="/second">Second &</a>` + "\n" + `<a href="/first">First</a>`, true},
+	}
+	for i, v := range versions {
+		p := mongodb.Page{URL: FakeURL, Content: v.content, IsMostRecent: v.changed, ScrapeDatetime: start.Add(time.Duration(i) * time.Hour)}
+		if err := s.SavePage(ctx, []mongodb.Page{p}); err != nil {
+			t.Fatal("error saving page", err)
+		}
+	}
+	return s
+}
+
+func TestEngineerFeed(t *testing.T) {
+	ctx := context.Background()
+	s := newFeedStorage(ctx, t)
+
+	f, err := EngineerFeed(ctx, s, FakeURL, "", DefaultFeedEntries)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(f.Entries) != 2 || f.Title != "John" {
+		t.Fatalf("expected the 2 changes of John, got %+v", f)
+	}
+	newest := f.Entries[0]
+	if !f.Updated.Equal(newest.Updated) || newest.Updated.Hour() != 2 {
+		t.Fatalf("expected the newest change first, got %+v", f.Entries)
+	}
+	if !strings.Contains(newest.Content.Body, FakeURL+"/second") || strings.Contains(newest.Content.Body, "/first") {
+		t.Fatalf("expected the new article only, got %s", newest.Content.Body)
+	}
+	if f.Entries[0].ID == f.Entries[1].ID {
+		t.Fatalf("expected unique entry IDs, got %s twice", f.Entries[0].ID)
+	}
+
+	// The entry of a limited feed is still compared to the version before it.
+	f, err = EngineerFeed(ctx, s, FakeURL, "", 1)
+	if err != nil || len(f.Entries) != 1 || f.Entries[0].Content.Body != newest.Content.Body {
+		t.Fatalf("expected the newest change only, got %+v (%v)", f.Entries, err)
+	}
+	if _, err := EngineerFeed(ctx, s, "http://unknown.test", "", 1); err != mongodb.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFeedToken(t *testing.T) {
+	token := FeedToken("s3cret", "j@gmail.com")
+	if email, err := ParseFeedToken("s3cret", token); err != nil || email != "j@gmail.com" {
+		t.Fatalf("expected j@gmail.com, got %q (%v)", email, err)
+	}
+
+	forged := FeedToken("other", "k@gmail.com")
+	for _, tt := range []string{"", "abc", forged, token[:len(token)-1], "!!!." + token[strings.Index(token, ".")+1:]} {
+		if email, err := ParseFeedToken("s3cret", tt); err == nil {
+			t.Errorf("%q: expected error, got %s", tt, email)
+		}
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	ctx := context.Background()
+	svr := httptest.NewServer(FeedHandler(newFeedStorage(ctx, t), "s3cret"))
+	defer svr.Close()
+
+	resp, err := http.Get(svr.URL + "/feeds/subscriptions/" + FeedToken("s3cret", "j@gmail.com"))
+	if err != nil {
+		t.Fatal("error getting feed", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	var f Feed
+	if err := xml.NewDecoder(resp.Body).Decode(&f); err != nil {
+		t.Fatal("error decoding feed", err)
+	}
+	if f.XMLName.Space != atomNamespace || len(f.Entries) != 2 || len(f.Links) != 1 || f.Links[0].Rel != "self" {
+		t.Fatalf("unexpected feed %+v", f)
+	}
+	etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" || modified != f.Entries[0].Updated.Format(http.TimeFormat) {
+		t.Fatalf("expected the ETag and Last-Modified of the newest entry, got %q and %q", etag, modified)
+	}
+
+	// The readers polling the feed are not sent it again until it changes.
+	for header, value := range map[string]string{"If-None-Match": etag, "If-Modified-Since": modified} {
+		req, _ := http.NewRequest(http.MethodGet, resp.Request.URL.String(), nil)
+		req.Header.Set(header, value)
+		cached, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error getting feed", err)
+		}
+		_ = cached.Body.Close()
+		if cached.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: got status %d, want %d", header, cached.StatusCode, http.StatusNotModified)
+		}
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/feeds/engineers?url=" + FakeURL, http.StatusOK},
+		{http.MethodGet, "/feeds/engineers?url=http://unknown.test", http.StatusNotFound},
+		{http.MethodGet, "/feeds/subscriptions/" + FeedToken("other", "j@gmail.com"), http.StatusNotFound},
+		{http.MethodGet, "/feeds/subscriptions/" + FeedToken("s3cret", "k@gmail.com"), http.StatusNotFound},
+		{http.MethodPost, "/feeds/engineers?url=" + FakeURL, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package newsletter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/perebaj/newsletter/htmltext"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// compileKeyword returns the expression of a keyword of a filter. A keyword matches as a whole word, ignoring the
+// case, and a keyword written as /expression/ is a regular expression, matched as it is.
+func compileKeyword(k string) (*regexp.Regexp, error) {
+	if len(k) > 2 && strings.HasPrefix(k, "/") && strings.HasSuffix(k, "/") {
+		re, err := regexp.Compile(k[1 : len(k)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %v", k, err)
+		}
+		return re, nil
+	}
+	k = strings.TrimSpace(k)
+	if k == "" {
+		return nil, fmt.Errorf("empty keyword")
+	}
+	// \b does not work around keywords that start or end with a symbol, like C++.
+	return regexp.MustCompile(`(?i)(^|\W)` + regexp.QuoteMeta(k) + `($|\W)`), nil
+}
+
+// ValidateFilter checks that the filter has keywords and all of them compile
+func ValidateFilter(f mongodb.Filter) error {
+	if len(f.Include) == 0 && len(f.Exclude) == 0 {
+		return fmt.Errorf("filter without keywords")
+	}
+	for _, k := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := compileKeyword(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFilter replaces the filter of the same URL of the newsletter, or removes it when f has no keywords.
+// The URL of the filter must be one of the newsletter, or empty to filter all of them.
+func SetFilter(n mongodb.Newsletter, f mongodb.Filter) (mongodb.Newsletter, error) {
+	if f.URL != "" && !contains(n.URLs, f.URL) {
+		return n, fmt.Errorf("%s is not subscribed to %s", n.UserEmail, f.URL)
+	}
+	remove := len(f.Include) == 0 && len(f.Exclude) == 0
+	if !remove {
+		if err := ValidateFilter(f); err != nil {
+			return n, err
+		}
+	}
+
+	filters := make([]mongodb.Filter, 0, len(n.Filters)+1)
+	for _, got := range n.Filters {
+		if got.URL != f.URL {
+			filters = append(filters, got)
+		}
+	}
+	if !remove {
+		filters = append(filters, f)
+	}
+	if len(filters) == 0 {
+		filters = nil
+	}
+	n.Filters = filters
+	return n, nil
+}
+
+// compiledFilter is a filter of a newsletter with its keywords compiled
+type compiledFilter struct {
+	url              string
+	include, exclude []*regexp.Regexp
+}
+
+// compileFilters compiles the keywords of the filters, once for every newsletter sent
+func compileFilters(filters []mongodb.Filter) ([]compiledFilter, error) {
+	compiled := make([]compiledFilter, 0, len(filters))
+	for _, f := range filters {
+		cf := compiledFilter{url: f.URL}
+		for _, k := range f.Include {
+			re, err := compileKeyword(k)
+			if err != nil {
+				return nil, err
+			}
+			cf.include = append(cf.include, re)
+		}
+		for _, k := range f.Exclude {
+			re, err := compileKeyword(k)
+			if err != nil {
+				return nil, err
+			}
+			cf.exclude = append(cf.exclude, re)
+		}
+		compiled = append(compiled, cf)
+	}
+	return compiled, nil
+}
+
+// newsletterFilters returns the compiled filters of the newsletter. Filters that do not compile, saved before they
+// were validated, are dropped, so the changes are notified rather than lost.
+func newsletterFilters(ctx context.Context, n mongodb.Newsletter) []compiledFilter {
+	filters, err := compileFilters(n.Filters)
+	if err != nil {
+		slog.ErrorContext(ctx, "error compiling filters", "user", n.UserEmail, "error", err)
+		return nil
+	}
+	return filters
+}
+
+// matchFilters reports if the text of the change of the page of url passes the filters of the newsletter that apply
+// to it: every filter of the url and every filter without url.
+func matchFilters(filters []compiledFilter, url, text string) bool {
+	for _, f := range filters {
+		if f.url != "" && f.url != url {
+			continue
+		}
+		for _, re := range f.exclude {
+			if re.MatchString(text) {
+				return false
+			}
+		}
+		included := len(f.include) == 0
+		for _, re := range f.include {
+			if re.MatchString(text) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	return true
+}
+
+// hasFilter reports if any filter of the newsletter applies to url
+func hasFilter(filters []compiledFilter, url string) bool {
+	for _, f := range filters {
+		if f.url == "" || f.url == url {
+			return true
+		}
+	}
+	return false
+}
+
+// passesFilters reports if the change of the page, the last version of its URL, passes the filters of the newsletter.
+func passesFilters(ctx context.Context, s Storage, filters []compiledFilter, p mongodb.Page) bool {
+	if !hasFilter(filters, p.URL) {
+		return true
+	}
+	history, err := s.PageHistory(ctx, p.URL, 2)
+	if err != nil || len(history) == 0 {
+		slog.ErrorContext(ctx, "error getting page history", "url", p.URL, "error", err)
+		return true
+	}
+	return matchChange(filters, history, 0)
+}
+
+// matchChange reports if the change of the version i of the history of a page, from the newest to the oldest, passes
+// the filters. The filters are evaluated against the lines of text added since the previous version, the whole
+// text of the first version.
+func matchChange(filters []compiledFilter, history []mongodb.Page, i int) bool {
+	p := history[i]
+	if !hasFilter(filters, p.URL) {
+		return true
+	}
+	if i+1 == len(history) {
+		return matchFilters(filters, p.URL, htmltext.Extract(p.Content))
+	}
+	added := addedLines(htmltext.Lines(history[i+1].Content), htmltext.Lines(p.Content))
+	return matchFilters(filters, p.URL, strings.Join(added, "\n"))
+}
+
+// addedLines returns the lines of new missing in old, in order
+func addedLines(old, new []string) []string {
+	count := make(map[string]int)
+	for _, l := range old {
+		count[l]++
+	}
+	var added []string
+	for _, l := range new {
+		if count[l] > 0 {
+			count[l]--
+			continue
+		}
+		added = append(added, l)
+	}
+	return added
+}
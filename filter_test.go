@@ -0,0 +1,134 @@
+package newsletter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+func TestMatchFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []mongodb.Filter
+		text    string
+		want    bool
+	}{
+		{"no filter", nil, "anything", true},
+		{"keyword", []mongodb.Filter{{Include: []string{"Go"}}}, "Generics in go 1.18", true},
+		{"whole word", []mongodb.Filter{{Include: []string{"go"}}}, "A good post", false},
+		{"symbols", []mongodb.Filter{{Include: []string{"C++"}}}, "Modern C++, again", true},
+		{"any include", []mongodb.Filter{{Include: []string{"rust", "databases"}}}, "On databases", true},
+		{"regex", []mongodb.Filter{{Include: []string{`/Postgre(SQL|s)/`}}}, "Tuning PostgreSQL", true},
+		{"case-sensitive regex", []mongodb.Filter{{Include: []string{`/\bGo\b/`}}}, "go home", false},
+		{"exclude", []mongodb.Filter{{Include: []string{"go"}, Exclude: []string{"hiring"}}}, "Go: we are hiring", false},
+		{"other URL", []mongodb.Filter{{URL: "https://other.test", Include: []string{"go"}}}, "Rust", true},
+		{"every filter", []mongodb.Filter{{Include: []string{"go"}}, {URL: FakeURL, Exclude: []string{"rust"}}}, "Go and Rust", false},
+	}
+	for _, tt := range tests {
+		filters, err := compileFilters(tt.filters)
+		if err != nil {
+			t.Fatalf("%s: error compiling filters: %v", tt.name, err)
+		}
+		if got := matchFilters(filters, FakeURL, tt.text); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := compileFilters([]mongodb.Filter{{Include: []string{"/(/"}}}); err == nil {
+		t.Error("expected error for an invalid expression")
+	}
+}
+
+func TestMatchChange(t *testing.T) {
+	filters, err := compileFilters([]mongodb.Filter{{Include: []string{"go"}}})
+	if err != nil {
+		t.Fatal("error compiling filters", err)
+	}
+	old := mongodb.Page{URL: FakeURL, Content: "<ul>\n<li>Go generics</li>\n</ul>"}
+
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"new text", "<ul>\n<li>Go generics</li>\n<li>Go iterators</li>\n</ul>", true},
+		{"other text", "<ul>\n<li>Go generics</li>\n<li>Rust traits</li>\n</ul>", false},
+		// The text of the old line is unchanged, only its markup is.
+		{"new markup", `<ul class="posts"><li class="new">Go generics</li><li>Rust traits</li></ul>`, false},
+	}
+	for _, tt := range tests {
+		history := []mongodb.Page{{URL: FakeURL, Content: tt.content}, old}
+		if got := matchChange(filters, history, 0); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	// The first version is matched as a whole.
+	if !matchChange(filters, []mongodb.Page{old}, 0) {
+		t.Error("expected the first version to match")
+	}
+}
+
+func TestSetFilter(t *testing.T) {
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}}
+
+	n, err := SetFilter(n, mongodb.Filter{URL: FakeURL, Include: []string{"go"}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	n, err = SetFilter(n, mongodb.Filter{URL: FakeURL, Exclude: []string{"hiring"}})
+	if err != nil || len(n.Filters) != 1 || n.Filters[0].Exclude[0] != "hiring" {
+		t.Fatalf("expected the filter to be replaced, got %v (%v)", n.Filters, err)
+	}
+	if n, _ = SetFilter(n, mongodb.Filter{URL: FakeURL}); n.Filters != nil {
+		t.Fatalf("expected the filter to be removed, got %v", n.Filters)
+	}
+
+	invalid := []mongodb.Filter{
+		{URL: "https://other.test", Include: []string{"go"}},
+		{Include: []string{"/[/"}},
+		{Include: []string{" "}},
+	}
+	for _, f := range invalid {
+		if _, err := SetFilter(n, f); err == nil {
+			t.Errorf("%v: expected error", f)
+		}
+	}
+}
+
+func TestEmailTrigger_Filters(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	filters := map[string][]mongodb.Filter{
+		"go@gmail.com": {{URL: FakeURL, Include: []string{"go"}}},
+		// The old post about Rust is still on the page, only the new one counts.
+		"rust@gmail.com": {{Include: []string{"rust"}}},
+		"nogo@gmail.com": {{Exclude: []string{"go"}}},
+	}
+	for email, f := range filters {
+		if err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: email, URLs: []string{FakeURL}, Filters: f}); err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+
+	start := time.Now().UTC()
+	err := s.SavePage(ctx, []mongodb.Page{
+		{URL: FakeURL, Content: "<li>Rust ownership</li>", IsMostRecent: true, ScrapeDatetime: start.Add(-time.Hour)},
+		{URL: FakeURL, Content: "<li>Generics in Go</li>\n<li>Rust ownership</li>", IsMostRecent: true, ScrapeDatetime: start},
+	})
+	if err != nil {
+		t.Fatal("error saving pages", err)
+	}
+
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, ok := e.sent["go@gmail.com"]; !ok || len(e.sent) != 1 {
+		t.Fatalf("expected only the email of the go filter, got %v", e.sent)
+	}
+}
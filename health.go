@@ -0,0 +1,108 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck is a named check of a dependency or a loop of the service
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// CheckStatus is the result of a HealthCheck
+type CheckStatus struct {
+	Name string `json:"name"`
+	// Status is "ok" or "failing"
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// HealthStatus is the body of the health endpoints
+type HealthStatus struct {
+	// Status is "ok" when every check passes, "failing" otherwise
+	Status string        `json:"status"`
+	Checks []CheckStatus `json:"checks"`
+}
+
+// HealthHandler runs the checks concurrently, each one bounded by timeout, and responds with the HealthStatus as JSON,
+// with status 200 when every check passes and 503 otherwise.
+func HealthHandler(timeout time.Duration, checks ...HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := HealthStatus{Status: "ok", Checks: make([]CheckStatus, len(checks))}
+
+		var wg sync.WaitGroup
+		for i, c := range checks {
+			wg.Add(1)
+			go func(i int, c HealthCheck) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+
+				start := time.Now()
+				err := c.Check(ctx)
+				cs := CheckStatus{Name: c.Name, Status: "ok", Duration: time.Since(start).String()}
+				if err != nil {
+					cs.Status, cs.Error = "failing", err.Error()
+				}
+				status.Checks[i] = cs
+			}(i, c)
+		}
+		wg.Wait()
+
+		code := http.StatusOK
+		for _, cs := range status.Checks {
+			if cs.Status != "ok" {
+				status.Status = "failing"
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			slog.Error("error encoding health status", "error", err)
+		}
+	})
+}
+
+// Heartbeat records the last time a loop made progress
+type Heartbeat struct {
+	last atomic.Int64
+}
+
+// Beat records progress now
+func (h *Heartbeat) Beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+// Last returns the time of the last beat, zero before the first one
+func (h *Heartbeat) Last() time.Time {
+	n := h.last.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// FreshnessCheck fails when the last progress of a loop is older than maxAge, or the loop never started.
+func FreshnessCheck(last func() time.Time, maxAge time.Duration) func(ctx context.Context) error {
+	return func(context.Context) error {
+		t := last()
+		if t.IsZero() {
+			return fmt.Errorf("not started")
+		}
+		if age := time.Since(t); age > maxAge {
+			return fmt.Errorf("last progress %v ago, more than %v", age.Round(time.Second), maxAge)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,150 @@
+package newsletter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	ok := HealthCheck{Name: "ok", Check: func(context.Context) error { return nil }}
+	failing := HealthCheck{Name: "failing", Check: func(context.Context) error { return errors.New("down") }}
+	slow := HealthCheck{Name: "slow", Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	tests := []struct {
+		name     string
+		checks   []HealthCheck
+		wantCode int
+		want     HealthStatus
+	}{
+		{
+			name:     "all ok",
+			checks:   []HealthCheck{ok},
+			wantCode: http.StatusOK,
+			want:     HealthStatus{Status: "ok", Checks: []CheckStatus{{Name: "ok", Status: "ok"}}},
+		},
+		{
+			name:     "one failing",
+			checks:   []HealthCheck{ok, failing},
+			wantCode: http.StatusServiceUnavailable,
+			want: HealthStatus{Status: "failing", Checks: []CheckStatus{
+				{Name: "ok", Status: "ok"},
+				{Name: "failing", Status: "failing", Error: "down"},
+			}},
+		},
+		{
+			name:     "timeout",
+			checks:   []HealthCheck{slow},
+			wantCode: http.StatusServiceUnavailable,
+			want: HealthStatus{Status: "failing", Checks: []CheckStatus{
+				{Name: "slow", Status: "failing", Error: context.DeadlineExceeded.Error()},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HealthHandler(10*time.Millisecond, tt.checks...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d", tt.wantCode, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Fatalf("expected application/json, got %s", got)
+			}
+
+			var got HealthStatus
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal("error decoding health status", err)
+			}
+			if got.Status != tt.want.Status || len(got.Checks) != len(tt.want.Checks) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+			for i, c := range got.Checks {
+				c.Duration = ""
+				if c != tt.want.Checks[i] {
+					t.Fatalf("expected check %+v, got %+v", tt.want.Checks[i], c)
+				}
+			}
+		})
+	}
+}
+
+func TestFreshnessCheck(t *testing.T) {
+	ctx := context.Background()
+	var h Heartbeat
+
+	check := FreshnessCheck(h.Last, time.Minute)
+	if err := check(ctx); err == nil {
+		t.Fatal("expected error before the first beat, got nil")
+	}
+
+	h.Beat()
+	if err := check(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	stale := FreshnessCheck(func() time.Time { return time.Now().Add(-2 * time.Minute) }, time.Minute)
+	if err := stale(ctx); err == nil {
+		t.Fatal("expected error for a stale loop, got nil")
+	}
+}
+
+func TestMailClientPing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening", err)
+	}
+	defer ln.Close()
+
+	// The fake SMTP server only greets and quits.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if line == "QUIT\r\n" {
+					fmt.Fprint(conn, "221 bye\r\n")
+					break
+				}
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+			conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := NewMailClient(EmailConfig{Host: host, Port: p}).Ping(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	ln.Close()
+	if err := NewMailClient(EmailConfig{Host: host, Port: p}).Ping(ctx); err == nil {
+		t.Fatal("expected error for an unreachable server, got nil")
+	}
+}
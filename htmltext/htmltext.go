@@ -0,0 +1,87 @@
+// Package htmltext extracts the readable text of the scraped pages.
+package htmltext
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// skipped are the elements whose content is not text read by people
+var skipped = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"svg":      true,
+	"iframe":   true,
+	"head":     true,
+}
+
+// blocks are the elements that break the lines of the text
+var blocks = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "figcaption": true, "figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true, "hr": true, "li": true, "main": true, "nav": true,
+	"ol": true, "p": true, "pre": true, "section": true, "table": true, "td": true, "th": true, "title": true,
+	"tr": true, "ul": true,
+}
+
+// Extract returns the text of the HTML document, without markup, scripts and styles, with the whitespace collapsed
+// to single spaces. The title is kept, the rest of the head is not.
+func Extract(doc string) string {
+	return strings.Join(Lines(doc), " ")
+}
+
+// Lines returns the text of the HTML document as Extract does, split in the lines of its paragraphs, headings, list
+// items and the other block elements. Blank lines are dropped.
+func Lines(doc string) []string {
+	var lines, words []string
+	flush := func() {
+		if len(words) > 0 {
+			lines = append(lines, strings.Join(words, " "))
+			words = words[:0]
+		}
+	}
+	// depth counts the skipped elements the tokenizer is inside of.
+	depth := 0
+	inTitle := false
+	z := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			flush()
+			return lines
+		case html.SelfClosingTagToken:
+			if name, _ := z.TagName(); blocks[string(name)] {
+				flush()
+			}
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); {
+			case tag == "title":
+				flush()
+				inTitle = true
+			case skipped[tag]:
+				depth++
+			case blocks[tag]:
+				flush()
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); {
+			case tag == "title":
+				flush()
+				inTitle = false
+			case skipped[tag] && depth > 0:
+				depth--
+			case blocks[tag]:
+				flush()
+			}
+		case html.TextToken:
+			if depth == 0 || inTitle {
+				words = append(words, strings.Fields(string(z.Text()))...)
+			}
+		}
+	}
+}
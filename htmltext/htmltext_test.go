@@ -0,0 +1,43 @@
+package htmltext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{
+			doc: `<html><head><title>Essays</title><style>p { color: red }</style><script>var x = "<p>";</script></head>
+				<body><h1>How to   Start</h1><p>Read <a href="/a.html">this &amp; that</a>.</p><noscript>Enable JS</noscript></body></html>`,
+			want: "Essays How to Start Read this & that .",
+		},
+		{doc: "plain\n\ttext", want: "plain text"},
+		{doc: "<svg><text>chart</text></svg><p>after</p>", want: "after"},
+		{doc: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := Extract(tt.doc); got != tt.want {
+			t.Errorf("Extract(%q) = %q, want %q", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	doc := `<html><head><title>Essays</title></head><body><h1>How to
+		Start</h1><p>Read <a href="/a.html">this</a> first.<br>Then <b>that</b>.</p><svg/><ul><li>One</li><li>Two</li></ul>
+		<div><p>Nested</p> tail</div></body></html>`
+	want := []string{"Essays", "How to Start", "Read this first.", "Then that .", "One", "Two", "Nested", "tail"}
+
+	got := Lines(doc)
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if Extract(doc) != strings.Join(want, " ") {
+		t.Fatalf("expected Extract to join the lines, got %q", Extract(doc))
+	}
+}
@@ -0,0 +1,128 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Elector elects a single leader among the instances for the singleton jobs, like the email loop.
+// Every term has a token, incremented when the leadership changes hands, so the renewals and the resignation of a
+// stale leader do not affect the term of the new one. The token does not fence the writes of the jobs.
+type Elector interface {
+	AcquireLeadership(ctx context.Context, name, holder string, ttl time.Duration) (int64, bool, error)
+	RenewLeadership(ctx context.Context, name, holder string, token int64, ttl time.Duration) error
+	ResignLeadership(ctx context.Context, name, holder string, token int64) error
+}
+
+// LeaderElection runs a job only on the instance elected leader
+type LeaderElection struct {
+	Elector Elector
+	// Name identifies the job the leader is elected for
+	Name   string
+	Holder string
+	// TTL is how long the leadership lasts without renewal, renewed every third of it
+	TTL time.Duration
+	// RetryInterval is how often a follower campaigns for the leadership
+	RetryInterval time.Duration
+}
+
+// NewLeaderElection initializes a new LeaderElection of the job name, with holder as candidate
+func NewLeaderElection(e Elector, name, holder string) *LeaderElection {
+	return &LeaderElection{
+		Elector:       e,
+		Name:          name,
+		Holder:        holder,
+		TTL:           DefaultLeaseTTL,
+		RetryInterval: DefaultLeaseTTL / 3,
+	}
+}
+
+// Run campaigns for the leadership until ctx is cancelled. Every time the instance is elected, lead runs with a context
+// cancelled when the leadership is lost. The leadership is resigned when lead returns, so another instance takes over
+// on shutdown without waiting for the TTL.
+//
+// The writes of lead are not fenced: a leader that lost its lease may still write until it notices, at most a third of
+// the TTL later, so the jobs must tolerate a short overlap, like the email loop whose leases prevent duplicate emails.
+func (l *LeaderElection) Run(ctx context.Context, lead func(ctx context.Context) error) error {
+	for {
+		token, ok, err := l.Elector.AcquireLeadership(ctx, l.Name, l.Holder, l.TTL)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("error acquiring leadership", "job", l.Name, "error", err)
+		}
+
+		if ok {
+			slog.Info("elected leader", "job", l.Name, "token", token)
+			if err := l.lead(ctx, token, lead); err != nil {
+				return err
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(l.RetryInterval):
+		}
+	}
+}
+
+// lead runs the job during a term, renewing the leadership until the job returns or the leadership is lost.
+func (l *LeaderElection) lead(ctx context.Context, token int64, lead func(ctx context.Context) error) error {
+	leadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.renew(leadCtx, cancel, token)
+	}()
+
+	err := lead(leadCtx)
+	// An error after the term ended is the job being cancelled, not a failure.
+	ended := leadCtx.Err() != nil
+	cancel()
+	<-done
+
+	// The job may have stopped on shutdown, the resignation must still reach the storage.
+	if rerr := l.Elector.ResignLeadership(context.WithoutCancel(ctx), l.Name, l.Holder, token); rerr != nil {
+		slog.Error("error resigning leadership", "job", l.Name, "error", rerr)
+	}
+	slog.Info("leadership ended", "job", l.Name, "token", token)
+
+	if err != nil && !ended {
+		return fmt.Errorf("error leading %s: %v", l.Name, err)
+	}
+	return nil
+}
+
+// renew extends the term every third of the TTL, cancelling the job when the leadership is lost.
+func (l *LeaderElection) renew(ctx context.Context, cancel context.CancelFunc, token int64) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := l.Elector.RenewLeadership(ctx, l.Name, l.Holder, token, l.TTL)
+		if errors.Is(err, mongodb.ErrLeaseLost) {
+			slog.Warn("leadership lost", "job", l.Name, "token", token)
+			cancel()
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			slog.Error("error renewing leadership", "job", l.Name, "error", err)
+		}
+	}
+}
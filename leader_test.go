@@ -0,0 +1,140 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+)
+
+func newTestLeaderElection(s *memory.Storage, holder string) *LeaderElection {
+	l := NewLeaderElection(s, "email", holder)
+	l.TTL = time.Duration(60) * time.Millisecond
+	l.RetryInterval = time.Duration(10) * time.Millisecond
+	return l
+}
+
+func TestLeaderElection_Handoff(t *testing.T) {
+	s := memory.NewStorage()
+
+	var leaders, maxLeaders int32
+	var tokens [2]atomic.Int64
+	lead := func(i int) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			n := atomic.AddInt32(&leaders, 1)
+			if n > atomic.LoadInt32(&maxLeaders) {
+				atomic.StoreInt32(&maxLeaders, n)
+			}
+			leader, err := s.Leader(ctx, "email")
+			if err != nil {
+				return err
+			}
+			tokens[i].Store(leader.Token)
+			<-ctx.Done()
+			atomic.AddInt32(&leaders, -1)
+			return nil
+		}
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	doneA, doneB := make(chan error, 1), make(chan error, 1)
+	go func() { doneA <- newTestLeaderElection(s, "a").Run(ctxA, lead(0)) }()
+	time.Sleep(time.Duration(30) * time.Millisecond)
+	go func() { doneB <- newTestLeaderElection(s, "b").Run(ctxB, lead(1)) }()
+
+	// The renewals keep a as the only leader beyond the ttl.
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	if got := tokens[1].Load(); got != 0 {
+		t.Fatalf("expected b to follow, got token %d", got)
+	}
+
+	// Shutting a down resigns, so b takes over well before the ttl.
+	cancelA()
+	if err := <-doneA; err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	time.Sleep(time.Duration(40) * time.Millisecond)
+	if got, prev := tokens[1].Load(), tokens[0].Load(); got <= prev {
+		t.Fatalf("expected b to lead with a newer token, got %d after %d", got, prev)
+	}
+
+	cancelB()
+	if err := <-doneB; err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if got := atomic.LoadInt32(&maxLeaders); got != 1 {
+		t.Fatalf("got %d leaders at the same time, want 1", got)
+	}
+}
+
+func TestLeaderElection_Lost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := memory.NewStorage()
+	l := newTestLeaderElection(s, "a")
+
+	terms := make(chan int64, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Run(ctx, func(ctx context.Context) error {
+			leader, err := s.Leader(ctx, "email")
+			if err != nil {
+				return err
+			}
+			terms <- leader.Token
+			<-ctx.Done()
+			return nil
+		})
+	}()
+
+	token := <-terms
+	// Another instance takes over, as if the leadership had expired.
+	if err := s.ResignLeadership(ctx, "email", "a", token); err != nil {
+		t.Fatal("error resigning leadership", err)
+	}
+	stolen, ok, err := s.AcquireLeadership(ctx, "email", "b", time.Duration(100)*time.Millisecond)
+	if !ok || err != nil {
+		t.Fatalf("expected leadership, got %v %v", ok, err)
+	}
+
+	// The lost term is cancelled and a campaigns again once b's leadership expires.
+	select {
+	case got := <-terms:
+		if got <= stolen {
+			t.Fatalf("expected a newer term than %d, got %d", stolen, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a to lead again")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestLeaderElection_Error(t *testing.T) {
+	s := memory.NewStorage()
+	l := newTestLeaderElection(s, "a")
+
+	err := l.Run(context.Background(), func(context.Context) error {
+		return errors.New("smtp down")
+	})
+	if err == nil {
+		t.Fatal("expected the error of the leader")
+	}
+
+	leader, err := s.Leader(context.Background(), "email")
+	if err != nil {
+		t.Fatal("error getting leader", err)
+	}
+	if leader.Holder != "" {
+		t.Fatalf("expected the leadership to be resigned, got %v", leader)
+	}
+}
@@ -0,0 +1,105 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// DefaultLeaseTTL is how long a job lease lasts without a heartbeat
+const DefaultLeaseTTL = time.Minute
+
+// Leaser coordinates the jobs of several instances, so each job is run by a single instance at a time.
+// A lease is renewed by heartbeats while the job runs and is reclaimed by other instances once it expires.
+type Leaser interface {
+	AcquireLease(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	RenewLease(ctx context.Context, key, owner string, ttl time.Duration) error
+	ReleaseLease(ctx context.Context, key, owner string, holdUntil time.Time) error
+}
+
+// InstanceID returns an identifier of the running instance, used as the owner of its leases
+func InstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// lease is a job lease held by the current instance, renewed by a heartbeat until released.
+type lease struct {
+	leaser Leaser
+	key    string
+	owner  string
+	ttl    time.Duration
+	// ctx is cancelled when the lease is lost
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// acquireLease claims the job key, returning a nil lease when another instance holds it.
+func acquireLease(ctx context.Context, l Leaser, key, owner string, ttl time.Duration) (*lease, error) {
+	ok, err := l.AcquireLease(ctx, key, owner, ttl)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	ls := &lease{
+		leaser: l,
+		key:    key,
+		owner:  owner,
+		ttl:    ttl,
+		ctx:    leaseCtx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go ls.heartbeat()
+	return ls, nil
+}
+
+// heartbeat renews the lease every third of its ttl, until it is released or lost.
+func (ls *lease) heartbeat() {
+	defer close(ls.done)
+	ticker := time.NewTicker(ls.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ls.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := ls.leaser.RenewLease(ls.ctx, ls.key, ls.owner, ls.ttl)
+		if errors.Is(err, mongodb.ErrLeaseLost) {
+			slog.Warn("lease lost", "job", ls.key)
+			ls.cancel()
+			return
+		}
+		if err != nil && ls.ctx.Err() == nil {
+			slog.Error("error renewing lease", "job", ls.key, "error", err)
+		}
+	}
+}
+
+// lost reports whether the lease expired or was claimed by another instance.
+func (ls *lease) lost() bool {
+	return ls.ctx.Err() != nil
+}
+
+// release stops the heartbeat and releases the job, that can not be claimed again until holdUntil.
+func (ls *lease) release(ctx context.Context, holdUntil time.Time) {
+	ls.cancel()
+	<-ls.done
+
+	if err := ls.leaser.ReleaseLease(ctx, ls.key, ls.owner, holdUntil); err != nil {
+		slog.Error("error releasing lease", "job", ls.key, "error", err)
+	}
+}
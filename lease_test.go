@@ -0,0 +1,172 @@
+package newsletter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+func TestLeaseHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	ttl := time.Duration(60) * time.Millisecond
+
+	ls, err := acquireLease(ctx, s, "crawl:1", "a", ttl)
+	if err != nil || ls == nil {
+		t.Fatalf("expected lease, got %v %v", ls, err)
+	}
+
+	// The heartbeat keeps the lease alive beyond its ttl.
+	time.Sleep(3 * ttl)
+	if ls.lost() {
+		t.Fatal("unexpected lease lost")
+	}
+	other, err := acquireLease(ctx, s, "crawl:1", "b", ttl)
+	if err != nil || other != nil {
+		t.Fatalf("expected lease held by a, got %v %v", other, err)
+	}
+
+	ls.release(ctx, time.Time{})
+	other, err = acquireLease(ctx, s, "crawl:1", "b", ttl)
+	if err != nil || other == nil {
+		t.Fatalf("expected released lease, got %v %v", other, err)
+	}
+	other.release(ctx, time.Time{})
+}
+
+func TestLeaseLost(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	ttl := time.Duration(60) * time.Millisecond
+
+	ls, err := acquireLease(ctx, s, "crawl:1", "a", ttl)
+	if err != nil || ls == nil {
+		t.Fatalf("expected lease, got %v %v", ls, err)
+	}
+
+	// Another owner steals the job, as if the lease had expired.
+	if err := s.ReleaseLease(ctx, "crawl:1", "a", time.Time{}); err != nil {
+		t.Fatal("error releasing lease", err)
+	}
+	if ok, err := s.AcquireLease(ctx, "crawl:1", "b", time.Minute); !ok || err != nil {
+		t.Fatalf("expected lease, got %v %v", ok, err)
+	}
+
+	select {
+	case <-ls.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the lease context to be cancelled")
+	}
+	ls.release(ctx, time.Time{})
+
+	jobs, err := s.Jobs(ctx)
+	if err != nil {
+		t.Fatal("error getting jobs", err)
+	}
+	if len(jobs) != 1 || jobs[0].Owner != "b" {
+		t.Fatalf("expected the job to be kept by b, got %v", jobs)
+	}
+}
+
+func TestCrawlerRun_SharedLeases(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(300)*time.Millisecond)
+	defer cancel()
+	s := memory.NewStorage()
+
+	urls := []string{"http://1.test", "http://2.test", "http://3.test"}
+	for _, url := range urls {
+		if err := s.SaveEngineer(ctx, mongodb.Engineer{URL: url}); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	var mu sync.Mutex
+	inFlight := map[string]bool{}
+	fetches := map[string]int{}
+	f := func(_ context.Context, url string) (string, error) {
+		mu.Lock()
+		if inFlight[url] {
+			t.Errorf("%s fetched by two instances at the same time", url)
+		}
+		inFlight[url] = true
+		fetches[url]++
+		mu.Unlock()
+
+		time.Sleep(time.Duration(20) * time.Millisecond)
+
+		mu.Lock()
+		inFlight[url] = false
+		mu.Unlock()
+		return "Hello, World!", nil
+	}
+
+	var wg sync.WaitGroup
+	for _, owner := range []string{"a", "b"} {
+		c := NewCrawler(2, time.Duration(10)*time.Millisecond)
+		c.Scheduler.Default = time.Hour
+		c.Leaser, c.Owner = s, owner
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Run(ctx, s, f); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, url := range urls {
+		if fetches[url] != 1 {
+			t.Errorf("expected %s to be fetched once, got %d", url, fetches[url])
+		}
+	}
+}
+
+func TestEmailTrigger_SharedLeases(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}})
+	if err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	err = s.SavePage(ctx, []mongodb.Page{{URL: FakeURL, Content: "Hello, World!", IsMostRecent: true}})
+	if err != nil {
+		t.Fatal("error saving page", err)
+	}
+
+	e := &MailClientCounter{}
+	for _, owner := range []string{"a", "b", "a"} {
+		err := EmailTrigger(ctx, s, e, EmailOptions{Leaser: s, Owner: owner, Interval: time.Minute})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	if e.count() != 1 {
+		t.Fatalf("expected 1 email, got %d", e.count())
+	}
+}
+
+type MailClientCounter struct {
+	mu   sync.Mutex
+	sent int
+}
+
+func (m *MailClientCounter) Send(_ []string, _ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent++
+	return nil
+}
+
+func (m *MailClientCounter) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sent
+}
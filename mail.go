@@ -2,18 +2,34 @@ package newsletter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/perebaj/newsletter/metrics"
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/notify"
+	"github.com/perebaj/newsletter/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // SMTPServer is the SMTP server of gmail
 const SMTPServer = "smtp.gmail.com"
 
+// SMTPPort is the submission port of the SMTP server
+const SMTPPort = 587
+
 // EmailConfig contains the necessary information to authenticate in the SMTP server
 type EmailConfig struct {
 	Password string
 	Username string
+	// Host and Port locate the SMTP server, SMTPServer and SMTPPort when empty
+	Host string
+	Port int
 }
 
 // MailClient is the client that sends emails
@@ -33,47 +49,361 @@ type Email interface {
 	Send(dest []string, bodyMessage string) error
 }
 
+// Message is an email rendered for a newsletter
+type Message struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+	// URLs are the URLs with new articles
+	URLs []string `json:"urls,omitempty"`
+}
+
+// NewMessage returns the message sent to dest with the given body
+func NewMessage(dest []string, bodyMessage string) Message {
+	return Message{To: dest, Subject: "Newsletter", Body: bodyMessage}
+}
+
+// Bytes returns the message as it is sent to the SMTP server
+func (m Message) Bytes() []byte {
+	return []byte("To: " + m.To[0] + "\r\n" +
+		"Subject: " + m.Subject + "\r\n" +
+		"\r\n" +
+		m.Body + "\r\n")
+}
+
+// server returns the host and the address of the SMTP server
+func (m MailClient) server() (string, string) {
+	host, port := m.cfg.Host, m.cfg.Port
+	if host == "" {
+		host = SMTPServer
+	}
+	if port == 0 {
+		port = SMTPPort
+	}
+	return host, net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // Send sends an email to the given destination
 func (m MailClient) Send(dest []string, bodyMessage string) error {
-	auth := smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, SMTPServer)
+	host, addr := m.server()
+	auth := smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
 
-	msg := []byte("To: " + dest[0] + "\r\n" +
-		"Subject: Newsletter\r\n" +
-		"\r\n" +
-		bodyMessage + "\r\n")
+	msg := NewMessage(dest, bodyMessage).Bytes()
 
-	err := smtp.SendMail(SMTPServer+":587", auth, m.cfg.Username, dest, []byte(msg))
+	err := smtp.SendMail(addr, auth, m.cfg.Username, dest, msg)
 	if err != nil {
 		return fmt.Errorf("error sending email: %v", err)
 	}
 	return nil
 }
 
-// EmailTrigger get all newsletters and send an email to the user with new articles were found
-func EmailTrigger(ctx context.Context, s Storage, e Email) error {
-	nl, err := s.Newsletter()
+// Ping checks that the SMTP server is reachable and greets, without authenticating
+func (m MailClient) Ping(ctx context.Context) error {
+	host, addr := m.server()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return fmt.Errorf("error getting newsletter: %v", err)
+		return fmt.Errorf("error greeting SMTP server: %v", err)
+	}
+	return c.Quit()
+}
+
+// DefaultEmailBatchSize is the number of newsletters loaded at once by EmailTrigger
+const DefaultEmailBatchSize = 100
+
+// EmailOptions are the settings of EmailTrigger
+type EmailOptions struct {
+	// BatchSize is the number of newsletters loaded at once, DefaultEmailBatchSize when zero
+	BatchSize int
+	// Leaser, when set, leases every newsletter before sending it, so several instances can run EmailTrigger
+	// without sending the same email twice. Owner identifies this instance and LeaseTTL is the lease duration,
+	// DefaultLeaseTTL when zero.
+	Leaser   Leaser
+	Owner    string
+	LeaseTTL time.Duration
+	// Interval is how long a sent newsletter is held, by every instance, before it can be sent again
+	Interval time.Duration
+	// DryRun renders the emails to the Email without leasing or holding the newsletters, so the delivery state
+	// is not touched. It is meant for Email implementations that preview the emails, like WriterEmail and DirEmail.
+	// The channels of the newsletters are ignored, every newsletter is rendered as an email to its user.
+	DryRun bool
+	// Notifiers deliver the newsletters to their channels other than email, by channel type
+	Notifiers map[string]notify.Notifier
+}
+
+// EmailTrigger iterates over all newsletters, in batches, and send an email to the user with new articles were found.
+// It stops when the context is cancelled, returning the context error.
+func EmailTrigger(ctx context.Context, s Storage, e Email, opts EmailOptions) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultEmailBatchSize
+	}
+	if opts.LeaseTTL <= 0 {
+		opts.LeaseTTL = DefaultLeaseTTL
+	}
+
+	notifiers := map[string]notify.Notifier{ChannelEmail: emailNotifier{e}}
+	for t, n := range opts.Notifiers {
+		if t != ChannelEmail {
+			notifiers[t] = n
+		}
 	}
 
-	for _, n := range nl {
-		pages, err := s.PageIn(ctx, n.URLs)
+	var after string
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		nl, err := s.Newsletter(ctx, after, opts.BatchSize)
 		if err != nil {
-			slog.Error("error getting pages", "error", err)
+			return fmt.Errorf("error getting newsletter: %v", err)
 		}
-		var validURLS []string
-		for _, p := range pages {
-			if p.IsMostRecent {
-				validURLS = append(validURLS, p.URL)
+
+		for _, n := range nl {
+			if opts.DryRun {
+				n.Channels = nil
 			}
-		}
-		if len(validURLS) > 0 {
-			err = e.Send([]string{n.UserEmail}, fmt.Sprintf("Hi %s, \n\nWe have found %d new articles for you: \n\n%s", n.UserEmail, len(validURLS), validURLS))
-			if err != nil {
-				slog.Error("error sending email", "error", err)
+			if opts.Leaser == nil || opts.DryRun {
+				sent, err := sendNewsletter(ctx, s, notifiers, n)
+				// A dry run renders the emails without sending them.
+				if !opts.DryRun {
+					recordEmail(sent, err)
+					if sent {
+						markSent(ctx, s, n)
+					}
+				}
+				continue
+			}
+			if err := sendLeasedNewsletter(ctx, s, notifiers, n, opts); err != nil {
+				slog.Error("error leasing newsletter", "user", n.UserEmail, "error", err)
 			}
 		}
+
+		if len(nl) < opts.BatchSize {
+			return nil
+		}
+		after = nl[len(nl)-1].UserEmail
 	}
+}
 
+// sendLeasedNewsletter sends the newsletter while holding its lease, skipping it when another instance holds it.
+// Once sent to any of its channels, the newsletter is held for the interval.
+func sendLeasedNewsletter(ctx context.Context, s Storage, notifiers map[string]notify.Notifier, n mongodb.Newsletter, opts EmailOptions) error {
+	ls, err := acquireLease(ctx, opts.Leaser, "email:"+n.UserEmail, opts.Owner, opts.LeaseTTL)
+	if err != nil {
+		return err
+	}
+	if ls == nil {
+		slog.DebugContext(ctx, "newsletter sent by another instance", "user", n.UserEmail)
+		return nil
+	}
+
+	var holdUntil time.Time
+	sent, err := sendNewsletter(ls.ctx, s, notifiers, n)
+	recordEmail(sent, err)
+	if sent {
+		holdUntil = time.Now().Add(opts.Interval)
+		markSent(ls.ctx, s, n)
+	}
+	ls.release(context.WithoutCancel(ctx), holdUntil)
 	return nil
 }
+
+// SentRecorder records when the newsletters with a cadence are sent, which the next digest waits from.
+// Storages without it send the newsletters with a cadence as soon as there are changes.
+type SentRecorder interface {
+	MarkNewsletterSent(ctx context.Context, userEmail string, at time.Time) error
+}
+
+// markSent records that the newsletter was sent when it has a cadence
+func markSent(ctx context.Context, s Storage, n mongodb.Newsletter) {
+	r, ok := s.(SentRecorder)
+	if !ok || n.Cadence == "" {
+		return
+	}
+	if err := r.MarkNewsletterSent(ctx, n.UserEmail, time.Now().UTC()); err != nil {
+		slog.ErrorContext(ctx, "error marking newsletter sent", "user", n.UserEmail, "error", err)
+	}
+}
+
+// recordEmail counts the result of sendNewsletter in the metrics
+func recordEmail(sent bool, err error) {
+	switch {
+	case err != nil:
+		metrics.EmailsFailed.Inc()
+	case sent:
+		metrics.EmailsSent.Inc()
+	}
+}
+
+// sendNewsletter sends the newsletter to every channel of its user if any of its urls has new articles,
+// reporting whether any channel got it. The error joins the errors of the channels that failed.
+//
+// A newsletter sent to some of its channels counts as sent, so it is not sent again to the channels that got it. The
+// channels that failed miss it, their errors are logged and counted.
+func sendNewsletter(ctx context.Context, s Storage, notifiers map[string]notify.Notifier, n mongodb.Newsletter) (sent bool, err error) {
+	ctx, span := tracing.Start(ctx, "email.newsletter", attribute.String("user", n.UserEmail))
+	defer func() { tracing.End(span, err) }()
+
+	msg, ok := renderNewsletter(ctx, s, n)
+	span.SetAttributes(attribute.Bool("email.pending", ok))
+	if !ok {
+		return false, nil
+	}
+
+	channels := n.Channels
+	if len(channels) == 0 {
+		channels = []mongodb.Channel{{Type: ChannelEmail, Address: n.UserEmail}}
+	}
+
+	var errs []error
+	for _, ch := range channels {
+		if err := notifyChannel(ctx, notifiers, ch, msg); err != nil {
+			slog.ErrorContext(ctx, "error sending newsletter", "channel", ch.Type, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		sent = true
+	}
+	return sent, errors.Join(errs...)
+}
+
+// notifyChannel delivers the message to the channel with the notifier of its type
+func notifyChannel(ctx context.Context, notifiers map[string]notify.Notifier, ch mongodb.Channel, msg Message) (err error) {
+	// The emails keep the span name of the mail client, whatever the Email implementation.
+	name := "Notifier.Notify"
+	if ch.Type == ChannelEmail {
+		name = "MailClient.Send"
+	}
+	ctx, span := tracing.Start(ctx, name, attribute.String("channel", ch.Type))
+	defer func() { tracing.End(span, err) }()
+
+	n, ok := notifiers[ch.Type]
+	if !ok {
+		return fmt.Errorf("no notifier for channel %s", ch.Type)
+	}
+	// Every webhook channel is signed with its own secret, so its receiver cannot forge the requests of the others.
+	if w, ok := n.(notify.Webhook); ok && ch.Type == ChannelWebhook {
+		w.Secret = ch.Secret
+		n = w
+	}
+	return n.Notify(ctx, ch.Address, notify.Message{Subject: msg.Subject, Body: msg.Body, URLs: msg.URLs})
+}
+
+// renderNewsletter renders the email of the newsletter, returning false when none of its urls has new articles
+// passing its filters. The newsletters with a cadence are rendered as digests of the changes since the last one.
+func renderNewsletter(ctx context.Context, s Storage, n mongodb.Newsletter) (Message, bool) {
+	var validURLS []string
+	interval := cadenceOf(ctx, n)
+	if _, ok := s.(SentRecorder); ok && interval > 0 {
+		validURLS = digestURLs(ctx, s, n, interval)
+	} else {
+		validURLS = changedURLs(ctx, s, n)
+	}
+	if len(validURLS) == 0 {
+		return Message{}, false
+	}
+
+	msg := NewMessage([]string{n.UserEmail}, fmt.Sprintf("Hi %s, \n\nWe have found %d new articles for you: \n\n%s", n.UserEmail, len(validURLS), validURLS))
+	msg.URLs = validURLS
+	return msg, true
+}
+
+// changedURLs returns the urls of the newsletter whose last crawl found a change passing its filters
+func changedURLs(ctx context.Context, s Storage, n mongodb.Newsletter) []string {
+	filters := newsletterFilters(ctx, n)
+	spanCtx, span := tracing.Start(ctx, "storage.PageIn", attribute.Int("urls", len(n.URLs)))
+	pages, err := s.PageIn(spanCtx, n.URLs)
+	tracing.End(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "error getting pages", "error", err)
+	}
+	var urls []string
+	for _, p := range pages {
+		if p.IsMostRecent && passesFilters(ctx, s, filters, p) {
+			urls = append(urls, p.URL)
+		}
+	}
+	return urls
+}
+
+// Cadences of the newsletters sent as digests
+const (
+	CadenceDaily  = "daily"
+	CadenceWeekly = "weekly"
+)
+
+// Cadences are the known cadences, the empty one sends the newsletters as soon as there are changes
+var Cadences = []string{"", CadenceDaily, CadenceWeekly}
+
+// digestHistory bounds the versions of a page a digest looks for changes in
+const digestHistory = 200
+
+// CadenceInterval returns the time between two digests of the cadence, zero for the empty cadence
+func CadenceInterval(cadence string) (time.Duration, error) {
+	switch cadence {
+	case "":
+		return 0, nil
+	case CadenceDaily:
+		return 24 * time.Hour, nil
+	case CadenceWeekly:
+		return 7 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown cadence %q, expected %s or %s", cadence, CadenceDaily, CadenceWeekly)
+}
+
+// cadenceOf returns the interval of the cadence of the newsletter, sending the newsletters of unknown cadences as
+// soon as there are changes
+func cadenceOf(ctx context.Context, n mongodb.Newsletter) time.Duration {
+	interval, err := CadenceInterval(n.Cadence)
+	if err != nil {
+		slog.WarnContext(ctx, "invalid newsletter cadence", "user", n.UserEmail, "error", err)
+	}
+	return interval
+}
+
+// digestURLs returns the urls of the newsletter that changed, passing its filters, since it was last sent, or during
+// the last interval when it was never sent. It returns none before the interval elapsed since the last digest.
+func digestURLs(ctx context.Context, s Storage, n mongodb.Newsletter, interval time.Duration) []string {
+	now := time.Now()
+	if !n.LastSent.IsZero() && now.Before(n.LastSent.Add(interval)) {
+		return nil
+	}
+	since := n.LastSent
+	if since.IsZero() {
+		since = now.Add(-interval)
+	}
+	filters := newsletterFilters(ctx, n)
+
+	var urls []string
+	for _, u := range n.URLs {
+		if contains(urls, u) {
+			continue
+		}
+		history, err := s.PageHistory(ctx, u, digestHistory)
+		if err != nil {
+			slog.ErrorContext(ctx, "error getting page history", "url", u, "error", err)
+			continue
+		}
+		for i, p := range history {
+			if !p.ScrapeDatetime.After(since) {
+				break
+			}
+			if p.IsMostRecent && matchChange(filters, history, i) {
+				urls = append(urls, u)
+				break
+			}
+		}
+	}
+	return urls
+}
@@ -2,7 +2,18 @@ package newsletter
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/metrics"
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type MailClientMockImpl struct{}
@@ -13,8 +24,151 @@ func TestEmailTrigger(t *testing.T) {
 	ctx := context.Background()
 	s := NewStorageMock()
 	e := MailClientMockImpl{}
-	err := EmailTrigger(ctx, s, e)
+	err := EmailTrigger(ctx, s, e, EmailOptions{})
 	if err != nil {
 		t.Errorf("expected nil, got %v", err)
 	}
 }
+
+func TestEmailTrigger_Batches(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	for _, email := range []string{"a@gmail.com", "b@gmail.com", "c@gmail.com", "d@gmail.com", "e@gmail.com"} {
+		err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: email, URLs: []string{FakeURL}})
+		if err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+	err := s.SavePage(ctx, []mongodb.Page{{URL: FakeURL, Content: "Hello, World!", IsMostRecent: true}})
+	if err != nil {
+		t.Fatal("error saving page", err)
+	}
+
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, EmailOptions{BatchSize: 2}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if len(e.sent) != 5 {
+		t.Fatalf("expected 5 emails, got %d", len(e.sent))
+	}
+}
+
+func TestEmailTrigger_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := EmailTrigger(ctx, NewStorageMock(), MailClientMockImpl{}, EmailOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+type MailClientRecorder struct {
+	mu   sync.Mutex
+	sent map[string]string
+}
+
+func (m *MailClientRecorder) Send(dest []string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sent == nil {
+		m.sent = map[string]string{}
+	}
+	m.sent[dest[0]] = body
+	return nil
+}
+
+func TestEmailTrigger_MemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}})
+	if err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	err = s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: "k@gmail.com", URLs: []string{"http://unchanged.test"}})
+	if err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+
+	err = s.SavePage(ctx, []mongodb.Page{
+		{URL: FakeURL, Content: "Hello, World!", IsMostRecent: true, ScrapeDatetime: time.Now().UTC()},
+		{URL: "http://unchanged.test", Content: "Hello, World!", IsMostRecent: false, ScrapeDatetime: time.Now().UTC()},
+	})
+	if err != nil {
+		t.Fatal("error saving pages", err)
+	}
+
+	e := &MailClientRecorder{}
+	if err := EmailTrigger(ctx, s, e, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if len(e.sent) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(e.sent))
+	}
+	if !strings.Contains(e.sent["j@gmail.com"], FakeURL) {
+		t.Errorf("expected email to j@gmail.com mentioning %s, got %q", FakeURL, e.sent["j@gmail.com"])
+	}
+}
+
+func TestEmailTrigger_Metrics(t *testing.T) {
+	ctx := context.Background()
+	s := newPreviewStorage(ctx, t)
+	sent, failed := testutil.ToFloat64(metrics.EmailsSent), testutil.ToFloat64(metrics.EmailsFailed)
+
+	if err := EmailTrigger(ctx, s, &MailClientRecorder{}, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := EmailTrigger(ctx, s, MailClientErrorMock{}, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// A dry run is not counted.
+	if err := EmailTrigger(ctx, s, &MailClientRecorder{}, EmailOptions{DryRun: true}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.EmailsSent) - sent; got != 1 {
+		t.Errorf("got %v emails sent, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.EmailsFailed) - failed; got != 1 {
+		t.Errorf("got %v emails failed, want 1", got)
+	}
+}
+
+type MailClientErrorMock struct{}
+
+func (m MailClientErrorMock) Send(_ []string, _ string) error { return errors.New("smtp down") }
+
+func TestEmailTrigger_Spans(t *testing.T) {
+	rec := recordSpans(t)
+	ctx := context.Background()
+	s := newPreviewStorage(ctx, t)
+
+	if err := EmailTrigger(ctx, s, MailClientErrorMock{}, EmailOptions{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// Every newsletter has its own trace, only j@gmail.com has an email to send.
+	spans := rec.Ended()
+	var got []string
+	for _, names := range spanNames(spans) {
+		got = append(got, strings.Join(names, " "))
+	}
+	sort.Strings(got)
+	want := []string{
+		"storage.PageIn MailClient.Send email.newsletter",
+		"storage.PageIn email.newsletter",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected traces %q, got %q", want, got)
+	}
+
+	for _, span := range spans {
+		if span.Name() == "MailClient.Send" && span.Status().Code != codes.Error {
+			t.Errorf("expected the failed send to be an error, got %v", span.Status())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// SaveAPIKey saves an API key, replacing the key with the same ID
+func (s *Storage) SaveAPIKey(ctx context.Context, k mongodb.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.apiKeys == nil {
+		s.apiKeys = make(map[string]mongodb.APIKey)
+	}
+	if before, ok := s.apiKeys[k.ID]; ok {
+		s.record(ctx, mongodb.ActionAPIKeySave, k.ID, before, k)
+	} else {
+		s.record(ctx, mongodb.ActionAPIKeySave, k.ID, nil, k)
+	}
+	s.apiKeys[k.ID] = k
+	return nil
+}
+
+// APIKeys returns all the API keys, revoked or not, sorted by creation time
+func (s *Storage) APIKeys(_ context.Context) ([]mongodb.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]mongodb.APIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// APIKeyByHash returns the API key of the hash, mongodb.ErrNotFound when there is none
+func (s *Storage) APIKeyByHash(_ context.Context, hash string) (mongodb.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, k := range s.apiKeys {
+		if k.Hash == hash {
+			return k, nil
+		}
+	}
+	return mongodb.APIKey{}, mongodb.ErrNotFound
+}
+
+// RevokeAPIKey revokes the API key of the ID at the given time, keeping the time of a key already revoked.
+// It returns mongodb.ErrNotFound when there is no such key.
+func (s *Storage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, ok := s.apiKeys[id]
+	if !ok {
+		return mongodb.ErrNotFound
+	}
+	k := before
+	if k.RevokedAt.IsZero() {
+		k.RevokedAt = at
+		s.apiKeys[id] = k
+	}
+	s.record(ctx, mongodb.ActionAPIKeyRevoke, id, before, k)
+	return nil
+}
+
+// SaveKeyUsage records a request authenticated by an API key
+func (s *Storage) SaveKeyUsage(_ context.Context, u mongodb.KeyUsage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyUsage = append(s.keyUsage, u)
+	return nil
+}
+
+// KeyUsage returns the latest requests authenticated by the API key of the ID, newest first, of all the keys when
+// the ID is empty. A limit of zero returns all of them.
+func (s *Storage) KeyUsage(_ context.Context, keyID string, limit int) ([]mongodb.KeyUsage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var usage []mongodb.KeyUsage
+	for i := len(s.keyUsage) - 1; i >= 0; i-- {
+		if u := s.keyUsage[i]; keyID == "" || u.KeyID == keyID {
+			usage = append(usage, u)
+		}
+	}
+	sort.SliceStable(usage, func(i, j int) bool { return usage[i].At.After(usage[j].At) })
+	if limit > 0 && len(usage) > limit {
+		usage = usage[:limit]
+	}
+	return usage, nil
+}
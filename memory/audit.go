@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// record appends the entry of a change made with ctx to the audit log, s.mu must be held
+func (s *Storage) record(ctx context.Context, action, target string, before, after interface{}) {
+	s.audit = append(s.audit, mongodb.NewAuditEntry(ctx, action, target, before, after))
+}
+
+// AuditLog returns the entries of the query, newest first. A limit of zero returns all of them.
+func (s *Storage) AuditLog(_ context.Context, q mongodb.AuditQuery) ([]mongodb.AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// The entries are recorded in order, so the newest is last.
+	var entries []mongodb.AuditEntry
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(entries) == q.Limit {
+			break
+		}
+		if q.Match(s.audit[i]) {
+			entries = append(entries, s.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+// AuditMentioning returns the entries that Mention the email, newest first
+func (s *Storage) AuditMentioning(_ context.Context, userEmail string) ([]mongodb.AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []mongodb.AuditEntry
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if s.audit[i].Mentions(userEmail) {
+			entries = append(entries, s.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+// ForgetSubscriber removes the traces of the subscriber left beyond its subscription and webhooks: the lease of its
+// emails, and its email in the audit log, replaced by alias, along with the snapshots of the entries that held it.
+// It returns the number of entries anonymized.
+func (s *Storage) ForgetSubscriber(_ context.Context, userEmail, alias string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, "email:"+userEmail)
+	var n int
+	for i, e := range s.audit {
+		if !e.Mentions(userEmail) {
+			continue
+		}
+		if e.Target == userEmail {
+			e.Target = alias
+		}
+		if e.Actor == "subscriber:"+userEmail {
+			e.Actor = "subscriber:" + alias
+		}
+		e.Before, e.After = nil, nil
+		s.audit[i] = e
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,81 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// AcquireLeadership makes holder the leader of name during ttl, when there is no leader, the leadership expired, or
+// holder is already the leader. It returns the token of the term and false when another holder leads.
+func (s *Storage) AcquireLeadership(_ context.Context, name, holder string, ttl time.Duration) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	l, ok := s.leaders[name]
+	if ok && l.ExpiresAt.After(now) && l.Holder != holder {
+		return 0, false, nil
+	}
+
+	if l.Holder != holder {
+		l.Token++
+	}
+	l.Name = name
+	l.Holder = holder
+	l.ExpiresAt = now.Add(ttl)
+
+	if s.leaders == nil {
+		s.leaders = make(map[string]mongodb.Leadership)
+	}
+	s.leaders[name] = l
+	return l.Token, true, nil
+}
+
+// RenewLeadership extends the term of holder by ttl, returning mongodb.ErrLeaseLost if holder is not the leader of the term anymore
+func (s *Storage) RenewLeadership(_ context.Context, name, holder string, token int64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	l, ok := s.leaders[name]
+	if !ok || l.Holder != holder || l.Token != token || !l.ExpiresAt.After(now) {
+		return mongodb.ErrLeaseLost
+	}
+
+	l.ExpiresAt = now.Add(ttl)
+	s.leaders[name] = l
+	return nil
+}
+
+// ResignLeadership ends the term of holder, so another holder can lead right away
+func (s *Storage) ResignLeadership(_ context.Context, name, holder string, token int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.leaders[name]
+	if !ok || l.Holder != holder || l.Token != token {
+		return nil
+	}
+
+	l.Holder = ""
+	l.ExpiresAt = time.Now().UTC()
+	s.leaders[name] = l
+	return nil
+}
+
+// Leader returns the current leadership of name, with an empty holder when nobody leads
+func (s *Storage) Leader(_ context.Context, name string) (mongodb.Leadership, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.leaders[name]
+	if !ok {
+		return mongodb.Leadership{Name: name}, nil
+	}
+	if !l.ExpiresAt.After(time.Now()) {
+		l.Holder = ""
+	}
+	return l, nil
+}
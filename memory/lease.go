@@ -0,0 +1,86 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// AcquireLease claims the job key for owner during ttl. It succeeds when the job does not exist, its lease expired,
+// or owner already holds it, and returns false when another owner holds it.
+func (s *Storage) AcquireLease(_ context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	job, ok := s.jobs[key]
+	if ok && job.LeaseUntil.After(now) && job.Owner != owner {
+		return false, nil
+	}
+
+	if s.jobs == nil {
+		s.jobs = make(map[string]mongodb.Job)
+	}
+	s.jobs[key] = mongodb.Job{
+		Key:         key,
+		Owner:       owner,
+		LeaseUntil:  now.Add(ttl),
+		HeartbeatAt: now,
+		Attempts:    job.Attempts + 1,
+	}
+	return true, nil
+}
+
+// RenewLease extends the lease of owner on the job key by ttl, returning mongodb.ErrLeaseLost if owner does not hold it anymore
+func (s *Storage) RenewLease(_ context.Context, key, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	job, ok := s.jobs[key]
+	if !ok || job.Owner != owner || !job.LeaseUntil.After(now) {
+		return mongodb.ErrLeaseLost
+	}
+
+	job.LeaseUntil = now.Add(ttl)
+	job.HeartbeatAt = now
+	s.jobs[key] = job
+	return nil
+}
+
+// ReleaseLease releases the lease of owner on the job key. The job can not be claimed by anyone until holdUntil,
+// a zero holdUntil frees it immediately.
+func (s *Storage) ReleaseLease(_ context.Context, key, owner string, holdUntil time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[key]
+	if !ok || job.Owner != owner {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if holdUntil.Before(now) {
+		holdUntil = now
+	}
+	job.Owner = ""
+	job.LeaseUntil = holdUntil.UTC()
+	job.Attempts = 0
+	s.jobs[key] = job
+	return nil
+}
+
+// Jobs returns all the jobs sorted by key
+func (s *Storage) Jobs(_ context.Context) ([]mongodb.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := make([]mongodb.Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Key < jobs[j].Key })
+	return jobs, nil
+}
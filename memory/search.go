@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// SearchPages returns the versions of the pages that changed matching the query, the most relevant first and then
+// the newest first. Unlike the text index of MongoDB, the words are matched as they are, without stemming.
+func (s *Storage) SearchPages(_ context.Context, q mongodb.PageQuery) ([]mongodb.Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := strings.Fields(strings.ToLower(q.Text))
+	type match struct {
+		page  mongodb.Page
+		score int
+	}
+	var matches []match
+	for _, p := range s.pages {
+		if !p.IsMostRecent || (len(q.URLs) > 0 && !contains(q.URLs, p.URL)) {
+			continue
+		}
+		if (!q.From.IsZero() && p.ScrapeDatetime.Before(q.From)) || (!q.To.IsZero() && p.ScrapeDatetime.After(q.To)) {
+			continue
+		}
+
+		score := 0
+		words := strings.Fields(strings.ToLower(p.Text))
+		for _, term := range terms {
+			for _, w := range words {
+				if strings.Trim(w, ".,;:!?\"'()[]") == term {
+					score++
+				}
+			}
+		}
+		if len(terms) > 0 && score == 0 {
+			continue
+		}
+		p.Content = ""
+		matches = append(matches, match{p, score})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].page.ScrapeDatetime.After(matches[j].page.ScrapeDatetime)
+	})
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	pages := make([]mongodb.Page, len(matches))
+	for i, m := range matches {
+		pages[i] = m.page
+	}
+	return pages, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, got := range values {
+		if got == v {
+			return true
+		}
+	}
+	return false
+}
+
+// PageVersion returns the version of the page of the url scraped at, mongodb.ErrNotFound when there is none
+func (s *Storage) PageVersion(_ context.Context, url string, at time.Time) (mongodb.Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.pages {
+		if p.URL == url && p.ScrapeDatetime.Equal(at) {
+			return p, nil
+		}
+	}
+	return mongodb.Page{}, mongodb.ErrNotFound
+}
@@ -0,0 +1,385 @@
+// Package memory provides an in-memory storage, useful for tests and local runs without MongoDB.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Storage keeps engineers, newsletters, pages, schedules, job leases, leaderships, webhooks and their deliveries, API
+// keys and their usage, and the audit log in memory. It is safe for concurrent use.
+type Storage struct {
+	mu          sync.RWMutex
+	engineers   []mongodb.Engineer
+	newsletters []mongodb.Newsletter
+	pages       []mongodb.Page
+	schedules   map[string]mongodb.Schedule
+	jobs        map[string]mongodb.Job
+	leaders     map[string]mongodb.Leadership
+	webhooks    map[string]mongodb.Webhook
+	deliveries  map[string]mongodb.Delivery
+	apiKeys     map[string]mongodb.APIKey
+	keyUsage    []mongodb.KeyUsage
+	audit       []mongodb.AuditEntry
+}
+
+// NewStorage initializes a new empty Storage
+func NewStorage() *Storage {
+	return &Storage{}
+}
+
+// SaveNewsletter saves a newsletter, returning an error if the user email already has one
+func (s *Storage) SaveNewsletter(ctx context.Context, n mongodb.Newsletter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, got := range s.newsletters {
+		if got.UserEmail == n.UserEmail {
+			return fmt.Errorf("newsletter already exists: %s", n.UserEmail)
+		}
+	}
+	s.newsletters = append(s.newsletters, cloneNewsletter(n))
+	s.record(ctx, mongodb.ActionNewsletterSave, n.UserEmail, nil, n)
+	return nil
+}
+
+// UpdateNewsletter replaces the URLs, channels, filters and cadence of the newsletter of the same user, keeping when
+// it was last sent. It returns ErrNotFound when there is none.
+func (s *Storage) UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, got := range s.newsletters {
+		if got.UserEmail == n.UserEmail {
+			n.LastSent = got.LastSent
+			s.newsletters[i] = cloneNewsletter(n)
+			s.record(ctx, mongodb.ActionNewsletterUpdate, n.UserEmail, got, n)
+			return nil
+		}
+	}
+	return mongodb.ErrNotFound
+}
+
+// MarkNewsletterSent records when the newsletter of the user was sent, ErrNotFound when there is none
+func (s *Storage) MarkNewsletterSent(_ context.Context, userEmail string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, got := range s.newsletters {
+		if got.UserEmail == userEmail {
+			s.newsletters[i].LastSent = at
+			return nil
+		}
+	}
+	return mongodb.ErrNotFound
+}
+
+// cloneNewsletter returns a copy of n that shares none of its slices
+func cloneNewsletter(n mongodb.Newsletter) mongodb.Newsletter {
+	n.URLs = append([]string(nil), n.URLs...)
+	n.Channels = append([]mongodb.Channel(nil), n.Channels...)
+	filters := n.Filters
+	n.Filters = nil
+	for _, f := range filters {
+		f.Include = append([]string(nil), f.Include...)
+		f.Exclude = append([]string(nil), f.Exclude...)
+		n.Filters = append(n.Filters, f)
+	}
+	return n
+}
+
+// SaveEngineer saves an engineer, replacing the engineer that has the same URL
+func (s *Storage) SaveEngineer(ctx context.Context, e mongodb.Engineer) error {
+	if err := mongodb.ValidateSchedule(e.Schedule); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, got := range s.engineers {
+		if got.URL == e.URL {
+			s.engineers[i] = e
+			s.record(ctx, mongodb.ActionEngineerSave, e.URL, got, e)
+			return nil
+		}
+	}
+	s.engineers = append(s.engineers, e)
+	s.record(ctx, mongodb.ActionEngineerSave, e.URL, nil, e)
+	return nil
+}
+
+// DeleteEngineer deletes the engineer of the URL and its crawl schedule, keeping the scraped pages
+func (s *Storage) DeleteEngineer(ctx context.Context, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, got := range s.engineers {
+		if got.URL == url {
+			s.engineers = append(s.engineers[:i], s.engineers[i+1:]...)
+			delete(s.schedules, url)
+			s.record(ctx, mongodb.ActionEngineerDelete, url, got, nil)
+			return nil
+		}
+	}
+	return mongodb.ErrNotFound
+}
+
+// DeleteNewsletter deletes the newsletter of the user email
+func (s *Storage) DeleteNewsletter(ctx context.Context, userEmail string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, got := range s.newsletters {
+		if got.UserEmail == userEmail {
+			s.newsletters = append(s.newsletters[:i], s.newsletters[i+1:]...)
+			s.record(ctx, mongodb.ActionNewsletterDelete, userEmail, got, nil)
+			return nil
+		}
+	}
+	return mongodb.ErrNotFound
+}
+
+// DistinctEngineerURLs returns all url sites of each distinct engineer, sorted
+func (s *Storage) DistinctEngineerURLs(_ context.Context) ([]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	urls := make([]string, 0, len(s.engineers))
+	for _, e := range s.engineers {
+		urls = append(urls, e.URL)
+	}
+	sort.Strings(urls)
+
+	resp := make([]interface{}, 0, len(urls))
+	for _, url := range urls {
+		resp = append(resp, url)
+	}
+	return resp, nil
+}
+
+// Engineer returns the engineer of the URL, mongodb.ErrNotFound when there is none
+func (s *Storage) Engineer(_ context.Context, url string) (mongodb.Engineer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, e := range s.engineers {
+		if e.URL == url {
+			return e, nil
+		}
+	}
+	return mongodb.Engineer{}, mongodb.ErrNotFound
+}
+
+// Engineers returns all the engineers sorted by URL
+func (s *Storage) Engineers(_ context.Context) ([]mongodb.Engineer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	engineers := append([]mongodb.Engineer(nil), s.engineers...)
+	sort.Slice(engineers, func(i, j int) bool { return engineers[i].URL < engineers[j].URL })
+	return engineers, nil
+}
+
+// Newsletter returns up to limit newsletters, sorted by user email, whose user email comes after the given one.
+// A limit less than or equal to zero returns all the remaining newsletters.
+func (s *Storage) Newsletter(ctx context.Context, after string, limit int) ([]mongodb.Newsletter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var newsletters []mongodb.Newsletter
+	for _, n := range s.newsletters {
+		if n.UserEmail <= after {
+			continue
+		}
+		newsletters = append(newsletters, cloneNewsletter(n))
+	}
+
+	sort.Slice(newsletters, func(i, j int) bool { return newsletters[i].UserEmail < newsletters[j].UserEmail })
+	if limit > 0 && len(newsletters) > limit {
+		newsletters = newsletters[:limit]
+	}
+	return newsletters, nil
+}
+
+// Subscription returns the newsletter of the user email, mongodb.ErrNotFound when there is none
+func (s *Storage) Subscription(_ context.Context, userEmail string) (mongodb.Newsletter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, n := range s.newsletters {
+		if n.UserEmail == userEmail {
+			return cloneNewsletter(n), nil
+		}
+	}
+	return mongodb.Newsletter{}, mongodb.ErrNotFound
+}
+
+// SavePage saves the scraped content of a website
+func (s *Storage) SavePage(_ context.Context, pages []mongodb.Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pages = append(s.pages, pages...)
+	return nil
+}
+
+// PageIn returns the last scraped content of a given list of urls
+func (s *Storage) PageIn(_ context.Context, urls []string) ([]mongodb.Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pages []mongodb.Page
+	seen := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		if p, ok := s.lastPage(url); ok {
+			pages = append(pages, p)
+		}
+	}
+	return pages, nil
+}
+
+// Page returns the last scraped content of a given url
+func (s *Storage) Page(_ context.Context, url string) ([]mongodb.Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if p, ok := s.lastPage(url); ok {
+		return []mongodb.Page{p}, nil
+	}
+	return []mongodb.Page{}, nil
+}
+
+// PageHistory returns up to limit scraped versions of a given url, from the newest to the oldest.
+// A limit less than or equal to zero returns all the versions.
+func (s *Storage) PageHistory(_ context.Context, url string, limit int) ([]mongodb.Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pages []mongodb.Page
+	for _, p := range s.pages {
+		if p.URL == url {
+			pages = append(pages, p)
+		}
+	}
+
+	sort.SliceStable(pages, func(i, j int) bool { return pages[i].ScrapeDatetime.After(pages[j].ScrapeDatetime) })
+	if limit > 0 && len(pages) > limit {
+		pages = pages[:limit]
+	}
+	return pages, nil
+}
+
+// PageChanges returns up to limit versions of the url that changed the page, the newest first, without their text.
+// A limit less than or equal to zero returns all of them.
+func (s *Storage) PageChanges(ctx context.Context, url string, limit int) ([]mongodb.Page, error) {
+	history, err := s.PageHistory(ctx, url, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []mongodb.Page
+	for _, p := range history {
+		if !p.IsMostRecent {
+			continue
+		}
+		p.Text = ""
+		pages = append(pages, p)
+		if len(pages) == limit {
+			break
+		}
+	}
+	return pages, nil
+}
+
+// lastPage returns the most recently scraped version of url. The caller must hold the lock.
+func (s *Storage) lastPage(url string) (mongodb.Page, bool) {
+	var last mongodb.Page
+	var found bool
+	for _, p := range s.pages {
+		if p.URL != url {
+			continue
+		}
+		if !found || p.ScrapeDatetime.After(last.ScrapeDatetime) {
+			last = p
+			found = true
+		}
+	}
+	return last, found
+}
+
+// DeletePagesBefore deletes the versions of the pages scraped before the given time, always keeping the last
+// version of every url, that the next crawl is compared with. It returns the number of deleted versions.
+func (s *Storage) DeletePagesBefore(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := make(map[string]int)
+	for i, p := range s.pages {
+		j, ok := last[p.URL]
+		if !ok || p.ScrapeDatetime.After(s.pages[j].ScrapeDatetime) {
+			last[p.URL] = i
+		}
+	}
+
+	kept := s.pages[:0]
+	var deleted int64
+	for i, p := range s.pages {
+		if p.ScrapeDatetime.Before(before) && last[p.URL] != i {
+			deleted++
+			continue
+		}
+		kept = append(kept, p)
+	}
+	s.pages = kept
+	return deleted, nil
+}
+
+// SaveSchedule saves the schedule of an URL, replacing the previous one
+func (s *Storage) SaveSchedule(_ context.Context, sch mongodb.Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.schedules == nil {
+		s.schedules = make(map[string]mongodb.Schedule)
+	}
+	s.schedules[sch.URL] = sch
+	return nil
+}
+
+// Schedule returns the schedule of the URL, mongodb.ErrNotFound when it was never scheduled
+func (s *Storage) Schedule(_ context.Context, url string) (mongodb.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sch, ok := s.schedules[url]
+	if !ok {
+		return sch, mongodb.ErrNotFound
+	}
+	return sch, nil
+}
+
+// Schedules returns the schedules of all the URLs sorted by URL
+func (s *Storage) Schedules(_ context.Context) ([]mongodb.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedules := make([]mongodb.Schedule, 0, len(s.schedules))
+	for _, sch := range s.schedules {
+		schedules = append(schedules, sch)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].URL < schedules[j].URL })
+	return schedules, nil
+}
@@ -0,0 +1,49 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/perebaj/newsletter/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storagetest.Storage {
+		return NewStorage()
+	})
+}
+
+func TestStorageLeaser(t *testing.T) {
+	storagetest.RunLeaser(t, func(_ *testing.T) storagetest.Leaser {
+		return NewStorage()
+	})
+}
+
+func TestStorageElector(t *testing.T) {
+	storagetest.RunElector(t, func(_ *testing.T) storagetest.Elector {
+		return NewStorage()
+	})
+}
+
+func TestStorageWebhooks(t *testing.T) {
+	storagetest.RunWebhooks(t, func(_ *testing.T) storagetest.Webhooks {
+		return NewStorage()
+	})
+}
+
+func TestStorageSearch(t *testing.T) {
+	storagetest.RunSearch(t, func(_ *testing.T) storagetest.Searcher {
+		return NewStorage()
+	})
+}
+
+func TestStorageAPIKeys(t *testing.T) {
+	storagetest.RunAPIKeys(t, func(_ *testing.T) storagetest.APIKeys {
+		return NewStorage()
+	})
+}
+
+func TestStorageAudit(t *testing.T) {
+	storagetest.RunAudit(t, func(_ *testing.T) storagetest.Auditor {
+		return NewStorage()
+	})
+}
@@ -0,0 +1,186 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// SaveWebhook saves a webhook, replacing the webhook with the same ID
+func (s *Storage) SaveWebhook(ctx context.Context, w mongodb.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.webhooks == nil {
+		s.webhooks = make(map[string]mongodb.Webhook)
+	}
+	w.URLs = append([]string(nil), w.URLs...)
+	if before, ok := s.webhooks[w.ID]; ok {
+		s.record(ctx, mongodb.ActionWebhookSave, w.ID, before, w)
+	} else {
+		s.record(ctx, mongodb.ActionWebhookSave, w.ID, nil, w)
+	}
+	s.webhooks[w.ID] = w
+	return nil
+}
+
+// Webhooks returns all the webhooks sorted by creation time
+func (s *Storage) Webhooks(_ context.Context) ([]mongodb.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhooks := make([]mongodb.Webhook, 0, len(s.webhooks))
+	for _, w := range s.webhooks {
+		w.URLs = append([]string(nil), w.URLs...)
+		webhooks = append(webhooks, w)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		if !webhooks[i].CreatedAt.Equal(webhooks[j].CreatedAt) {
+			return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+		}
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks, nil
+}
+
+// Webhook returns the webhook of the ID, mongodb.ErrNotFound when there is none
+func (s *Storage) Webhook(_ context.Context, id string) (mongodb.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w, ok := s.webhooks[id]
+	if !ok {
+		return mongodb.Webhook{}, mongodb.ErrNotFound
+	}
+	w.URLs = append([]string(nil), w.URLs...)
+	return w, nil
+}
+
+// WebhooksFollowing returns the webhooks that receive the changes of the url, the ones following it and the ones
+// following every page, sorted by creation time
+func (s *Storage) WebhooksFollowing(ctx context.Context, url string) ([]mongodb.Webhook, error) {
+	all, err := s.Webhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []mongodb.Webhook
+	for _, w := range all {
+		if len(w.URLs) == 0 || contains(w.URLs, url) {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks, nil
+}
+
+// WebhooksOf returns the webhooks registered by the email sorted by creation time
+func (s *Storage) WebhooksOf(ctx context.Context, userEmail string) ([]mongodb.Webhook, error) {
+	all, err := s.Webhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []mongodb.Webhook
+	for _, w := range all {
+		if w.UserEmail == userEmail {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes the webhook and its deliveries
+func (s *Storage) DeleteWebhook(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, ok := s.webhooks[id]
+	if !ok {
+		return mongodb.ErrNotFound
+	}
+	delete(s.webhooks, id)
+	s.record(ctx, mongodb.ActionWebhookDelete, id, before, nil)
+	for did, d := range s.deliveries {
+		if d.WebhookID == id {
+			delete(s.deliveries, did)
+		}
+	}
+	return nil
+}
+
+// SaveDelivery saves a delivery, replacing the delivery with the same ID
+func (s *Storage) SaveDelivery(_ context.Context, d mongodb.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deliveries == nil {
+		s.deliveries = make(map[string]mongodb.Delivery)
+	}
+	s.deliveries[d.ID] = copyDelivery(d)
+	return nil
+}
+
+// Delivery returns the delivery of the ID, mongodb.ErrNotFound when there is none
+func (s *Storage) Delivery(_ context.Context, id string) (mongodb.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.deliveries[id]
+	if !ok {
+		return mongodb.Delivery{}, mongodb.ErrNotFound
+	}
+	return copyDelivery(d), nil
+}
+
+// Deliveries returns up to limit deliveries of the webhook, from the newest to the oldest.
+// A limit less than or equal to zero returns all the deliveries.
+func (s *Storage) Deliveries(_ context.Context, webhookID string, limit int) ([]mongodb.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var deliveries []mongodb.Delivery
+	for _, d := range s.deliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+		}
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// PendingDeliveries returns up to limit pending deliveries due at now, the ones due first first
+func (s *Storage) PendingDeliveries(_ context.Context, now time.Time, limit int) ([]mongodb.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var deliveries []mongodb.Delivery
+	for _, d := range s.deliveries {
+		if d.Status == mongodb.DeliveryPending && !d.NextAttempt.After(now) {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].NextAttempt.Equal(deliveries[j].NextAttempt) {
+			return deliveries[i].NextAttempt.Before(deliveries[j].NextAttempt)
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func copyDelivery(d mongodb.Delivery) mongodb.Delivery {
+	d.Payload = append([]byte(nil), d.Payload...)
+	d.Attempts = append([]mongodb.DeliveryAttempt(nil), d.Attempts...)
+	return d
+}
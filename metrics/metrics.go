@@ -0,0 +1,126 @@
+// Package metrics holds the Prometheus metrics of the crawler, storage, mail and webhooks subsystems.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "newsletter"
+
+var (
+	// Fetches counts the fetches by host and HTTP status, "error" when the request failed
+	Fetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "fetches_total",
+		Help:      "Number of fetches by host and HTTP status.",
+	}, []string{"host", "status"})
+
+	// FetchDuration observes the latency of the fetches by host
+	FetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "fetch_duration_seconds",
+		Help:      "Latency of the fetches by host.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"host"})
+
+	// FetchedBytes counts the bytes downloaded by host
+	FetchedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "fetched_bytes_total",
+		Help:      "Number of bytes downloaded by host.",
+	}, []string{"host"})
+
+	// PagesSaved counts the page versions saved
+	PagesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "pages_saved_total",
+		Help:      "Number of page versions saved.",
+	})
+
+	// ChangesDetected counts the saved page versions that changed since the previous one
+	ChangesDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "changes_detected_total",
+		Help:      "Number of saved page versions that changed since the previous one.",
+	})
+
+	// QueueDepth is the number of items waiting in the crawler queues: "urls" are due URLs waiting for a worker,
+	// "results" are fetched pages waiting to be saved
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "queue_depth",
+		Help:      "Number of items waiting in the crawler queues.",
+	}, []string{"queue"})
+
+	// Workers is the number of crawler workers
+	Workers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "workers",
+		Help:      "Number of crawler workers.",
+	})
+
+	// BusyWorkers is the number of crawler workers fetching an URL
+	BusyWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "crawler",
+		Name:      "busy_workers",
+		Help:      "Number of crawler workers fetching an URL.",
+	})
+
+	// StorageDuration observes the latency of the storage operations by operation
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of the storage operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"operation"})
+
+	// StorageErrors counts the failed storage operations by operation
+	StorageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_errors_total",
+		Help:      "Number of failed storage operations.",
+	}, []string{"operation"})
+
+	// EmailsSent counts the emails sent
+	EmailsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mail",
+		Name:      "emails_sent_total",
+		Help:      "Number of emails sent.",
+	})
+
+	// EmailsFailed counts the emails that could not be sent
+	EmailsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mail",
+		Name:      "emails_failed_total",
+		Help:      "Number of emails that could not be sent.",
+	})
+
+	// WebhookAttempts counts the requests sent to the webhooks by result: delivered, retry or failed
+	WebhookAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhooks",
+		Name:      "attempts_total",
+		Help:      "Number of requests sent to the webhooks by result.",
+	}, []string{"result"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
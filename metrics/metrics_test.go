@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	Fetches.WithLabelValues("example.com", "200").Inc()
+	StorageDuration.WithLabelValues("find").Observe(0.01)
+	QueueDepth.WithLabelValues("urls").Set(0)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal("error reading metrics", err)
+	}
+
+	for _, want := range []string{
+		`newsletter_crawler_fetches_total{host="example.com",status="200"} 1`,
+		`newsletter_storage_operation_duration_seconds_count{operation="find"} 1`,
+		`newsletter_crawler_queue_depth{queue="urls"} 0`,
+		"newsletter_crawler_workers 0",
+		"newsletter_mail_emails_sent_total 0",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %q in the metrics", want)
+		}
+	}
+}
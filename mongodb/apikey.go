@@ -0,0 +1,136 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKey is a key that grants a role on the admin routes of the HTTP server
+type APIKey struct {
+	ID   string `bson:"_id"`
+	Name string `bson:"name"`
+	Role string `bson:"role"`
+	// Hash is the hex SHA-256 hash of the key, the key itself is never stored
+	Hash      string    `bson:"hash"`
+	CreatedAt time.Time `bson:"created_at"`
+	// RevokedAt is when the key stopped granting its role, zero while it is valid
+	RevokedAt time.Time `bson:"revoked_at,omitempty"`
+}
+
+// KeyUsage is a request authenticated by an API key, recorded for the audit of the keys
+type KeyUsage struct {
+	KeyID      string    `bson:"key_id"`
+	At         time.Time `bson:"at"`
+	Method     string    `bson:"method"`
+	Path       string    `bson:"path"`
+	Status     int       `bson:"status"`
+	RemoteAddr string    `bson:"remote_addr"`
+}
+
+// SaveAPIKey saves an API key, replacing the key with the same ID
+func (m *NLStorage) SaveAPIKey(ctx context.Context, k APIKey) error {
+	return m.audited(ctx, func(ctx context.Context) error {
+		collection := m.client.Database(m.DBName).Collection("api_keys")
+		var before APIKey
+		err := collection.FindOneAndReplace(ctx, bson.M{"_id": k.ID}, k, options.FindOneAndReplace().SetUpsert(true)).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return m.audit(ctx, ActionAPIKeySave, k.ID, nil, k)
+		}
+		if err != nil {
+			return fmt.Errorf("error saving API key: %v", err)
+		}
+		return m.audit(ctx, ActionAPIKeySave, k.ID, before, k)
+	})
+}
+
+// APIKeys returns all the API keys, revoked or not, sorted by creation time
+func (m *NLStorage) APIKeys(ctx context.Context) ([]APIKey, error) {
+	collection := m.client.Database(m.DBName).Collection("api_keys")
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("error getting API keys: %v", err)
+	}
+
+	var keys []APIKey
+	if err = cursor.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("error decoding API keys: %v", err)
+	}
+	return keys, nil
+}
+
+// APIKeyByHash returns the API key of the hash, ErrNotFound when there is none
+func (m *NLStorage) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	collection := m.client.Database(m.DBName).Collection("api_keys")
+
+	var k APIKey
+	err := collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&k)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return APIKey{}, ErrNotFound
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("error getting API key: %v", err)
+	}
+	return k, nil
+}
+
+// RevokeAPIKey revokes the API key of the ID at the given time, keeping the time of a key already revoked.
+// It returns ErrNotFound when there is no such key.
+func (m *NLStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return m.audited(ctx, func(ctx context.Context) error {
+		collection := m.client.Database(m.DBName).Collection("api_keys")
+		var before APIKey
+		err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.A{
+			bson.M{"$set": bson.M{"revoked_at": bson.M{"$ifNull": bson.A{"$revoked_at", at}}}},
+		}).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error revoking API key: %v", err)
+		}
+		after := before
+		if after.RevokedAt.IsZero() {
+			after.RevokedAt = at
+		}
+		return m.audit(ctx, ActionAPIKeyRevoke, id, before, after)
+	})
+}
+
+// SaveKeyUsage records a request authenticated by an API key
+func (m *NLStorage) SaveKeyUsage(ctx context.Context, u KeyUsage) error {
+	collection := m.client.Database(m.DBName).Collection("key_usage")
+	if _, err := collection.InsertOne(ctx, u); err != nil {
+		return fmt.Errorf("error saving key usage: %v", err)
+	}
+	return nil
+}
+
+// KeyUsage returns the latest requests authenticated by the API key of the ID, newest first, of all the keys when
+// the ID is empty. A limit of zero returns all of them.
+func (m *NLStorage) KeyUsage(ctx context.Context, keyID string, limit int) ([]KeyUsage, error) {
+	collection := m.client.Database(m.DBName).Collection("key_usage")
+	filter := bson.M{}
+	if keyID != "" {
+		filter["key_id"] = keyID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key usage: %v", err)
+	}
+	var usage []KeyUsage
+	if err = cursor.All(ctx, &usage); err != nil {
+		return nil, fmt.Errorf("error decoding key usage: %v", err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,287 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ActorSystem is the actor of the changes made without one in their context
+const ActorSystem = "system"
+
+// Actions of the audit entries
+const (
+	ActionEngineerSave     = "engineer.save"
+	ActionEngineerDelete   = "engineer.delete"
+	ActionNewsletterSave   = "newsletter.save"
+	ActionNewsletterUpdate = "newsletter.update"
+	ActionNewsletterDelete = "newsletter.delete"
+	ActionWebhookSave      = "webhook.save"
+	ActionWebhookDelete    = "webhook.delete"
+	ActionAPIKeySave       = "apikey.save"
+	ActionAPIKeyRevoke     = "apikey.revoke"
+)
+
+// AuditEntry is a change of an engineer, a subscription, a webhook or an API key, recorded when it is made
+type AuditEntry struct {
+	ID string    `bson:"_id"`
+	At time.Time `bson:"at"`
+	// Actor made the change, e.g. key:<id>, subscriber:<email>, cli:<user> or system
+	Actor  string `bson:"actor"`
+	Action string `bson:"action"`
+	// Target is the URL of the engineer, the email of the subscription or the ID of the webhook or the key
+	Target string `bson:"target"`
+	// Before and After are the snapshots of the target, missing when it did not exist
+	Before bson.Raw `bson:"before,omitempty"`
+	After  bson.Raw `bson:"after,omitempty"`
+}
+
+// AuditQuery selects the entries of AuditLog, every field narrowing the entries when set
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	// From and To bound the time of the entries, inclusive
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// Match reports if the entry is selected by the query, ignoring the limit
+func (q AuditQuery) Match(e AuditEntry) bool {
+	return (q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Target == "" || e.Target == q.Target) &&
+		(q.From.IsZero() || !e.At.Before(q.From)) &&
+		(q.To.IsZero() || !e.At.After(q.To))
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes are recorded as made by the actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorOf returns the actor of the context, ActorSystem when it has none
+func ActorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return ActorSystem
+}
+
+// NewAuditEntry returns the entry of a change made with ctx. Before and after are nil when the target did not
+// exist, the secrets of the webhooks and the hashes of the keys are left out of their snapshots.
+func NewAuditEntry(ctx context.Context, action, target string, before, after interface{}) AuditEntry {
+	return AuditEntry{
+		ID:     primitive.NewObjectID().Hex(),
+		At:     time.Now().UTC().Truncate(time.Millisecond),
+		Actor:  ActorOf(ctx),
+		Action: action,
+		Target: target,
+		Before: snapshot(before),
+		After:  snapshot(after),
+	}
+}
+
+func snapshot(v interface{}) bson.Raw {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case Webhook:
+		t.Secret = ""
+		v = t
+	case APIKey:
+		t.Hash = ""
+		v = t
+	case Newsletter:
+		if len(t.Channels) > 0 {
+			channels := make([]Channel, len(t.Channels))
+			for i, ch := range t.Channels {
+				ch.Secret = ""
+				channels[i] = ch
+			}
+			t.Channels = channels
+		}
+		v = t
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		// The documents of the storage always marshal.
+		panic(fmt.Sprintf("error marshaling snapshot: %v", err))
+	}
+	return raw
+}
+
+// SnapshotJSON returns a snapshot of an entry as relaxed extended JSON, nil when the snapshot is missing
+func SnapshotJSON(raw bson.Raw) (json.RawMessage, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	b, err := bson.MarshalExtJSON(raw, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("error converting snapshot to JSON: %v", err)
+	}
+	return b, nil
+}
+
+// audited runs change, that writes a change and its audit entry with the context it is given, in a transaction, so
+// neither is kept without the other. The standalone servers do not support transactions, change runs without one.
+func (m *NLStorage) audited(ctx context.Context, change func(ctx context.Context) error) error {
+	ok, err := m.supportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return change(ctx)
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("error starting session: %v", err)
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sctx mongo.SessionContext) (interface{}, error) {
+		return nil, change(sctx)
+	})
+	return err
+}
+
+// supportsTransactions reports whether the deployment is a replica set or a sharded cluster, asking it once
+func (m *NLStorage) supportsTransactions(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.transactions == nil {
+		var hello struct {
+			SetName string `bson:"setName"`
+			Msg     string `bson:"msg"`
+		}
+		err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+		if err != nil {
+			return false, fmt.Errorf("error checking transaction support: %v", err)
+		}
+		ok := hello.SetName != "" || hello.Msg == "isdbgrid"
+		m.transactions = &ok
+	}
+	return *m.transactions, nil
+}
+
+// audit records the entry of a change made with ctx
+func (m *NLStorage) audit(ctx context.Context, action, target string, before, after interface{}) error {
+	collection := m.client.Database(m.DBName).Collection("audit")
+	if _, err := collection.InsertOne(ctx, NewAuditEntry(ctx, action, target, before, after)); err != nil {
+		return fmt.Errorf("error recording audit entry: %v", err)
+	}
+	return nil
+}
+
+// AuditLog returns the entries of the query, newest first. A limit of zero returns all of them.
+func (m *NLStorage) AuditLog(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	collection := m.client.Database(m.DBName).Collection("audit")
+
+	filter := bson.M{}
+	for field, v := range map[string]string{"actor": q.Actor, "action": q.Action, "target": q.Target} {
+		if v != "" {
+			filter[field] = v
+		}
+	}
+	at := bson.M{}
+	if !q.From.IsZero() {
+		at["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		at["$lte"] = q.To
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting audit log: %v", err)
+	}
+	var entries []AuditEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("error decoding audit log: %v", err)
+	}
+	return entries, nil
+}
+
+// mentioning is the filter of the entries that Mention the email
+func mentioning(userEmail string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"target": userEmail},
+		bson.M{"actor": "subscriber:" + userEmail},
+		bson.M{"before.user_email": userEmail},
+		bson.M{"after.user_email": userEmail},
+	}}
+}
+
+// AuditMentioning returns the entries that Mention the email, newest first
+func (m *NLStorage) AuditMentioning(ctx context.Context, userEmail string) ([]AuditEntry, error) {
+	collection := m.client.Database(m.DBName).Collection("audit")
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+	cursor, err := collection.Find(ctx, mentioning(userEmail), opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting audit log: %v", err)
+	}
+	var entries []AuditEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("error decoding audit log: %v", err)
+	}
+	return entries, nil
+}
+
+// ForgetSubscriber removes the traces of the subscriber left beyond its subscription and webhooks: the lease of its
+// emails, and its email in the audit log, replaced by alias, along with the snapshots of the entries that held it.
+// It returns the number of entries anonymized.
+func (m *NLStorage) ForgetSubscriber(ctx context.Context, userEmail, alias string) (int, error) {
+	database := m.client.Database(m.DBName)
+	if _, err := database.Collection("jobs").DeleteOne(ctx, bson.M{"_id": "email:" + userEmail}); err != nil {
+		return 0, fmt.Errorf("error deleting lease: %v", err)
+	}
+
+	actor := "subscriber:" + userEmail
+	replace := func(field, v, by string) bson.M {
+		return bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$" + field, v}}, by, "$" + field}}
+	}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"target": replace("target", userEmail, alias),
+			"actor":  replace("actor", actor, "subscriber:"+alias),
+		}},
+		bson.M{"$unset": bson.A{"before", "after"}},
+	}
+	res, err := database.Collection("audit").UpdateMany(ctx, mentioning(userEmail), update)
+	if err != nil {
+		return 0, fmt.Errorf("error anonymizing audit log: %v", err)
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// Mentions reports if the entry holds the email of the subscriber, as its actor, its target or in its snapshots
+func (e AuditEntry) Mentions(userEmail string) bool {
+	if e.Target == userEmail || e.Actor == "subscriber:"+userEmail {
+		return true
+	}
+	for _, raw := range []bson.Raw{e.Before, e.After} {
+		if v, err := raw.LookupErr("user_email"); err == nil {
+			if s, ok := v.StringValueOK(); ok && s == userEmail {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+//go:build integration
+// +build integration
+
+package mongodb_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/storagetest"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNLStorageConformance(t *testing.T) {
+	ctx := context.Background()
+	client, err := mongodb.OpenDB(ctx, mongodb.Config{
+		URI: os.Getenv("NL_MONGO_URI"),
+	})
+	if err != nil {
+		t.Fatal("error connecting to MongoDB", err)
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return newStorage(ctx, t, client)
+	})
+	storagetest.RunLeaser(t, func(t *testing.T) storagetest.Leaser {
+		return newStorage(ctx, t, client)
+	})
+	storagetest.RunElector(t, func(t *testing.T) storagetest.Elector {
+		return newStorage(ctx, t, client)
+	})
+	storagetest.RunWebhooks(t, func(t *testing.T) storagetest.Webhooks {
+		return newStorage(ctx, t, client)
+	})
+	storagetest.RunSearch(t, func(t *testing.T) storagetest.Searcher {
+		return newStorage(ctx, t, client)
+	})
+	storagetest.RunAPIKeys(t, func(t *testing.T) storagetest.APIKeys {
+		return newStorage(ctx, t, client)
+	})
+	storagetest.RunAudit(t, func(t *testing.T) storagetest.Auditor {
+		return newStorage(ctx, t, client)
+	})
+}
+
+func newStorage(ctx context.Context, t *testing.T, client *mongo.Client) *mongodb.NLStorage {
+	DBName := fmt.Sprintf("conformance%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		if err := client.Database(DBName).Drop(ctx); err != nil {
+			t.Error("error dropping database", err)
+		}
+	})
+
+	storage := mongodb.NewNLStorage(client, DBName)
+	if err := storage.Migrate(ctx); err != nil {
+		t.Fatal("error migrating", err)
+	}
+	return storage
+}
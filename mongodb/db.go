@@ -4,9 +4,13 @@ package mongodb
 import (
 	"context"
 	"fmt"
+	"sync"
 
+	"github.com/perebaj/newsletter/metrics"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // Config is the configuration for the MongoDB connection.
@@ -27,7 +31,8 @@ func OpenDB(ctx context.Context, cfg Config) (*mongo.Client, error) {
 
 	client, err := mongo.Connect(ctx, options.Client().
 		ApplyURI(cfg.URI).
-		SetBSONOptions(bsonOpts))
+		SetBSONOptions(bsonOpts).
+		SetMonitor(commandMonitor()))
 
 	if err != nil {
 		return nil, err
@@ -45,6 +50,10 @@ func OpenDB(ctx context.Context, cfg Config) (*mongo.Client, error) {
 type NLStorage struct {
 	client *mongo.Client
 	DBName string
+
+	// mu guards transactions, known once the deployment answered whether it supports them
+	mu           sync.Mutex
+	transactions *bool
 }
 
 // NewNLStorage initializes a new NLStorage
@@ -54,3 +63,24 @@ func NewNLStorage(client *mongo.Client, DBName string) *NLStorage {
 		DBName: DBName,
 	}
 }
+
+// Ping checks the connection to the MongoDB primary
+func (m *NLStorage) Ping(ctx context.Context) error {
+	if err := m.client.Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("error pinging MongoDB: %v", err)
+	}
+	return nil
+}
+
+// commandMonitor records the latency and the errors of every command sent to MongoDB
+func commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			metrics.StorageDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			metrics.StorageDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			metrics.StorageErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
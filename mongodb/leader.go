@@ -0,0 +1,115 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Leadership is the leader lease of a singleton job, like the email loop
+type Leadership struct {
+	Name   string `bson:"_id"`
+	Holder string `bson:"holder"`
+	// Token identifies the term, incremented every time the leadership changes hands
+	Token     int64     `bson:"token"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// AcquireLeadership makes holder the leader of name during ttl, when there is no leader, the leadership expired, or
+// holder is already the leader. It returns the token of the term and false when another holder leads.
+func (m *NLStorage) AcquireLeadership(ctx context.Context, name, holder string, ttl time.Duration) (int64, bool, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("leaders")
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id": name,
+		"$or": []bson.M{
+			{"expires_at": bson.M{"$lte": now}},
+			{"holder": holder},
+		},
+	}
+	// The token is only incremented when the leadership changes hands, a leader renewing keeps its term.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"token": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$holder", holder}},
+				"$token",
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$token", 0}}, 1}},
+			}},
+			"holder":     holder,
+			"expires_at": now.Add(ttl),
+		}}},
+	}
+
+	var leadership Leadership
+	err := collection.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&leadership)
+	// The leadership exists and the filter did not match, so the upsert tried to insert the same _id.
+	if mongo.IsDuplicateKeyError(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error acquiring leadership: %v", err)
+	}
+	return leadership.Token, true, nil
+}
+
+// RenewLeadership extends the term of holder by ttl, returning ErrLeaseLost if holder is not the leader of the term anymore
+func (m *NLStorage) RenewLeadership(ctx context.Context, name, holder string, token int64, ttl time.Duration) error {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("leaders")
+
+	now := time.Now().UTC()
+	resp, err := collection.UpdateOne(ctx,
+		bson.M{"_id": name, "holder": holder, "token": token, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"expires_at": now.Add(ttl)}},
+	)
+	if err != nil {
+		return fmt.Errorf("error renewing leadership: %v", err)
+	}
+	if resp.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// ResignLeadership ends the term of holder, so another holder can lead right away
+func (m *NLStorage) ResignLeadership(ctx context.Context, name, holder string, token int64) error {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("leaders")
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": name, "holder": holder, "token": token},
+		bson.M{"$set": bson.M{"holder": "", "expires_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return fmt.Errorf("error resigning leadership: %v", err)
+	}
+	return nil
+}
+
+// Leader returns the current leadership of name, with an empty holder when nobody leads
+func (m *NLStorage) Leader(ctx context.Context, name string) (Leadership, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("leaders")
+
+	var leadership Leadership
+	err := collection.FindOne(ctx, bson.M{"_id": name}).Decode(&leadership)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Leadership{Name: name}, nil
+	}
+	if err != nil {
+		return leadership, fmt.Errorf("error getting leader: %v", err)
+	}
+	if !leadership.ExpiresAt.After(time.Now()) {
+		leadership.Holder = ""
+	}
+	return leadership, nil
+}
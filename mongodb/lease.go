@@ -0,0 +1,118 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrLeaseLost is returned when renewing a lease that expired or was claimed by another owner
+var ErrLeaseLost = errors.New("lease lost")
+
+// Job is a unit of work, like crawling an URL or sending a newsletter, leased by a single owner at a time
+type Job struct {
+	Key string `bson:"_id"`
+	// Owner is the instance holding the lease, empty when the job is free or held after being done
+	Owner       string    `bson:"owner"`
+	LeaseUntil  time.Time `bson:"lease_until"`
+	HeartbeatAt time.Time `bson:"heartbeat_at"`
+	// Attempts is the number of times the job was claimed since it was last released
+	Attempts int `bson:"attempts"`
+}
+
+// AcquireLease claims the job key for owner during ttl. It succeeds when the job does not exist, its lease expired,
+// or owner already holds it, and returns false when another owner holds it.
+func (m *NLStorage) AcquireLease(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("jobs")
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id": key,
+		"$or": []bson.M{
+			{"lease_until": bson.M{"$lte": now}},
+			{"owner": owner},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"owner":        owner,
+			"lease_until":  now.Add(ttl),
+			"heartbeat_at": now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	// The job exists and the filter did not match, so the upsert tried to insert the same _id.
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error acquiring lease: %v", err)
+	}
+	return true, nil
+}
+
+// RenewLease extends the lease of owner on the job key by ttl, returning ErrLeaseLost if owner does not hold it anymore
+func (m *NLStorage) RenewLease(ctx context.Context, key, owner string, ttl time.Duration) error {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("jobs")
+
+	now := time.Now().UTC()
+	resp, err := collection.UpdateOne(ctx,
+		bson.M{"_id": key, "owner": owner, "lease_until": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"lease_until": now.Add(ttl), "heartbeat_at": now}},
+	)
+	if err != nil {
+		return fmt.Errorf("error renewing lease: %v", err)
+	}
+	if resp.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// ReleaseLease releases the lease of owner on the job key. The job can not be claimed by anyone until holdUntil,
+// a zero holdUntil frees it immediately.
+func (m *NLStorage) ReleaseLease(ctx context.Context, key, owner string, holdUntil time.Time) error {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("jobs")
+
+	now := time.Now().UTC()
+	if holdUntil.Before(now) {
+		holdUntil = now
+	}
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": key, "owner": owner},
+		bson.M{"$set": bson.M{"owner": "", "lease_until": holdUntil.UTC(), "attempts": 0}},
+	)
+	if err != nil {
+		return fmt.Errorf("error releasing lease: %v", err)
+	}
+	return nil
+}
+
+// Jobs returns all the jobs sorted by key
+func (m *NLStorage) Jobs(ctx context.Context) ([]Job, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("jobs")
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error getting jobs: %v", err)
+	}
+
+	var jobs []Job
+	if err = cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("error decoding jobs: %v", err)
+	}
+
+	return jobs, nil
+}
@@ -0,0 +1,422 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/perebaj/newsletter/htmltext"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrationsCollection is the collection where the applied migration versions are recorded.
+const migrationsCollection = "migrations"
+
+// Migration is a versioned change of indexes, validators or data of the database.
+// Every Up function must be idempotent, since two instances may apply the same migration at the same time.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// AppliedMigration is the record saved in the migrations collection after a migration runs.
+type AppliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// Migrations returns the list of known migrations sorted by version.
+func Migrations() []Migration {
+	m := []Migration{
+		{
+			Version:     1,
+			Description: "create pages url and scrape_date index",
+			Up:          createPagesIndex,
+		},
+		{
+			Version:     2,
+			Description: "deduplicate engineers and enforce unique url",
+			Up:          uniqueEngineerURL,
+		},
+		{
+			Version:     3,
+			Description: "merge duplicated newsletters and enforce unique user_email",
+			Up:          uniqueNewsletterEmail,
+		},
+		{
+			Version:     4,
+			Description: "add engineers and newsletter validators",
+			Up:          addValidators,
+		},
+		{
+			Version:     5,
+			Description: "create schedules unique url index",
+			Up:          uniqueScheduleURL,
+		},
+		{
+			Version:     6,
+			Description: "create deliveries pending and webhook indexes",
+			Up:          createDeliveriesIndexes,
+		},
+		{
+			Version:     7,
+			Description: "extract the text of the changed pages and create the pages text index",
+			Up:          createPagesTextIndex,
+		},
+		{
+			Version:     8,
+			Description: "create api keys unique hash and key usage indexes",
+			Up:          createAPIKeysIndexes,
+		},
+		{
+			Version:     9,
+			Description: "create audit actor, target and time indexes",
+			Up:          createAuditIndexes,
+		},
+		{
+			Version:     10,
+			Description: "create webhooks urls index",
+			Up:          createWebhooksURLsIndex,
+		},
+		{
+			Version:     11,
+			Description: "create webhooks user_email index",
+			Up:          createWebhooksUserEmailIndex,
+		},
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].Version < m[j].Version })
+	return m
+}
+
+// Migrate applies all the pending migrations, in version order, and records them in the migrations collection.
+func (m *NLStorage) Migrate(ctx context.Context) error {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection(migrationsCollection)
+
+	applied, err := m.AppliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	for _, mig := range Migrations() {
+		if done[mig.Version] {
+			continue
+		}
+
+		slog.Info("applying migration", "version", mig.Version, "description", mig.Description)
+		if err := mig.Up(ctx, database); err != nil {
+			return fmt.Errorf("error applying migration %d: %v", mig.Version, err)
+		}
+
+		_, err := collection.InsertOne(ctx, AppliedMigration{
+			Version:     mig.Version,
+			Description: mig.Description,
+			AppliedAt:   time.Now().UTC(),
+		})
+		// Another instance may have applied the same migration concurrently.
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("error recording migration %d: %v", mig.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// AppliedMigrations returns the migrations already applied in the database sorted by version.
+func (m *NLStorage) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection(migrationsCollection)
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error getting migrations: %v", err)
+	}
+
+	var applied []AppliedMigration
+	if err = cursor.All(ctx, &applied); err != nil {
+		return nil, fmt.Errorf("error decoding migrations: %v", err)
+	}
+
+	return applied, nil
+}
+
+func createPagesIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("pages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "url", Value: 1}, {Key: "scrape_date", Value: -1}},
+		Options: options.Index().SetName("url_scrape_date"),
+	})
+	return err
+}
+
+func uniqueEngineerURL(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection("engineers")
+
+	if err := deleteDuplicates(ctx, collection, "$url"); err != nil {
+		return err
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "url", Value: 1}},
+		Options: options.Index().SetName("url_unique").SetUnique(true),
+	})
+	return err
+}
+
+func uniqueNewsletterEmail(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection("newsletter")
+
+	// Keep the first document of each user, with the union of the urls of all its duplicates.
+	cursor, err := collection.Aggregate(ctx, []bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$unwind": bson.M{"path": "$urls", "preserveNullAndEmptyArrays": true}},
+		{"$group": bson.M{
+			"_id":  "$user_email",
+			"keep": bson.M{"$first": "$_id"},
+			"ids":  bson.M{"$addToSet": "$_id"},
+			"urls": bson.M{"$addToSet": "$urls"},
+		}},
+		{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error finding duplicated newsletters: %v", err)
+	}
+
+	var dups []struct {
+		Keep interface{}   `bson:"keep"`
+		IDs  []interface{} `bson:"ids"`
+		URLs []string      `bson:"urls"`
+	}
+	if err = cursor.All(ctx, &dups); err != nil {
+		return fmt.Errorf("error decoding duplicated newsletters: %v", err)
+	}
+
+	for _, d := range dups {
+		_, err := collection.UpdateByID(ctx, d.Keep, bson.M{"$set": bson.M{"urls": d.URLs}})
+		if err != nil {
+			return fmt.Errorf("error merging newsletters: %v", err)
+		}
+		_, err = collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": d.IDs, "$ne": d.Keep}})
+		if err != nil {
+			return fmt.Errorf("error deleting duplicated newsletters: %v", err)
+		}
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_email", Value: 1}},
+		Options: options.Index().SetName("user_email_unique").SetUnique(true),
+	})
+	return err
+}
+
+func addValidators(ctx context.Context, db *mongo.Database) error {
+	validators := map[string]bson.M{
+		"engineers": {
+			"bsonType": "object",
+			"required": []string{"url"},
+			"properties": bson.M{
+				"url": bson.M{"bsonType": "string", "minLength": 1},
+			},
+		},
+		"newsletter": {
+			"bsonType": "object",
+			"required": []string{"user_email"},
+			"properties": bson.M{
+				"user_email": bson.M{"bsonType": "string", "minLength": 1},
+				"urls":       bson.M{"bsonType": "array", "items": bson.M{"bsonType": "string"}},
+			},
+		},
+	}
+
+	for name, schema := range validators {
+		if err := ensureCollection(ctx, db, name); err != nil {
+			return err
+		}
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: name},
+			{Key: "validator", Value: bson.M{"$jsonSchema": schema}},
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("error adding %s validator: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func uniqueScheduleURL(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("schedules").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "url", Value: 1}},
+		Options: options.Index().SetName("url_unique").SetUnique(true),
+	})
+	return err
+}
+
+func createDeliveriesIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("deliveries").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}},
+			Options: options.Index().SetName("status_next_attempt"),
+		},
+		{
+			Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("webhook_id_created_at"),
+		},
+	})
+	return err
+}
+
+// createAPIKeysIndexes lets the requests find their key by hash, and the audit list the usage of a key.
+func createAPIKeysIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("api_keys").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetName("hash").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("key_usage").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key_id", Value: 1}, {Key: "at", Value: -1}},
+			Options: options.Index().SetName("key_id_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "at", Value: -1}},
+			Options: options.Index().SetName("at"),
+		},
+	})
+	return err
+}
+
+// createAuditIndexes lets the audit log be listed by time, and the changes of an actor or a target be found.
+func createAuditIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("audit").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "at", Value: -1}},
+			Options: options.Index().SetName("at"),
+		},
+		{
+			Keys:    bson.D{{Key: "actor", Value: 1}, {Key: "at", Value: -1}},
+			Options: options.Index().SetName("actor_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "target", Value: 1}, {Key: "at", Value: -1}},
+			Options: options.Index().SetName("target_at"),
+		},
+	})
+	return err
+}
+
+// createPagesTextIndex extracts the text of the changed pages scraped before the search, so they can be found too.
+func createPagesTextIndex(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection("pages")
+
+	filter := bson.M{"is_most_recent": true, "text": bson.M{"$exists": false}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"content": 1}))
+	if err != nil {
+		return fmt.Errorf("error finding pages without text: %v", err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	for cursor.Next(ctx) {
+		var page struct {
+			ID      interface{} `bson:"_id"`
+			Content string      `bson:"content"`
+		}
+		if err := cursor.Decode(&page); err != nil {
+			return fmt.Errorf("error decoding page: %v", err)
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": page.ID}, bson.M{"$set": bson.M{"text": htmltext.Extract(page.Content)}})
+		if err != nil {
+			return fmt.Errorf("error saving page text: %v", err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("error finding pages without text: %v", err)
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "text", Value: "text"}},
+		Options: options.Index().SetName("text"),
+	})
+	return err
+}
+
+// createWebhooksURLsIndex lets the webhooks following a changed page be found without scanning them all.
+func createWebhooksURLsIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("webhooks").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "urls", Value: 1}},
+		Options: options.Index().SetName("urls"),
+	})
+	return err
+}
+
+// createWebhooksUserEmailIndex lets the webhooks of a subscriber be exported and erased without scanning them all.
+func createWebhooksUserEmailIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("webhooks").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_email", Value: 1}},
+		Options: options.Index().SetName("user_email"),
+	})
+	return err
+}
+
+// deleteDuplicates removes every document that shares the same value of the key expression with an older document.
+func deleteDuplicates(ctx context.Context, collection *mongo.Collection, key string) error {
+	cursor, err := collection.Aggregate(ctx, []bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{
+			"_id": key,
+			"ids": bson.M{"$push": "$_id"},
+		}},
+		{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error finding duplicates in %s: %v", collection.Name(), err)
+	}
+
+	var dups []struct {
+		IDs []interface{} `bson:"ids"`
+	}
+	if err = cursor.All(ctx, &dups); err != nil {
+		return fmt.Errorf("error decoding duplicates in %s: %v", collection.Name(), err)
+	}
+
+	for _, d := range dups {
+		_, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": d.IDs[1:]}})
+		if err != nil {
+			return fmt.Errorf("error deleting duplicates in %s: %v", collection.Name(), err)
+		}
+	}
+	return nil
+}
+
+// ensureCollection creates the collection if it does not exist yet.
+func ensureCollection(ctx context.Context, db *mongo.Database, name string) error {
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("error listing collections: %v", err)
+	}
+	if len(names) > 0 {
+		return nil
+	}
+
+	err = db.CreateCollection(ctx, name)
+	// NamespaceExists, the collection was created by a concurrent migration.
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 48 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+//go:build integration
+// +build integration
+
+package mongodb
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNLStorageMigrate(t *testing.T) {
+	ctx := context.Background()
+	client, DBName := setup(ctx, t)
+	t.Cleanup(teardown(ctx, client, DBName))
+
+	database := client.Database(DBName)
+
+	_, err := database.Collection("engineers").InsertMany(ctx, []interface{}{
+		Engineer{Name: "John", URL: "https://www.1.com"},
+		Engineer{Name: "John 2", URL: "https://www.1.com"},
+		Engineer{Name: "Mary", URL: "https://www.2.com"},
+	})
+	if err != nil {
+		t.Fatal("error saving engineers", err)
+	}
+
+	_, err = database.Collection("newsletter").InsertMany(ctx, []interface{}{
+		Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://www.1.com"}},
+		Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://www.2.com"}},
+	})
+	if err != nil {
+		t.Fatal("error saving newsletters", err)
+	}
+
+	storage := NewNLStorage(client, DBName)
+	if err := storage.Migrate(ctx); err != nil {
+		t.Fatal("error migrating", err)
+	}
+
+	// Running it twice must be a no-op.
+	if err := storage.Migrate(ctx); err != nil {
+		t.Fatal("error migrating twice", err)
+	}
+
+	applied, err := storage.AppliedMigrations(ctx)
+	if err != nil {
+		t.Fatal("error getting applied migrations", err)
+	}
+	assert(t, len(applied), len(Migrations()))
+
+	engineers, err := storage.DistinctEngineerURLs(ctx)
+	if err != nil {
+		t.Fatal("error getting engineers", err)
+	}
+	count, err := database.Collection("engineers").CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal("error counting engineers", err)
+	}
+	assert(t, int(count), len(engineers))
+
+	err = storage.SaveEngineer(ctx, Engineer{Name: "John 3", URL: "https://www.1.com"})
+	if err != nil {
+		t.Fatal("error replacing engineer", err)
+	}
+
+	newsletters, err := storage.Newsletter(ctx, "", 0)
+	if err != nil {
+		t.Fatal("error getting newsletters", err)
+	}
+	if len(newsletters) != 1 {
+		t.Fatal("expected 1 newsletter, got", len(newsletters))
+	}
+	sort.Strings(newsletters[0].URLs)
+	if !reflect.DeepEqual(newsletters[0].URLs, []string{"https://www.1.com", "https://www.2.com"}) {
+		t.Fatalf("got %v, want merged urls", newsletters[0].URLs)
+	}
+
+	err = storage.SaveNewsletter(ctx, Newsletter{UserEmail: "j@gmail.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("expected duplicate key error, got %v", err)
+	}
+
+	err = storage.SaveEngineer(ctx, Engineer{Name: "No URL"})
+	if err == nil {
+		t.Fatal("expected validation error for engineer without url")
+	}
+}
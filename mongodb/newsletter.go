@@ -2,16 +2,53 @@ package mongodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ErrNotFound is returned by every storage when the document a lookup, an update or a deletion targets does not
+// exist: an engineer, a subscription, a schedule, a page version, a webhook, a delivery or an API key.
+var ErrNotFound = errors.New("not found")
+
 // Newsletter is the struct that gather what websites to scrape for an user email
 type Newsletter struct {
 	UserEmail string   `bson:"user_email"`
 	URLs      []string `bson:"urls"`
+	// Channels are where the newsletter is delivered, the email of UserEmail when empty
+	Channels []Channel `bson:"channels,omitempty"`
+	// Filters narrow the changes of the URLs the newsletter notifies about, all the changes when empty
+	Filters []Filter `bson:"filters,omitempty"`
+	// Cadence is how often the newsletter is sent, daily or weekly, as soon as there are changes when empty
+	Cadence string `bson:"cadence,omitempty"`
+	// LastSent is when the newsletter with a cadence was last sent
+	LastSent time.Time `bson:"last_sent,omitempty"`
+}
+
+// Filter selects the changes of a page by the keywords of their text. A keyword written as /expression/ is a
+// regular expression.
+type Filter struct {
+	// URL is the page filtered, every page of the newsletter when empty
+	URL string `bson:"url,omitempty"`
+	// Include are the keywords of which the change must have at least one, any change when empty
+	Include []string `bson:"include,omitempty"`
+	// Exclude are the keywords of which the change must have none
+	Exclude []string `bson:"exclude,omitempty"`
+}
+
+// Channel is a delivery channel of a newsletter
+type Channel struct {
+	// Type is email, slack, discord, telegram, matrix or webhook
+	Type string `bson:"type"`
+	// Address is the email address, the webhook URL, the chat ID or the room ID, depending on the type
+	Address string `bson:"address"`
+	// Secret signs the requests of a webhook channel, generated when the channel is set
+	Secret string `bson:"secret,omitempty"`
 }
 
 // Engineer is the struct that gather the scraped content of an engineer
@@ -19,6 +56,27 @@ type Engineer struct {
 	Name        string `bson:"name"`
 	Description string `bson:"description"`
 	URL         string `bson:"url"`
+	// Schedule is how often the URL is crawled, an interval ("6h", "@every 6h") or a cron expression ("0 8 * * *", "@daily").
+	// Empty means the crawler default interval.
+	Schedule string `bson:"schedule,omitempty"`
+}
+
+// ValidateSchedule returns an error when the schedule of an engineer is neither empty, a positive interval nor a
+// standard cron expression
+func ValidateSchedule(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return fmt.Errorf("invalid schedule interval: %s", spec)
+		}
+		return nil
+	}
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return fmt.Errorf("invalid schedule %q: %v", spec, err)
+	}
+	return nil
 }
 
 // Page is the struct that gather the scraped content of a website
@@ -28,28 +86,140 @@ type Page struct {
 	ScrapeDatetime time.Time `bson:"scrape_date"`
 	HashMD5        [16]byte  `bson:"hash_md5"`
 	IsMostRecent   bool      `bson:"is_most_recent"`
+	// Text is the readable text of the content, extracted for the search of the versions that changed
+	Text string `bson:"text,omitempty"`
 }
 
 // SaveNewsletter saves a newsletter in the database
 func (m *NLStorage) SaveNewsletter(ctx context.Context, newsletter Newsletter) error {
-	database := m.client.Database(m.DBName)
-	collection := database.Collection("newsletter")
-	_, err := collection.InsertOne(ctx, newsletter)
+	return m.audited(ctx, func(ctx context.Context) error {
+		database := m.client.Database(m.DBName)
+		collection := database.Collection("newsletter")
+		_, err := collection.InsertOne(ctx, newsletter)
+		if err != nil {
+			return err
+		}
+		return m.audit(ctx, ActionNewsletterSave, newsletter.UserEmail, nil, newsletter)
+	})
+}
+
+// UpdateNewsletter replaces the URLs, channels, filters and cadence of the newsletter of the same user, keeping when it
+// was last sent. It returns ErrNotFound when there is none.
+func (m *NLStorage) UpdateNewsletter(ctx context.Context, newsletter Newsletter) error {
+	// The validator requires an array of URLs.
+	urls := newsletter.URLs
+	if urls == nil {
+		urls = []string{}
+	}
+	// The empty fields are removed, as SaveNewsletter omits them.
+	set := bson.M{"urls": urls}
+	unset := bson.M{}
+	if len(newsletter.Channels) > 0 {
+		set["channels"] = newsletter.Channels
+	} else {
+		unset["channels"] = ""
+	}
+	if len(newsletter.Filters) > 0 {
+		set["filters"] = newsletter.Filters
+	} else {
+		unset["filters"] = ""
+	}
+	if newsletter.Cadence != "" {
+		set["cadence"] = newsletter.Cadence
+	} else {
+		unset["cadence"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	return m.audited(ctx, func(ctx context.Context) error {
+		collection := m.client.Database(m.DBName).Collection("newsletter")
+		var before Newsletter
+		err := collection.FindOneAndUpdate(ctx, bson.M{"user_email": newsletter.UserEmail}, update).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error updating newsletter: %v", err)
+		}
+		newsletter.LastSent = before.LastSent
+		return m.audit(ctx, ActionNewsletterUpdate, newsletter.UserEmail, before, newsletter)
+	})
+}
+
+// MarkNewsletterSent records when the newsletter of the user was sent, ErrNotFound when there is none
+func (m *NLStorage) MarkNewsletterSent(ctx context.Context, userEmail string, at time.Time) error {
+	collection := m.client.Database(m.DBName).Collection("newsletter")
+	res, err := collection.UpdateOne(ctx, bson.M{"user_email": userEmail}, bson.M{"$set": bson.M{"last_sent": at}})
 	if err != nil {
-		return err
+		return fmt.Errorf("error marking newsletter sent: %v", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
 	}
 	return nil
 }
 
-// SaveEngineer saves an engineer in the database
+// SaveEngineer saves an engineer in the database, replacing the engineer that has the same URL
 func (m *NLStorage) SaveEngineer(ctx context.Context, e Engineer) error {
-	database := m.client.Database(m.DBName)
-	collection := database.Collection("engineers")
-	_, err := collection.InsertOne(ctx, e)
-	if err != nil {
+	if err := ValidateSchedule(e.Schedule); err != nil {
 		return err
 	}
-	return nil
+	return m.audited(ctx, func(ctx context.Context) error {
+		database := m.client.Database(m.DBName)
+		collection := database.Collection("engineers")
+		var before Engineer
+		err := collection.FindOneAndReplace(ctx, bson.M{"url": e.URL}, e, options.FindOneAndReplace().SetUpsert(true)).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return m.audit(ctx, ActionEngineerSave, e.URL, nil, e)
+		}
+		if err != nil {
+			return err
+		}
+		return m.audit(ctx, ActionEngineerSave, e.URL, before, e)
+	})
+}
+
+// DeleteEngineer deletes the engineer of the URL and its crawl schedule, keeping the scraped pages
+func (m *NLStorage) DeleteEngineer(ctx context.Context, url string) error {
+	return m.audited(ctx, func(ctx context.Context) error {
+		database := m.client.Database(m.DBName)
+
+		var before Engineer
+		err := database.Collection("engineers").FindOneAndDelete(ctx, bson.M{"url": url}).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting engineer: %v", err)
+		}
+
+		_, err = database.Collection("schedules").DeleteOne(ctx, bson.M{"url": url})
+		if err != nil {
+			return fmt.Errorf("error deleting schedule: %v", err)
+		}
+		return m.audit(ctx, ActionEngineerDelete, url, before, nil)
+	})
+}
+
+// DeleteNewsletter deletes the newsletter of the user email
+func (m *NLStorage) DeleteNewsletter(ctx context.Context, userEmail string) error {
+	return m.audited(ctx, func(ctx context.Context) error {
+		database := m.client.Database(m.DBName)
+		collection := database.Collection("newsletter")
+
+		var before Newsletter
+		err := collection.FindOneAndDelete(ctx, bson.M{"user_email": userEmail}).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting newsletter: %v", err)
+		}
+		return m.audit(ctx, ActionNewsletterDelete, userEmail, before, nil)
+	})
 }
 
 // DistinctEngineerURLs returns all url sites of each distinct engineer
@@ -65,23 +235,80 @@ func (m *NLStorage) DistinctEngineerURLs(ctx context.Context) ([]interface{}, er
 	return resp, nil
 }
 
-// Newsletter returns all the newsletters in the database
-func (m *NLStorage) Newsletter() ([]Newsletter, error) {
+// Engineers returns all the engineers sorted by URL
+func (m *NLStorage) Engineers(ctx context.Context) ([]Engineer, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("engineers")
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"url": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error getting engineers: %v", err)
+	}
+
+	var engineers []Engineer
+	if err = cursor.All(ctx, &engineers); err != nil {
+		return nil, fmt.Errorf("error decoding engineers: %v", err)
+	}
+
+	return engineers, nil
+}
+
+// Engineer returns the engineer of the URL, ErrNotFound when there is none
+func (m *NLStorage) Engineer(ctx context.Context, url string) (Engineer, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("engineers")
+
+	var e Engineer
+	err := collection.FindOne(ctx, bson.M{"url": url}).Decode(&e)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return e, ErrNotFound
+	}
+	if err != nil {
+		return e, fmt.Errorf("error getting engineer: %v", err)
+	}
+	return e, nil
+}
+
+// Newsletter returns up to limit newsletters, sorted by user email, whose user email comes after the given one.
+// An empty after starts from the beginning and a limit less than or equal to zero returns all the remaining newsletters.
+func (m *NLStorage) Newsletter(ctx context.Context, after string, limit int) ([]Newsletter, error) {
 	var newsletters []Newsletter
 	database := m.client.Database(m.DBName)
 	collection := database.Collection("newsletter")
-	cursor, err := collection.Find(context.Background(), bson.M{})
+
+	opts := options.Find().SetSort(bson.M{"user_email": 1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"user_email": bson.M{"$gt": after}}, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = cursor.All(context.Background(), &newsletters); err != nil {
+	if err = cursor.All(ctx, &newsletters); err != nil {
 		return nil, err
 	}
 
 	return newsletters, nil
 }
 
+// Subscription returns the newsletter of the user email, ErrNotFound when there is none
+func (m *NLStorage) Subscription(ctx context.Context, userEmail string) (Newsletter, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("newsletter")
+
+	var n Newsletter
+	err := collection.FindOne(ctx, bson.M{"user_email": userEmail}).Decode(&n)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return n, ErrNotFound
+	}
+	if err != nil {
+		return n, fmt.Errorf("error getting subscription: %v", err)
+	}
+	return n, nil
+}
+
 // SavePage saves the scraped content of a website
 func (m *NLStorage) SavePage(ctx context.Context, pages []Page) error {
 	database := m.client.Database(m.DBName)
@@ -144,6 +371,52 @@ func (m *NLStorage) PageIn(ctx context.Context, urls []string) ([]Page, error) {
 	return page, nil
 }
 
+// PageHistory returns up to limit scraped versions of a given url, from the newest to the oldest.
+// A limit less than or equal to zero returns all the versions.
+func (m *NLStorage) PageHistory(ctx context.Context, url string, limit int) ([]Page, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("pages")
+
+	opts := options.Find().SetSort(bson.M{"scrape_date": -1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"url": url}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting page history: %v", err)
+	}
+
+	var pages []Page
+	if err = cursor.All(ctx, &pages); err != nil {
+		return nil, fmt.Errorf("error decoding page history: %v", err)
+	}
+
+	return pages, nil
+}
+
+// PageChanges returns up to limit versions of the url that changed the page, the newest first, without their text.
+// A limit less than or equal to zero returns all of them.
+func (m *NLStorage) PageChanges(ctx context.Context, url string, limit int) ([]Page, error) {
+	collection := m.client.Database(m.DBName).Collection("pages")
+
+	opts := options.Find().SetSort(bson.M{"scrape_date": -1}).SetProjection(bson.M{"text": 0})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"url": url, "is_most_recent": true}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting page changes: %v", err)
+	}
+
+	var pages []Page
+	if err = cursor.All(ctx, &pages); err != nil {
+		return nil, fmt.Errorf("error decoding page changes: %v", err)
+	}
+	return pages, nil
+}
+
 // Page returns the last scraped content of a given url
 func (m *NLStorage) Page(ctx context.Context, url string) ([]Page, error) {
 	var page []Page
@@ -177,3 +450,44 @@ func (m *NLStorage) Page(ctx context.Context, url string) ([]Page, error) {
 
 	return page, nil
 }
+
+// DeletePagesBefore deletes the versions of the pages scraped before the given time, always keeping the last
+// version of every url, that the next crawl is compared with. It returns the number of deleted versions.
+func (m *NLStorage) DeletePagesBefore(ctx context.Context, before time.Time) (int64, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("pages")
+
+	cursor, err := collection.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"scrape_date": bson.M{"$lt": before}}},
+		{"$group": bson.M{"_id": "$url"}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting expired pages: %v", err)
+	}
+	var urls []struct {
+		URL string `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &urls); err != nil {
+		return 0, fmt.Errorf("error decoding expired pages: %v", err)
+	}
+
+	var deleted int64
+	for _, u := range urls {
+		last, err := m.Page(ctx, u.URL)
+		if err != nil {
+			return deleted, err
+		}
+
+		filter := bson.M{"url": u.URL, "scrape_date": bson.M{"$lt": before}}
+		if len(last) > 0 && !last[0].ScrapeDatetime.After(before) {
+			filter["scrape_date"] = bson.M{"$lt": last[0].ScrapeDatetime}
+		}
+
+		resp, err := collection.DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, fmt.Errorf("error deleting pages: %v", err)
+		}
+		deleted += resp.DeletedCount
+	}
+	return deleted, nil
+}
@@ -75,7 +75,7 @@ func TestNLStorageNewsletter(t *testing.T) {
 	}
 
 	NLStorage := NewNLStorage(client, DBName)
-	got, err := NLStorage.Newsletter()
+	got, err := NLStorage.Newsletter(ctx, "", 0)
 	if err != nil {
 		t.Fatal("error getting newsletter", err)
 	}
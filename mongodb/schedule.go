@@ -0,0 +1,70 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Schedule is the crawl state of an engineer URL
+type Schedule struct {
+	URL     string    `bson:"url"`
+	NextRun time.Time `bson:"next_run"`
+	LastRun time.Time `bson:"last_run"`
+	// UnchangedRuns is the number of consecutive crawls that found no change in the page
+	UnchangedRuns int `bson:"unchanged_runs"`
+	// Interval is the current polling interval learned from the change history, zero when not adaptive
+	Interval time.Duration `bson:"interval"`
+	// ChangeRate is the estimated number of changes per day of the page
+	ChangeRate float64 `bson:"change_rate"`
+}
+
+// SaveSchedule saves the schedule of an URL, replacing the previous one
+func (m *NLStorage) SaveSchedule(ctx context.Context, s Schedule) error {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("schedules")
+	_, err := collection.ReplaceOne(ctx, bson.M{"url": s.URL}, s, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error saving schedule: %v", err)
+	}
+	return nil
+}
+
+// Schedule returns the schedule of the URL, ErrNotFound when it was never scheduled
+func (m *NLStorage) Schedule(ctx context.Context, url string) (Schedule, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("schedules")
+
+	var s Schedule
+	err := collection.FindOne(ctx, bson.M{"url": url}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s, ErrNotFound
+	}
+	if err != nil {
+		return s, fmt.Errorf("error getting schedule: %v", err)
+	}
+	return s, nil
+}
+
+// Schedules returns the schedules of all the URLs sorted by URL
+func (m *NLStorage) Schedules(ctx context.Context) ([]Schedule, error) {
+	database := m.client.Database(m.DBName)
+	collection := database.Collection("schedules")
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"url": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error getting schedules: %v", err)
+	}
+
+	var schedules []Schedule
+	if err = cursor.All(ctx, &schedules); err != nil {
+		return nil, fmt.Errorf("error decoding schedules: %v", err)
+	}
+
+	return schedules, nil
+}
@@ -0,0 +1,84 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PageQuery selects the versions of the pages that changed
+type PageQuery struct {
+	// Text are the words searched in the text of the versions, any of them matches. Empty matches every version.
+	Text string
+	// URLs are the pages searched, all of them when empty
+	URLs []string
+	// From and To bound the scrape time of the versions, when not zero
+	From time.Time
+	To   time.Time
+	// Limit is the maximum number of versions, all of them when less than or equal to zero
+	Limit int
+}
+
+// SearchPages returns the versions of the pages that changed matching the query, the most relevant first and then
+// the newest first. The versions are returned without content, their Text is enough to show them.
+func (m *NLStorage) SearchPages(ctx context.Context, q PageQuery) ([]Page, error) {
+	collection := m.client.Database(m.DBName).Collection("pages")
+
+	filter := bson.M{"is_most_recent": true}
+	if len(q.URLs) > 0 {
+		filter["url"] = bson.M{"$in": q.URLs}
+	}
+	date := bson.M{}
+	if !q.From.IsZero() {
+		date["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		date["$lte"] = q.To
+	}
+	if len(date) > 0 {
+		filter["scrape_date"] = date
+	}
+
+	projection := bson.M{"content": 0}
+	sort := bson.D{{Key: "scrape_date", Value: -1}}
+	if q.Text != "" {
+		filter["$text"] = bson.M{"$search": q.Text}
+		projection["score"] = bson.M{"$meta": "textScore"}
+		sort = append(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}}, sort...)
+	}
+
+	opts := options.Find().SetProjection(projection).SetSort(sort)
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error searching pages: %v", err)
+	}
+
+	var pages []Page
+	if err = cursor.All(ctx, &pages); err != nil {
+		return nil, fmt.Errorf("error decoding pages: %v", err)
+	}
+	return pages, nil
+}
+
+// PageVersion returns the version of the page of the url scraped at, ErrNotFound when there is none
+func (m *NLStorage) PageVersion(ctx context.Context, url string, at time.Time) (Page, error) {
+	collection := m.client.Database(m.DBName).Collection("pages")
+
+	var p Page
+	err := collection.FindOne(ctx, bson.M{"url": url, "scrape_date": at}).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Page{}, ErrNotFound
+	}
+	if err != nil {
+		return Page{}, fmt.Errorf("error getting page version: %v", err)
+	}
+	return p, nil
+}
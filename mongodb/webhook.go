@@ -0,0 +1,225 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Webhook is an URL registered by a subscriber to receive the change events of the pages
+type Webhook struct {
+	ID        string `bson:"_id"`
+	UserEmail string `bson:"user_email"`
+	// Endpoint is the URL the events are posted to
+	Endpoint string `bson:"endpoint"`
+	// Secret signs the requests, so the receiver can check they come from the newsletter
+	Secret string `bson:"secret"`
+	// URLs are the pages whose changes are sent, all of them when empty
+	URLs      []string  `bson:"urls,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is an event sent, or to be sent, to a webhook, with the log of its attempts
+type Delivery struct {
+	ID        string `bson:"_id"`
+	WebhookID string `bson:"webhook_id"`
+	Event     string `bson:"event"`
+	// Payload is the JSON body of the requests, the same on every attempt and replay
+	Payload []byte `bson:"payload"`
+	// Status is pending until the delivery succeeds or runs out of attempts
+	Status   string            `bson:"status"`
+	Attempts []DeliveryAttempt `bson:"attempts"`
+	// NextAttempt is when a pending delivery is tried again
+	NextAttempt time.Time `bson:"next_attempt"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+// DeliveryAttempt is a request sent to a webhook
+type DeliveryAttempt struct {
+	At       time.Time     `bson:"at"`
+	Duration time.Duration `bson:"duration"`
+	// Error is empty when the webhook accepted the request
+	Error string `bson:"error,omitempty"`
+}
+
+// SaveWebhook saves a webhook, replacing the webhook with the same ID
+func (m *NLStorage) SaveWebhook(ctx context.Context, w Webhook) error {
+	return m.audited(ctx, func(ctx context.Context) error {
+		collection := m.client.Database(m.DBName).Collection("webhooks")
+		var before Webhook
+		err := collection.FindOneAndReplace(ctx, bson.M{"_id": w.ID}, w, options.FindOneAndReplace().SetUpsert(true)).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return m.audit(ctx, ActionWebhookSave, w.ID, nil, w)
+		}
+		if err != nil {
+			return fmt.Errorf("error saving webhook: %v", err)
+		}
+		return m.audit(ctx, ActionWebhookSave, w.ID, before, w)
+	})
+}
+
+// Webhooks returns all the webhooks sorted by creation time
+func (m *NLStorage) Webhooks(ctx context.Context) ([]Webhook, error) {
+	collection := m.client.Database(m.DBName).Collection("webhooks")
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhooks: %v", err)
+	}
+
+	var webhooks []Webhook
+	if err = cursor.All(ctx, &webhooks); err != nil {
+		return nil, fmt.Errorf("error decoding webhooks: %v", err)
+	}
+	return webhooks, nil
+}
+
+// Webhook returns the webhook of the ID, ErrNotFound when there is none
+func (m *NLStorage) Webhook(ctx context.Context, id string) (Webhook, error) {
+	collection := m.client.Database(m.DBName).Collection("webhooks")
+
+	var w Webhook
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&w)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Webhook{}, ErrNotFound
+	}
+	if err != nil {
+		return Webhook{}, fmt.Errorf("error getting webhook: %v", err)
+	}
+	return w, nil
+}
+
+// WebhooksFollowing returns the webhooks that receive the changes of the url, the ones following it and the ones
+// following every page, sorted by creation time
+func (m *NLStorage) WebhooksFollowing(ctx context.Context, url string) ([]Webhook, error) {
+	collection := m.client.Database(m.DBName).Collection("webhooks")
+
+	// The webhooks following every page are saved without urls.
+	filter := bson.M{"$or": bson.A{bson.M{"urls": url}, bson.M{"urls": bson.M{"$exists": false}}}}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhooks: %v", err)
+	}
+
+	var webhooks []Webhook
+	if err = cursor.All(ctx, &webhooks); err != nil {
+		return nil, fmt.Errorf("error decoding webhooks: %v", err)
+	}
+	return webhooks, nil
+}
+
+// WebhooksOf returns the webhooks registered by the email sorted by creation time
+func (m *NLStorage) WebhooksOf(ctx context.Context, userEmail string) ([]Webhook, error) {
+	collection := m.client.Database(m.DBName).Collection("webhooks")
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"user_email": userEmail}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhooks: %v", err)
+	}
+
+	var webhooks []Webhook
+	if err = cursor.All(ctx, &webhooks); err != nil {
+		return nil, fmt.Errorf("error decoding webhooks: %v", err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes the webhook and its deliveries
+func (m *NLStorage) DeleteWebhook(ctx context.Context, id string) error {
+	return m.audited(ctx, func(ctx context.Context) error {
+		database := m.client.Database(m.DBName)
+		var before Webhook
+		err := database.Collection("webhooks").FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting webhook: %v", err)
+		}
+
+		_, err = database.Collection("deliveries").DeleteMany(ctx, bson.M{"webhook_id": id})
+		if err != nil {
+			return fmt.Errorf("error deleting webhook deliveries: %v", err)
+		}
+		return m.audit(ctx, ActionWebhookDelete, id, before, nil)
+	})
+}
+
+// SaveDelivery saves a delivery, replacing the delivery with the same ID
+func (m *NLStorage) SaveDelivery(ctx context.Context, d Delivery) error {
+	collection := m.client.Database(m.DBName).Collection("deliveries")
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": d.ID}, d, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error saving delivery: %v", err)
+	}
+	return nil
+}
+
+// Delivery returns the delivery of the ID, ErrNotFound when there is none
+func (m *NLStorage) Delivery(ctx context.Context, id string) (Delivery, error) {
+	collection := m.client.Database(m.DBName).Collection("deliveries")
+
+	var d Delivery
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Delivery{}, ErrNotFound
+	}
+	if err != nil {
+		return Delivery{}, fmt.Errorf("error getting delivery: %v", err)
+	}
+	return d, nil
+}
+
+// Deliveries returns up to limit deliveries of the webhook, from the newest to the oldest.
+// A limit less than or equal to zero returns all the deliveries.
+func (m *NLStorage) Deliveries(ctx context.Context, webhookID string, limit int) ([]Delivery, error) {
+	collection := m.client.Database(m.DBName).Collection("deliveries")
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := collection.Find(ctx, bson.M{"webhook_id": webhookID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting deliveries: %v", err)
+	}
+
+	var deliveries []Delivery
+	if err = cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("error decoding deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// PendingDeliveries returns up to limit pending deliveries due at now, the ones due first first
+func (m *NLStorage) PendingDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	collection := m.client.Database(m.DBName).Collection("deliveries")
+
+	filter := bson.M{"status": DeliveryPending, "next_attempt": bson.M{"$lte": now}}
+	opts := options.Find().SetSort(bson.D{{Key: "next_attempt", Value: 1}, {Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting pending deliveries: %v", err)
+	}
+
+	var deliveries []Delivery
+	if err = cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("error decoding pending deliveries: %v", err)
+	}
+	return deliveries, nil
+}
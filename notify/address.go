@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// ErrPrivateHost is returned for the addresses on loopback, private or link-local hosts. The subscribers choose the
+// URLs the notifications are sent to, reaching those hosts would let them probe the network of the newsletter.
+var ErrPrivateHost = errors.New("private host")
+
+// internalNets are the IPv4 ranges that are neither private nor loopback, yet reach hosts of the local network: the
+// shared address space of carrier-grade NAT, the IETF protocol assignments and the benchmarking networks, all routed
+// inside cloud networks.
+var internalNets = []*net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(192, 0, 0, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)},
+}
+
+// IsPublic reports whether ip is neither loopback, private, link-local, unspecified nor in an internal range
+func IsPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost resolves the host of the URL, failing with ErrPrivateHost when any of its addresses is not public
+func CheckHost(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !IsPublic(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateHost, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !IsPublic(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrPrivateHost, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// NewClient returns a client bounded by Timeout. Unless allowPrivate, it refuses to connect to any address that is not
+// public, checking every connection so that a host cannot pass CheckHost and then resolve to the private network.
+func NewClient(allowPrivate bool) *http.Client {
+	if allowPrivate {
+		return &http.Client{Timeout: Timeout}
+	}
+	dialer := &net.Dialer{Timeout: Timeout, Control: func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateHost, host)
+		}
+		return nil
+	}}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: Timeout, Transport: transport}
+}
@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// truncate cuts s to at most n runes, the limit of the message length of a chat app
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// Slack posts the messages to Slack incoming webhooks, the address is the URL of the webhook. Without a Client, it
+// only connects to public hosts.
+type Slack struct {
+	Client *http.Client
+}
+
+// Notify posts the message to the webhook
+func (s Slack) Notify(ctx context.Context, to string, m Message) error {
+	return send(ctx, hookClient(s.Client), http.MethodPost, to, nil, map[string]string{"text": m.Text()})
+}
+
+// discordMaxLength is the maximum length of the content of a Discord message
+const discordMaxLength = 2000
+
+// Discord posts the messages to Discord webhooks, the address is the URL of the webhook. Without a Client, it only
+// connects to public hosts.
+type Discord struct {
+	Client *http.Client
+}
+
+// Notify posts the message to the webhook
+func (d Discord) Notify(ctx context.Context, to string, m Message) error {
+	return send(ctx, hookClient(d.Client), http.MethodPost, to, nil, map[string]string{"content": truncate(m.Text(), discordMaxLength)})
+}
+
+// TelegramAPI is the base URL of the Telegram Bot API
+const TelegramAPI = "https://api.telegram.org"
+
+// telegramMaxLength is the maximum length of the text of a Telegram message
+const telegramMaxLength = 4096
+
+// Telegram sends the messages with a Telegram bot, the address is the ID of the chat
+type Telegram struct {
+	// Token is the token of the bot
+	Token string
+	// BaseURL is the URL of the Bot API, TelegramAPI when empty
+	BaseURL string
+	Client  *http.Client
+}
+
+// Notify sends the message to the chat
+func (t Telegram) Notify(ctx context.Context, to string, m Message) error {
+	base := t.BaseURL
+	if base == "" {
+		base = TelegramAPI
+	}
+	return send(ctx, client(t.Client), http.MethodPost, base+"/bot"+t.Token+"/sendMessage", nil, map[string]interface{}{
+		"chat_id":                  to,
+		"text":                     truncate(m.Text(), telegramMaxLength),
+		"disable_web_page_preview": true,
+	})
+}
+
+// Matrix sends the messages as a Matrix user, the address is the ID of the room, that the user must have joined
+type Matrix struct {
+	// Homeserver is the URL of the homeserver of the user, e.g. https://matrix.org
+	Homeserver string
+	// Token is the access token of the user
+	Token  string
+	Client *http.Client
+}
+
+// matrixTxn makes the transaction IDs of the Matrix messages unique within the process
+var matrixTxn atomic.Int64
+
+// Notify sends the message to the room
+func (mx Matrix) Notify(ctx context.Context, to string, m Message) error {
+	txn := strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatInt(matrixTxn.Add(1), 36)
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		mx.Homeserver, url.PathEscape(to), txn)
+	header := http.Header{"Authorization": {"Bearer " + mx.Token}}
+	return send(ctx, client(mx.Client), http.MethodPut, endpoint, header, map[string]string{
+		"msgtype": "m.text",
+		"body":    m.Text(),
+	})
+}
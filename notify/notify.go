@@ -0,0 +1,110 @@
+// Package notify delivers the notifications of the newsletter through chat apps and webhooks.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Timeout bounds every request of the notifiers without a Client
+const Timeout = 10 * time.Second
+
+var (
+	defaultClient = NewClient(true)
+	publicClient  = NewClient(false)
+)
+
+// Message is a notification of new articles
+type Message struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// URLs are the URLs with new articles
+	URLs []string `json:"urls"`
+}
+
+// Text returns the message as plain text
+func (m Message) Text() string {
+	return m.Subject + "\n\n" + m.Body
+}
+
+// Notifier delivers a message to an address, whose meaning depends on the channel: an email address, a webhook
+// URL, a chat ID or a room ID.
+type Notifier interface {
+	Notify(ctx context.Context, to string, m Message) error
+}
+
+// NotifierFunc is a function that implements Notifier
+type NotifierFunc func(ctx context.Context, to string, m Message) error
+
+// Notify calls f
+func (f NotifierFunc) Notify(ctx context.Context, to string, m Message) error {
+	return f(ctx, to, m)
+}
+
+// client returns c, a client bounded by Timeout when nil
+func client(c *http.Client) *http.Client {
+	if c == nil {
+		return defaultClient
+	}
+	return c
+}
+
+// hookClient returns c, a client bounded by Timeout that only connects to public hosts when nil. It is the default of
+// the notifiers whose addresses are URLs chosen by the subscribers.
+func hookClient(c *http.Client) *http.Client {
+	if c == nil {
+		return publicClient
+	}
+	return c
+}
+
+// redact returns the cause of a request error without the URL, that carries the token of a Telegram bot
+func redact(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return uerr.Err
+	}
+	return err
+}
+
+// send sends the JSON payload to url and fails on any status other than 2xx, reporting the body of the response.
+func send(ctx context.Context, c *http.Client, method, endpoint string, header http.Header, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %v", err)
+	}
+	return sendBytes(ctx, c, method, endpoint, header, body)
+}
+
+func sendBytes(ctx context.Context, c *http.Client, method, endpoint string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating notification request: %v", redact(err))
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending notification: %v", redact(err))
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("error sending notification: status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request is a request received by the stand-in server
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newServer starts a stand-in of a chat API that records the requests and answers with status.
+func newServer(t *testing.T, status int) (*httptest.Server, <-chan request) {
+	reqs := make(chan request, 4)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error("error reading request", err)
+		}
+		reqs <- request{method: r.Method, path: r.URL.EscapedPath(), header: r.Header, body: body}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"ok":false,"description":"Bad Request: chat not found"}`))
+	}))
+	t.Cleanup(svr.Close)
+	return svr, reqs
+}
+
+func decode(t *testing.T, body []byte) map[string]interface{} {
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("error decoding %s: %v", body, err)
+	}
+	return got
+}
+
+var msg = Message{Subject: "Newsletter", Body: "We have found 1 new article", URLs: []string{"http://a.test"}}
+
+func TestSlack(t *testing.T) {
+	svr, reqs := newServer(t, http.StatusOK)
+
+	if err := (Slack{Client: svr.Client()}).Notify(context.Background(), svr.URL+"/services/T0/B0/X", msg); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	r := <-reqs
+	if r.method != http.MethodPost || r.path != "/services/T0/B0/X" {
+		t.Fatalf("unexpected request %s %s", r.method, r.path)
+	}
+	if got := decode(t, r.body); got["text"] != msg.Text() {
+		t.Fatalf("unexpected payload %v", got)
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	svr, reqs := newServer(t, http.StatusNoContent)
+
+	long := Message{Subject: "Newsletter", Body: strings.Repeat("a", 3000)}
+	if err := (Discord{Client: svr.Client()}).Notify(context.Background(), svr.URL, long); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	content, _ := decode(t, (<-reqs).body)["content"].(string)
+	if n := len([]rune(content)); n != discordMaxLength {
+		t.Fatalf("expected the content to be truncated to %d characters, got %d", discordMaxLength, n)
+	}
+}
+
+func TestTelegram(t *testing.T) {
+	svr, reqs := newServer(t, http.StatusOK)
+
+	tg := Telegram{Token: "123:abc", BaseURL: svr.URL}
+	if err := tg.Notify(context.Background(), "-1001", msg); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	r := <-reqs
+	if r.path != "/bot123:abc/sendMessage" {
+		t.Fatalf("unexpected path %s", r.path)
+	}
+	if got := decode(t, r.body); got["chat_id"] != "-1001" || got["text"] != msg.Text() {
+		t.Fatalf("unexpected payload %v", got)
+	}
+}
+
+func TestTelegram_Error(t *testing.T) {
+	svr, _ := newServer(t, http.StatusBadRequest)
+
+	err := Telegram{Token: "123:abc", BaseURL: svr.URL}.Notify(context.Background(), "-1001", msg)
+	if err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Fatalf("expected the error of the API, got %v", err)
+	}
+}
+
+func TestTelegram_Unreachable(t *testing.T) {
+	svr, _ := newServer(t, http.StatusOK)
+	svr.Close()
+
+	err := Telegram{Token: "123:abc", BaseURL: svr.URL}.Notify(context.Background(), "-1001", msg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if strings.Contains(err.Error(), "123:abc") {
+		t.Fatalf("expected the token to be redacted, got %v", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	if got := client(nil).Timeout; got != Timeout {
+		t.Fatalf("got timeout %v, want %v", got, Timeout)
+	}
+	c := &http.Client{}
+	if got := client(c); got != c {
+		t.Fatal("expected the client to be kept")
+	}
+	if got := hookClient(c); got != c {
+		t.Fatal("expected the client to be kept")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	svr, _ := newServer(t, http.StatusOK)
+
+	err := (Slack{}).Notify(context.Background(), svr.URL, msg)
+	if err == nil || !strings.Contains(err.Error(), ErrPrivateHost.Error()) {
+		t.Fatalf("expected %v, got %v", ErrPrivateHost, err)
+	}
+	if err := (Slack{Client: NewClient(true)}).Notify(context.Background(), svr.URL, msg); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	svr, reqs := newServer(t, http.StatusOK)
+
+	mx := Matrix{Homeserver: svr.URL, Token: "syt_token"}
+	for i := 0; i < 2; i++ {
+		if err := mx.Notify(context.Background(), "!room:matrix.org", msg); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	first, second := <-reqs, <-reqs
+	prefix := "/_matrix/client/v3/rooms/%21room:matrix.org/send/m.room.message/"
+	if first.method != http.MethodPut || !strings.HasPrefix(first.path, prefix) {
+		t.Fatalf("unexpected request %s %s", first.method, first.path)
+	}
+	if first.path == second.path {
+		t.Fatalf("expected a new transaction ID for every message, got %s twice", first.path)
+	}
+	if got := first.header.Get("Authorization"); got != "Bearer syt_token" {
+		t.Fatalf("unexpected authorization %q", got)
+	}
+	if got := decode(t, first.body); got["msgtype"] != "m.text" || got["body"] != msg.Text() {
+		t.Fatalf("unexpected payload %v", got)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	svr, reqs := newServer(t, http.StatusAccepted)
+
+	if err := (Webhook{Secret: "s3cret", Client: svr.Client()}).Notify(context.Background(), svr.URL, msg); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	r := <-reqs
+	req := httptest.NewRequest(r.method, "/", nil)
+	req.Header = r.header
+	if err := Verify("s3cret", req, r.body, time.Minute); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	if err := Verify("other", req, r.body, time.Minute); err == nil {
+		t.Fatal("expected an invalid signature with another secret")
+	}
+	if err := Verify("s3cret", req, append(r.body, ' '), time.Minute); err == nil {
+		t.Fatal("expected an invalid signature for a tampered body")
+	}
+
+	var got Message
+	if err := json.Unmarshal(r.body, &got); err != nil {
+		t.Fatal("error decoding message", err)
+	}
+	if got.Subject != msg.Subject || got.Body != msg.Body || len(got.URLs) != 1 {
+		t.Fatalf("unexpected message %v", got)
+	}
+
+	if err := (Webhook{Client: svr.Client()}).Notify(context.Background(), svr.URL, msg); err == nil {
+		t.Fatal("expected an error notifying without a secret")
+	}
+	if len(reqs) != 0 {
+		t.Fatal("expected no request without a secret")
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	body := []byte(`{}`)
+	timestamp := time.Now().Add(-time.Hour).Unix()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(TimestampHeader, "yesterday")
+	if err := Verify("s3cret", req, body, time.Minute); err == nil {
+		t.Fatal("expected error for an invalid timestamp")
+	}
+
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign("s3cret", timestamp, body))
+	if err := Verify("s3cret", req, body, time.Minute); err == nil {
+		t.Fatal("expected error for an old request")
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		url     string
+		private bool
+	}{
+		{url: "https://93.184.216.34/hook"},
+		{url: "https://[2606:2800:220:1:248:1893:25c8:1946]/hook"},
+		{url: "http://127.0.0.1:8080/hook", private: true},
+		{url: "http://localhost/hook", private: true},
+		{url: "http://10.0.0.1/hook", private: true},
+		{url: "http://192.168.1.1/hook", private: true},
+		{url: "http://169.254.169.254/latest/meta-data", private: true},
+		{url: "http://0.0.0.0/hook", private: true},
+		{url: "http://[::1]/hook", private: true},
+		{url: "http://[fe80::1]/hook", private: true},
+		{url: "http://[::ffff:127.0.0.1]/hook", private: true},
+		{url: "http://100.64.0.1/hook", private: true},
+		{url: "http://100.127.255.254/hook", private: true},
+		{url: "http://192.0.0.8/hook", private: true},
+		{url: "http://198.18.0.1/hook", private: true},
+		{url: "http://198.19.255.254/hook", private: true},
+		{url: "http://[::ffff:100.64.0.1]/hook", private: true},
+		{url: "https://100.128.0.1/hook"},
+		{url: "https://198.20.0.1/hook"},
+	}
+
+	for _, tt := range tests {
+		err := CheckHost(context.Background(), tt.url)
+		if got := errors.Is(err, ErrPrivateHost); got != tt.private || (!tt.private && err != nil) {
+			t.Errorf("%s: got %v, want private %v", tt.url, err, tt.private)
+		}
+	}
+}
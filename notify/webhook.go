@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 signature of a webhook request, as "sha256=<hex>"
+	SignatureHeader = "X-Newsletter-Signature"
+	// TimestampHeader carries the Unix time the webhook request was signed at
+	TimestampHeader = "X-Newsletter-Timestamp"
+)
+
+// Sign returns the signature of a webhook body sent at timestamp: the HMAC-SHA256, keyed by secret, of the
+// timestamp, a dot and the body. Signing the timestamp keeps a captured request from being replayed later.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a webhook request, rejecting the requests signed more than maxAge ago.
+// It is meant for the receivers of the webhooks.
+func Verify(secret string, r *http.Request, body []byte, maxAge time.Duration) error {
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp: %v", err)
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("webhook signed %v ago, more than %v", age.Round(time.Second), maxAge)
+	}
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(Sign(secret, timestamp, body))) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+	return nil
+}
+
+// Webhook posts the messages as JSON to any URL, signed with Secret, the address is the URL. Without a Client, it only
+// connects to public hosts.
+type Webhook struct {
+	Secret string
+	Client *http.Client
+}
+
+// Notify posts the signed message to the URL. Unsigned messages could be forged, so it fails without a Secret.
+func (w Webhook) Notify(ctx context.Context, to string, m Message) error {
+	if w.Secret == "" {
+		return errors.New("webhook without a secret")
+	}
+	return w.Post(ctx, to, nil, m)
+}
+
+// Post posts the payload as JSON to the URL with the extra header, signed with Secret
+func (w Webhook) Post(ctx context.Context, url string, header http.Header, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %v", err)
+	}
+
+	timestamp := time.Now().Unix()
+	signed := http.Header{
+		TimestampHeader: {strconv.FormatInt(timestamp, 10)},
+		SignatureHeader: {Sign(w.Secret, timestamp, body)},
+	}
+	for k, v := range header {
+		signed[k] = v
+	}
+	return sendBytes(ctx, hookClient(w.Client), http.MethodPost, url, signed, body)
+}
@@ -0,0 +1,258 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// maxOPMLSize bounds the OPML documents read on import
+const maxOPMLSize = 5 << 20
+
+// OPML is an outline of the sources followed in a feed reader
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    OPMLHead `xml:"head"`
+	Body    OPMLBody `xml:"body"`
+}
+
+// OPMLHead is the head of an OPML document
+type OPMLHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+// OPMLBody is the body of an OPML document
+type OPMLBody struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+// Outline is a source of an OPML document, or a category of sources when it has outlines of its own
+type Outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// ParseOPML returns the engineers of the sources of the OPML document, in order and without duplicates.
+// The URL of an engineer is the website of its source, the feed when the source has no website.
+func ParseOPML(r io.Reader) ([]mongodb.Engineer, error) {
+	var doc OPML
+	if err := xml.NewDecoder(io.LimitReader(r, maxOPMLSize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding OPML: %v", err)
+	}
+
+	var engineers []mongodb.Engineer
+	seen := make(map[string]bool)
+	var walk func(outlines []Outline) error
+	walk = func(outlines []Outline) error {
+		for _, o := range outlines {
+			if err := walk(o.Outlines); err != nil {
+				return err
+			}
+
+			source := o.HTMLURL
+			if source == "" {
+				source = o.XMLURL
+			}
+			if source == "" {
+				continue
+			}
+			u, err := url.Parse(source)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("invalid URL %q of %q", source, o.Text)
+			}
+			if seen[source] {
+				continue
+			}
+			seen[source] = true
+
+			name := o.Title
+			if name == "" {
+				name = o.Text
+			}
+			engineers = append(engineers, mongodb.Engineer{Name: name, URL: source})
+		}
+		return nil
+	}
+	if err := walk(doc.Body.Outlines); err != nil {
+		return nil, err
+	}
+	return engineers, nil
+}
+
+// OPMLStorage is the storage of the engineers and subscriptions imported from OPML
+type OPMLStorage interface {
+	Storage
+	SaveEngineer(ctx context.Context, e mongodb.Engineer) error
+	SaveNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error
+}
+
+// ImportResult counts what an import added
+type ImportResult struct {
+	// Engineers is the number of engineers created, the existing ones are kept as they are
+	Engineers int `json:"engineers"`
+	// URLs is the number of URLs added to the subscription
+	URLs int `json:"urls"`
+}
+
+// ImportOPML creates the engineers of the sources of ParseOPML and subscribes the user to them, creating the
+// subscription when the user has none.
+func ImportOPML(ctx context.Context, s OPMLStorage, userEmail string, sources []mongodb.Engineer) (ImportResult, error) {
+	engineers, err := s.Engineers(ctx)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("error getting engineers: %v", err)
+	}
+	var res ImportResult
+	for _, e := range sources {
+		if _, ok := engineerOf(engineers, e.URL); ok {
+			continue
+		}
+		if err := s.SaveEngineer(ctx, e); err != nil {
+			return res, fmt.Errorf("error saving engineer: %v", err)
+		}
+		res.Engineers++
+	}
+
+	n, err := s.Subscription(ctx, userEmail)
+	exists := err == nil
+	if err != nil && !errors.Is(err, mongodb.ErrNotFound) {
+		return res, err
+	}
+	n.UserEmail = userEmail
+	for _, e := range sources {
+		if !contains(n.URLs, e.URL) {
+			n.URLs = append(n.URLs, e.URL)
+			res.URLs++
+		}
+	}
+
+	switch {
+	case res.URLs == 0:
+	case exists:
+		err = s.UpdateNewsletter(ctx, n)
+	default:
+		err = s.SaveNewsletter(ctx, n)
+	}
+	if err != nil {
+		return res, fmt.Errorf("error saving newsletter: %v", err)
+	}
+	return res, nil
+}
+
+// ExportOPML returns the OPML document of the sources the user subscribed to. When feedBase, the URL the feeds
+// are served at, is not empty, every source links to the Atom feed of its engineer.
+// It returns mongodb.ErrNotFound when the user has no subscription.
+func ExportOPML(ctx context.Context, s Storage, userEmail, feedBase string) (OPML, error) {
+	n, err := s.Subscription(ctx, userEmail)
+	if err != nil {
+		return OPML{}, err
+	}
+	engineers, err := s.Engineers(ctx)
+	if err != nil {
+		return OPML{}, fmt.Errorf("error getting engineers: %v", err)
+	}
+
+	doc := OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title:       "Newsletter of " + userEmail,
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, u := range n.URLs {
+		e, _ := engineerOf(engineers, u)
+		o := Outline{Text: e.Name, Title: e.Name, HTMLURL: u}
+		if feedBase != "" {
+			o.Type = "rss"
+			o.XMLURL = strings.TrimSuffix(feedBase, "/") + "/feeds/engineers?url=" + url.QueryEscape(u)
+		}
+		doc.Body.Outlines = append(doc.Body.Outlines, o)
+	}
+	return doc, nil
+}
+
+// WriteOPML writes the OPML document to w
+func WriteOPML(w io.Writer, doc OPML) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("error writing OPML: %v", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("error writing OPML: %v", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// OPMLHandler serves the OPML documents of the subscribers at /opml:
+//
+//	GET  /opml?email=<email>    exports the sources of the subscriber
+//	POST /opml?email=<email>    imports the sources of the OPML body into the subscription
+//
+// With feeds, the exported sources link to the feeds of FeedHandler, served by the same server.
+func OPMLHandler(s OPMLStorage, feeds bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			http.Error(w, "missing email", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var feedBase string
+			if feeds {
+				feedBase = requestBase(r)
+			}
+			doc, err := ExportOPML(r.Context(), s, email, feedBase)
+			if errors.Is(err, mongodb.ErrNotFound) {
+				http.Error(w, "subscriber not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error exporting OPML", "error", err)
+				http.Error(w, "error exporting OPML", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+			if err := WriteOPML(w, doc); err != nil {
+				slog.ErrorContext(r.Context(), "error writing OPML", "error", err)
+			}
+		case http.MethodPost:
+			if !strings.Contains(email, "@") {
+				http.Error(w, fmt.Sprintf("invalid email address %q", email), http.StatusBadRequest)
+				return
+			}
+			sources, err := ParseOPML(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res, err := ImportOPML(r.Context(), s, email, sources)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error importing OPML", "error", err)
+				http.Error(w, "error importing OPML", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, res)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+const testOPML = `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+  <head><title>Feeds</title></head>
+  <body>
+    <outline text="Essays">
+      <outline text="pg" title="Paul Graham" type="rss" xmlUrl="http://www.aaronsw.com/2002/feeds/pgessays.rss" htmlUrl="http://www.paulgraham.com/articles.html"/>
+      <outline text="Joel on Software" type="rss" xmlUrl="https://www.joelonsoftware.com/feed/"/>
+    </outline>
+    <outline text="Paul Graham again" htmlUrl="http://www.paulgraham.com/articles.html"/>
+  </body>
+</opml>`
+
+func TestParseOPML(t *testing.T) {
+	got, err := ParseOPML(strings.NewReader(testOPML))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	want := []mongodb.Engineer{
+		{Name: "Paul Graham", URL: "http://www.paulgraham.com/articles.html"},
+		{Name: "Joel on Software", URL: "https://www.joelonsoftware.com/feed/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for _, doc := range []string{"<html></html>", `<opml><body><outline text="x" htmlUrl="ftp://x.test"/></body></opml>`} {
+		if _, err := ParseOPML(strings.NewReader(doc)); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+}
+
+func TestImportOPML(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	sub := mongodb.Newsletter{
+		UserEmail: "j@gmail.com",
+		URLs:      []string{"https://www.joelonsoftware.com/feed/"},
+		Channels:  []mongodb.Channel{{Type: ChannelTelegram, Address: "-1001"}},
+	}
+	if err := s.SaveNewsletter(ctx, sub); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	if err := s.SaveEngineer(ctx, mongodb.Engineer{Name: "Joel", URL: "https://www.joelonsoftware.com/feed/", Schedule: "6h"}); err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+
+	sources, err := ParseOPML(strings.NewReader(testOPML))
+	if err != nil {
+		t.Fatal("error parsing OPML", err)
+	}
+	for i, want := range []ImportResult{{Engineers: 1, URLs: 1}, {}} {
+		got, err := ImportOPML(ctx, s, "j@gmail.com", sources)
+		if err != nil || got != want {
+			t.Fatalf("import %d: expected %v, got %v (%v)", i, want, got, err)
+		}
+	}
+
+	n, err := s.Subscription(ctx, "j@gmail.com")
+	if err != nil {
+		t.Fatal("error getting newsletter", err)
+	}
+	sub.URLs = append(sub.URLs, "http://www.paulgraham.com/articles.html")
+	if !reflect.DeepEqual(n, sub) {
+		t.Fatalf("expected the URLs to be added and the channels kept, got %v", n)
+	}
+	// The existing engineers are not overwritten.
+	engineers, _ := s.Engineers(ctx)
+	if e, _ := engineerOf(engineers, "https://www.joelonsoftware.com/feed/"); e.Name != "Joel" || e.Schedule != "6h" {
+		t.Fatalf("expected the engineer to be kept, got %v", e)
+	}
+
+	if got, err := ImportOPML(ctx, s, "k@gmail.com", sources); err != nil || got.URLs != 2 {
+		t.Fatalf("expected a new subscription of 2 URLs, got %v (%v)", got, err)
+	}
+}
+
+func TestOPMLHandler(t *testing.T) {
+	svr := httptest.NewServer(OPMLHandler(memory.NewStorage(), true))
+	defer svr.Close()
+
+	resp, err := http.Post(svr.URL+"/opml?email=j@gmail.com", "text/x-opml", strings.NewReader(testOPML))
+	if err != nil {
+		t.Fatal("error importing OPML", err)
+	}
+	var res ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal("error decoding result", err)
+	}
+	_ = resp.Body.Close()
+	if res != (ImportResult{Engineers: 2, URLs: 2}) {
+		t.Fatalf("unexpected result %v", res)
+	}
+
+	resp, err = http.Get(svr.URL + "/opml?email=j@gmail.com")
+	if err != nil {
+		t.Fatal("error exporting OPML", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	sources, err := ParseOPML(resp.Body)
+	if err != nil {
+		t.Fatal("error parsing exported OPML", err)
+	}
+	if len(sources) != 2 || sources[0].Name != "Paul Graham" {
+		t.Fatalf("unexpected sources %v", sources)
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodGet, "/opml?email=k@gmail.com", "", http.StatusNotFound},
+		{http.MethodGet, "/opml", "", http.StatusBadRequest},
+		{http.MethodPost, "/opml?email=j@gmail.com", "not xml", http.StatusBadRequest},
+		{http.MethodPost, "/opml?email=j", testOPML, http.StatusBadRequest},
+		{http.MethodDelete, "/opml?email=j@gmail.com", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
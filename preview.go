@@ -0,0 +1,115 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WriterEmail writes the emails to W instead of sending them, separated by a blank line
+type WriterEmail struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+// Send writes the email to W
+func (w *WriterEmail) Send(dest []string, bodyMessage string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := fmt.Fprintf(w.W, "%s\n", NewMessage(dest, bodyMessage).Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing email: %v", err)
+	}
+	return nil
+}
+
+// DirEmail writes every email to a .eml file in Dir, named after its recipient, instead of sending it.
+// The files of a previous run are overwritten.
+type DirEmail struct {
+	Dir string
+}
+
+// Send writes the email to Dir
+func (d DirEmail) Send(dest []string, bodyMessage string) error {
+	if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+		return fmt.Errorf("error creating email directory: %v", err)
+	}
+
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(dest[0]) + ".eml"
+	err := os.WriteFile(filepath.Join(d.Dir, name), NewMessage(dest, bodyMessage).Bytes(), 0o644)
+	if err != nil {
+		return fmt.Errorf("error writing email: %v", err)
+	}
+	return nil
+}
+
+// Preview renders the pending emails of every newsletter, without sending them nor touching the delivery state.
+func Preview(ctx context.Context, s Storage) ([]Message, error) {
+	var msgs []Message
+	var after string
+	for {
+		nl, err := s.Newsletter(ctx, after, DefaultEmailBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("error getting newsletter: %v", err)
+		}
+
+		for _, n := range nl {
+			if msg, ok := renderNewsletter(ctx, s, n); ok {
+				msgs = append(msgs, msg)
+			}
+		}
+
+		if len(nl) < DefaultEmailBatchSize {
+			return msgs, nil
+		}
+		after = nl[len(nl)-1].UserEmail
+	}
+}
+
+// PreviewHandler serves the pending emails. Without query it lists all of them as JSON, with the email query it
+// returns the email of that user as a message/rfc822 document.
+func PreviewHandler(s Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		msgs, err := Preview(r.Context(), s)
+		if err != nil {
+			slog.Error("error previewing emails", "error", err)
+			http.Error(w, "error previewing emails", http.StatusInternalServerError)
+			return
+		}
+
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			if msgs == nil {
+				msgs = []Message{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(msgs); err != nil {
+				slog.Error("error encoding emails", "error", err)
+			}
+			return
+		}
+
+		for _, msg := range msgs {
+			if msg.To[0] == email {
+				w.Header().Set("Content-Type", "message/rfc822")
+				_, _ = w.Write(msg.Bytes())
+				return
+			}
+		}
+		http.Error(w, "no pending email for "+email, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,130 @@
+package newsletter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// newPreviewStorage returns a storage where only j@gmail.com has a pending email.
+func newPreviewStorage(ctx context.Context, t *testing.T) *memory.Storage {
+	s := memory.NewStorage()
+
+	newsletters := []mongodb.Newsletter{
+		{UserEmail: "j@gmail.com", URLs: []string{FakeURL}},
+		{UserEmail: "k@gmail.com", URLs: []string{"http://unchanged.test"}},
+	}
+	for _, n := range newsletters {
+		if err := s.SaveNewsletter(ctx, n); err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+
+	err := s.SavePage(ctx, []mongodb.Page{
+		{URL: FakeURL, Content: "Hello, World!", IsMostRecent: true, ScrapeDatetime: time.Now().UTC()},
+		{URL: "http://unchanged.test", Content: "Hello, World!", IsMostRecent: false, ScrapeDatetime: time.Now().UTC()},
+	})
+	if err != nil {
+		t.Fatal("error saving pages", err)
+	}
+	return s
+}
+
+func TestEmailTrigger_DryRun(t *testing.T) {
+	ctx := context.Background()
+	s := newPreviewStorage(ctx, t)
+	dir := t.TempDir()
+
+	opts := EmailOptions{Leaser: s, Owner: "a", Interval: time.Hour, DryRun: true}
+	if err := EmailTrigger(ctx, s, DirEmail{Dir: dir}, opts); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("error reading email directory", err)
+	}
+	if len(files) != 1 || files[0].Name() != "j@gmail.com.eml" {
+		t.Fatalf("expected only j@gmail.com.eml, got %v", files)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal("error reading email", err)
+	}
+	if !strings.HasPrefix(string(content), "To: j@gmail.com\r\nSubject: Newsletter\r\n\r\n") ||
+		!strings.Contains(string(content), FakeURL) {
+		t.Fatalf("unexpected email %q", content)
+	}
+
+	// Nothing was leased nor held, a real run still sends the email.
+	jobs, err := s.Jobs(ctx)
+	if err != nil {
+		t.Fatal("error getting jobs", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("expected no jobs, got %v", jobs)
+	}
+}
+
+func TestWriterEmail(t *testing.T) {
+	ctx := context.Background()
+	s := newPreviewStorage(ctx, t)
+
+	var buf bytes.Buffer
+	if err := EmailTrigger(ctx, s, &WriterEmail{W: &buf}, EmailOptions{DryRun: true}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "To: j@gmail.com") || strings.Contains(out, "k@gmail.com") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestPreviewHandler(t *testing.T) {
+	ctx := context.Background()
+	s := newPreviewStorage(ctx, t)
+	h := PreviewHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/preview", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	var msgs []Message
+	if err := json.NewDecoder(rec.Body).Decode(&msgs); err != nil {
+		t.Fatal("error decoding preview", err)
+	}
+	if len(msgs) != 1 || msgs[0].To[0] != "j@gmail.com" || !strings.Contains(msgs[0].Body, FakeURL) {
+		t.Fatalf("unexpected preview %v", msgs)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/preview?email=j@gmail.com", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "message/rfc822" ||
+		!strings.HasPrefix(rec.Body.String(), "To: j@gmail.com") {
+		t.Fatalf("unexpected email preview %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/preview?email=k@gmail.com", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected not found without pending email, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/preview", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %d", rec.Code)
+	}
+}
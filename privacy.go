@@ -0,0 +1,273 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// ErrNotConfirmed is returned by Privacy.Erase when the data was erased but the confirmation could not be sent
+var ErrNotConfirmed = errors.New("erasure not confirmed")
+
+// PrivacyStorage is the storage of the subscriptions whose data is exported and erased. The webhooks, the audit
+// log and the leases are covered too when the storage keeps them.
+type PrivacyStorage interface {
+	Storage
+	DeleteNewsletter(ctx context.Context, userEmail string) error
+}
+
+// ForgetStorage is a storage that keeps traces of the subscribers beyond their subscription and webhooks, the
+// leases of their emails and their email in the audit log.
+type ForgetStorage interface {
+	ForgetSubscriber(ctx context.Context, userEmail, alias string) (int, error)
+	// AuditMentioning returns the entries of the audit log that mention the email, newest first
+	AuditMentioning(ctx context.Context, userEmail string) ([]mongodb.AuditEntry, error)
+}
+
+// Privacy exports everything stored about an email and erases it, for the subscribers exercising their rights
+type Privacy struct {
+	Storage PrivacyStorage
+	// Email confirms the erasures to the subscribers, they are not confirmed when nil
+	Email Email
+
+	now func() time.Time
+}
+
+// NewPrivacy returns the Privacy of the data of s, confirming the erasures with e
+func NewPrivacy(s PrivacyStorage, e Email) *Privacy {
+	return &Privacy{Storage: s, Email: e, now: time.Now}
+}
+
+// DataExport is everything stored about an email
+type DataExport struct {
+	Email      string    `json:"email"`
+	ExportedAt time.Time `json:"exported_at"`
+	// Subscription is missing when the email is not subscribed
+	Subscription *subscriptionJSON   `json:"subscription"`
+	Webhooks     []webhookExportJSON `json:"webhooks"`
+	// Audit are the changes made by the email or to its data, newest first
+	Audit []AuditEntryJSON `json:"audit"`
+}
+
+// subscriptionJSON is a subscription as exported, the Account with what the subscriber does not edit
+type subscriptionJSON struct {
+	Account
+	Filters  []filterJSON `json:"filters"`
+	LastSent *time.Time   `json:"last_sent,omitempty"`
+}
+
+type filterJSON struct {
+	URL     string   `json:"url,omitempty"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// webhookExportJSON is a webhook as exported, with its deliveries
+type webhookExportJSON struct {
+	webhookJSON
+	Deliveries []deliveryJSON `json:"deliveries"`
+}
+
+// Erasure is what an erasure deleted or anonymized
+type Erasure struct {
+	Subscription bool `json:"subscription"`
+	Webhooks     int  `json:"webhooks"`
+	AuditEntries int  `json:"audit_entries"`
+}
+
+// erasureJSON is an Erasure as answered by PrivacyHandler, with whether the subscriber was emailed the confirmation
+type erasureJSON struct {
+	Erasure
+	Confirmed bool `json:"confirmed"`
+}
+
+// Export returns everything stored about the email, mongodb.ErrNotFound when there is nothing
+func (p *Privacy) Export(ctx context.Context, userEmail string) (DataExport, error) {
+	export := DataExport{
+		Email:      userEmail,
+		ExportedAt: p.now().UTC(),
+		Webhooks:   []webhookExportJSON{},
+		Audit:      []AuditEntryJSON{},
+	}
+
+	n, err := p.Storage.Subscription(ctx, userEmail)
+	if err != nil && !errors.Is(err, mongodb.ErrNotFound) {
+		return export, err
+	}
+	if err == nil {
+		sub := subscriptionJSON{Account: accountOf(n), Filters: []filterJSON{}}
+		for _, f := range n.Filters {
+			sub.Filters = append(sub.Filters, filterJSON{URL: f.URL, Include: nonNil(f.Include), Exclude: nonNil(f.Exclude)})
+		}
+		if !n.LastSent.IsZero() {
+			sub.LastSent = &n.LastSent
+		}
+		export.Subscription = &sub
+	}
+
+	if ws, ok := p.Storage.(WebhookStorage); ok {
+		webhooks, err := ws.WebhooksOf(ctx, userEmail)
+		if err != nil {
+			return export, err
+		}
+		for _, wh := range webhooks {
+			deliveries, err := ws.Deliveries(ctx, wh.ID, 0)
+			if err != nil {
+				return export, fmt.Errorf("error getting deliveries: %v", err)
+			}
+			e := webhookExportJSON{webhookJSON: newWebhookJSON(wh), Deliveries: make([]deliveryJSON, len(deliveries))}
+			for i, d := range deliveries {
+				e.Deliveries[i] = newDeliveryJSON(d)
+			}
+			export.Webhooks = append(export.Webhooks, e)
+		}
+	}
+
+	if fs, ok := p.Storage.(ForgetStorage); ok {
+		entries, err := fs.AuditMentioning(ctx, userEmail)
+		if err != nil {
+			return export, err
+		}
+		for _, e := range entries {
+			v, err := NewAuditEntryJSON(e)
+			if err != nil {
+				return export, err
+			}
+			export.Audit = append(export.Audit, v)
+		}
+	}
+
+	if export.Subscription == nil && len(export.Webhooks) == 0 && len(export.Audit) == 0 {
+		return export, mongodb.ErrNotFound
+	}
+	return export, nil
+}
+
+// Erase deletes the subscription and the webhooks of the email, then forgets it everywhere else, replacing it by an
+// alias in the audit log. It emails the subscriber a confirmation once done, returning ErrNotConfirmed with the Erasure
+// when it cannot be sent, and mongodb.ErrNotFound when there is nothing to erase.
+func (p *Privacy) Erase(ctx context.Context, userEmail string) (Erasure, error) {
+	var erasure Erasure
+
+	err := p.Storage.DeleteNewsletter(ctx, userEmail)
+	if err != nil && !errors.Is(err, mongodb.ErrNotFound) {
+		return erasure, fmt.Errorf("error deleting subscription: %v", err)
+	}
+	erasure.Subscription = err == nil
+
+	if ws, ok := p.Storage.(WebhookStorage); ok {
+		webhooks, err := ws.WebhooksOf(ctx, userEmail)
+		if err != nil {
+			return erasure, err
+		}
+		for _, wh := range webhooks {
+			if err := ws.DeleteWebhook(ctx, wh.ID); err != nil {
+				return erasure, fmt.Errorf("error deleting webhook: %v", err)
+			}
+			erasure.Webhooks++
+		}
+	}
+
+	// Forgetting comes last, so the entries of the deletions above are anonymized too.
+	if fs, ok := p.Storage.(ForgetStorage); ok {
+		erasure.AuditEntries, err = fs.ForgetSubscriber(ctx, userEmail, "erased:"+randomID(8))
+		if err != nil {
+			return erasure, err
+		}
+	}
+
+	if erasure == (Erasure{}) {
+		return erasure, mongodb.ErrNotFound
+	}
+	slog.InfoContext(ctx, "subscriber data erased", "subscription", erasure.Subscription,
+		"webhooks", erasure.Webhooks, "audit_entries", erasure.AuditEntries)
+	if p.Email == nil {
+		return erasure, nil
+	}
+	body := fmt.Sprintf("Hi,\n\nAs asked, everything the newsletter stored about %s was erased: the subscription, "+
+		"the webhooks and their deliveries. The changes in our audit log no longer name you.\n\n"+
+		"This is the last email you receive from us.", userEmail)
+	if err := p.Email.Send([]string{userEmail}, body); err != nil {
+		return erasure, fmt.Errorf("%w: error sending confirmation: %v", ErrNotConfirmed, err)
+	}
+	return erasure, nil
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// PrivacyHandler serves the export and the erasure of the data of the subscribers to the operators, mounted on
+// /admin/privacy/:
+//
+//	GET  /admin/privacy/export?email=   everything stored about an email as a DataExport
+//	POST /admin/privacy/erase?email=    erases the data of an email and emails the confirmation, answering the Erasure
+//
+// The erasure answers 202 Accepted with "confirmed": false when the data was erased but the confirmation could not be
+// sent, so the operator can confirm it by other means.
+//
+// It is meant to be protected by APIKeys.Protect with the admin role.
+func PrivacyHandler(p *Privacy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("email")
+		switch strings.Trim(r.URL.Path, "/") {
+		case "admin/privacy/export":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			if email == "" {
+				http.Error(w, "the email query parameter is required", http.StatusBadRequest)
+				return
+			}
+			export, err := p.Export(r.Context(), email)
+			if errors.Is(err, mongodb.ErrNotFound) {
+				http.Error(w, "nothing stored about "+email, http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error exporting data", "error", err)
+				http.Error(w, "error exporting data", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, export)
+		case "admin/privacy/erase":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			if email == "" {
+				http.Error(w, "the email query parameter is required", http.StatusBadRequest)
+				return
+			}
+			erasure, err := p.Erase(r.Context(), email)
+			if errors.Is(err, mongodb.ErrNotFound) {
+				http.Error(w, "nothing stored about "+email, http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, ErrNotConfirmed) {
+				// The data is erased, only the confirmation is missing.
+				slog.ErrorContext(r.Context(), "error confirming erasure", "error", err)
+				writeJSON(w, http.StatusAccepted, erasureJSON{Erasure: erasure})
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error erasing data", "error", err)
+				http.Error(w, "error erasing data", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, erasureJSON{Erasure: erasure, Confirmed: p.Email != nil})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// newPrivacyStorage returns a storage with the subscription, a webhook and its delivery, and the lease of the
+// emails of j@gmail.com, next to the subscription of k@gmail.com
+func newPrivacyStorage(t *testing.T) *memory.Storage {
+	t.Helper()
+	ctx := context.Background()
+	s := memory.NewStorage()
+	sent := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, n := range []mongodb.Newsletter{
+		{UserEmail: "j@gmail.com", URLs: []string{FakeURL}, Filters: []mongodb.Filter{{Include: []string{"go"}}}, LastSent: sent},
+		{UserEmail: "k@gmail.com", URLs: []string{FakeURL}},
+	} {
+		if err := s.SaveNewsletter(ctx, n); err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+	if err := s.SaveWebhook(ctx, mongodb.Webhook{ID: "w1", UserEmail: "j@gmail.com", Endpoint: "https://j.test/hook", Secret: "s3cret", CreatedAt: sent}); err != nil {
+		t.Fatal("error saving webhook", err)
+	}
+	if err := s.SaveDelivery(ctx, mongodb.Delivery{ID: "d1", WebhookID: "w1", Event: "page.changed", Payload: []byte(`{}`), CreatedAt: sent}); err != nil {
+		t.Fatal("error saving delivery", err)
+	}
+	if ok, err := s.AcquireLease(ctx, "email:j@gmail.com", "a", time.Hour); err != nil || !ok {
+		t.Fatalf("expected the lease, got %v (%v)", ok, err)
+	}
+	return s
+}
+
+func TestPrivacy_Export(t *testing.T) {
+	ctx := context.Background()
+	p := NewPrivacy(newPrivacyStorage(t), nil)
+
+	export, err := p.Export(ctx, "j@gmail.com")
+	if err != nil {
+		t.Fatal("error exporting data", err)
+	}
+	sub := export.Subscription
+	if sub == nil || sub.Email != "j@gmail.com" || len(sub.Filters) != 1 || sub.Filters[0].Include[0] != "go" || sub.LastSent == nil {
+		t.Fatalf("expected the subscription with its filters, got %+v", sub)
+	}
+	if len(export.Webhooks) != 1 || export.Webhooks[0].Secret != "" || len(export.Webhooks[0].Deliveries) != 1 {
+		t.Fatalf("expected the webhook without its secret and with its delivery, got %+v", export.Webhooks)
+	}
+	if len(export.Audit) != 2 || export.Audit[0].Target != "w1" || export.Audit[1].Target != "j@gmail.com" {
+		t.Fatalf("expected the audit entries of the webhook and the subscription, got %+v", export.Audit)
+	}
+
+	if _, err := p.Export(ctx, "x@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// The storages without webhooks nor audit log export the subscription only.
+	p = NewPrivacy(struct{ PrivacyStorage }{newPrivacyStorage(t)}, nil)
+	export, err = p.Export(ctx, "j@gmail.com")
+	if err != nil || export.Subscription == nil || len(export.Webhooks) != 0 || len(export.Audit) != 0 {
+		t.Fatalf("expected the subscription only, got %+v (%v)", export, err)
+	}
+}
+
+func TestPrivacy_Erase(t *testing.T) {
+	ctx := context.Background()
+	s := newPrivacyStorage(t)
+	e := &MailClientRecorder{}
+	p := NewPrivacy(s, e)
+
+	erasure, err := p.Erase(ctx, "j@gmail.com")
+	if err != nil {
+		t.Fatal("error erasing data", err)
+	}
+	// The creation and the deletion of the subscription and of the webhook.
+	want := Erasure{Subscription: true, Webhooks: 1, AuditEntries: 4}
+	if erasure != want {
+		t.Fatalf("expected %+v, got %+v", want, erasure)
+	}
+	if !strings.Contains(e.sent["j@gmail.com"], "erased") {
+		t.Fatalf("expected the confirmation of the erasure, got %q", e.sent["j@gmail.com"])
+	}
+
+	if _, err := p.Export(ctx, "j@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected nothing left, got %v", err)
+	}
+	if deliveries, _ := s.Deliveries(ctx, "w1", 0); len(deliveries) != 0 {
+		t.Fatalf("expected the deliveries erased, got %+v", deliveries)
+	}
+	if ok, _ := s.AcquireLease(ctx, "email:j@gmail.com", "b", time.Hour); !ok {
+		t.Fatal("expected the lease of the emails erased")
+	}
+	if _, err := s.Subscription(ctx, "k@gmail.com"); err != nil {
+		t.Fatalf("expected the other subscriptions kept, got %v", err)
+	}
+
+	if _, err := p.Erase(ctx, "j@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected nothing to erase, got %v", err)
+	}
+}
+
+func TestPrivacyHandler(t *testing.T) {
+	svr := httptest.NewServer(PrivacyHandler(NewPrivacy(newPrivacyStorage(t), &MailClientRecorder{})))
+	defer svr.Close()
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/admin/privacy/export?email=j@gmail.com", http.StatusOK},
+		{http.MethodGet, "/admin/privacy/export", http.StatusBadRequest},
+		{http.MethodPost, "/admin/privacy/export?email=j@gmail.com", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/privacy/erase?email=j@gmail.com", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/privacy/erase?email=j@gmail.com", http.StatusOK},
+		{http.MethodPost, "/admin/privacy/erase?email=j@gmail.com", http.StatusNotFound},
+		{http.MethodGet, "/admin/privacy/export?email=j@gmail.com", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Fatalf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestPrivacyHandler_EraseNotConfirmed(t *testing.T) {
+	s := newPrivacyStorage(t)
+	svr := httptest.NewServer(PrivacyHandler(NewPrivacy(s, MailClientErrorMock{})))
+	defer svr.Close()
+
+	resp, err := http.Post(svr.URL+"/admin/privacy/erase?email=j@gmail.com", "", nil)
+	if err != nil {
+		t.Fatal("error sending request", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	var got erasureJSON
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal("error decoding erasure", err)
+	}
+	if got.Confirmed || !got.Subscription {
+		t.Fatalf("expected the erasure done but not confirmed, got %+v", got)
+	}
+	if _, err := s.Subscription(context.Background(), "j@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected the subscription erased, got %v", err)
+	}
+}
+
+func TestAccountHandler_Erase(t *testing.T) {
+	ctx := context.Background()
+	s := newPrivacyStorage(t)
+	e := &MailClientRecorder{}
+	mux := http.NewServeMux()
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+	a := NewAccounts(s, e, "s3cret", svr.URL)
+	mux.Handle("/account/", AccountHandler(a))
+
+	session := &http.Cookie{Name: SessionCookie, Value: a.sign(purposeSession, "j@gmail.com", time.Now().Add(time.Hour))}
+	do := func(method, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, svr.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(session)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/account/export", "")
+	var export DataExport
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil || export.Email != "j@gmail.com" {
+		t.Fatalf("expected the export of the subscriber, got %+v (%v)", export, err)
+	}
+	_ = resp.Body.Close()
+
+	resp = do(http.MethodPost, "/account/erase", "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", resp.StatusCode)
+	}
+	token := a.sign(purposeErase, "j@gmail.com", time.Now().Add(time.Hour))
+	if !strings.Contains(e.sent["j@gmail.com"], "/account/erase/confirm?token=") {
+		t.Fatalf("expected the link to confirm the erasure, got %q", e.sent["j@gmail.com"])
+	}
+
+	// Opening the link shows the form without erasing, and a session token does not erase.
+	resp = do(http.MethodGet, "/account/erase/confirm?token="+token, "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	resp = do(http.MethodPost, "/account/erase/confirm", "token="+session.Value)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", resp.StatusCode)
+	}
+	if _, err := s.Subscription(ctx, "j@gmail.com"); err != nil {
+		t.Fatalf("expected the subscription kept until confirmed, got %v", err)
+	}
+
+	resp = do(http.MethodPost, "/account/erase/confirm", "token="+token)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if _, err := s.Subscription(ctx, "j@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected the subscription erased, got %v", err)
+	}
+	if entries, _ := s.AuditLog(ctx, mongodb.AuditQuery{Action: mongodb.ActionNewsletterDelete}); len(entries) != 1 ||
+		!strings.HasPrefix(entries[0].Actor, "subscriber:erased:") {
+		t.Fatalf("expected the erasure audited under an alias, got %+v", entries)
+	}
+	if !strings.Contains(e.sent["j@gmail.com"], "was erased") {
+		t.Fatalf("expected the confirmation of the erasure, got %q", e.sent["j@gmail.com"])
+	}
+}
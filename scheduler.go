@@ -0,0 +1,315 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/robfig/cron/v3"
+)
+
+// maxBackoffExponent bounds the exponential backoff of sources that rarely change
+const maxBackoffExponent = 10
+
+// changeHistoryLimit is the number of past versions of a page used to estimate its change rate
+const changeHistoryLimit = 100
+
+// minRateSamples and minRateWindow are the versions and the time a change rate needs to be observed over before the
+// interval adapts to it, so a few quick polls do not pass for a source that never changes.
+const (
+	minRateSamples = 10
+	minRateWindow  = 24 * time.Hour
+)
+
+// maxIntervalFactor bounds how much the learned interval changes on a single crawl
+const maxIntervalFactor = 2
+
+// Scheduler decides when each engineer URL is crawled, according to the engineer schedule.
+// The next run of every URL is persisted in the storage, so it survives restarts.
+type Scheduler struct {
+	// Default is the interval of the engineers without schedule
+	Default time.Duration
+	// Jitter is the maximum random delay added to every next run, spreading the fetches of URLs with the same schedule
+	Jitter time.Duration
+	// MaxBackoff is the maximum interval between two runs of a source that is not changing.
+	// Every crawl without change doubles the interval until MaxBackoff, zero disables the backoff.
+	MaxBackoff time.Duration
+	// Adaptive enables learning the interval of the engineers without schedule from the change history of their
+	// pages, polling about twice per expected change, bounded by MinInterval and MaxInterval. The interval moves
+	// towards the rate by at most a factor of 2 per crawl, and the backoff applies until a rate is learned.
+	Adaptive    bool
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	now    func() time.Time
+	jitter func(max time.Duration) time.Duration
+}
+
+// NewScheduler initializes a new Scheduler where d is the interval of the engineers without schedule
+func NewScheduler(d time.Duration) *Scheduler {
+	return &Scheduler{
+		Default:     d,
+		Jitter:      d / 10,
+		MaxBackoff:  24 * time.Hour,
+		Adaptive:    true,
+		MinInterval: d,
+		MaxInterval: 24 * time.Hour,
+		now:         func() time.Time { return time.Now().UTC() },
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(max)))
+		},
+	}
+}
+
+// ParseSchedule parses an engineer schedule, either an interval ("6h", "@every 6h") or a
+// standard cron expression ("0 8 * * *", "@daily").
+func ParseSchedule(spec string) (cron.Schedule, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid schedule interval: %s", spec)
+		}
+		return every(d), nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+	}
+	return schedule, nil
+}
+
+// Due returns the URLs whose next run has come, and reserves their next run, so the URLs are not returned again
+// while they are being crawled.
+func (s *Scheduler) Due(ctx context.Context, st Storage) ([]string, error) {
+	engineers, err := st.Engineers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting engineers: %v", err)
+	}
+
+	schedules, err := s.schedules(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var due []string
+	for _, e := range engineers {
+		sch, ok := schedules[e.URL]
+		if ok && sch.NextRun.After(now) {
+			continue
+		}
+		if !ok {
+			sch = mongodb.Schedule{URL: e.URL}
+		}
+
+		sch.NextRun = s.next(e, sch, now)
+		if err := st.SaveSchedule(ctx, sch); err != nil {
+			return nil, err
+		}
+		due = append(due, e.URL)
+	}
+
+	return due, nil
+}
+
+// Done records the crawl of url, backing off the next run while the page does not change.
+func (s *Scheduler) Done(ctx context.Context, st Storage, url string, changed bool) error {
+	// The engineer may have been removed while its URL was crawled.
+	engineer, err := st.Engineer(ctx, url)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		engineer = mongodb.Engineer{URL: url}
+	} else if err != nil {
+		return fmt.Errorf("error getting engineer: %v", err)
+	}
+
+	sch, err := st.Schedule(ctx, url)
+	if err != nil && !errors.Is(err, mongodb.ErrNotFound) {
+		return fmt.Errorf("error getting schedule: %v", err)
+	}
+	sch.URL = url
+	sch.LastRun = s.now()
+	if changed {
+		sch.UnchangedRuns = 0
+	} else {
+		sch.UnchangedRuns++
+	}
+
+	if s.adaptive(engineer) {
+		history, err := st.PageHistory(ctx, url, changeHistoryLimit)
+		if err != nil {
+			return fmt.Errorf("error getting page history: %v", err)
+		}
+		if rate, ok := EstimateChangeRate(history); ok {
+			sch.ChangeRate = rate
+			sch.Interval = s.adaptiveInterval(rate, sch.Interval)
+		}
+	}
+
+	sch.NextRun = s.next(engineer, sch, sch.LastRun)
+
+	return st.SaveSchedule(ctx, sch)
+}
+
+// SourceStatus is the crawl state of an engineer URL
+type SourceStatus struct {
+	Engineer mongodb.Engineer
+	// Interval is the current polling interval, learned or given by the schedule
+	Interval time.Duration
+	// ChangeRate is the estimated number of changes per day, zero while unknown
+	ChangeRate float64
+	NextRun    time.Time
+	LastRun    time.Time
+}
+
+// Status returns the current interval and estimated change rate of every engineer.
+func (s *Scheduler) Status(ctx context.Context, st Storage) ([]SourceStatus, error) {
+	engineers, err := st.Engineers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting engineers: %v", err)
+	}
+
+	schedules, err := s.schedules(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]SourceStatus, 0, len(engineers))
+	for _, e := range engineers {
+		sch := schedules[e.URL]
+		from := sch.LastRun
+		if from.IsZero() {
+			from = s.now()
+		}
+		status = append(status, SourceStatus{
+			Engineer:   e,
+			Interval:   s.schedule(e, sch).Next(from).Sub(from),
+			ChangeRate: sch.ChangeRate,
+			NextRun:    sch.NextRun,
+			LastRun:    sch.LastRun,
+		})
+	}
+	return status, nil
+}
+
+// EstimateChangeRate returns the estimated number of changes per day of a page, given its versions from the newest
+// to the oldest. It returns false when the history has too few versions or spans too little time to estimate.
+func EstimateChangeRate(history []mongodb.Page) (float64, bool) {
+	if len(history) < minRateSamples {
+		return 0, false
+	}
+
+	oldest := history[len(history)-1]
+	window := history[0].ScrapeDatetime.Sub(oldest.ScrapeDatetime)
+	if window < minRateWindow {
+		return 0, false
+	}
+
+	// The oldest version is compared with nothing in the window, so its flag is not a change.
+	var changes int
+	for _, p := range history[:len(history)-1] {
+		if p.IsMostRecent {
+			changes++
+		}
+	}
+
+	return float64(changes) / (window.Hours() / 24), true
+}
+
+// adaptiveInterval returns the interval that polls about twice per expected change, within the bounds. It moves from
+// the previous interval, the default when there is none, by at most maxIntervalFactor.
+func (s *Scheduler) adaptiveInterval(changesPerDay float64, previous time.Duration) time.Duration {
+	interval := s.MaxInterval
+	if changesPerDay > 0 {
+		interval = time.Duration(float64(24*time.Hour) / (2 * changesPerDay))
+	}
+	if previous <= 0 {
+		previous = s.Default
+	}
+	if interval > previous*maxIntervalFactor {
+		interval = previous * maxIntervalFactor
+	}
+	if interval < previous/maxIntervalFactor {
+		interval = previous / maxIntervalFactor
+	}
+	if interval > s.MaxInterval {
+		interval = s.MaxInterval
+	}
+	if interval < s.MinInterval {
+		interval = s.MinInterval
+	}
+	return interval
+}
+
+func (s *Scheduler) adaptive(e mongodb.Engineer) bool {
+	return s.Adaptive && e.Schedule == ""
+}
+
+// schedule returns the schedule of the engineer: the given one, the learned interval or the default.
+func (s *Scheduler) schedule(e mongodb.Engineer, sch mongodb.Schedule) cron.Schedule {
+	if s.adaptive(e) && sch.Interval > 0 {
+		return every(sch.Interval)
+	}
+	if e.Schedule != "" {
+		parsed, err := ParseSchedule(e.Schedule)
+		if err == nil {
+			return parsed
+		}
+		slog.Warn("invalid engineer schedule, using the default", "url", e.URL, "error", err)
+	}
+	return every(s.Default)
+}
+
+// next returns the next run of the engineer after from, considering the backoff and the jitter.
+// The backoff does not apply once an interval is learned, it already follows the change rate.
+func (s *Scheduler) next(e mongodb.Engineer, sch mongodb.Schedule, from time.Time) time.Time {
+	schedule := s.schedule(e, sch)
+	unchangedRuns := sch.UnchangedRuns
+	if s.adaptive(e) && sch.Interval > 0 {
+		unchangedRuns = 0
+	}
+
+	next := schedule.Next(from)
+	interval := next.Sub(from)
+
+	if s.MaxBackoff > interval && unchangedRuns > 0 {
+		exp := unchangedRuns
+		if exp > maxBackoffExponent {
+			exp = maxBackoffExponent
+		}
+		backoff := interval * time.Duration(1<<exp)
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+		// Moving the reference forward keeps cron schedules aligned with their expression.
+		next = schedule.Next(from.Add(backoff - interval))
+	}
+
+	return next.Add(s.jitter(s.Jitter))
+}
+
+func (s *Scheduler) schedules(ctx context.Context, st Storage) (map[string]mongodb.Schedule, error) {
+	schedules, err := st.Schedules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting schedules: %v", err)
+	}
+
+	byURL := make(map[string]mongodb.Schedule, len(schedules))
+	for _, sch := range schedules {
+		byURL[sch.URL] = sch
+	}
+	return byURL, nil
+}
+
+// every is a fixed interval schedule. Unlike cron.Every, it is not rounded to seconds.
+type every time.Duration
+
+// Next returns the time after t by the interval
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
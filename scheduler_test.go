@@ -0,0 +1,288 @@
+package newsletter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+func newTestScheduler(now *time.Time) *Scheduler {
+	s := NewScheduler(time.Hour)
+	s.now = func() time.Time { return *now }
+	s.jitter = func(time.Duration) time.Duration { return 0 }
+	return s
+}
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"6h", from.Add(6 * time.Hour)},
+		{"@every 30m", from.Add(30 * time.Minute)},
+		{"0 8 * * *", time.Date(2023, time.August, 14, 8, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2023, time.August, 14, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		schedule, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", tt.spec, err)
+		}
+		if got := schedule.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "-1h", "every day", "* * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
+
+// legacyStorage serves an engineer saved before the storages validated the schedules
+type legacyStorage struct {
+	*memory.Storage
+	legacy mongodb.Engineer
+}
+
+func (s legacyStorage) Engineers(ctx context.Context) ([]mongodb.Engineer, error) {
+	engineers, err := s.Storage.Engineers(ctx)
+	return append(engineers, s.legacy), err
+}
+
+func TestSchedulerDue(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+	st := legacyStorage{Storage: memory.NewStorage(), legacy: mongodb.Engineer{URL: "https://www.3.com", Schedule: "invalid"}}
+	s := newTestScheduler(&now)
+
+	engineers := []mongodb.Engineer{
+		{URL: "https://www.1.com"},
+		{URL: "https://www.2.com", Schedule: "10m"},
+	}
+	for _, e := range engineers {
+		if err := st.SaveEngineer(ctx, e); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	got, err := s.Due(ctx, st)
+	if err != nil {
+		t.Fatal("error getting due urls", err)
+	}
+	want := []string{"https://www.1.com", "https://www.2.com", "https://www.3.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// The next runs are reserved, so nothing is due until the schedules are reached.
+	got, err = s.Due(ctx, st)
+	if err != nil {
+		t.Fatal("error getting due urls", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no due urls, got %v", got)
+	}
+
+	now = now.Add(10 * time.Minute)
+	got, err = s.Due(ctx, st)
+	if err != nil {
+		t.Fatal("error getting due urls", err)
+	}
+	if !reflect.DeepEqual(got, []string{"https://www.2.com"}) {
+		t.Fatalf("got %v, want only the 10m schedule", got)
+	}
+}
+
+func TestSchedulerDone_Backoff(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+	st := memory.NewStorage()
+	s := newTestScheduler(&now)
+	s.MaxBackoff = 6 * time.Hour
+	s.Adaptive = false
+
+	url := "https://www.1.com"
+	if err := st.SaveEngineer(ctx, mongodb.Engineer{URL: url}); err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+
+	wantIntervals := []time.Duration{2 * time.Hour, 4 * time.Hour, 6 * time.Hour, 6 * time.Hour}
+	for i, want := range wantIntervals {
+		if err := s.Done(ctx, st, url, false); err != nil {
+			t.Fatal("error saving schedule", err)
+		}
+		sch := schedule(ctx, t, st, url)
+		if got := sch.NextRun.Sub(now); got != want {
+			t.Fatalf("run %d: got interval %v, want %v", i, got, want)
+		}
+	}
+
+	if err := s.Done(ctx, st, url, true); err != nil {
+		t.Fatal("error saving schedule", err)
+	}
+	sch := schedule(ctx, t, st, url)
+	if got := sch.NextRun.Sub(now); got != time.Hour || sch.UnchangedRuns != 0 {
+		t.Fatalf("expected the backoff to reset on change, got %v", sch)
+	}
+}
+
+func TestSchedulerDone_CronBackoff(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+	st := memory.NewStorage()
+	s := newTestScheduler(&now)
+	s.MaxBackoff = 7 * 24 * time.Hour
+
+	url := "https://www.1.com"
+	if err := st.SaveEngineer(ctx, mongodb.Engineer{URL: url, Schedule: "0 8 * * *"}); err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+
+	if err := s.Done(ctx, st, url, false); err != nil {
+		t.Fatal("error saving schedule", err)
+	}
+
+	// The first run is tomorrow at 8, the backoff skips it but keeps the cron alignment.
+	want := time.Date(2023, time.August, 15, 8, 0, 0, 0, time.UTC)
+	if got := schedule(ctx, t, st, url).NextRun; !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerDone_AdaptiveWithoutRate(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+	st := memory.NewStorage()
+	s := newTestScheduler(&now)
+
+	url := "https://www.1.com"
+	if err := st.SaveEngineer(ctx, mongodb.Engineer{URL: url}); err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+
+	// Without enough history to learn a rate, the unchanged crawls back off from the default.
+	for _, want := range []time.Duration{2 * time.Hour, 4 * time.Hour} {
+		if err := s.Done(ctx, st, url, false); err != nil {
+			t.Fatal("error saving schedule", err)
+		}
+		if got := schedule(ctx, t, st, url); got.Interval != 0 || !got.NextRun.Equal(now.Add(want)) {
+			t.Fatalf("expected the next run in %v, got %v", want, got)
+		}
+	}
+}
+
+func TestEstimateChangeRate(t *testing.T) {
+	start := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+
+	// 10 days of daily versions, newest first, with 2 changes besides the first scrape.
+	var history []mongodb.Page
+	for day := 10; day >= 0; day-- {
+		history = append(history, mongodb.Page{
+			ScrapeDatetime: start.Add(time.Duration(day) * 24 * time.Hour),
+			IsMostRecent:   day == 0 || day == 3 || day == 7,
+		})
+	}
+
+	got, ok := EstimateChangeRate(history)
+	if !ok {
+		t.Fatal("expected an estimate")
+	}
+	if got != 0.2 {
+		t.Fatalf("got %v changes per day, want 0.2", got)
+	}
+
+	if _, ok := EstimateChangeRate(history[:1]); ok {
+		t.Fatal("expected no estimate for a single version")
+	}
+
+	// A few unchanged versions scraped seconds apart do not mean the page never changes.
+	var quick []mongodb.Page
+	for i := 20; i >= 0; i-- {
+		quick = append(quick, mongodb.Page{ScrapeDatetime: start.Add(time.Duration(i) * time.Second)})
+	}
+	if _, ok := EstimateChangeRate(quick); ok {
+		t.Fatal("expected no estimate for a window of seconds")
+	}
+	if _, ok := EstimateChangeRate(history[:5]); ok {
+		t.Fatal("expected no estimate for 5 versions")
+	}
+}
+
+func TestSchedulerDone_Adaptive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, time.August, 13, 0, 0, 0, 0, time.UTC)
+	st := memory.NewStorage()
+	s := newTestScheduler(&now)
+	s.MinInterval = time.Hour
+	s.MaxInterval = 48 * time.Hour
+
+	rare, frequent := "https://rare.com", "https://frequent.com"
+	for _, url := range []string{rare, frequent} {
+		if err := st.SaveEngineer(ctx, mongodb.Engineer{URL: url}); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	// rare changed once in 10 days of hourly polls, frequent changed on every poll.
+	var pages []mongodb.Page
+	for h := 0; h <= 240; h++ {
+		scrapeDate := now.Add(-time.Duration(h) * time.Hour)
+		pages = append(pages,
+			mongodb.Page{URL: rare, ScrapeDatetime: scrapeDate, IsMostRecent: h == 50 || h == 240},
+			mongodb.Page{URL: frequent, ScrapeDatetime: scrapeDate, IsMostRecent: true},
+		)
+	}
+	if err := st.SavePage(ctx, pages); err != nil {
+		t.Fatal("error saving pages", err)
+	}
+
+	// The last 100 versions of rare span 99 hours with one change: ~0.24 changes per day, polled every ~49h. The
+	// interval doubles from the default on every crawl until the max interval.
+	for _, want := range []time.Duration{2 * time.Hour, 4 * time.Hour, 8 * time.Hour, 16 * time.Hour, 32 * time.Hour, 48 * time.Hour, 48 * time.Hour} {
+		if err := s.Done(ctx, st, rare, false); err != nil {
+			t.Fatal("error saving schedule", err)
+		}
+		if got := schedule(ctx, t, st, rare); got.Interval != want || !got.NextRun.Equal(now.Add(want)) {
+			t.Fatalf("expected rare to be polled every %v, got %v", want, got)
+		}
+	}
+	if err := s.Done(ctx, st, frequent, false); err != nil {
+		t.Fatal("error saving schedule", err)
+	}
+	if got := schedule(ctx, t, st, frequent); got.Interval != time.Hour || got.ChangeRate != 24 {
+		t.Fatalf("expected frequent to be polled on the min interval, got %v", got)
+	}
+
+	status, err := s.Status(ctx, st)
+	if err != nil {
+		t.Fatal("error getting status", err)
+	}
+	if len(status) != 2 || status[0].Engineer.URL != frequent || status[0].Interval != time.Hour ||
+		status[1].Engineer.URL != rare || status[1].Interval != 48*time.Hour {
+		t.Fatalf("unexpected status %v", status)
+	}
+}
+
+func schedule(ctx context.Context, t *testing.T, st Storage, url string) mongodb.Schedule {
+	t.Helper()
+	schedules, err := st.Schedules(ctx)
+	if err != nil {
+		t.Fatal("error getting schedules", err)
+	}
+	for _, sch := range schedules {
+		if sch.URL == url {
+			return sch
+		}
+	}
+	t.Fatalf("schedule of %s not found", url)
+	return mongodb.Schedule{}
+}
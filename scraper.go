@@ -8,12 +8,17 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
+	"strconv"
 	"sync"
-	"syscall"
 	"time"
 
+	"github.com/perebaj/newsletter/htmltext"
+	"github.com/perebaj/newsletter/metrics"
 	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 // Page is the struct that gather important information of a website
@@ -21,88 +26,240 @@ type Page struct {
 	Content        string
 	URL            string
 	ScrapeDateTime time.Time
+	// lease is the crawl job lease of the URL, held until the page is saved
+	lease *lease
+	// span is the crawl span of the URL, ended once the page is saved
+	span trace.Span
 }
 
 // Storage is the interface that wraps the basic methods to save and get data from the database
 type Storage interface {
 	SavePage(ctx context.Context, site []mongodb.Page) error
 	DistinctEngineerURLs(ctx context.Context) ([]interface{}, error)
+	Engineers(ctx context.Context) ([]mongodb.Engineer, error)
+	// Engineer returns the engineer of the URL, mongodb.ErrNotFound when there is none.
+	Engineer(ctx context.Context, url string) (mongodb.Engineer, error)
 	Page(ctx context.Context, url string) ([]mongodb.Page, error)
-	Newsletter() ([]mongodb.Newsletter, error)
+	// Newsletter returns up to limit newsletters sorted by user email, starting after the given user email.
+	Newsletter(ctx context.Context, after string, limit int) ([]mongodb.Newsletter, error)
+	// Subscription returns the newsletter of the user email, mongodb.ErrNotFound when there is none.
+	Subscription(ctx context.Context, userEmail string) (mongodb.Newsletter, error)
 	PageIn(ctx context.Context, urls []string) ([]mongodb.Page, error)
+	PageHistory(ctx context.Context, url string, limit int) ([]mongodb.Page, error)
+	// PageChanges returns up to limit versions of the url that changed the page, the newest first, without their text.
+	PageChanges(ctx context.Context, url string, limit int) ([]mongodb.Page, error)
+	SaveSchedule(ctx context.Context, s mongodb.Schedule) error
+	Schedules(ctx context.Context) ([]mongodb.Schedule, error)
+	// Schedule returns the schedule of the URL, mongodb.ErrNotFound when it was never scheduled.
+	Schedule(ctx context.Context, url string) (mongodb.Schedule, error)
 }
 
+// DefaultGracePeriod is the time in-flight fetches and pending saves have to finish once the crawler is stopped
+const DefaultGracePeriod = 10 * time.Second
+
 // Crawler contains the necessary information to run the crawler
 type Crawler struct {
 	URLch    chan string
 	resultCh chan Page
-	signalCh chan os.Signal
 	MaxJobs  int
-	wg       *sync.WaitGroup
-	// scheduler is the pace time between each fetch
+	// scheduler is the pace time between each check for due URLs
 	scheduler time.Duration
+	// Scheduler decides which URLs are due on each check
+	Scheduler *Scheduler
+	// GracePeriod is the time in-flight fetches and pending saves have to finish after the context is cancelled
+	GracePeriod time.Duration
+	// Leaser, when set, leases every URL before crawling it, so several instances can share the crawl of the
+	// same engineers without fetching an URL twice. Owner identifies this instance and LeaseTTL is the lease duration.
+	Leaser   Leaser
+	Owner    string
+	LeaseTTL time.Duration
+	// OnChange, when set, is called with the previous and the new version of every page that changed
+	OnChange func(ctx context.Context, old, new mongodb.Page)
+
+	heartbeat Heartbeat
 }
 
-// NewCrawler initializes a new Crawler
-func NewCrawler(maxJobs int, s time.Duration, signalCh chan os.Signal) *Crawler {
+// NewCrawler initializes a new Crawler, where s is both the pace between each check for due URLs and the interval
+// of the engineers without schedule
+func NewCrawler(maxJobs int, s time.Duration) *Crawler {
 	return &Crawler{
-		URLch:     make(chan string),
-		resultCh:  make(chan Page),
-		signalCh:  signalCh,
-		wg:        &sync.WaitGroup{},
-		MaxJobs:   maxJobs,
-		scheduler: s,
+		URLch:       make(chan string),
+		resultCh:    make(chan Page),
+		MaxJobs:     maxJobs,
+		scheduler:   s,
+		Scheduler:   NewScheduler(s),
+		GracePeriod: DefaultGracePeriod,
+		LeaseTTL:    DefaultLeaseTTL,
 	}
 }
 
-// Run starts the crawler, where s represents the storage and f the function to fetch the content of a website
-func (c *Crawler) Run(ctx context.Context, s Storage, f func(string) (string, error)) {
-	c.wg.Add(c.MaxJobs)
-	for i := 0; i < c.MaxJobs; i++ {
-		go c.Worker(f)
-	}
+// LastTick returns the last time the crawler checked for due URLs, zero before Run starts
+func (c *Crawler) LastTick() time.Time {
+	return c.heartbeat.Last()
+}
 
-	go func() {
+// Run starts the crawler, where s represents the storage and f the function to fetch the content of a website.
+// It blocks until the context is cancelled or the storage fails. Once the context is cancelled, the scheduler stops
+// and the in-flight fetches and pending saves have the grace period to finish, then Run returns nil.
+// Storage errors stop the crawler immediately and are returned.
+func (c *Crawler) Run(ctx context.Context, s Storage, f func(ctx context.Context, url string) (string, error)) error {
+	g, gctx := errgroup.WithContext(ctx)
+
+	// workCtx outlives ctx by the grace period, so the work already scheduled can be finished.
+	workCtx, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+	stopGrace := context.AfterFunc(gctx, func() {
+		time.AfterFunc(c.GracePeriod, abort)
+	})
+	defer stopGrace()
+
+	g.Go(func() error {
 		defer close(c.URLch)
-		for range time.Tick(c.scheduler) {
-			slog.Debug("fetching engineers")
-			gotURLs, err := s.DistinctEngineerURLs(ctx)
-			if err != nil {
-				slog.Error("error getting engineers: %v", err)
-				c.signalCh <- syscall.SIGTERM
+		ticker := time.NewTicker(c.scheduler)
+		defer ticker.Stop()
+
+		c.heartbeat.Beat()
+		for {
+			select {
+			case <-gctx.Done():
+				return nil
+			case <-ticker.C:
 			}
 
-			slog.Debug("fetched engineers", "engineers", len(gotURLs))
-			for _, url := range gotURLs {
-				c.URLch <- url.(string)
+			if err := c.cycle(gctx, s); err != nil {
+				if gctx.Err() != nil {
+					return nil
+				}
+				abort()
+				return err
 			}
 		}
-	}()
+	})
+
+	metrics.Workers.Add(float64(c.MaxJobs))
+	defer metrics.Workers.Sub(float64(c.MaxJobs))
+
+	var workers sync.WaitGroup
+	workers.Add(c.MaxJobs)
+	for i := 0; i < c.MaxJobs; i++ {
+		go func() {
+			defer workers.Done()
+			c.worker(workCtx, f)
+		}()
+	}
 
 	go func() {
-		c.wg.Wait()
-		defer close(c.resultCh)
+		workers.Wait()
+		close(c.resultCh)
 	}()
 
-	go func() {
+	g.Go(func() error {
 		for r := range c.resultCh {
-			slog.Debug("saving fetched sites response")
+			metrics.QueueDepth.WithLabelValues("results").Dec()
+			ctx := trace.ContextWithSpan(workCtx, r.span)
+			if r.lease != nil && r.lease.lost() {
+				slog.WarnContext(ctx, "crawl lease lost, discarding fetched site", "url", r.URL)
+				tracing.End(r.span, mongodb.ErrLeaseLost)
+				continue
+			}
+			slog.DebugContext(ctx, "saving fetched sites response")
 
-			lastScrapedPage, err := s.Page(ctx, r.URL)
+			_, err := c.save(ctx, s, r)
+			tracing.End(r.span, err)
 			if err != nil {
-				slog.Error("error getting page: %v", err)
-				c.signalCh <- syscall.SIGTERM
+				abort()
+				if r.lease != nil {
+					r.lease.release(context.WithoutCancel(workCtx), time.Time{})
+				}
+				c.discardResults(workCtx)
+				return err
 			}
 
-			newPage := pageComparation(lastScrapedPage, r)
-
-			err = s.SavePage(ctx, newPage)
-			if err != nil {
-				slog.Error("error saving site result: %v", err)
-				c.signalCh <- syscall.SIGTERM
+			// Holding the job for a check keeps the other instances, that found the URL due at the same
+			// time, from crawling it again.
+			if r.lease != nil {
+				r.lease.release(workCtx, time.Now().Add(c.scheduler))
 			}
 		}
-	}()
+		return nil
+	})
+
+	return g.Wait()
+}
+
+// cycle sends the due URLs to the workers, until all of them are taken or ctx is cancelled.
+func (c *Crawler) cycle(ctx context.Context, s Storage) (err error) {
+	ctx, span := tracing.Start(ctx, "crawler.cycle")
+	defer func() { tracing.End(span, err) }()
+
+	slog.DebugContext(ctx, "fetching due engineers")
+	gotURLs, err := c.Scheduler.Due(ctx, s)
+	if err != nil {
+		return fmt.Errorf("error scheduling engineers: %v", err)
+	}
+	c.heartbeat.Beat()
+
+	slog.DebugContext(ctx, "fetched due engineers", "engineers", len(gotURLs))
+	span.SetAttributes(attribute.Int("crawler.due_urls", len(gotURLs)))
+	metrics.QueueDepth.WithLabelValues("urls").Add(float64(len(gotURLs)))
+	for i, url := range gotURLs {
+		select {
+		case c.URLch <- url:
+			metrics.QueueDepth.WithLabelValues("urls").Dec()
+		case <-ctx.Done():
+			metrics.QueueDepth.WithLabelValues("urls").Sub(float64(len(gotURLs) - i))
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// CrawlOnce fetches the url right away, regardless of its schedule, saves the new version of the page and
+// records the crawl in the schedule. It returns the saved page.
+func (c *Crawler) CrawlOnce(ctx context.Context, s Storage, url string, f func(ctx context.Context, url string) (string, error)) (page mongodb.Page, err error) {
+	ctx, span := tracing.Start(ctx, "crawler.crawl", attribute.String("url", url))
+	defer func() { tracing.End(span, err) }()
+
+	content, err := f(ctx, url)
+	if err != nil {
+		return mongodb.Page{}, fmt.Errorf("error getting reference: %v", err)
+	}
+	return c.save(ctx, s, Page{Content: content, URL: url, ScrapeDateTime: time.Now().UTC()})
+}
+
+// save compares the fetched page with the last version, saves it and records the crawl in the schedule.
+func (c *Crawler) save(ctx context.Context, s Storage, r Page) (mongodb.Page, error) {
+	spanCtx, span := tracing.Start(ctx, "storage.Page")
+	lastScrapedPage, err := s.Page(spanCtx, r.URL)
+	tracing.End(span, err)
+	if err != nil {
+		return mongodb.Page{}, fmt.Errorf("error getting page: %v", err)
+	}
+
+	_, span = tracing.Start(ctx, "pageComparation")
+	newPage := pageComparation(lastScrapedPage, r)
+	span.SetAttributes(attribute.Bool("page.changed", newPage[0].IsMostRecent))
+	span.End()
+
+	spanCtx, span = tracing.Start(ctx, "storage.SavePage")
+	err = s.SavePage(spanCtx, newPage)
+	tracing.End(span, err)
+	if err != nil {
+		return mongodb.Page{}, fmt.Errorf("error saving site result: %v", err)
+	}
+	metrics.PagesSaved.Inc()
+	if len(lastScrapedPage) > 0 && newPage[0].IsMostRecent {
+		metrics.ChangesDetected.Inc()
+		if c.OnChange != nil {
+			c.OnChange(ctx, lastScrapedPage[0], newPage[0])
+		}
+	}
+
+	err = c.Scheduler.Done(ctx, s, r.URL, newPage[0].IsMostRecent)
+	if err != nil {
+		return mongodb.Page{}, fmt.Errorf("error saving schedule: %v", err)
+	}
+	return newPage[0], nil
 }
 
 // pageComparation verify if the content of a website has changed and assign the flag updated to true if it has changed or false otherwise.
@@ -128,44 +285,112 @@ func pageComparation(lastScrapedPage []mongodb.Page, recentScrapedPage Page) []m
 			newPage[0].IsMostRecent = false
 		}
 	}
+	// Only the versions that changed are searched, the others have the same text as the version they repeat.
+	if newPage[0].IsMostRecent {
+		newPage[0].Text = htmltext.Extract(recentScrapedPage.Content)
+	}
 	return newPage
 }
 
-// Worker use a worker pool to process jobs and send the restuls through a channel
-func (c *Crawler) Worker(f func(string) (string, error)) {
-	defer c.wg.Done()
+// discardResults drains resultCh once the crawler is aborted, until the workers are done, ending the spans of the
+// fetched pages and releasing their leases so the other instances can crawl them right away.
+func (c *Crawler) discardResults(ctx context.Context) {
+	for r := range c.resultCh {
+		metrics.QueueDepth.WithLabelValues("results").Dec()
+		if r.lease != nil {
+			r.lease.release(context.WithoutCancel(ctx), time.Time{})
+		}
+		tracing.End(r.span, context.Canceled)
+	}
+}
+
+// worker fetches the urls received from URLch and send the results through resultCh, until URLch is closed
+// or the context is cancelled. Failed fetches and URLs leased by other instances are skipped.
+func (c *Crawler) worker(ctx context.Context, f func(ctx context.Context, url string) (string, error)) {
 	for url := range c.URLch {
-		content, err := f(url)
+		spanCtx, span := tracing.Start(ctx, "crawler.crawl", attribute.String("url", url))
+		fetchCtx := spanCtx
+		var ls *lease
+		if c.Leaser != nil {
+			var err error
+			ls, err = acquireLease(spanCtx, c.Leaser, "crawl:"+url, c.Owner, c.LeaseTTL)
+			if err != nil {
+				slog.ErrorContext(spanCtx, "error leasing crawl", "url", url, "error", err)
+				tracing.End(span, err)
+				continue
+			}
+			if ls == nil {
+				slog.DebugContext(spanCtx, "url crawled by another instance", "url", url)
+				span.SetAttributes(attribute.Bool("crawler.skipped", true))
+				span.End()
+				continue
+			}
+			fetchCtx = trace.ContextWithSpan(ls.ctx, span)
+		}
+
+		metrics.BusyWorkers.Inc()
+		content, err := f(fetchCtx, url)
+		metrics.BusyWorkers.Dec()
 		if err != nil {
-			slog.Error(fmt.Sprintf("error getting reference: %s", url), "error", err)
+			slog.ErrorContext(spanCtx, fmt.Sprintf("error getting reference: %s", url), "error", err)
+			if ls != nil {
+				ls.release(context.WithoutCancel(ctx), time.Time{})
+			}
+			tracing.End(span, err)
+			continue
+		}
+
+		metrics.QueueDepth.WithLabelValues("results").Inc()
+		select {
+		case c.resultCh <- Page{Content: content, URL: url, ScrapeDateTime: time.Now().UTC(), lease: ls, span: span}:
+		case <-ctx.Done():
+			metrics.QueueDepth.WithLabelValues("results").Dec()
+			if ls != nil {
+				ls.release(context.WithoutCancel(ctx), time.Time{})
+			}
+			tracing.End(span, ctx.Err())
+			return
 		}
-		c.resultCh <- Page{Content: content, URL: url, ScrapeDateTime: time.Now().UTC()}
 	}
 }
 
-// Fetch returns the content of a url as a string
-func Fetch(url string) (string, error) {
-	resp, err := http.Get(url)
+// Fetch returns the content of a url as a string, failing on any status other than 200
+func Fetch(ctx context.Context, url string) (content string, err error) {
+	ctx, span := tracing.Start(ctx, "Fetch", attribute.String("url", url))
+	defer func() { tracing.End(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return "", err
 	}
 
+	host := req.URL.Host
+	start := time.Now()
 	defer func() {
-		_ = resp.Body.Close()
+		metrics.FetchDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
 	}()
 
-	var bodyString string
-	if resp.StatusCode == 200 {
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(resp.Body)
-		if err != nil {
-			return "", err
-		}
-		bodyString = buf.String()
-	} else {
-		slog.Warn(fmt.Sprintf("%s returned status code %d", url, resp.StatusCode))
-		return "", nil
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		metrics.Fetches.WithLabelValues(host, "error").Inc()
+		return "", err
 	}
 
-	return bodyString, nil
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	metrics.Fetches.WithLabelValues(host, strconv.Itoa(resp.StatusCode)).Inc()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	// The page of an error is not a version of the page, saving it would report a change on failure and recovery.
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status code %d", url, resp.StatusCode)
+	}
+	buf := new(bytes.Buffer)
+	n, err := buf.ReadFrom(resp.Body)
+	metrics.FetchedBytes.WithLabelValues(host).Add(float64(n))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
 }
@@ -3,13 +3,22 @@ package newsletter
 import (
 	"context"
 	"crypto/md5"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/metrics"
 	"github.com/perebaj/newsletter/mongodb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type StorageMockImpl struct{}
@@ -21,11 +30,42 @@ func (s StorageMockImpl) SavePage(_ context.Context, _ []mongodb.Page) error { r
 func (s StorageMockImpl) DistinctEngineerURLs(_ context.Context) ([]interface{}, error) {
 	return []interface{}{FakeURL}, nil
 }
+func (s StorageMockImpl) Engineers(_ context.Context) ([]mongodb.Engineer, error) {
+	return []mongodb.Engineer{{URL: FakeURL}}, nil
+}
+func (s StorageMockImpl) Engineer(_ context.Context, url string) (mongodb.Engineer, error) {
+	if url != FakeURL {
+		return mongodb.Engineer{}, mongodb.ErrNotFound
+	}
+	return mongodb.Engineer{URL: FakeURL}, nil
+}
+func (s StorageMockImpl) Schedule(_ context.Context, _ string) (mongodb.Schedule, error) {
+	return mongodb.Schedule{}, mongodb.ErrNotFound
+}
+func (s StorageMockImpl) SaveSchedule(_ context.Context, _ mongodb.Schedule) error { return nil }
+func (s StorageMockImpl) Schedules(_ context.Context) ([]mongodb.Schedule, error) {
+	return []mongodb.Schedule{}, nil
+}
 func (s StorageMockImpl) Page(_ context.Context, _ string) ([]mongodb.Page, error) {
 	return []mongodb.Page{}, nil
 }
-func (s StorageMockImpl) Newsletter() ([]mongodb.Newsletter, error) {
-	return []mongodb.Newsletter{{URLs: []string{FakeURL}}}, nil
+func (s StorageMockImpl) Newsletter(_ context.Context, after string, _ int) ([]mongodb.Newsletter, error) {
+	if after != "" {
+		return nil, nil
+	}
+	return []mongodb.Newsletter{{UserEmail: "j@gmail.com", URLs: []string{FakeURL}}}, nil
+}
+func (s StorageMockImpl) Subscription(_ context.Context, userEmail string) (mongodb.Newsletter, error) {
+	if userEmail != "j@gmail.com" {
+		return mongodb.Newsletter{}, mongodb.ErrNotFound
+	}
+	return mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{FakeURL}}, nil
+}
+func (s StorageMockImpl) PageHistory(_ context.Context, _ string, _ int) ([]mongodb.Page, error) {
+	return []mongodb.Page{}, nil
+}
+func (s StorageMockImpl) PageChanges(_ context.Context, _ string, _ int) ([]mongodb.Page, error) {
+	return []mongodb.Page{}, nil
 }
 func (s StorageMockImpl) PageIn(_ context.Context, _ []string) ([]mongodb.Page, error) {
 	return []mongodb.Page{
@@ -77,25 +117,244 @@ func TestPageComparation(t *testing.T) {
 // Even not verifying the result, this test is useful to check if the crawler is running properly, since it is
 // using Mocks for the Storage and the Fetch function.
 func TestCrawlerRun(t *testing.T) {
-	timeoutCh := time.After(time.Duration(150) * time.Millisecond)
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(150)*time.Millisecond)
+	defer cancel()
 	s := NewStorageMock()
 
-	f := func(string) (string, error) {
+	f := func(context.Context, string) (string, error) {
+		return "Hello, World!", nil
+	}
+
+	c := NewCrawler(1, time.Duration(10)*time.Millisecond)
+	if !c.LastTick().IsZero() {
+		t.Errorf("expected no tick before Run, got %v", c.LastTick())
+	}
+	start := time.Now()
+	if err := c.Run(ctx, s, f); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !c.LastTick().After(start.Add(50 * time.Millisecond)) {
+		t.Errorf("expected a recent tick, got %v", c.LastTick())
+	}
+}
+
+type StorageErrorMockImpl struct {
+	StorageMockImpl
+}
+
+func (s StorageErrorMockImpl) SavePage(_ context.Context, _ []mongodb.Page) error {
+	return errors.New("storage unavailable")
+}
+
+func TestCrawlerRun_StorageError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	f := func(context.Context, string) (string, error) {
+		return "Hello, World!", nil
+	}
+
+	c := NewCrawler(2, time.Duration(10)*time.Millisecond)
+	err := c.Run(ctx, StorageErrorMockImpl{}, f)
+	if err == nil || !strings.Contains(err.Error(), "storage unavailable") {
+		t.Fatalf("expected storage error, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the crawler to stop before the timeout")
+	}
+}
+
+// failingSaveStorage is a memory storage that cannot save pages
+type failingSaveStorage struct {
+	*memory.Storage
+}
+
+func (s failingSaveStorage) SavePage(_ context.Context, _ []mongodb.Page) error {
+	return errors.New("storage unavailable")
+}
+
+func TestCrawlerRun_StorageErrorDiscardsResults(t *testing.T) {
+	rec := recordSpans(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s := memory.NewStorage()
+
+	var urls []string
+	for i := 0; i < 20; i++ {
+		url := fmt.Sprintf("http://%d.fakeurl.test", i)
+		urls = append(urls, url)
+		if err := s.SaveEngineer(ctx, mongodb.Engineer{Name: "John", URL: url}); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	f := func(context.Context, string) (string, error) {
+		return "Hello, World!", nil
+	}
+
+	c := NewCrawler(4, time.Duration(10)*time.Millisecond)
+	c.Leaser, c.Owner = s, "a"
+	err := c.Run(ctx, failingSaveStorage{s}, f)
+	if err == nil || !strings.Contains(err.Error(), "storage unavailable") {
+		t.Fatalf("expected storage error, got %v", err)
+	}
+
+	// Every fetched page was saved or discarded, its span ended and its lease released.
+	var started, ended int
+	for _, span := range rec.Started() {
+		if span.Name() == "crawler.crawl" {
+			started++
+		}
+	}
+	for _, span := range rec.Ended() {
+		if span.Name() == "crawler.crawl" {
+			ended++
+		}
+	}
+	if started == 0 || started != ended {
+		t.Fatalf("expected every crawl span to end, got %d ended of %d", ended, started)
+	}
+	for _, url := range urls {
+		ok, err := s.AcquireLease(ctx, "crawl:"+url, "b", time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("expected the lease of %s to be released, got %v %v", url, ok, err)
+		}
+	}
+}
+
+func TestCrawlerRun_MemoryStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := memory.NewStorage()
+
+	err := s.SaveEngineer(ctx, mongodb.Engineer{Name: "John", URL: FakeURL})
+	if err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+
+	f := func(context.Context, string) (string, error) {
 		return "Hello, World!", nil
 	}
 
-	signalCh := make(chan os.Signal, 1)
+	c := NewCrawler(1, time.Duration(10)*time.Millisecond)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Run(ctx, s, f)
+	}()
+
+	timeoutCh := time.After(time.Second)
+	for {
+		got, err := s.Page(ctx, FakeURL)
+		if err != nil {
+			t.Fatal("error getting page", err)
+		}
+		if len(got) == 1 {
+			if got[0].Content != "Hello, World!" || !got[0].IsMostRecent {
+				t.Fatalf("unexpected page %v", got[0])
+			}
+			break
+		}
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("unexpected crawler stop: %v", err)
+		case <-timeoutCh:
+			t.Fatal("timeout waiting for the crawler to save the page")
+		case <-time.After(time.Duration(5) * time.Millisecond):
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected graceful stop, got %v", err)
+	}
+}
+
+func TestCrawlerRun_GracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := memory.NewStorage()
 
-	c := NewCrawler(1, time.Duration(1000)*time.Millisecond, signalCh)
+	err := s.SaveEngineer(ctx, mongodb.Engineer{Name: "John", URL: FakeURL})
+	if err != nil {
+		t.Fatal("error saving engineer", err)
+	}
+
+	fetching := make(chan struct{})
+	var once sync.Once
+	f := func(context.Context, string) (string, error) {
+		once.Do(func() { close(fetching) })
+		time.Sleep(time.Duration(50) * time.Millisecond)
+		return "Hello, World!", nil
+	}
+
+	c := NewCrawler(1, time.Duration(10)*time.Millisecond)
+	c.GracePeriod = time.Second
+	errCh := make(chan error, 1)
 	go func() {
-		c.Run(ctx, s, f)
+		errCh <- c.Run(ctx, s, f)
 	}()
 
-	select {
-	case <-signalCh:
-		t.Error("unexpected signal error")
-	case <-timeoutCh:
+	// Stop the crawler while the first fetch is in flight, its result must still be saved.
+	<-fetching
+	cancel()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected graceful stop, got %v", err)
+	}
+
+	got, err := s.Page(context.Background(), FakeURL)
+	if err != nil {
+		t.Fatal("error getting page", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected the in-flight page to be saved, got %d pages", len(got))
+	}
+}
+
+func TestCrawlerCrawlOnce(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	content := "Hello, World!"
+	f := func(context.Context, string) (string, error) {
+		return content, nil
+	}
+
+	saved, changes := testutil.ToFloat64(metrics.PagesSaved), testutil.ToFloat64(metrics.ChangesDetected)
+	c := NewCrawler(1, time.Hour)
+	for i, want := range []bool{true, false} {
+		got, err := c.CrawlOnce(ctx, s, FakeURL, f)
+		if err != nil {
+			t.Fatal("error crawling", err)
+		}
+		if got.URL != FakeURL || got.Content != content || got.IsMostRecent != want {
+			t.Fatalf("crawl %d: unexpected page %v", i, got)
+		}
+	}
+
+	history, err := s.PageHistory(ctx, FakeURL, 0)
+	if err != nil {
+		t.Fatal("error getting page history", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(history))
+	}
+	// The first version has nothing to be compared with, so it is not a change.
+	if got := testutil.ToFloat64(metrics.PagesSaved) - saved; got != 2 {
+		t.Errorf("got %v pages saved, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.ChangesDetected) - changes; got != 0 {
+		t.Errorf("got %v changes, want 0", got)
+	}
+	if sch := schedule(ctx, t, s, FakeURL); sch.LastRun.IsZero() || sch.UnchangedRuns != 1 {
+		t.Fatalf("expected the crawl to be recorded in the schedule, got %v", sch)
+	}
+
+	f = func(context.Context, string) (string, error) {
+		return "", errors.New("connection refused")
+	}
+	if _, err := c.CrawlOnce(ctx, s, FakeURL, f); err == nil {
+		t.Fatal("expected error crawling")
 	}
 }
 
@@ -109,7 +368,7 @@ func TestFetch(t *testing.T) {
 
 	defer server.Close()
 
-	got, err := Fetch(server.URL)
+	got, err := Fetch(context.Background(), server.URL)
 	if err != nil {
 		t.Errorf("error getting reference: %v", err)
 	}
@@ -126,12 +385,84 @@ func TestFetch_Status500(t *testing.T) {
 
 	defer server.Close()
 
-	got, err := Fetch(server.URL)
-	if err != nil {
-		t.Errorf("error getting reference: %v", err)
+	got, err := Fetch(context.Background(), server.URL)
+	if err == nil {
+		t.Error("expected an error")
 	}
 
 	if got != "" {
 		t.Errorf("expected empty body, got %s", got)
 	}
 }
+
+func TestFetch_Metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("Hello, World!"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		if _, err := Fetch(context.Background(), server.URL+path); (err != nil) != (path == "/missing") {
+			t.Fatalf("%s: unexpected error %v", path, err)
+		}
+	}
+
+	if got := testutil.ToFloat64(metrics.Fetches.WithLabelValues(host, "200")); got != 2 {
+		t.Errorf("got %v fetches with status 200, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.Fetches.WithLabelValues(host, "404")); got != 1 {
+		t.Errorf("got %v fetches with status 404, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.FetchedBytes.WithLabelValues(host)); got != 26 {
+		t.Errorf("got %v bytes, want 26", got)
+	}
+}
+
+// recordSpans installs a tracer provider that records the ended spans until the end of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return rec
+}
+
+// spanNames returns the names of the spans, by trace, in the order they ended.
+func spanNames(spans []sdktrace.ReadOnlySpan) map[string][]string {
+	names := make(map[string][]string)
+	for _, s := range spans {
+		id := s.SpanContext().TraceID().String()
+		names[id] = append(names[id], s.Name())
+	}
+	return names
+}
+
+func TestCrawlerCrawlOnce_Spans(t *testing.T) {
+	rec := recordSpans(t)
+	ctx := context.Background()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("Hello, World!"))
+	}))
+	defer svr.Close()
+
+	if _, err := NewCrawler(1, time.Hour).CrawlOnce(ctx, memory.NewStorage(), svr.URL, Fetch); err != nil {
+		t.Fatal("error crawling", err)
+	}
+
+	traces := spanNames(rec.Ended())
+	if len(traces) != 1 {
+		t.Fatalf("expected a single trace, got %v", traces)
+	}
+	want := "Fetch storage.Page pageComparation storage.SavePage crawler.crawl"
+	for _, names := range traces {
+		if got := strings.Join(names, " "); got != want {
+			t.Fatalf("expected spans %q, got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+const (
+	// DefaultSearchLimit is the number of results of a search without limit
+	DefaultSearchLimit = 20
+	// MaxSearchLimit is the maximum number of results of a search
+	MaxSearchLimit = 100
+	// snippetWords is the number of words of a snippet
+	snippetWords = 30
+)
+
+// SearchStorage is the storage of the pages that can be searched
+type SearchStorage interface {
+	Storage
+	SearchPages(ctx context.Context, q mongodb.PageQuery) ([]mongodb.Page, error)
+	// PageVersion returns the version of the page of the url scraped at, mongodb.ErrNotFound when there is none
+	PageVersion(ctx context.Context, url string, at time.Time) (mongodb.Page, error)
+}
+
+// SearchQuery is a search of the versions of the pages
+type SearchQuery struct {
+	// Text are the words searched, any of them matches
+	Text string
+	// Engineer is the URL or the name of the engineer whose page is searched, all of them when empty
+	Engineer string
+	// From and To bound the scrape time of the versions, when not zero
+	From time.Time
+	To   time.Time
+	// Limit is the maximum number of results, DefaultSearchLimit when zero
+	Limit int
+}
+
+// SearchResult is a version of a page matching a search
+type SearchResult struct {
+	URL       string        `json:"url"`
+	Engineer  EventEngineer `json:"engineer"`
+	ScrapedAt time.Time     `json:"scraped_at"`
+	// Snippet is the HTML of the text around the first match, with the matches in <mark> elements
+	Snippet string `json:"snippet"`
+	// Version is the path of the version served by SearchHandler
+	Version string `json:"version"`
+}
+
+// Search returns the versions of the pages that changed matching the query, the most relevant first.
+func Search(ctx context.Context, s SearchStorage, q SearchQuery) ([]SearchResult, error) {
+	engineers, err := s.Engineers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting engineers: %v", err)
+	}
+
+	pq := mongodb.PageQuery{Text: q.Text, From: q.From, To: q.To, Limit: q.Limit}
+	if pq.Limit <= 0 {
+		pq.Limit = DefaultSearchLimit
+	}
+	if q.Engineer != "" {
+		for _, e := range engineers {
+			if e.URL == q.Engineer || strings.EqualFold(e.Name, q.Engineer) {
+				pq.URLs = append(pq.URLs, e.URL)
+			}
+		}
+		if len(pq.URLs) == 0 {
+			return []SearchResult{}, nil
+		}
+	}
+
+	pages, err := s.SearchPages(ctx, pq)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := strings.Fields(strings.ToLower(q.Text))
+	results := make([]SearchResult, 0, len(pages))
+	for _, p := range pages {
+		e, _ := engineerOf(engineers, p.URL)
+		results = append(results, SearchResult{
+			URL:       p.URL,
+			Engineer:  EventEngineer{Name: e.Name, URL: e.URL},
+			ScrapedAt: p.ScrapeDatetime,
+			Snippet:   snippet(p.Text, terms),
+			Version:   versionPath(p),
+		})
+	}
+	return results, nil
+}
+
+// versionPath returns the path SearchHandler serves the version of the page at
+func versionPath(p mongodb.Page) string {
+	v := url.Values{"url": {p.URL}, "at": {p.ScrapeDatetime.UTC().Format(time.RFC3339Nano)}}
+	return "/search/versions?" + v.Encode()
+}
+
+// matches reports if the word of a text is a term of a search, or its plural, as the search of MongoDB stems
+// the words. The other words starting with a term do not match.
+func matches(word string, terms []string) bool {
+	w := strings.ToLower(strings.Trim(word, ".,;:!?\"'()[]{}"))
+	for _, t := range terms {
+		if w == t || strings.TrimSuffix(w, "s") == t {
+			return true
+		}
+	}
+	return false
+}
+
+// snippet returns the HTML of the words of text around the first match of the terms, with the matches highlighted,
+// or the first words of the text when nothing matches.
+func snippet(text string, terms []string) string {
+	words := strings.Fields(text)
+	start := 0
+	for i, w := range words {
+		if matches(w, terms) {
+			start = i - snippetWords/3
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("… ")
+	}
+	for i, w := range words[start:end] {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		if matches(w, terms) {
+			b.WriteString("<mark>" + html.EscapeString(w) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(w))
+		}
+	}
+	if end < len(words) {
+		b.WriteString(" …")
+	}
+	return b.String()
+}
+
+// parseSearchTime parses the bound of a search, a RFC 3339 time or a date. The date of an upper bound is included.
+func parseSearchTime(v string, upper bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a RFC 3339 time or a date", v)
+	}
+	if upper {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// ParseSearchQuery returns the query of the q, engineer, from, to and limit parameters
+func ParseSearchQuery(v url.Values) (SearchQuery, error) {
+	q := SearchQuery{Text: v.Get("q"), Engineer: v.Get("engineer")}
+
+	var err error
+	if q.From, err = parseSearchTime(v.Get("from"), false); err != nil {
+		return q, err
+	}
+	if q.To, err = parseSearchTime(v.Get("to"), true); err != nil {
+		return q, err
+	}
+	if l := v.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit <= 0 || q.Limit > MaxSearchLimit {
+			return q, fmt.Errorf("invalid limit %q, expected a number between 1 and %d", l, MaxSearchLimit)
+		}
+	}
+	return q, nil
+}
+
+// SearchHandler serves the search of the versions of the pages, mounted on /search/:
+//
+//	GET /search?q=<words>&engineer=<url or name>&from=<time>&to=<time>&limit=<n>    the results as JSON
+//	GET /search/versions?url=<url>&at=<time>                                         a version of a page
+//
+// The versions are served as they were scraped, sandboxed so their scripts do not run on this origin.
+func SearchHandler(s SearchStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		switch strings.Trim(r.URL.Path, "/") {
+		case "search":
+			q, err := ParseSearchQuery(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			results, err := Search(r.Context(), s, q)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error searching pages", "error", err)
+				http.Error(w, "error searching pages", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, results)
+		case "search/versions":
+			serveVersion(w, r, s)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request, s SearchStorage) {
+	at, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("at"))
+	if err != nil {
+		http.Error(w, "invalid time "+r.URL.Query().Get("at"), http.StatusBadRequest)
+		return
+	}
+	p, err := s.PageVersion(r.Context(), r.URL.Query().Get("url"), at)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting page version", "error", err)
+		http.Error(w, "error getting page version", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(p.Content))
+}
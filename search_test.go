@@ -0,0 +1,187 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/htmltext"
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// newSearchStorage returns a storage with two versions of the page of John, that wrote about Go and then about
+// Rust, and a version of the page of Mary, that wrote about Go.
+func newSearchStorage(ctx context.Context, t *testing.T) *memory.Storage {
+	s := memory.NewStorage()
+	for _, e := range []mongodb.Engineer{{Name: "John", URL: FakeURL}, {Name: "Mary", URL: "https://mary.test"}} {
+		if err := s.SaveEngineer(ctx, e); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []struct {
+		url, content string
+		day          int
+	}{
+		{FakeURL, `<h1>Go & channels</h1><script>go()</script>`, 0},
+		{FakeURL, `<h1>Rust</h1><p>Ownership</p>`, 2},
+		{"https://mary.test", `<p>Why I use Go every day, and go again</p>`, 1},
+	}
+	for _, v := range versions {
+		p := mongodb.Page{URL: v.url, Content: v.content, Text: htmltext.Extract(v.content), IsMostRecent: true, ScrapeDatetime: start.AddDate(0, 0, v.day)}
+		if err := s.SavePage(ctx, []mongodb.Page{p}); err != nil {
+			t.Fatal("error saving page", err)
+		}
+	}
+	return s
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	s := newSearchStorage(ctx, t)
+
+	got, err := Search(ctx, s, SearchQuery{Text: "go"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(got) != 2 || got[0].Engineer.Name != "Mary" || got[1].Engineer.Name != "John" {
+		t.Fatalf("expected the most relevant version of Mary first, got %+v", got)
+	}
+	if want := "<mark>Go</mark> &amp; channels"; got[1].Snippet != want {
+		t.Fatalf("expected snippet %q, got %q", want, got[1].Snippet)
+	}
+	if !strings.HasPrefix(got[1].Version, "/search/versions?") {
+		t.Fatalf("unexpected version %q", got[1].Version)
+	}
+
+	tests := []struct {
+		name string
+		q    SearchQuery
+		want int
+	}{
+		{"engineer name", SearchQuery{Text: "go", Engineer: "john"}, 1},
+		{"engineer URL", SearchQuery{Text: "go", Engineer: "https://mary.test"}, 1},
+		{"unknown engineer", SearchQuery{Text: "go", Engineer: "Bob"}, 0},
+		{"range", SearchQuery{Text: "go", From: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}, 1},
+		{"no text", SearchQuery{}, 3},
+		{"limit", SearchQuery{Limit: 1}, 1},
+		{"no match", SearchQuery{Text: "python"}, 0},
+	}
+	for _, tt := range tests {
+		got, err := Search(ctx, s, tt.q)
+		if err != nil || len(got) != tt.want {
+			t.Errorf("%s: expected %d results, got %d (%v)", tt.name, tt.want, len(got), err)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("word ", 20) + "goroutines <leak> " + strings.Repeat("word ", 40)
+	got := snippet(text, []string{"goroutine"})
+	if !strings.HasPrefix(got, "… ") || !strings.HasSuffix(got, " …") {
+		t.Fatalf("expected a truncated snippet, got %q", got)
+	}
+	if !strings.Contains(got, "<mark>goroutines</mark> &lt;leak&gt;") {
+		t.Fatalf("expected the match highlighted and the text escaped, got %q", got)
+	}
+	if got := snippet("no match here", []string{"go"}); got != "no match here" {
+		t.Fatalf("expected the start of the text, got %q", got)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		word string
+		want bool
+	}{
+		{"go", true},
+		{"Go,", true},
+		{"gos", true},
+		{"(go)", true},
+		{"gopher", false},
+		{"google", false},
+		{"ago", false},
+		{"startups", true},
+		{"startup", true},
+		{"startupsss", false},
+	}
+
+	for _, tt := range tests {
+		if got := matches(tt.word, []string{"go", "startup"}); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := ParseSearchQuery(map[string][]string{"q": {"go"}, "from": {"2024-01-01"}, "to": {"2024-01-31"}, "limit": {"5"}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if q.Text != "go" || q.Limit != 5 || q.From.Day() != 1 || !q.To.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)) {
+		t.Fatalf("unexpected query %+v", q)
+	}
+
+	for _, v := range []map[string][]string{{"from": {"yesterday"}}, {"limit": {"0"}}, {"limit": {"101"}}} {
+		if _, err := ParseSearchQuery(v); err == nil {
+			t.Errorf("%v: expected error", v)
+		}
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	svr := httptest.NewServer(SearchHandler(newSearchStorage(context.Background(), t)))
+	defer svr.Close()
+
+	resp, err := http.Get(svr.URL + "/search?q=rust")
+	if err != nil {
+		t.Fatal("error searching", err)
+	}
+	var results []SearchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal("error decoding results", err)
+	}
+	_ = resp.Body.Close()
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %+v", results)
+	}
+
+	resp, err = http.Get(svr.URL + results[0].Version)
+	if err != nil {
+		t.Fatal("error getting version", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != `<h1>Rust</h1><p>Ownership</p>` || resp.Header.Get("Content-Security-Policy") != "sandbox" {
+		t.Fatalf("expected the sandboxed version, got %q %v", body, resp.Header)
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/search?limit=x", http.StatusBadRequest},
+		{http.MethodGet, "/search/versions?url=" + FakeURL + "&at=2020-01-01T00:00:00Z", http.StatusNotFound},
+		{http.MethodGet, "/search/versions?url=" + FakeURL + "&at=x", http.StatusBadRequest},
+		{http.MethodGet, "/search/other", http.StatusNotFound},
+		{http.MethodPost, "/search?q=go", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
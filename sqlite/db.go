@@ -0,0 +1,68 @@
+// Package sqlite provides a SQLite storage, an alternative to MongoDB for small deployments.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	// registers the pure Go "sqlite" database/sql driver.
+	_ "modernc.org/sqlite"
+)
+
+// Config is the configuration for the SQLite database.
+type Config struct {
+	// Path is the database file, ":memory:" keeps the whole database in memory.
+	Path string
+}
+
+// OpenDB opens the SQLite database file, creating it if it does not exist.
+func OpenDB(ctx context.Context, cfg Config) (*sql.DB, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("SQLite path is empty")
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "foreign_keys(1)")
+	if cfg.Path != ":memory:" {
+		params.Add("_pragma", "journal_mode(WAL)")
+	}
+
+	db, err := sql.Open("sqlite", "file:"+cfg.Path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, serializing the connections avoids "database is locked" errors
+	// and keeps ":memory:" databases, that live per connection, consistent.
+	db.SetMaxOpenConns(1)
+
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Storage joins the SQLite operations of the newsletter
+type Storage struct {
+	db *sql.DB
+}
+
+// NewStorage initializes a new Storage
+func NewStorage(db *sql.DB) *Storage {
+	return &Storage{
+		db: db,
+	}
+}
+
+// Ping checks the connection to the database
+func (s *Storage) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("error pinging SQLite: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Migration is a versioned change of the database schema, applied inside a transaction.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, tx *sql.Tx) error
+}
+
+// AppliedMigration is the record saved in the schema_migrations table after a migration runs.
+type AppliedMigration struct {
+	Version     int
+	Description string
+	AppliedAt   time.Time
+}
+
+// Migrations returns the list of known migrations sorted by version.
+func Migrations() []Migration {
+	m := []Migration{
+		{
+			Version:     1,
+			Description: "create engineers, newsletters and pages tables",
+			Up: execStatements(
+				`CREATE TABLE engineers (
+					url TEXT PRIMARY KEY CHECK (url <> ''),
+					name TEXT NOT NULL DEFAULT '',
+					description TEXT NOT NULL DEFAULT ''
+				)`,
+				`CREATE TABLE newsletters (
+					user_email TEXT PRIMARY KEY CHECK (user_email <> '')
+				)`,
+				`CREATE TABLE newsletter_urls (
+					user_email TEXT NOT NULL REFERENCES newsletters (user_email) ON DELETE CASCADE,
+					position INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					PRIMARY KEY (user_email, position)
+				)`,
+				`CREATE TABLE pages (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					url TEXT NOT NULL,
+					content TEXT NOT NULL,
+					scrape_date INTEGER NOT NULL,
+					hash_md5 BLOB NOT NULL,
+					is_most_recent INTEGER NOT NULL
+				)`,
+				`CREATE INDEX pages_url_scrape_date ON pages (url, scrape_date DESC)`,
+			),
+		},
+		{
+			Version:     2,
+			Description: "add engineers schedule and schedules table",
+			Up: execStatements(
+				`ALTER TABLE engineers ADD COLUMN schedule TEXT NOT NULL DEFAULT ''`,
+				`CREATE TABLE schedules (
+					url TEXT PRIMARY KEY,
+					next_run INTEGER NOT NULL,
+					last_run INTEGER NOT NULL,
+					unchanged_runs INTEGER NOT NULL
+				)`,
+			),
+		},
+		{
+			Version:     3,
+			Description: "add schedules interval and change rate",
+			Up: execStatements(
+				`ALTER TABLE schedules ADD COLUMN interval INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE schedules ADD COLUMN change_rate REAL NOT NULL DEFAULT 0`,
+			),
+		},
+		{
+			Version:     4,
+			Description: "add newsletters channels",
+			Up: execStatements(
+				`ALTER TABLE newsletters ADD COLUMN channels TEXT NOT NULL DEFAULT ''`,
+			),
+		},
+		{
+			Version:     5,
+			Description: "add newsletters filters",
+			Up: execStatements(
+				`ALTER TABLE newsletters ADD COLUMN filters TEXT NOT NULL DEFAULT ''`,
+			),
+		},
+		{
+			Version:     6,
+			Description: "add newsletters cadence and last sent time",
+			Up: execStatements(
+				`ALTER TABLE newsletters ADD COLUMN cadence TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE newsletters ADD COLUMN last_sent INTEGER NOT NULL DEFAULT 0`,
+			),
+		},
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].Version < m[j].Version })
+	return m
+}
+
+// Migrate applies all the pending migrations, in version order, and records them in the schema_migrations table.
+func (s *Storage) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %v", err)
+	}
+
+	applied, err := s.AppliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	for _, mig := range Migrations() {
+		if done[mig.Version] {
+			continue
+		}
+
+		slog.Info("applying migration", "version", mig.Version, "description", mig.Description)
+		if err := s.apply(ctx, mig); err != nil {
+			return fmt.Errorf("error applying migration %d: %v", mig.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// AppliedMigrations returns the migrations already applied in the database sorted by version.
+func (s *Storage) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT version, description, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting migrations: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var a AppliedMigration
+		var appliedAt int64
+		if err := rows.Scan(&a.Version, &a.Description, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error decoding migrations: %v", err)
+		}
+		a.AppliedAt = time.Unix(0, appliedAt).UTC()
+		applied = append(applied, a)
+	}
+
+	return applied, rows.Err()
+}
+
+func (s *Storage) apply(ctx context.Context, mig Migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := mig.Up(ctx, tx); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+		mig.Version, mig.Description, time.Now().UTC().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// execStatements returns a migration step that executes each statement in order.
+func execStatements(statements ...string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
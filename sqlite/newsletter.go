@@ -0,0 +1,448 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// SaveNewsletter saves a newsletter in the database
+func (s *Storage) SaveNewsletter(ctx context.Context, newsletter mongodb.Newsletter) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	channels, err := encodeList("channels", newsletter.Channels)
+	if err != nil {
+		return err
+	}
+	filters, err := encodeList("filters", newsletter.Filters)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO newsletters (user_email, channels, filters, cadence, last_sent)
+		VALUES (?, ?, ?, ?, ?)`, newsletter.UserEmail, channels, filters, newsletter.Cadence, unixNano(newsletter.LastSent))
+	if err != nil {
+		return fmt.Errorf("error saving newsletter: %v", err)
+	}
+
+	for i, url := range newsletter.URLs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO newsletter_urls (user_email, position, url) VALUES (?, ?, ?)`,
+			newsletter.UserEmail, i, url)
+		if err != nil {
+			return fmt.Errorf("error saving newsletter url: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateNewsletter replaces the URLs, channels, filters and cadence of the newsletter of the same user, keeping when
+// it was last sent. It returns ErrNotFound when there is none.
+func (s *Storage) UpdateNewsletter(ctx context.Context, newsletter mongodb.Newsletter) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	channels, err := encodeList("channels", newsletter.Channels)
+	if err != nil {
+		return err
+	}
+	filters, err := encodeList("filters", newsletter.Filters)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE newsletters SET channels = ?, filters = ?, cadence = ? WHERE user_email = ?`,
+		channels, filters, newsletter.Cadence, newsletter.UserEmail)
+	if err != nil {
+		return fmt.Errorf("error updating newsletter: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error counting affected rows: %v", err)
+	}
+	if n == 0 {
+		return mongodb.ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM newsletter_urls WHERE user_email = ?`, newsletter.UserEmail)
+	if err != nil {
+		return fmt.Errorf("error deleting newsletter urls: %v", err)
+	}
+	for i, url := range newsletter.URLs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO newsletter_urls (user_email, position, url) VALUES (?, ?, ?)`,
+			newsletter.UserEmail, i, url)
+		if err != nil {
+			return fmt.Errorf("error saving newsletter url: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveEngineer saves an engineer in the database, replacing the engineer that has the same URL
+func (s *Storage) SaveEngineer(ctx context.Context, e mongodb.Engineer) error {
+	if err := mongodb.ValidateSchedule(e.Schedule); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO engineers (url, name, description, schedule) VALUES (?, ?, ?, ?)
+		ON CONFLICT (url) DO UPDATE SET name = excluded.name, description = excluded.description, schedule = excluded.schedule`,
+		e.URL, e.Name, e.Description, e.Schedule)
+	if err != nil {
+		return fmt.Errorf("error saving engineer: %v", err)
+	}
+	return nil
+}
+
+// DeleteEngineer deletes the engineer of the URL and its crawl schedule, keeping the scraped pages
+func (s *Storage) DeleteEngineer(ctx context.Context, url string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM engineers WHERE url = ?`, url)
+	if err != nil {
+		return fmt.Errorf("error deleting engineer: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error counting affected rows: %v", err)
+	}
+	if n == 0 {
+		return mongodb.ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schedules WHERE url = ?`, url)
+	if err != nil {
+		return fmt.Errorf("error deleting schedule: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// DeleteNewsletter deletes the newsletter of the user email, with its urls
+func (s *Storage) DeleteNewsletter(ctx context.Context, userEmail string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM newsletters WHERE user_email = ?`, userEmail)
+	if err != nil {
+		return fmt.Errorf("error deleting newsletter: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error counting affected rows: %v", err)
+	}
+	if n == 0 {
+		return mongodb.ErrNotFound
+	}
+	return nil
+}
+
+// DistinctEngineerURLs returns all url sites of each distinct engineer
+func (s *Storage) DistinctEngineerURLs(ctx context.Context) ([]interface{}, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT url FROM engineers ORDER BY url`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting engineers: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	resp := []interface{}{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, fmt.Errorf("error decoding engineers: %v", err)
+		}
+		resp = append(resp, url)
+	}
+
+	return resp, rows.Err()
+}
+
+// Engineer returns the engineer of the URL, mongodb.ErrNotFound when there is none
+func (s *Storage) Engineer(ctx context.Context, url string) (mongodb.Engineer, error) {
+	e := mongodb.Engineer{URL: url}
+	err := s.db.QueryRowContext(ctx, `SELECT name, description, schedule FROM engineers WHERE url = ?`, url).
+		Scan(&e.Name, &e.Description, &e.Schedule)
+	if errors.Is(err, sql.ErrNoRows) {
+		return mongodb.Engineer{}, mongodb.ErrNotFound
+	}
+	if err != nil {
+		return mongodb.Engineer{}, fmt.Errorf("error getting engineer: %v", err)
+	}
+	return e, nil
+}
+
+// Engineers returns all the engineers sorted by URL
+func (s *Storage) Engineers(ctx context.Context) ([]mongodb.Engineer, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT url, name, description, schedule FROM engineers ORDER BY url`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting engineers: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var engineers []mongodb.Engineer
+	for rows.Next() {
+		var e mongodb.Engineer
+		if err := rows.Scan(&e.URL, &e.Name, &e.Description, &e.Schedule); err != nil {
+			return nil, fmt.Errorf("error decoding engineers: %v", err)
+		}
+		engineers = append(engineers, e)
+	}
+
+	return engineers, rows.Err()
+}
+
+// Newsletter returns up to limit newsletters, sorted by user email, whose user email comes after the given one.
+// A limit less than or equal to zero returns all the remaining newsletters.
+func (s *Storage) Newsletter(ctx context.Context, after string, limit int) ([]mongodb.Newsletter, error) {
+	// SQLite treats a negative LIMIT as no limit.
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT n.user_email, n.channels, n.filters, n.cadence, n.last_sent, u.url FROM (
+			SELECT user_email, channels, filters, cadence, last_sent FROM newsletters WHERE user_email > ? ORDER BY user_email LIMIT ?
+		) n
+		LEFT JOIN newsletter_urls u ON u.user_email = n.user_email
+		ORDER BY n.user_email, u.position`, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting newsletters: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var newsletters []mongodb.Newsletter
+	for rows.Next() {
+		var email, channels, filters, cadence string
+		var lastSent int64
+		var url sql.NullString
+		if err := rows.Scan(&email, &channels, &filters, &cadence, &lastSent, &url); err != nil {
+			return nil, fmt.Errorf("error decoding newsletters: %v", err)
+		}
+
+		if len(newsletters) == 0 || newsletters[len(newsletters)-1].UserEmail != email {
+			n := mongodb.Newsletter{UserEmail: email, Cadence: cadence, LastSent: fromUnixNano(lastSent)}
+			if err := decodeList("channels", channels, &n.Channels); err != nil {
+				return nil, err
+			}
+			if err := decodeList("filters", filters, &n.Filters); err != nil {
+				return nil, err
+			}
+			newsletters = append(newsletters, n)
+		}
+		if url.Valid {
+			last := &newsletters[len(newsletters)-1]
+			last.URLs = append(last.URLs, url.String)
+		}
+	}
+
+	return newsletters, rows.Err()
+}
+
+// Subscription returns the newsletter of the user email, mongodb.ErrNotFound when there is none
+func (s *Storage) Subscription(ctx context.Context, userEmail string) (mongodb.Newsletter, error) {
+	n := mongodb.Newsletter{UserEmail: userEmail}
+	var channels, filters string
+	var lastSent int64
+	err := s.db.QueryRowContext(ctx, `SELECT channels, filters, cadence, last_sent FROM newsletters WHERE user_email = ?`,
+		userEmail).Scan(&channels, &filters, &n.Cadence, &lastSent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return mongodb.Newsletter{}, mongodb.ErrNotFound
+	}
+	if err != nil {
+		return mongodb.Newsletter{}, fmt.Errorf("error getting subscription: %v", err)
+	}
+	n.LastSent = fromUnixNano(lastSent)
+	if err := decodeList("channels", channels, &n.Channels); err != nil {
+		return mongodb.Newsletter{}, err
+	}
+	if err := decodeList("filters", filters, &n.Filters); err != nil {
+		return mongodb.Newsletter{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT url FROM newsletter_urls WHERE user_email = ? ORDER BY position`, userEmail)
+	if err != nil {
+		return mongodb.Newsletter{}, fmt.Errorf("error getting subscription: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return mongodb.Newsletter{}, fmt.Errorf("error decoding subscription: %v", err)
+		}
+		n.URLs = append(n.URLs, url)
+	}
+	return n, rows.Err()
+}
+
+// MarkNewsletterSent records when the newsletter of the user was sent, ErrNotFound when there is none
+func (s *Storage) MarkNewsletterSent(ctx context.Context, userEmail string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE newsletters SET last_sent = ? WHERE user_email = ?`, unixNano(at), userEmail)
+	if err != nil {
+		return fmt.Errorf("error marking newsletter sent: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error counting affected rows: %v", err)
+	}
+	if n == 0 {
+		return mongodb.ErrNotFound
+	}
+	return nil
+}
+
+// encodeList encodes the channels or the filters of a newsletter, named name, as JSON, empty when there is none
+func encodeList[T any](name string, list []T) (string, error) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return "", fmt.Errorf("error encoding %s: %v", name, err)
+	}
+	return string(b), nil
+}
+
+func decodeList[T any](name, s string, list *[]T) error {
+	if s == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(s), list); err != nil {
+		return fmt.Errorf("error decoding %s: %v", name, err)
+	}
+	return nil
+}
+
+// SavePage saves the scraped content of a website
+func (s *Storage) SavePage(ctx context.Context, pages []mongodb.Page) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, p := range pages {
+		_, err = tx.ExecContext(ctx, `INSERT INTO pages (url, content, scrape_date, hash_md5, is_most_recent)
+			VALUES (?, ?, ?, ?, ?)`,
+			p.URL, p.Content, unixNano(p.ScrapeDatetime), p.HashMD5[:], p.IsMostRecent)
+		if err != nil {
+			return fmt.Errorf("error saving page: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PageIn returns the last scraped content of a given list of urls
+func (s *Storage) PageIn(ctx context.Context, urls []string) ([]mongodb.Page, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(urls))
+	for i, url := range urls {
+		args[i] = url
+	}
+
+	query := `SELECT url, content, scrape_date, hash_md5, is_most_recent FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY url ORDER BY scrape_date DESC, id DESC) AS version
+			FROM pages WHERE url IN (?` + strings.Repeat(", ?", len(urls)-1) + `)
+		) WHERE version = 1`
+
+	return s.queryPages(ctx, query, args...)
+}
+
+// DeletePagesBefore deletes the versions of the pages scraped before the given time, always keeping the last
+// version of every url, that the next crawl is compared with. It returns the number of deleted versions.
+func (s *Storage) DeletePagesBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pages WHERE scrape_date < ? AND id NOT IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY url ORDER BY scrape_date DESC, id DESC) AS n FROM pages
+		) WHERE n = 1
+	)`, unixNano(before))
+	if err != nil {
+		return 0, fmt.Errorf("error deleting pages: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+// Page returns the last scraped content of a given url
+func (s *Storage) Page(ctx context.Context, url string) ([]mongodb.Page, error) {
+	page, err := s.queryPages(ctx, `SELECT url, content, scrape_date, hash_md5, is_most_recent FROM pages
+		WHERE url = ? ORDER BY scrape_date DESC, id DESC LIMIT 1`, url)
+	if page == nil {
+		page = []mongodb.Page{}
+	}
+	return page, err
+}
+
+// PageHistory returns up to limit scraped versions of a given url, from the newest to the oldest.
+// A limit less than or equal to zero returns all the versions.
+func (s *Storage) PageHistory(ctx context.Context, url string, limit int) ([]mongodb.Page, error) {
+	// SQLite treats a negative LIMIT as no limit.
+	if limit <= 0 {
+		limit = -1
+	}
+	return s.queryPages(ctx, `SELECT url, content, scrape_date, hash_md5, is_most_recent FROM pages
+		WHERE url = ? ORDER BY scrape_date DESC, id DESC LIMIT ?`, url, limit)
+}
+
+// PageChanges returns up to limit versions of the url that changed the page, the newest first.
+// A limit less than or equal to zero returns all of them.
+func (s *Storage) PageChanges(ctx context.Context, url string, limit int) ([]mongodb.Page, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return s.queryPages(ctx, `SELECT url, content, scrape_date, hash_md5, is_most_recent FROM pages
+		WHERE url = ? AND is_most_recent = 1 ORDER BY scrape_date DESC, id DESC LIMIT ?`, url, limit)
+}
+
+func (s *Storage) queryPages(ctx context.Context, query string, args ...interface{}) ([]mongodb.Page, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting page: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var pages []mongodb.Page
+	for rows.Next() {
+		var p mongodb.Page
+		var scrapeDate int64
+		var hash []byte
+		if err := rows.Scan(&p.URL, &p.Content, &scrapeDate, &hash, &p.IsMostRecent); err != nil {
+			return nil, fmt.Errorf("error decoding page: %v", err)
+		}
+		p.ScrapeDatetime = fromUnixNano(scrapeDate)
+		copy(p.HashMD5[:], hash)
+		pages = append(pages, p)
+	}
+
+	return pages, rows.Err()
+}
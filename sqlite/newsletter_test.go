@@ -0,0 +1,49 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/perebaj/newsletter/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return setup(context.Background(), t)
+	})
+}
+
+func TestStorageMigrate(t *testing.T) {
+	ctx := context.Background()
+	storage := setup(ctx, t)
+
+	// Running it again must be a no-op.
+	if err := storage.Migrate(ctx); err != nil {
+		t.Fatal("error migrating twice", err)
+	}
+
+	applied, err := storage.AppliedMigrations(ctx)
+	if err != nil {
+		t.Fatal("error getting applied migrations", err)
+	}
+	if len(applied) != len(Migrations()) {
+		t.Fatalf("expected %d migrations, got %d", len(Migrations()), len(applied))
+	}
+}
+
+func setup(ctx context.Context, t testing.TB) *Storage {
+	db, err := OpenDB(ctx, Config{Path: filepath.Join(t.TempDir(), "newsletter.db")})
+	if err != nil {
+		t.Fatal("error opening database", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	storage := NewStorage(db)
+	if err := storage.Migrate(ctx); err != nil {
+		t.Fatal("error migrating", err)
+	}
+	return storage
+}
@@ -0,0 +1,85 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// SaveSchedule saves the schedule of an URL, replacing the previous one
+func (s *Storage) SaveSchedule(ctx context.Context, sch mongodb.Schedule) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO schedules (url, next_run, last_run, unchanged_runs, interval, change_rate)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (url) DO UPDATE SET next_run = excluded.next_run, last_run = excluded.last_run,
+		unchanged_runs = excluded.unchanged_runs, interval = excluded.interval, change_rate = excluded.change_rate`,
+		sch.URL, unixNano(sch.NextRun), unixNano(sch.LastRun), sch.UnchangedRuns, int64(sch.Interval), sch.ChangeRate)
+	if err != nil {
+		return fmt.Errorf("error saving schedule: %v", err)
+	}
+	return nil
+}
+
+// Schedule returns the schedule of the URL, mongodb.ErrNotFound when it was never scheduled
+func (s *Storage) Schedule(ctx context.Context, url string) (mongodb.Schedule, error) {
+	sch := mongodb.Schedule{URL: url}
+	var nextRun, lastRun, interval int64
+	err := s.db.QueryRowContext(ctx, `SELECT next_run, last_run, unchanged_runs, interval, change_rate
+		FROM schedules WHERE url = ?`, url).Scan(&nextRun, &lastRun, &sch.UnchangedRuns, &interval, &sch.ChangeRate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return mongodb.Schedule{}, mongodb.ErrNotFound
+	}
+	if err != nil {
+		return mongodb.Schedule{}, fmt.Errorf("error getting schedule: %v", err)
+	}
+	sch.NextRun = fromUnixNano(nextRun)
+	sch.LastRun = fromUnixNano(lastRun)
+	sch.Interval = time.Duration(interval)
+	return sch, nil
+}
+
+// Schedules returns the schedules of all the URLs sorted by URL
+func (s *Storage) Schedules(ctx context.Context) ([]mongodb.Schedule, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT url, next_run, last_run, unchanged_runs, interval, change_rate
+		FROM schedules ORDER BY url`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting schedules: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var schedules []mongodb.Schedule
+	for rows.Next() {
+		var sch mongodb.Schedule
+		var nextRun, lastRun, interval int64
+		if err := rows.Scan(&sch.URL, &nextRun, &lastRun, &sch.UnchangedRuns, &interval, &sch.ChangeRate); err != nil {
+			return nil, fmt.Errorf("error decoding schedules: %v", err)
+		}
+		sch.NextRun = fromUnixNano(nextRun)
+		sch.LastRun = fromUnixNano(lastRun)
+		sch.Interval = time.Duration(interval)
+		schedules = append(schedules, sch)
+	}
+
+	return schedules, rows.Err()
+}
+
+// unixNano converts t to the integer stored in the database, keeping the zero time as 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UTC().UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
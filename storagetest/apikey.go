@@ -0,0 +1,138 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// APIKeys is the set of API key operations covered by the conformance suite.
+type APIKeys interface {
+	SaveAPIKey(ctx context.Context, k mongodb.APIKey) error
+	APIKeys(ctx context.Context) ([]mongodb.APIKey, error)
+	APIKeyByHash(ctx context.Context, hash string) (mongodb.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	SaveKeyUsage(ctx context.Context, u mongodb.KeyUsage) error
+	KeyUsage(ctx context.Context, keyID string, limit int) ([]mongodb.KeyUsage, error)
+}
+
+// RunAPIKeys runs the API keys suite. newAPIKeys must return a storage without API keys for every call.
+func RunAPIKeys(t *testing.T, newAPIKeys func(t *testing.T) APIKeys) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, k APIKeys)
+	}{
+		{"SaveAPIKey", testSaveAPIKey},
+		{"RevokeAPIKey", testRevokeAPIKey},
+		{"KeyUsage", testKeyUsage},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newAPIKeys(t))
+		})
+	}
+}
+
+func testSaveAPIKey(t *testing.T, k APIKeys) {
+	ctx := context.Background()
+	created := now()
+
+	want := []mongodb.APIKey{
+		{ID: "b", Name: "ci", Role: "read-only", Hash: "h1", CreatedAt: created},
+		{ID: "a", Name: "ops", Role: "admin", Hash: "h2", CreatedAt: created.Add(time.Second)},
+	}
+	for _, key := range want {
+		if err := k.SaveAPIKey(ctx, key); err != nil {
+			t.Fatal("error saving API key", err)
+		}
+	}
+
+	got, err := k.APIKeys(ctx)
+	if err != nil {
+		t.Fatal("error getting API keys", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	key, err := k.APIKeyByHash(ctx, "h2")
+	if err != nil {
+		t.Fatal("error getting API key", err)
+	}
+	if !reflect.DeepEqual(key, want[1]) {
+		t.Fatalf("got %v, want %v", key, want[1])
+	}
+	if _, err := k.APIKeyByHash(ctx, "missing"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testRevokeAPIKey(t *testing.T, k APIKeys) {
+	ctx := context.Background()
+	created := now()
+
+	if err := k.SaveAPIKey(ctx, mongodb.APIKey{ID: "a", Role: "editor", Hash: "h", CreatedAt: created}); err != nil {
+		t.Fatal("error saving API key", err)
+	}
+	revoked := created.Add(time.Minute)
+	if err := k.RevokeAPIKey(ctx, "a", revoked); err != nil {
+		t.Fatal("error revoking API key", err)
+	}
+	// Revoking again keeps the first revocation.
+	if err := k.RevokeAPIKey(ctx, "a", revoked.Add(time.Minute)); err != nil {
+		t.Fatal("error revoking API key", err)
+	}
+	if err := k.RevokeAPIKey(ctx, "missing", revoked); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	got, err := k.APIKeyByHash(ctx, "h")
+	if err != nil {
+		t.Fatal("error getting API key", err)
+	}
+	if !got.RevokedAt.Equal(revoked) {
+		t.Fatalf("expected the key revoked at %v, got %v", revoked, got.RevokedAt)
+	}
+}
+
+func testKeyUsage(t *testing.T, k APIKeys) {
+	ctx := context.Background()
+	at := now()
+
+	usage := []mongodb.KeyUsage{
+		{KeyID: "a", At: at, Method: "GET", Path: "/webhooks", Status: 200, RemoteAddr: "10.0.0.1:5000"},
+		{KeyID: "b", At: at.Add(time.Second), Method: "POST", Path: "/opml", Status: 403, RemoteAddr: "10.0.0.2:5000"},
+		{KeyID: "a", At: at.Add(2 * time.Second), Method: "DELETE", Path: "/webhooks/x", Status: 204, RemoteAddr: "10.0.0.1:5000"},
+	}
+	for _, u := range usage {
+		if err := k.SaveKeyUsage(ctx, u); err != nil {
+			t.Fatal("error saving key usage", err)
+		}
+	}
+
+	tests := []struct {
+		keyID string
+		limit int
+		want  []mongodb.KeyUsage
+	}{
+		{"a", 0, []mongodb.KeyUsage{usage[2], usage[0]}},
+		{"a", 1, []mongodb.KeyUsage{usage[2]}},
+		{"", 0, []mongodb.KeyUsage{usage[2], usage[1], usage[0]}},
+		{"missing", 0, nil},
+	}
+	for _, tt := range tests {
+		got, err := k.KeyUsage(ctx, tt.keyID, tt.limit)
+		if err != nil {
+			t.Fatal("error getting key usage", err)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("key %q limit %d: got %v, want %v", tt.keyID, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package storagetest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Auditor is the set of audited operations covered by the conformance suite.
+type Auditor interface {
+	SaveEngineer(ctx context.Context, e mongodb.Engineer) error
+	DeleteEngineer(ctx context.Context, url string) error
+	SaveNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	DeleteNewsletter(ctx context.Context, userEmail string) error
+	SaveWebhook(ctx context.Context, w mongodb.Webhook) error
+	SaveAPIKey(ctx context.Context, k mongodb.APIKey) error
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	AuditLog(ctx context.Context, q mongodb.AuditQuery) ([]mongodb.AuditEntry, error)
+	ForgetSubscriber(ctx context.Context, userEmail, alias string) (int, error)
+	AuditMentioning(ctx context.Context, userEmail string) ([]mongodb.AuditEntry, error)
+}
+
+// RunAudit runs the audit suite. newAuditor must return an empty storage for every call.
+func RunAudit(t *testing.T, newAuditor func(t *testing.T) Auditor) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, a Auditor)
+	}{
+		{"AuditLog", testAuditLog},
+		{"AuditSnapshots", testAuditSnapshots},
+		{"ForgetSubscriber", testForgetSubscriber},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newAuditor(t))
+		})
+	}
+}
+
+func testAuditLog(t *testing.T, a Auditor) {
+	start := now()
+	cli := mongodb.WithActor(context.Background(), "cli:j")
+	key := mongodb.WithActor(context.Background(), "key:k1")
+
+	steps := []func() error{
+		func() error { return a.SaveEngineer(cli, mongodb.Engineer{Name: "John", URL: "https://jj.com"}) },
+		func() error {
+			return a.SaveNewsletter(key, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://jj.com"}})
+		},
+		func() error {
+			return a.UpdateNewsletter(key, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://jj.com", "https://k.com"}})
+		},
+		func() error { return a.DeleteNewsletter(context.Background(), "j@gmail.com") },
+		func() error { return a.DeleteEngineer(cli, "https://jj.com") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal("error changing storage", err)
+		}
+	}
+	// The changes that fail are not recorded.
+	if err := a.DeleteEngineer(cli, "https://jj.com"); err == nil {
+		t.Fatal("expected error deleting a missing engineer")
+	}
+
+	tests := []struct {
+		name string
+		q    mongodb.AuditQuery
+		want []string
+	}{
+		{"all", mongodb.AuditQuery{}, []string{
+			mongodb.ActionEngineerDelete, mongodb.ActionNewsletterDelete, mongodb.ActionNewsletterUpdate,
+			mongodb.ActionNewsletterSave, mongodb.ActionEngineerSave,
+		}},
+		{"actor", mongodb.AuditQuery{Actor: "cli:j"}, []string{mongodb.ActionEngineerDelete, mongodb.ActionEngineerSave}},
+		{"system", mongodb.AuditQuery{Actor: mongodb.ActorSystem}, []string{mongodb.ActionNewsletterDelete}},
+		{"target", mongodb.AuditQuery{Target: "j@gmail.com", Limit: 2}, []string{mongodb.ActionNewsletterDelete, mongodb.ActionNewsletterUpdate}},
+		{"action", mongodb.AuditQuery{Action: mongodb.ActionNewsletterSave}, []string{mongodb.ActionNewsletterSave}},
+		{"range", mongodb.AuditQuery{From: start.Add(-time.Hour), To: start.Add(-time.Minute)}, nil},
+		{"from", mongodb.AuditQuery{From: start, Limit: 1}, []string{mongodb.ActionEngineerDelete}},
+	}
+	for _, tt := range tests {
+		entries, err := a.AuditLog(context.Background(), tt.q)
+		if err != nil {
+			t.Fatal("error getting audit log", err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Action)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testAuditSnapshots(t *testing.T, a Auditor) {
+	ctx := mongodb.WithActor(context.Background(), "key:k1")
+
+	before := mongodb.Engineer{Name: "John", URL: "https://jj.com"}
+	after := mongodb.Engineer{Name: "John Doe", URL: "https://jj.com", Schedule: "6h"}
+	for _, e := range []mongodb.Engineer{before, after} {
+		if err := a.SaveEngineer(ctx, e); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+	if err := a.SaveWebhook(ctx, mongodb.Webhook{ID: "w1", Endpoint: "https://j.test/hook", Secret: "s3cret", CreatedAt: now()}); err != nil {
+		t.Fatal("error saving webhook", err)
+	}
+	if err := a.SaveAPIKey(ctx, mongodb.APIKey{ID: "k2", Role: "editor", Hash: "h", CreatedAt: now()}); err != nil {
+		t.Fatal("error saving API key", err)
+	}
+	revoked := now()
+	if err := a.RevokeAPIKey(ctx, "k2", revoked); err != nil {
+		t.Fatal("error revoking API key", err)
+	}
+
+	entries, err := a.AuditLog(context.Background(), mongodb.AuditQuery{Target: "https://jj.com"})
+	if err != nil {
+		t.Fatal("error getting audit log", err)
+	}
+	if len(entries) != 2 || entries[1].Before != nil || entries[0].Actor != "key:k1" || entries[0].ID == entries[1].ID {
+		t.Fatalf("expected the creation and the update of the engineer, got %v", entries)
+	}
+	var gotBefore, gotAfter mongodb.Engineer
+	if err := bson.Unmarshal(entries[0].Before, &gotBefore); err != nil || gotBefore != before {
+		t.Fatalf("expected before %v, got %v (%v)", before, gotBefore, err)
+	}
+	if err := bson.Unmarshal(entries[0].After, &gotAfter); err != nil || gotAfter != after {
+		t.Fatalf("expected after %v, got %v (%v)", after, gotAfter, err)
+	}
+
+	// The secrets are left out of the snapshots.
+	entries, err = a.AuditLog(context.Background(), mongodb.AuditQuery{Target: "w1"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the webhook entry, got %v (%v)", entries, err)
+	}
+	var wh mongodb.Webhook
+	if err := bson.Unmarshal(entries[0].After, &wh); err != nil || wh.Secret != "" || wh.Endpoint != "https://j.test/hook" {
+		t.Fatalf("expected the webhook without its secret, got %+v (%v)", wh, err)
+	}
+
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://jj.com"},
+		Channels: []mongodb.Channel{{Type: "webhook", Address: "https://j.test/hook", Secret: "s3cret"}}}
+	if err := a.SaveNewsletter(ctx, n); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	entries, err = a.AuditLog(context.Background(), mongodb.AuditQuery{Target: "j@gmail.com"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the newsletter entry, got %v (%v)", entries, err)
+	}
+	var gotNewsletter mongodb.Newsletter
+	if err := bson.Unmarshal(entries[0].After, &gotNewsletter); err != nil || len(gotNewsletter.Channels) != 1 ||
+		gotNewsletter.Channels[0] != (mongodb.Channel{Type: "webhook", Address: "https://j.test/hook"}) {
+		t.Fatalf("expected the newsletter without the secret of its channel, got %+v (%v)", gotNewsletter, err)
+	}
+	if n.Channels[0].Secret != "s3cret" {
+		t.Fatal("expected the snapshot to leave the channels of the newsletter untouched")
+	}
+
+	entries, err = a.AuditLog(context.Background(), mongodb.AuditQuery{Action: mongodb.ActionAPIKeyRevoke})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the revocation entry, got %v (%v)", entries, err)
+	}
+	var k mongodb.APIKey
+	if err := bson.Unmarshal(entries[0].After, &k); err != nil || k.Hash != "" || !k.RevokedAt.Equal(revoked) {
+		t.Fatalf("expected the revoked key without its hash, got %+v (%v)", k, err)
+	}
+}
+
+func testForgetSubscriber(t *testing.T, a Auditor) {
+	subscriber := mongodb.WithActor(context.Background(), "subscriber:j@gmail.com")
+	steps := []func() error{
+		func() error {
+			return a.SaveNewsletter(context.Background(), mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://jj.com"}})
+		},
+		func() error {
+			return a.UpdateNewsletter(subscriber, mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://k.com"}})
+		},
+		func() error {
+			return a.SaveWebhook(context.Background(), mongodb.Webhook{ID: "w1", UserEmail: "j@gmail.com", Endpoint: "https://j.test/hook", CreatedAt: now()})
+		},
+		func() error {
+			return a.SaveEngineer(context.Background(), mongodb.Engineer{Name: "John", URL: "https://jj.com"})
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal("error changing storage", err)
+		}
+	}
+
+	mentioning, err := a.AuditMentioning(context.Background(), "j@gmail.com")
+	if err != nil {
+		t.Fatal("error getting audit log", err)
+	}
+	var targets []string
+	for _, e := range mentioning {
+		targets = append(targets, e.Target)
+	}
+	if want := []string{"w1", "j@gmail.com", "j@gmail.com"}; !reflect.DeepEqual(targets, want) {
+		t.Fatalf("expected the entries of %v mentioning the email, got %v", want, targets)
+	}
+
+	n, err := a.ForgetSubscriber(context.Background(), "j@gmail.com", "erased:1")
+	if err != nil {
+		t.Fatal("error forgetting subscriber", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 entries anonymized, got %d", n)
+	}
+
+	entries, err := a.AuditLog(context.Background(), mongodb.AuditQuery{})
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("expected the entries to be kept, got %v (%v)", entries, err)
+	}
+	for _, e := range entries {
+		if e.Mentions("j@gmail.com") {
+			t.Errorf("expected the email to be forgotten, got %+v", e)
+		}
+	}
+	if mentioning, err := a.AuditMentioning(context.Background(), "j@gmail.com"); err != nil || len(mentioning) != 0 {
+		t.Errorf("expected no entry mentioning the email, got %v (%v)", mentioning, err)
+	}
+	if entries[0].Action != mongodb.ActionEngineerSave || entries[0].After == nil {
+		t.Errorf("expected the entry of the engineer untouched, got %+v", entries[0])
+	}
+	if entries[1].Target != "w1" || entries[1].After != nil {
+		t.Errorf("expected the webhook entry without its snapshot, got %+v", entries[1])
+	}
+	if entries[2].Target != "erased:1" || entries[2].Actor != "subscriber:erased:1" || entries[2].Before != nil {
+		t.Errorf("expected the update by the subscriber under its alias, got %+v", entries[2])
+	}
+	if entries[3].Target != "erased:1" || entries[3].Actor != mongodb.ActorSystem {
+		t.Errorf("expected the subscription under the alias, got %+v", entries[3])
+	}
+}
@@ -0,0 +1,125 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Elector is the set of leader election operations covered by the conformance suite.
+type Elector interface {
+	AcquireLeadership(ctx context.Context, name, holder string, ttl time.Duration) (int64, bool, error)
+	RenewLeadership(ctx context.Context, name, holder string, token int64, ttl time.Duration) error
+	ResignLeadership(ctx context.Context, name, holder string, token int64) error
+	Leader(ctx context.Context, name string) (mongodb.Leadership, error)
+}
+
+// RunElector runs the leader election suite. newElector must return an elector without leaders for every call.
+func RunElector(t *testing.T, newElector func(t *testing.T) Elector) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, e Elector)
+	}{
+		{"AcquireLeadership", testAcquireLeadership},
+		{"LeadershipExpiry", testLeadershipExpiry},
+		{"ResignLeadership", testResignLeadership},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newElector(t))
+		})
+	}
+}
+
+func testAcquireLeadership(t *testing.T, e Elector) {
+	ctx := context.Background()
+
+	token := elect(ctx, t, e, "email", "a", time.Minute, true)
+	elect(ctx, t, e, "email", "b", time.Minute, false)
+
+	// Acquiring again keeps the term of the leader.
+	if got := elect(ctx, t, e, "email", "a", time.Minute, true); got != token {
+		t.Fatalf("got token %d, want %d", got, token)
+	}
+	if err := e.RenewLeadership(ctx, "email", "a", token, time.Minute); err != nil {
+		t.Fatal("error renewing leadership", err)
+	}
+	if err := e.RenewLeadership(ctx, "email", "b", token, time.Minute); !errors.Is(err, mongodb.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+
+	leader, err := e.Leader(ctx, "email")
+	if err != nil {
+		t.Fatal("error getting leader", err)
+	}
+	if leader.Holder != "a" || leader.Token != token {
+		t.Fatalf("unexpected leader %v", leader)
+	}
+}
+
+func testLeadershipExpiry(t *testing.T, e Elector) {
+	ctx := context.Background()
+
+	token := elect(ctx, t, e, "email", "a", time.Duration(50)*time.Millisecond, true)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	// The leadership of a crashed holder is taken over in a new term once it expires.
+	got := elect(ctx, t, e, "email", "b", time.Minute, true)
+	if got <= token {
+		t.Fatalf("expected the token to increase, got %d after %d", got, token)
+	}
+	if err := e.RenewLeadership(ctx, "email", "a", token, time.Minute); !errors.Is(err, mongodb.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+
+	// A stale leader resigning does not end the term of the new one.
+	if err := e.ResignLeadership(ctx, "email", "a", token); err != nil {
+		t.Fatal("error resigning leadership", err)
+	}
+	leader, err := e.Leader(ctx, "email")
+	if err != nil {
+		t.Fatal("error getting leader", err)
+	}
+	if leader.Holder != "b" || leader.Token != got {
+		t.Fatalf("unexpected leader %v", leader)
+	}
+}
+
+func testResignLeadership(t *testing.T, e Elector) {
+	ctx := context.Background()
+
+	token := elect(ctx, t, e, "email", "a", time.Minute, true)
+	if err := e.ResignLeadership(ctx, "email", "a", token); err != nil {
+		t.Fatal("error resigning leadership", err)
+	}
+
+	leader, err := e.Leader(ctx, "email")
+	if err != nil {
+		t.Fatal("error getting leader", err)
+	}
+	if leader.Holder != "" {
+		t.Fatalf("expected no leader, got %v", leader)
+	}
+
+	// Another holder takes over right away, without waiting for the ttl.
+	if got := elect(ctx, t, e, "email", "b", time.Minute, true); got <= token {
+		t.Fatalf("expected the token to increase, got %d after %d", got, token)
+	}
+}
+
+func elect(ctx context.Context, t *testing.T, e Elector, name, holder string, ttl time.Duration, want bool) int64 {
+	t.Helper()
+	token, ok, err := e.AcquireLeadership(ctx, name, holder, ttl)
+	if err != nil {
+		t.Fatal("error acquiring leadership", err)
+	}
+	if ok != want {
+		t.Fatalf("%s acquiring %s: got %v, want %v", holder, name, ok, want)
+	}
+	return token
+}
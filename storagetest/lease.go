@@ -0,0 +1,111 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Leaser is the set of job lease operations covered by the conformance suite.
+type Leaser interface {
+	AcquireLease(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	RenewLease(ctx context.Context, key, owner string, ttl time.Duration) error
+	ReleaseLease(ctx context.Context, key, owner string, holdUntil time.Time) error
+	Jobs(ctx context.Context) ([]mongodb.Job, error)
+}
+
+// RunLeaser runs the job lease suite. newLeaser must return a leaser without jobs for every call.
+func RunLeaser(t *testing.T, newLeaser func(t *testing.T) Leaser) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, l Leaser)
+	}{
+		{"AcquireLease", testAcquireLease},
+		{"LeaseExpiry", testLeaseExpiry},
+		{"ReleaseLease", testReleaseLease},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newLeaser(t))
+		})
+	}
+}
+
+func testAcquireLease(t *testing.T, l Leaser) {
+	ctx := context.Background()
+
+	acquire(ctx, t, l, "crawl:1", "a", time.Minute, true)
+	acquire(ctx, t, l, "crawl:1", "b", time.Minute, false)
+	acquire(ctx, t, l, "crawl:1", "a", time.Minute, true)
+	acquire(ctx, t, l, "crawl:2", "b", time.Minute, true)
+
+	if err := l.RenewLease(ctx, "crawl:1", "a", time.Minute); err != nil {
+		t.Fatal("error renewing lease", err)
+	}
+	if err := l.RenewLease(ctx, "crawl:1", "b", time.Minute); !errors.Is(err, mongodb.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+
+	jobs, err := l.Jobs(ctx)
+	if err != nil {
+		t.Fatal("error getting jobs", err)
+	}
+	if len(jobs) != 2 || jobs[0].Key != "crawl:1" || jobs[0].Owner != "a" || jobs[0].Attempts != 2 ||
+		jobs[1].Key != "crawl:2" || jobs[1].Owner != "b" {
+		t.Fatalf("unexpected jobs %v", jobs)
+	}
+}
+
+func testLeaseExpiry(t *testing.T, l Leaser) {
+	ctx := context.Background()
+
+	acquire(ctx, t, l, "crawl:1", "a", time.Duration(50)*time.Millisecond, true)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	// The lease of a crashed owner is reclaimed once it expires.
+	acquire(ctx, t, l, "crawl:1", "b", time.Minute, true)
+	if err := l.RenewLease(ctx, "crawl:1", "a", time.Minute); !errors.Is(err, mongodb.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+}
+
+func testReleaseLease(t *testing.T, l Leaser) {
+	ctx := context.Background()
+
+	acquire(ctx, t, l, "email:1", "a", time.Minute, true)
+	if err := l.ReleaseLease(ctx, "email:1", "a", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal("error releasing lease", err)
+	}
+
+	// A held job is not claimed by anyone, not even its last owner.
+	acquire(ctx, t, l, "email:1", "a", time.Minute, false)
+	acquire(ctx, t, l, "email:1", "b", time.Minute, false)
+
+	acquire(ctx, t, l, "crawl:1", "a", time.Minute, true)
+	if err := l.ReleaseLease(ctx, "crawl:1", "a", time.Time{}); err != nil {
+		t.Fatal("error releasing lease", err)
+	}
+	acquire(ctx, t, l, "crawl:1", "b", time.Minute, true)
+
+	// Releasing a lease owned by someone else is a no-op.
+	if err := l.ReleaseLease(ctx, "crawl:1", "a", time.Time{}); err != nil {
+		t.Fatal("error releasing lease", err)
+	}
+	acquire(ctx, t, l, "crawl:1", "a", time.Minute, false)
+}
+
+func acquire(ctx context.Context, t *testing.T, l Leaser, key, owner string, ttl time.Duration, want bool) {
+	t.Helper()
+	got, err := l.AcquireLease(ctx, key, owner, ttl)
+	if err != nil {
+		t.Fatal("error acquiring lease", err)
+	}
+	if got != want {
+		t.Fatalf("acquiring %s by %s: got %v, want %v", key, owner, got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Searcher is the set of search operations covered by the conformance suite.
+type Searcher interface {
+	SavePage(ctx context.Context, pages []mongodb.Page) error
+	SearchPages(ctx context.Context, q mongodb.PageQuery) ([]mongodb.Page, error)
+	PageVersion(ctx context.Context, url string, at time.Time) (mongodb.Page, error)
+}
+
+// RunSearch runs the search suite. newSearcher must return an empty storage for every call.
+func RunSearch(t *testing.T, newSearcher func(t *testing.T) Searcher) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s Searcher)
+	}{
+		{"SearchPages", testSearchPages},
+		{"SearchPagesFilters", testSearchPagesFilters},
+		{"PageVersion", testPageVersion},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newSearcher(t))
+		})
+	}
+}
+
+var searchStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// saveSearchPages saves the versions of two blogs, scraped an hour apart in order
+func saveSearchPages(t *testing.T, s Searcher) {
+	pages := []mongodb.Page{
+		{URL: "https://www.1.com", Text: "Startups and growth", IsMostRecent: true},
+		{URL: "https://www.1.com", Text: "Startups and growth", IsMostRecent: false},
+		{URL: "https://www.2.com", Text: "Painless functional specifications", IsMostRecent: true},
+		{URL: "https://www.1.com", Text: "Startups, startups everywhere: how to start a startup", IsMostRecent: true},
+	}
+	for i := range pages {
+		pages[i].Content = "<p>" + pages[i].Text + "</p>"
+		pages[i].ScrapeDatetime = searchStart.Add(time.Duration(i) * time.Hour)
+		if err := s.SavePage(context.Background(), pages[i:i+1]); err != nil {
+			t.Fatal("error saving page", err)
+		}
+	}
+}
+
+// searchTimes returns the hours after searchStart the versions were scraped at
+func searchTimes(pages []mongodb.Page) []int {
+	hours := []int{}
+	for _, p := range pages {
+		hours = append(hours, int(p.ScrapeDatetime.Sub(searchStart).Hours()))
+	}
+	return hours
+}
+
+func testSearchPages(t *testing.T, s Searcher) {
+	ctx := context.Background()
+	saveSearchPages(t, s)
+
+	got, err := s.SearchPages(ctx, mongodb.PageQuery{Text: "startups"})
+	if err != nil {
+		t.Fatal("error searching pages", err)
+	}
+	// The unchanged versions are not searched, and the version with more matches comes first.
+	if want := []int{3, 0}; !reflect.DeepEqual(searchTimes(got), want) {
+		t.Fatalf("expected the versions %v, got %v", want, searchTimes(got))
+	}
+	if got[0].Text == "" || got[0].URL != "https://www.1.com" {
+		t.Fatalf("expected the text of the version, got %v", got[0])
+	}
+
+	got, err = s.SearchPages(ctx, mongodb.PageQuery{Text: "specifications growth"})
+	if err != nil {
+		t.Fatal("error searching pages", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected the versions matching any word, got %v", searchTimes(got))
+	}
+
+	got, err = s.SearchPages(ctx, mongodb.PageQuery{Text: "kubernetes"})
+	if err != nil {
+		t.Fatal("error searching pages", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no version, got %v", searchTimes(got))
+	}
+}
+
+func testSearchPagesFilters(t *testing.T, s Searcher) {
+	ctx := context.Background()
+	saveSearchPages(t, s)
+
+	tests := []struct {
+		q    mongodb.PageQuery
+		want []int
+	}{
+		{mongodb.PageQuery{}, []int{3, 2, 0}},
+		{mongodb.PageQuery{Limit: 1}, []int{3}},
+		{mongodb.PageQuery{URLs: []string{"https://www.2.com"}}, []int{2}},
+		{mongodb.PageQuery{From: searchStart.Add(time.Hour), To: searchStart.Add(2 * time.Hour)}, []int{2}},
+		{mongodb.PageQuery{Text: "startups", To: searchStart.Add(time.Hour)}, []int{0}},
+		{mongodb.PageQuery{Text: "startups", URLs: []string{"https://www.2.com"}}, []int{}},
+	}
+	for _, tt := range tests {
+		got, err := s.SearchPages(ctx, tt.q)
+		if err != nil {
+			t.Fatal("error searching pages", err)
+		}
+		if !reflect.DeepEqual(searchTimes(got), tt.want) {
+			t.Errorf("%+v: expected the versions %v, got %v", tt.q, tt.want, searchTimes(got))
+		}
+	}
+}
+
+func testPageVersion(t *testing.T, s Searcher) {
+	ctx := context.Background()
+	saveSearchPages(t, s)
+
+	got, err := s.PageVersion(ctx, "https://www.1.com", searchStart.Add(time.Hour))
+	if err != nil {
+		t.Fatal("error getting page version", err)
+	}
+	if got.Content != "<p>Startups and growth</p>" || got.IsMostRecent {
+		t.Fatalf("expected the unchanged version, got %v", got)
+	}
+
+	for _, at := range []time.Time{searchStart.Add(2 * time.Hour), searchStart.Add(time.Minute)} {
+		if _, err := s.PageVersion(ctx, "https://www.1.com", at); !errors.Is(err, mongodb.ErrNotFound) {
+			t.Errorf("%v: expected ErrNotFound, got %v", at, err)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+// Package storagetest provides a conformance test suite that every storage implementation must pass.
+package storagetest
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Storage is the set of operations covered by the conformance suite.
+type Storage interface {
+	SaveNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	UpdateNewsletter(ctx context.Context, n mongodb.Newsletter) error
+	MarkNewsletterSent(ctx context.Context, userEmail string, at time.Time) error
+	SaveEngineer(ctx context.Context, e mongodb.Engineer) error
+	DeleteEngineer(ctx context.Context, url string) error
+	DeleteNewsletter(ctx context.Context, userEmail string) error
+	Engineers(ctx context.Context) ([]mongodb.Engineer, error)
+	Engineer(ctx context.Context, url string) (mongodb.Engineer, error)
+	DistinctEngineerURLs(ctx context.Context) ([]interface{}, error)
+	Newsletter(ctx context.Context, after string, limit int) ([]mongodb.Newsletter, error)
+	Subscription(ctx context.Context, userEmail string) (mongodb.Newsletter, error)
+	SavePage(ctx context.Context, pages []mongodb.Page) error
+	PageIn(ctx context.Context, urls []string) ([]mongodb.Page, error)
+	Page(ctx context.Context, url string) ([]mongodb.Page, error)
+	PageHistory(ctx context.Context, url string, limit int) ([]mongodb.Page, error)
+	PageChanges(ctx context.Context, url string, limit int) ([]mongodb.Page, error)
+	DeletePagesBefore(ctx context.Context, before time.Time) (int64, error)
+	SaveSchedule(ctx context.Context, s mongodb.Schedule) error
+	Schedules(ctx context.Context) ([]mongodb.Schedule, error)
+	Schedule(ctx context.Context, url string) (mongodb.Schedule, error)
+}
+
+// Run runs the whole suite. newStorage must return an empty storage for every call.
+func Run(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s Storage)
+	}{
+		{"SaveNewsletter", testSaveNewsletter},
+		{"SaveNewsletterDuplicated", testSaveNewsletterDuplicated},
+		{"NewsletterPagination", testNewsletterPagination},
+		{"DeleteNewsletter", testDeleteNewsletter},
+		{"UpdateNewsletter", testUpdateNewsletter},
+		{"MarkNewsletterSent", testMarkNewsletterSent},
+		{"SaveEngineer", testSaveEngineer},
+		{"DeleteEngineer", testDeleteEngineer},
+		{"DistinctEngineerURLs", testDistinctEngineerURLs},
+		{"Engineers", testEngineers},
+		{"SaveSchedule", testSaveSchedule},
+		{"Page", testPage},
+		{"PageNotFound", testPageNotFound},
+		{"PageIn", testPageIn},
+		{"PageHistory", testPageHistory},
+		{"PageChanges", testPageChanges},
+		{"DeletePagesBefore", testDeletePagesBefore},
+		{"ConcurrentSavePage", testConcurrentSavePage},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newStorage(t))
+		})
+	}
+}
+
+func testSaveNewsletter(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	want := []mongodb.Newsletter{
+		{UserEmail: "j@gmail.com", URLs: []string{"https://www.google.com"}},
+		{UserEmail: "k@gmail.com", URLs: []string{"https://www.google.com", "https://jj.com"}, Channels: []mongodb.Channel{
+			{Type: "email", Address: "k@gmail.com"},
+			{Type: "slack", Address: "https://hooks.slack.com/services/T0/B0/X"},
+			{Type: "webhook", Address: "https://k.test/hook", Secret: "s3cret"},
+		}, Filters: []mongodb.Filter{
+			{Include: []string{"go", "/postgres(ql)?/"}},
+			{URL: "https://jj.com", Exclude: []string{"hiring"}},
+		}, Cadence: "weekly"},
+	}
+	for _, n := range want {
+		if err := s.SaveNewsletter(ctx, n); err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+
+	got, err := s.Newsletter(ctx, "", 0)
+	if err != nil {
+		t.Fatal("error getting newsletter", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, n := range want {
+		got, err := s.Subscription(ctx, n.UserEmail)
+		if err != nil {
+			t.Fatal("error getting subscription", err)
+		}
+		if !reflect.DeepEqual(got, n) {
+			t.Fatalf("got %v, want %v", got, n)
+		}
+	}
+	if _, err := s.Subscription(ctx, "l@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testNewsletterPagination(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	emails := []string{"d@gmail.com", "a@gmail.com", "c@gmail.com", "e@gmail.com", "b@gmail.com"}
+	for _, email := range emails {
+		err := s.SaveNewsletter(ctx, mongodb.Newsletter{UserEmail: email, URLs: []string{"https://www.google.com"}})
+		if err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+
+	var got []string
+	var after string
+	for {
+		page, err := s.Newsletter(ctx, after, 2)
+		if err != nil {
+			t.Fatal("error getting newsletter", err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("expected at most 2 newsletters, got %d", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, n := range page {
+			got = append(got, n.UserEmail)
+		}
+		after = page[len(page)-1].UserEmail
+	}
+
+	want := []string{"a@gmail.com", "b@gmail.com", "c@gmail.com", "d@gmail.com", "e@gmail.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func testSaveNewsletterDuplicated(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://www.google.com"}}
+	if err := s.SaveNewsletter(ctx, n); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+
+	if err := s.SaveNewsletter(ctx, n); err == nil {
+		t.Fatal("expected error saving a duplicated user email")
+	}
+}
+
+func testDeleteNewsletter(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for _, email := range []string{"j@gmail.com", "k@gmail.com"} {
+		n := mongodb.Newsletter{UserEmail: email, URLs: []string{"https://www.google.com"}}
+		if err := s.SaveNewsletter(ctx, n); err != nil {
+			t.Fatal("error saving newsletter", err)
+		}
+	}
+
+	if err := s.DeleteNewsletter(ctx, "j@gmail.com"); err != nil {
+		t.Fatal("error deleting newsletter", err)
+	}
+	if err := s.DeleteNewsletter(ctx, "j@gmail.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	got, err := s.Newsletter(ctx, "", 0)
+	if err != nil {
+		t.Fatal("error getting newsletter", err)
+	}
+	if len(got) != 1 || got[0].UserEmail != "k@gmail.com" {
+		t.Fatalf("expected only k@gmail.com, got %v", got)
+	}
+
+	// The user email can subscribe again once deleted.
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://jj.com"}}
+	if err := s.SaveNewsletter(ctx, n); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+}
+
+func testUpdateNewsletter(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://www.google.com"}}
+	if err := s.UpdateNewsletter(ctx, n); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.SaveNewsletter(ctx, n); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+
+	want := mongodb.Newsletter{
+		UserEmail: "j@gmail.com",
+		URLs:      []string{"https://jj.com", "https://www.google.com"},
+		Channels:  []mongodb.Channel{{Type: "telegram", Address: "-1001"}},
+		Filters:   []mongodb.Filter{{URL: "https://jj.com", Include: []string{"databases"}}},
+		Cadence:   "daily",
+	}
+	if err := s.UpdateNewsletter(ctx, want); err != nil {
+		t.Fatal("error updating newsletter", err)
+	}
+
+	got, err := s.Newsletter(ctx, "", 0)
+	if err != nil {
+		t.Fatal("error getting newsletter", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func testMarkNewsletterSent(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	at := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	if err := s.MarkNewsletterSent(ctx, "j@gmail.com", at); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	n := mongodb.Newsletter{UserEmail: "j@gmail.com", URLs: []string{"https://www.google.com"}, Cadence: "daily"}
+	if err := s.SaveNewsletter(ctx, n); err != nil {
+		t.Fatal("error saving newsletter", err)
+	}
+	if err := s.MarkNewsletterSent(ctx, "j@gmail.com", at); err != nil {
+		t.Fatal("error marking newsletter sent", err)
+	}
+	// Updating the newsletter keeps when it was sent.
+	n.URLs = append(n.URLs, "https://jj.com")
+	if err := s.UpdateNewsletter(ctx, n); err != nil {
+		t.Fatal("error updating newsletter", err)
+	}
+
+	got, err := s.Newsletter(ctx, "", 0)
+	if err != nil {
+		t.Fatal("error getting newsletter", err)
+	}
+	if len(got) != 1 || !got[0].LastSent.Equal(at) || len(got[0].URLs) != 2 {
+		t.Fatalf("expected the newsletter sent at %v, got %v", at, got)
+	}
+}
+
+func testSaveEngineer(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	engineers := []mongodb.Engineer{
+		{Name: "John", URL: "https://www.1.com", Description: "John is a software engineer"},
+		{Name: "John Doe", URL: "https://www.1.com", Description: "John is a software engineer"},
+		{Name: "Mary", URL: "https://www.2.com", Description: "Mary is a software engineer"},
+	}
+	for _, e := range engineers {
+		if err := s.SaveEngineer(ctx, e); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	got, err := s.DistinctEngineerURLs(ctx)
+	if err != nil {
+		t.Fatal("error getting engineers", err)
+	}
+
+	want := []interface{}{"https://www.1.com", "https://www.2.com"}
+	if !reflect.DeepEqual(sortedURLs(got), want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, schedule := range []string{"0s", "-1h", "every day", "* * *"} {
+		if err := s.SaveEngineer(ctx, mongodb.Engineer{URL: "https://www.3.com", Schedule: schedule}); err == nil {
+			t.Errorf("%s: expected error saving an invalid schedule", schedule)
+		}
+	}
+	if _, err := s.Engineer(ctx, "https://www.3.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected the engineers of invalid schedules not saved, got %v", err)
+	}
+}
+
+func testDeleteEngineer(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for _, url := range []string{"https://www.1.com", "https://www.2.com"} {
+		if err := s.SaveEngineer(ctx, mongodb.Engineer{URL: url}); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+		if err := s.SaveSchedule(ctx, mongodb.Schedule{URL: url, NextRun: time.Now().UTC()}); err != nil {
+			t.Fatal("error saving schedule", err)
+		}
+	}
+
+	if err := s.DeleteEngineer(ctx, "https://www.1.com"); err != nil {
+		t.Fatal("error deleting engineer", err)
+	}
+	if err := s.DeleteEngineer(ctx, "https://www.1.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	engineers, err := s.Engineers(ctx)
+	if err != nil {
+		t.Fatal("error getting engineers", err)
+	}
+	if len(engineers) != 1 || engineers[0].URL != "https://www.2.com" {
+		t.Fatalf("expected only https://www.2.com, got %v", engineers)
+	}
+
+	schedules, err := s.Schedules(ctx)
+	if err != nil {
+		t.Fatal("error getting schedules", err)
+	}
+	if len(schedules) != 1 || schedules[0].URL != "https://www.2.com" {
+		t.Fatalf("expected the schedule to be deleted, got %v", schedules)
+	}
+}
+
+func testDistinctEngineerURLs(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	got, err := s.DistinctEngineerURLs(ctx)
+	if err != nil {
+		t.Fatal("error getting engineers", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no engineers, got %v", got)
+	}
+}
+
+func testEngineers(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	engineers := []mongodb.Engineer{
+		{Name: "Mary", URL: "https://www.2.com", Description: "Mary is a software engineer", Schedule: "@daily"},
+		{Name: "John", URL: "https://www.1.com", Description: "John is a software engineer"},
+		{Name: "John Doe", URL: "https://www.1.com", Description: "John is a software engineer", Schedule: "6h"},
+	}
+	for _, e := range engineers {
+		if err := s.SaveEngineer(ctx, e); err != nil {
+			t.Fatal("error saving engineer", err)
+		}
+	}
+
+	got, err := s.Engineers(ctx)
+	if err != nil {
+		t.Fatal("error getting engineers", err)
+	}
+
+	want := []mongodb.Engineer{engineers[2], engineers[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	e, err := s.Engineer(ctx, "https://www.1.com")
+	if err != nil || e != engineers[2] {
+		t.Fatalf("expected %v, got %v (%v)", engineers[2], e, err)
+	}
+	if _, err := s.Engineer(ctx, "https://www.3.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testSaveSchedule(t *testing.T, s Storage) {
+	ctx := context.Background()
+	lastRun := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+
+	schedules := []mongodb.Schedule{
+		{URL: "https://www.2.com", NextRun: lastRun.Add(time.Hour)},
+		{URL: "https://www.1.com", NextRun: lastRun.Add(time.Hour)},
+		{URL: "https://www.1.com", NextRun: lastRun.Add(2 * time.Hour), LastRun: lastRun, UnchangedRuns: 3, Interval: 2 * time.Hour, ChangeRate: 0.5},
+	}
+	for _, sch := range schedules {
+		if err := s.SaveSchedule(ctx, sch); err != nil {
+			t.Fatal("error saving schedule", err)
+		}
+	}
+
+	got, err := s.Schedules(ctx)
+	if err != nil {
+		t.Fatal("error getting schedules", err)
+	}
+
+	want := []mongodb.Schedule{schedules[2], schedules[0]}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].URL != want[i].URL || !got[i].NextRun.Equal(want[i].NextRun) ||
+			!got[i].LastRun.Equal(want[i].LastRun) || got[i].UnchangedRuns != want[i].UnchangedRuns ||
+			got[i].Interval != want[i].Interval || got[i].ChangeRate != want[i].ChangeRate {
+			t.Fatalf("got %v, want %v", got[i], want[i])
+		}
+	}
+
+	sch, err := s.Schedule(ctx, "https://www.1.com")
+	if err != nil || !sch.NextRun.Equal(schedules[2].NextRun) || sch.UnchangedRuns != 3 || sch.Interval != 2*time.Hour {
+		t.Fatalf("expected %v, got %v (%v)", schedules[2], sch, err)
+	}
+	if _, err := s.Schedule(ctx, "https://www.3.com"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testPage(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	pages := []mongodb.Page{
+		page("https://www.google.com", "HTML 1", time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC), true),
+		page("https://www.google.com", "HTML 2", time.Date(2023, time.August, 11, 15, 30, 0, 0, time.UTC), false),
+		page("https://www.google.com", "HTML 3", time.Date(2023, time.August, 12, 15, 30, 0, 0, time.UTC), true),
+	}
+	if err := s.SavePage(ctx, pages); err != nil {
+		t.Fatal("error saving page", err)
+	}
+
+	got, err := s.Page(ctx, "https://www.google.com")
+	if err != nil {
+		t.Fatal("error getting page", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatal("expected 1 page, got", len(got))
+	}
+	if !reflect.DeepEqual(got[0], pages[0]) {
+		t.Fatalf("got %v, want %v", got[0], pages[0])
+	}
+}
+
+func testPageNotFound(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	got, err := s.Page(ctx, "https://www.google.com")
+	if err != nil {
+		t.Fatal("error getting page", err)
+	}
+	if len(got) != 0 {
+		t.Fatal("expected 0 pages, got", len(got))
+	}
+
+	gotIn, err := s.PageIn(ctx, []string{"https://www.google.com"})
+	if err != nil {
+		t.Fatal("error getting pages", err)
+	}
+	if len(gotIn) != 0 {
+		t.Fatal("expected 0 pages, got", len(gotIn))
+	}
+}
+
+func testPageIn(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	pages := []mongodb.Page{
+		page("https://www.google.com", "HTML 1", time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC), true),
+		page("https://www.google.com", "HTML 2", time.Date(2023, time.August, 12, 15, 30, 0, 0, time.UTC), true),
+		page("https://facebook.com", "HTML 3", time.Date(2023, time.August, 11, 15, 30, 0, 0, time.UTC), false),
+		page("https://jj.com", "HTML 4", time.Date(2023, time.August, 15, 15, 30, 0, 0, time.UTC), true),
+		page("https://ignored.com", "HTML 5", time.Date(2023, time.August, 15, 15, 30, 0, 0, time.UTC), true),
+	}
+	if err := s.SavePage(ctx, pages); err != nil {
+		t.Fatal("error saving page", err)
+	}
+
+	got, err := s.PageIn(ctx, []string{"https://www.google.com", "https://facebook.com", "https://jj.com"})
+	if err != nil {
+		t.Fatal("error getting page", err)
+	}
+
+	sort.Slice(got, func(i, j int) bool { return got[i].URL < got[j].URL })
+	want := []mongodb.Page{pages[2], pages[3], pages[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func testPageHistory(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	pages := []mongodb.Page{
+		page("https://www.google.com", "HTML 1", time.Date(2023, time.August, 12, 15, 30, 0, 0, time.UTC), true),
+		page("https://www.google.com", "HTML 2", time.Date(2023, time.August, 14, 15, 30, 0, 0, time.UTC), true),
+		page("https://facebook.com", "HTML 3", time.Date(2023, time.August, 15, 15, 30, 0, 0, time.UTC), true),
+		page("https://www.google.com", "HTML 2", time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC), false),
+	}
+	if err := s.SavePage(ctx, pages); err != nil {
+		t.Fatal("error saving page", err)
+	}
+
+	got, err := s.PageHistory(ctx, "https://www.google.com", 0)
+	if err != nil {
+		t.Fatal("error getting page history", err)
+	}
+	want := []mongodb.Page{pages[1], pages[3], pages[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got, err = s.PageHistory(ctx, "https://www.google.com", 2)
+	if err != nil {
+		t.Fatal("error getting page history", err)
+	}
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Fatalf("got %v, want %v", got, want[:2])
+	}
+}
+
+func testPageChanges(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	pages := []mongodb.Page{
+		page("https://www.google.com", "HTML 1", time.Date(2023, time.August, 12, 15, 30, 0, 0, time.UTC), true),
+		page("https://www.google.com", "HTML 1", time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC), false),
+		page("https://www.google.com", "HTML 2", time.Date(2023, time.August, 14, 15, 30, 0, 0, time.UTC), true),
+		page("https://www.google.com", "HTML 3", time.Date(2023, time.August, 15, 15, 30, 0, 0, time.UTC), true),
+		page("https://facebook.com", "HTML 4", time.Date(2023, time.August, 16, 15, 30, 0, 0, time.UTC), true),
+	}
+	if err := s.SavePage(ctx, pages); err != nil {
+		t.Fatal("error saving page", err)
+	}
+
+	got, err := s.PageChanges(ctx, "https://www.google.com", 0)
+	if err != nil {
+		t.Fatal("error getting page changes", err)
+	}
+	want := []mongodb.Page{pages[3], pages[2], pages[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got, err = s.PageChanges(ctx, "https://www.google.com", 2)
+	if err != nil {
+		t.Fatal("error getting page changes", err)
+	}
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Fatalf("got %v, want %v", got, want[:2])
+	}
+}
+
+func testDeletePagesBefore(t *testing.T, s Storage) {
+	ctx := context.Background()
+	start := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+
+	// 1.com has 5 daily versions, 2.com a single old version.
+	var pages []mongodb.Page
+	for day := 0; day < 5; day++ {
+		pages = append(pages, page("https://www.1.com", "v", start.Add(time.Duration(day)*24*time.Hour), day == 0))
+	}
+	pages = append(pages, page("https://www.2.com", "v", start, true))
+	if err := s.SavePage(ctx, pages); err != nil {
+		t.Fatal("error saving pages", err)
+	}
+
+	deleted, err := s.DeletePagesBefore(ctx, start.Add(3*24*time.Hour))
+	if err != nil {
+		t.Fatal("error deleting pages", err)
+	}
+	if deleted != 3 {
+		t.Fatalf("got %d deleted pages, want 3", deleted)
+	}
+
+	history, err := s.PageHistory(ctx, "https://www.1.com", 0)
+	if err != nil {
+		t.Fatal("error getting page history", err)
+	}
+	if len(history) != 2 || !history[1].ScrapeDatetime.Equal(start.Add(3*24*time.Hour)) {
+		t.Fatalf("expected the versions since day 3, got %v", history)
+	}
+
+	// The last version is kept however old it is, the next crawl is compared with it.
+	got, err := s.Page(ctx, "https://www.2.com")
+	if err != nil {
+		t.Fatal("error getting page", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected the last version of https://www.2.com, got %v", got)
+	}
+}
+
+func testConcurrentSavePage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	start := time.Date(2023, time.August, 13, 15, 30, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := page("https://www.google.com", "HTML", start.Add(time.Duration(i)*time.Hour), true)
+			if err := s.SavePage(ctx, []mongodb.Page{p}); err != nil {
+				t.Error("error saving page", err)
+			}
+			if _, err := s.Page(ctx, p.URL); err != nil {
+				t.Error("error getting page", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := s.Page(ctx, "https://www.google.com")
+	if err != nil {
+		t.Fatal("error getting page", err)
+	}
+	if len(got) != 1 || !got[0].ScrapeDatetime.Equal(start.Add(9*time.Hour)) {
+		t.Fatalf("expected the last saved version, got %v", got)
+	}
+}
+
+func page(url, content string, scrapeDate time.Time, mostRecent bool) mongodb.Page {
+	return mongodb.Page{
+		URL:            url,
+		Content:        content,
+		ScrapeDatetime: scrapeDate,
+		HashMD5:        md5.Sum([]byte(content)),
+		IsMostRecent:   mostRecent,
+	}
+}
+
+func sortedURLs(urls []interface{}) []interface{} {
+	sorted := append([]interface{}(nil), urls...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].(string) < sorted[j].(string) })
+	return sorted
+}
@@ -0,0 +1,304 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/mongodb"
+)
+
+// Webhooks is the set of webhook operations covered by the conformance suite.
+type Webhooks interface {
+	SaveWebhook(ctx context.Context, w mongodb.Webhook) error
+	Webhooks(ctx context.Context) ([]mongodb.Webhook, error)
+	Webhook(ctx context.Context, id string) (mongodb.Webhook, error)
+	WebhooksFollowing(ctx context.Context, url string) ([]mongodb.Webhook, error)
+	WebhooksOf(ctx context.Context, userEmail string) ([]mongodb.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	SaveDelivery(ctx context.Context, d mongodb.Delivery) error
+	Delivery(ctx context.Context, id string) (mongodb.Delivery, error)
+	Deliveries(ctx context.Context, webhookID string, limit int) ([]mongodb.Delivery, error)
+	PendingDeliveries(ctx context.Context, now time.Time, limit int) ([]mongodb.Delivery, error)
+}
+
+// RunWebhooks runs the webhooks suite. newWebhooks must return a storage without webhooks for every call.
+func RunWebhooks(t *testing.T, newWebhooks func(t *testing.T) Webhooks) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, w Webhooks)
+	}{
+		{"SaveWebhook", testSaveWebhook},
+		{"WebhooksFollowing", testWebhooksFollowing},
+		{"WebhooksOf", testWebhooksOf},
+		{"DeleteWebhook", testDeleteWebhook},
+		{"Deliveries", testDeliveries},
+		{"PendingDeliveries", testPendingDeliveries},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newWebhooks(t))
+		})
+	}
+}
+
+// now returns the current time with the precision of the storages
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+func testSaveWebhook(t *testing.T, w Webhooks) {
+	ctx := context.Background()
+	created := now()
+
+	want := []mongodb.Webhook{
+		{ID: "b", UserEmail: "j@gmail.com", Endpoint: "https://j.test/hook", Secret: "s1", CreatedAt: created},
+		{ID: "a", UserEmail: "k@gmail.com", Endpoint: "https://k.test/hook", Secret: "s2",
+			URLs: []string{"https://jj.com"}, CreatedAt: created.Add(time.Second)},
+	}
+	for _, wh := range want {
+		if err := w.SaveWebhook(ctx, wh); err != nil {
+			t.Fatal("error saving webhook", err)
+		}
+	}
+
+	got, err := w.Webhooks(ctx)
+	if err != nil {
+		t.Fatal("error getting webhooks", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	want[0].Endpoint = "https://j.test/other"
+	if err := w.SaveWebhook(ctx, want[0]); err != nil {
+		t.Fatal("error saving webhook", err)
+	}
+	got, err = w.Webhooks(ctx)
+	if err != nil {
+		t.Fatal("error getting webhooks", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the webhook to be replaced, got %v, want %v", got, want)
+	}
+
+	wh, err := w.Webhook(ctx, "a")
+	if err != nil {
+		t.Fatal("error getting webhook", err)
+	}
+	if !reflect.DeepEqual(wh, want[1]) {
+		t.Fatalf("got %v, want %v", wh, want[1])
+	}
+	if _, err := w.Webhook(ctx, "c"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testWebhooksFollowing(t *testing.T, w Webhooks) {
+	ctx := context.Background()
+	created := now()
+
+	webhooks := []mongodb.Webhook{
+		{ID: "all", Endpoint: "https://j.test/hook", CreatedAt: created},
+		{ID: "jj", Endpoint: "https://j.test/hook", URLs: []string{"https://jj.com", "https://kk.com"}, CreatedAt: created.Add(time.Second)},
+		{ID: "kk", Endpoint: "https://k.test/hook", URLs: []string{"https://kk.com"}, CreatedAt: created.Add(2 * time.Second)},
+	}
+	for _, wh := range webhooks {
+		if err := w.SaveWebhook(ctx, wh); err != nil {
+			t.Fatal("error saving webhook", err)
+		}
+	}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{url: "https://jj.com", want: []string{"all", "jj"}},
+		{url: "https://kk.com", want: []string{"all", "jj", "kk"}},
+		{url: "https://ll.com", want: []string{"all"}},
+	}
+	for _, tt := range tests {
+		got, err := w.WebhooksFollowing(ctx, tt.url)
+		if err != nil {
+			t.Fatal("error getting webhooks", err)
+		}
+		var ids []string
+		for _, wh := range got {
+			ids = append(ids, wh.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: got webhooks %v, want %v", tt.url, ids, tt.want)
+		}
+	}
+}
+
+func testWebhooksOf(t *testing.T, w Webhooks) {
+	ctx := context.Background()
+	created := now()
+
+	webhooks := []mongodb.Webhook{
+		{ID: "j2", UserEmail: "j@gmail.com", Endpoint: "https://j.test/hook", CreatedAt: created.Add(time.Second)},
+		{ID: "k", UserEmail: "k@gmail.com", Endpoint: "https://k.test/hook", CreatedAt: created},
+		{ID: "j1", UserEmail: "j@gmail.com", Endpoint: "https://j.test/other", CreatedAt: created},
+	}
+	for _, wh := range webhooks {
+		if err := w.SaveWebhook(ctx, wh); err != nil {
+			t.Fatal("error saving webhook", err)
+		}
+	}
+
+	tests := []struct {
+		email string
+		want  []string
+	}{
+		{email: "j@gmail.com", want: []string{"j1", "j2"}},
+		{email: "k@gmail.com", want: []string{"k"}},
+		{email: "l@gmail.com", want: nil},
+	}
+	for _, tt := range tests {
+		got, err := w.WebhooksOf(ctx, tt.email)
+		if err != nil {
+			t.Fatal("error getting webhooks", err)
+		}
+		var ids []string
+		for _, wh := range got {
+			ids = append(ids, wh.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: got webhooks %v, want %v", tt.email, ids, tt.want)
+		}
+	}
+}
+
+func testDeleteWebhook(t *testing.T, w Webhooks) {
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		if err := w.SaveWebhook(ctx, mongodb.Webhook{ID: id, Endpoint: "https://j.test/hook", CreatedAt: now()}); err != nil {
+			t.Fatal("error saving webhook", err)
+		}
+		d := mongodb.Delivery{ID: "d" + id, WebhookID: id, Status: mongodb.DeliveryPending, CreatedAt: now(), NextAttempt: now()}
+		if err := w.SaveDelivery(ctx, d); err != nil {
+			t.Fatal("error saving delivery", err)
+		}
+	}
+
+	if err := w.DeleteWebhook(ctx, "a"); err != nil {
+		t.Fatal("error deleting webhook", err)
+	}
+	if err := w.DeleteWebhook(ctx, "a"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	webhooks, err := w.Webhooks(ctx)
+	if err != nil {
+		t.Fatal("error getting webhooks", err)
+	}
+	if len(webhooks) != 1 || webhooks[0].ID != "b" {
+		t.Fatalf("expected only webhook b, got %v", webhooks)
+	}
+	if _, err := w.Delivery(ctx, "da"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected the deliveries of the webhook to be deleted, got %v", err)
+	}
+	if _, err := w.Delivery(ctx, "db"); err != nil {
+		t.Fatalf("expected the deliveries of the other webhook to be kept, got %v", err)
+	}
+}
+
+func testDeliveries(t *testing.T, w Webhooks) {
+	ctx := context.Background()
+	created := now()
+
+	var want []mongodb.Delivery
+	for i, id := range []string{"d1", "d2", "d3"} {
+		d := mongodb.Delivery{
+			ID:          id,
+			WebhookID:   "a",
+			Event:       "page.changed",
+			Payload:     []byte(`{"url":"https://jj.com"}`),
+			Status:      mongodb.DeliveryDelivered,
+			Attempts:    []mongodb.DeliveryAttempt{{At: created, Duration: time.Second, Error: "status 500"}, {At: created, Duration: time.Second}},
+			NextAttempt: created,
+			CreatedAt:   created.Add(time.Duration(i) * time.Second),
+		}
+		if err := w.SaveDelivery(ctx, d); err != nil {
+			t.Fatal("error saving delivery", err)
+		}
+		want = append([]mongodb.Delivery{d}, want...)
+	}
+	err := w.SaveDelivery(ctx, mongodb.Delivery{ID: "other", WebhookID: "b", Status: mongodb.DeliveryPending, CreatedAt: created})
+	if err != nil {
+		t.Fatal("error saving delivery", err)
+	}
+
+	got, err := w.Deliveries(ctx, "a", 0)
+	if err != nil {
+		t.Fatal("error getting deliveries", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got, err = w.Deliveries(ctx, "a", 2)
+	if err != nil {
+		t.Fatal("error getting deliveries", err)
+	}
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Fatalf("got %v, want %v", got, want[:2])
+	}
+
+	d, err := w.Delivery(ctx, "d2")
+	if err != nil {
+		t.Fatal("error getting delivery", err)
+	}
+	if !reflect.DeepEqual(d, want[1]) {
+		t.Fatalf("got %v, want %v", d, want[1])
+	}
+	if _, err := w.Delivery(ctx, "missing"); !errors.Is(err, mongodb.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testPendingDeliveries(t *testing.T, w Webhooks) {
+	ctx := context.Background()
+	at := now()
+
+	deliveries := []mongodb.Delivery{
+		{ID: "late", Status: mongodb.DeliveryPending, NextAttempt: at.Add(-time.Second)},
+		{ID: "due", Status: mongodb.DeliveryPending, NextAttempt: at},
+		{ID: "later", Status: mongodb.DeliveryPending, NextAttempt: at.Add(time.Minute)},
+		{ID: "delivered", Status: mongodb.DeliveryDelivered, NextAttempt: at.Add(-time.Minute)},
+		{ID: "failed", Status: mongodb.DeliveryFailed, NextAttempt: at.Add(-time.Minute)},
+		{ID: "oldest", Status: mongodb.DeliveryPending, NextAttempt: at.Add(-time.Hour)},
+	}
+	for _, d := range deliveries {
+		d.WebhookID, d.CreatedAt = "a", at
+		if err := w.SaveDelivery(ctx, d); err != nil {
+			t.Fatal("error saving delivery", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{"oldest", "late", "due"}},
+		{2, []string{"oldest", "late"}},
+	} {
+		got, err := w.PendingDeliveries(ctx, at, tt.limit)
+		if err != nil {
+			t.Fatal("error getting pending deliveries", err)
+		}
+		var ids []string
+		for _, d := range got {
+			ids = append(ids, d.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Fatalf("limit %d: got %v, want %v", tt.limit, ids, tt.want)
+		}
+	}
+}
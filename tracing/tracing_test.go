@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup_Stdout(t *testing.T) {
+	ctx := context.Background()
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	var out bytes.Buffer
+	shutdown, err := Setup(ctx, Config{Exporter: "stdout", SampleRatio: 1}, &out)
+	if err != nil {
+		t.Fatal("error setting up tracing", err)
+	}
+
+	_, span := Start(ctx, "crawler.cycle")
+	span.End()
+	if err := shutdown(ctx); err != nil {
+		t.Fatal("error shutting down tracing", err)
+	}
+
+	if !strings.Contains(out.String(), `"Name":"crawler.cycle"`) || !strings.Contains(out.String(), `"Value":"newsletter"`) {
+		t.Fatalf("expected the span of the newsletter service, got %s", out.String())
+	}
+}
+
+func TestSetup_Invalid(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "jaeger"}, nil); err == nil {
+		t.Fatal("expected error for an unknown exporter")
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	ctx := context.Background()
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	var spans bytes.Buffer
+	shutdown, err := Setup(ctx, Config{Exporter: "stdout", SampleRatio: 1}, &spans)
+	if err != nil {
+		t.Fatal("error setting up tracing", err)
+	}
+	defer func() { _ = shutdown(ctx) }()
+
+	var out bytes.Buffer
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(&out, nil))).With("component", "crawler")
+
+	spanCtx, span := Start(ctx, "Fetch")
+	logger.InfoContext(spanCtx, "within span")
+	span.End()
+	logger.InfoContext(ctx, "without span")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", out.String())
+	}
+
+	var within, without map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &within); err != nil {
+		t.Fatal("error decoding record", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &without); err != nil {
+		t.Fatal("error decoding record", err)
+	}
+
+	if within["trace_id"] != span.SpanContext().TraceID().String() || within["span_id"] != span.SpanContext().SpanID().String() {
+		t.Errorf("expected the IDs of the span, got %v", within)
+	}
+	if within["component"] != "crawler" {
+		t.Errorf("expected the attributes of the logger, got %v", within)
+	}
+	if _, ok := without["trace_id"]; ok {
+		t.Errorf("expected no trace_id without span, got %v", without)
+	}
+}
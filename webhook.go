@@ -0,0 +1,595 @@
+package newsletter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perebaj/newsletter/metrics"
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/notify"
+	"github.com/perebaj/newsletter/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/html"
+)
+
+// EventPageChanged is the event sent to the webhooks when a new version of a page is found
+const EventPageChanged = "page.changed"
+
+const (
+	// EventHeader carries the event of a webhook request
+	EventHeader = "X-Newsletter-Event"
+	// DeliveryHeader carries the ID of the delivery of a webhook request, the same on retries and replays
+	DeliveryHeader = "X-Newsletter-Delivery"
+)
+
+const (
+	// DefaultWebhookAttempts is the number of requests sent to a webhook before its delivery fails
+	DefaultWebhookAttempts = 5
+	// DefaultWebhookBackoff is the delay before the first retry of a delivery, doubled on every retry
+	DefaultWebhookBackoff = 30 * time.Second
+	// webhookTimeout bounds every request sent to a webhook
+	webhookTimeout = 10 * time.Second
+	// maxArticles is the maximum number of articles of a ChangeEvent
+	maxArticles = 50
+)
+
+// ChangeEvent is the payload posted to the webhooks when a new version of a page is found
+type ChangeEvent struct {
+	Event    string        `json:"event"`
+	Engineer EventEngineer `json:"engineer"`
+	URL      string        `json:"url"`
+	// OldHash and NewHash are the hex MD5 hashes of the previous and the new version
+	OldHash string `json:"old_hash"`
+	NewHash string `json:"new_hash"`
+	// Articles are the links of the new version missing in the previous one
+	Articles   []string    `json:"articles"`
+	Diff       DiffSummary `json:"diff"`
+	DetectedAt time.Time   `json:"detected_at"`
+}
+
+// EventEngineer is the engineer of the changed page
+type EventEngineer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// DiffSummary counts the lines of the page added and removed by the new version
+type DiffSummary struct {
+	AddedLines   int `json:"added_lines"`
+	RemovedLines int `json:"removed_lines"`
+}
+
+// NewChangeEvent returns the event of the new version of the page of the engineer
+func NewChangeEvent(e mongodb.Engineer, old, new mongodb.Page) ChangeEvent {
+	ev := ChangeEvent{
+		Event:      EventPageChanged,
+		Engineer:   EventEngineer{Name: e.Name, URL: e.URL},
+		URL:        new.URL,
+		OldHash:    hex.EncodeToString(old.HashMD5[:]),
+		NewHash:    hex.EncodeToString(new.HashMD5[:]),
+		Articles:   []string{},
+		DetectedAt: new.ScrapeDatetime,
+	}
+
+	seen := make(map[string]bool)
+	for _, link := range links(old.Content, old.URL) {
+		seen[link] = true
+	}
+	for _, link := range links(new.Content, new.URL) {
+		if !seen[link] && len(ev.Articles) < maxArticles {
+			ev.Articles = append(ev.Articles, link)
+		}
+		seen[link] = true
+	}
+
+	ev.Diff.AddedLines, ev.Diff.RemovedLines = diffLines(old.Content, new.Content)
+	return ev
+}
+
+// links returns the absolute URLs of the anchors of the HTML document, in order, resolved against base.
+func links(doc, base string) []string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		baseURL = &url.URL{}
+	}
+
+	var found []string
+	z := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return found
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" {
+				continue
+			}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) != "href" {
+					continue
+				}
+				ref, err := url.Parse(strings.TrimSpace(string(val)))
+				if err != nil {
+					continue
+				}
+				u := baseURL.ResolveReference(ref)
+				u.Fragment = ""
+				if u.Scheme == "http" || u.Scheme == "https" {
+					found = append(found, u.String())
+				}
+			}
+		}
+	}
+}
+
+// diffLines counts the non-blank lines of new missing in old and the ones of old missing in new.
+func diffLines(old, new string) (added, removed int) {
+	count := make(map[string]int)
+	for _, l := range strings.Split(old, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			count[l]++
+		}
+	}
+	for _, l := range strings.Split(new, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			count[l]--
+		}
+	}
+	for _, n := range count {
+		if n > 0 {
+			removed += n
+		} else {
+			added -= n
+		}
+	}
+	return added, removed
+}
+
+// WebhookStorage is the storage of the webhooks and their deliveries
+type WebhookStorage interface {
+	Engineer(ctx context.Context, url string) (mongodb.Engineer, error)
+	SaveWebhook(ctx context.Context, w mongodb.Webhook) error
+	Webhooks(ctx context.Context) ([]mongodb.Webhook, error)
+	// Webhook returns the webhook of the ID, mongodb.ErrNotFound when there is none
+	Webhook(ctx context.Context, id string) (mongodb.Webhook, error)
+	// WebhooksFollowing returns the webhooks that receive the changes of the url
+	WebhooksFollowing(ctx context.Context, url string) ([]mongodb.Webhook, error)
+	// WebhooksOf returns the webhooks registered by the email
+	WebhooksOf(ctx context.Context, userEmail string) ([]mongodb.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	SaveDelivery(ctx context.Context, d mongodb.Delivery) error
+	Delivery(ctx context.Context, id string) (mongodb.Delivery, error)
+	Deliveries(ctx context.Context, webhookID string, limit int) ([]mongodb.Delivery, error)
+	PendingDeliveries(ctx context.Context, now time.Time, limit int) ([]mongodb.Delivery, error)
+}
+
+// Webhooks registers the webhooks of the subscribers and delivers the change events to them, retrying the failed
+// requests with an exponential backoff.
+type Webhooks struct {
+	Storage WebhookStorage
+	Client  *http.Client
+	// MaxAttempts is the number of requests sent before a delivery fails
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled on every retry
+	Backoff time.Duration
+	// AllowPrivateHosts lets the endpoints be on loopback, private and link-local hosts, for the receivers on the
+	// network of the newsletter. Register rejects them otherwise, and so do the deliveries without a Client.
+	AllowPrivateHosts bool
+}
+
+// privateClient delivers to the endpoints on private hosts when AllowPrivateHosts is set
+var privateClient = notify.NewClient(true)
+
+// NewWebhooks initializes a new Webhooks with the default attempts and backoff
+func NewWebhooks(s WebhookStorage) *Webhooks {
+	return &Webhooks{
+		Storage:     s,
+		MaxAttempts: DefaultWebhookAttempts,
+		Backoff:     DefaultWebhookBackoff,
+	}
+}
+
+// randomID returns a random hex string of n bytes
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("error reading random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Register registers the endpoint of the user, that receives the changes of the urls, all of them when empty.
+// The returned webhook carries the secret that signs its requests. The endpoints on private hosts are rejected with
+// notify.ErrPrivateHost, unless AllowPrivateHosts is set.
+func (w *Webhooks) Register(ctx context.Context, userEmail, endpoint string, urls []string) (mongodb.Webhook, error) {
+	if !strings.Contains(userEmail, "@") {
+		return mongodb.Webhook{}, fmt.Errorf("invalid email address %q", userEmail)
+	}
+	if err := ValidateChannel(mongodb.Channel{Type: ChannelWebhook, Address: endpoint}); err != nil {
+		return mongodb.Webhook{}, err
+	}
+	if !w.AllowPrivateHosts {
+		if err := notify.CheckHost(ctx, endpoint); err != nil {
+			return mongodb.Webhook{}, err
+		}
+	}
+
+	wh := mongodb.Webhook{
+		ID:        randomID(8),
+		UserEmail: userEmail,
+		Endpoint:  endpoint,
+		Secret:    randomID(32),
+		URLs:      urls,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := w.Storage.SaveWebhook(ctx, wh); err != nil {
+		return mongodb.Webhook{}, err
+	}
+	return wh, nil
+}
+
+// PageChanged records a pending delivery of the change of the page for every webhook that follows it.
+// It is meant to be the OnChange hook of the Crawler, so the errors are logged.
+func (w *Webhooks) PageChanged(ctx context.Context, old, new mongodb.Page) {
+	if err := w.enqueue(ctx, old, new); err != nil {
+		slog.ErrorContext(ctx, "error enqueuing change event", "url", new.URL, "error", err)
+	}
+}
+
+func (w *Webhooks) enqueue(ctx context.Context, old, new mongodb.Page) error {
+	followers, err := w.Storage.WebhooksFollowing(ctx, new.URL)
+	if err != nil {
+		return err
+	}
+	if len(followers) == 0 {
+		return nil
+	}
+
+	engineer, err := w.Storage.Engineer(ctx, new.URL)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		engineer = mongodb.Engineer{URL: new.URL}
+	} else if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(NewChangeEvent(engineer, old, new))
+	if err != nil {
+		return fmt.Errorf("error encoding change event: %v", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, wh := range followers {
+		err := w.Storage.SaveDelivery(ctx, mongodb.Delivery{
+			ID:          randomID(8),
+			WebhookID:   wh.ID,
+			Event:       EventPageChanged,
+			Payload:     payload,
+			Status:      mongodb.DeliveryPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, got := range values {
+		if got == v {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliverPending sends the pending deliveries that are due, in batches, until there is none left or ctx is cancelled.
+func (w *Webhooks) DeliverPending(ctx context.Context) error {
+	const batchSize = 100
+	for {
+		deliveries, err := w.Storage.PendingDeliveries(ctx, time.Now().UTC(), batchSize)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, err := w.attempt(ctx, d, false); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < batchSize {
+			return nil
+		}
+	}
+}
+
+// Replay sends the delivery of the ID again right away, whatever its status. It returns the delivery with the
+// new attempt, that failed when its Error is not empty, and mongodb.ErrNotFound when there is no such delivery.
+func (w *Webhooks) Replay(ctx context.Context, id string) (mongodb.Delivery, error) {
+	d, err := w.Storage.Delivery(ctx, id)
+	if err != nil {
+		return mongodb.Delivery{}, err
+	}
+	// A replay is a single attempt, a failed one does not start the retries again.
+	return w.attempt(ctx, d, true)
+}
+
+// attempt sends the delivery to its webhook and saves it with the attempt. A failed delivery is retried after the
+// backoff, while it has attempts left and it is not a replay.
+func (w *Webhooks) attempt(ctx context.Context, d mongodb.Delivery, replay bool) (mongodb.Delivery, error) {
+	ctx, span := tracing.Start(ctx, "webhook.deliver", attribute.String("delivery", d.ID), attribute.String("webhook", d.WebhookID))
+	defer span.End()
+
+	start := time.Now().UTC()
+	err := w.post(ctx, d)
+	d.Attempts = append(d.Attempts, mongodb.DeliveryAttempt{At: start.Truncate(time.Millisecond), Duration: time.Since(start)})
+
+	d.Status = mongodb.DeliveryDelivered
+	result := "delivered"
+	if err != nil {
+		slog.WarnContext(ctx, "error delivering webhook", "delivery", d.ID, "webhook", d.WebhookID, "error", err)
+		d.Attempts[len(d.Attempts)-1].Error = err.Error()
+		span.SetAttributes(attribute.String("error", err.Error()))
+
+		maxAttempts := w.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = DefaultWebhookAttempts
+		}
+		d.Status, result = mongodb.DeliveryFailed, "failed"
+		if !replay && len(d.Attempts) < maxAttempts {
+			d.Status, result = mongodb.DeliveryPending, "retry"
+			backoff := w.Backoff
+			if backoff <= 0 {
+				backoff = DefaultWebhookBackoff
+			}
+			d.NextAttempt = time.Now().UTC().Add(backoff << (len(d.Attempts) - 1)).Truncate(time.Millisecond)
+		}
+	}
+	metrics.WebhookAttempts.WithLabelValues(result).Inc()
+
+	// The attempt is recorded even when ctx is cancelled, so a request sent is never sent again unknowingly.
+	if err := w.Storage.SaveDelivery(context.WithoutCancel(ctx), d); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// post sends the payload of the delivery to its webhook
+func (w *Webhooks) post(ctx context.Context, d mongodb.Delivery) error {
+	wh, err := w.Storage.Webhook(ctx, d.WebhookID)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		return errors.New("webhook not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	c := w.Client
+	if c == nil && w.AllowPrivateHosts {
+		c = privateClient
+	}
+	header := http.Header{EventHeader: {d.Event}, DeliveryHeader: {d.ID}}
+	return notify.Webhook{Secret: wh.Secret, Client: c}.Post(ctx, wh.Endpoint, header, json.RawMessage(d.Payload))
+}
+
+// webhookJSON is a webhook served by WebhookHandler. The secret is only served when the webhook is registered.
+type webhookJSON struct {
+	ID        string    `json:"id"`
+	UserEmail string    `json:"user_email"`
+	Endpoint  string    `json:"endpoint"`
+	Secret    string    `json:"secret,omitempty"`
+	URLs      []string  `json:"urls"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookJSON(wh mongodb.Webhook) webhookJSON {
+	urls := wh.URLs
+	if urls == nil {
+		urls = []string{}
+	}
+	return webhookJSON{ID: wh.ID, UserEmail: wh.UserEmail, Endpoint: wh.Endpoint, URLs: urls, CreatedAt: wh.CreatedAt}
+}
+
+// deliveryJSON is a delivery served by WebhookHandler
+type deliveryJSON struct {
+	ID          string          `json:"id"`
+	WebhookID   string          `json:"webhook_id"`
+	Event       string          `json:"event"`
+	Status      string          `json:"status"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    []attemptJSON   `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+type attemptJSON struct {
+	At         time.Time `json:"at"`
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func newDeliveryJSON(d mongodb.Delivery) deliveryJSON {
+	attempts := make([]attemptJSON, len(d.Attempts))
+	for i, a := range d.Attempts {
+		attempts[i] = attemptJSON{At: a.At, DurationMS: a.Duration.Milliseconds(), Error: a.Error}
+	}
+	return deliveryJSON{
+		ID:          d.ID,
+		WebhookID:   d.WebhookID,
+		Event:       d.Event,
+		Status:      d.Status,
+		Payload:     json.RawMessage(d.Payload),
+		Attempts:    attempts,
+		NextAttempt: d.NextAttempt,
+		CreatedAt:   d.CreatedAt,
+	}
+}
+
+// WebhookHandler serves the webhooks, mounted on /webhooks/:
+//
+//	GET    /webhooks                           lists the webhooks, of the user of the email query when given
+//	POST   /webhooks                           registers a webhook from {"user_email", "endpoint", "urls"}
+//	DELETE /webhooks/{id}                      deletes a webhook and its deliveries
+//	GET    /webhooks/{id}/deliveries           lists the latest deliveries of a webhook, up to the limit query
+//	POST   /webhooks/deliveries/{id}/replay    sends a delivery again
+func WebhookHandler(w *Webhooks) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "":
+			switch r.Method {
+			case http.MethodGet:
+				w.list(rw, r)
+			case http.MethodPost:
+				w.register(rw, r)
+			default:
+				methodNotAllowed(rw, http.MethodGet, http.MethodPost)
+			}
+		case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "replay":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(rw, http.MethodPost)
+				return
+			}
+			w.replay(rw, r, parts[1])
+		case len(parts) == 2 && parts[1] == "deliveries":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(rw, http.MethodGet)
+				return
+			}
+			w.deliveries(rw, r, parts[0])
+		case len(parts) == 1:
+			if r.Method != http.MethodDelete {
+				methodNotAllowed(rw, http.MethodDelete)
+				return
+			}
+			w.delete(rw, r, parts[0])
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow ...string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error encoding response", "error", err)
+	}
+}
+
+func (w *Webhooks) list(rw http.ResponseWriter, r *http.Request) {
+	webhooks, err := w.Storage.Webhooks(r.Context())
+	if err != nil {
+		slog.Error("error getting webhooks", "error", err)
+		http.Error(rw, "error getting webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	email := r.URL.Query().Get("email")
+	list := []webhookJSON{}
+	for _, wh := range webhooks {
+		if email == "" || wh.UserEmail == email {
+			list = append(list, newWebhookJSON(wh))
+		}
+	}
+	writeJSON(rw, http.StatusOK, list)
+}
+
+func (w *Webhooks) register(rw http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserEmail string   `json:"user_email"`
+		Endpoint  string   `json:"endpoint"`
+		URLs      []string `json:"urls"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(rw, "invalid webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wh, err := w.Register(r.Context(), req.UserEmail, req.Endpoint, req.URLs)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := newWebhookJSON(wh)
+	resp.Secret = wh.Secret
+	writeJSON(rw, http.StatusCreated, resp)
+}
+
+func (w *Webhooks) delete(rw http.ResponseWriter, r *http.Request, id string) {
+	err := w.Storage.DeleteWebhook(r.Context(), id)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(rw, "webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("error deleting webhook", "error", err)
+		http.Error(rw, "error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (w *Webhooks) deliveries(rw http.ResponseWriter, r *http.Request, id string) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(rw, "invalid limit "+v, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := w.Storage.Deliveries(r.Context(), id, limit)
+	if err != nil {
+		slog.Error("error getting deliveries", "error", err)
+		http.Error(rw, "error getting deliveries", http.StatusInternalServerError)
+		return
+	}
+	list := make([]deliveryJSON, len(deliveries))
+	for i, d := range deliveries {
+		list[i] = newDeliveryJSON(d)
+	}
+	writeJSON(rw, http.StatusOK, list)
+}
+
+func (w *Webhooks) replay(rw http.ResponseWriter, r *http.Request, id string) {
+	d, err := w.Replay(r.Context(), id)
+	if errors.Is(err, mongodb.ErrNotFound) {
+		http.Error(rw, "delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("error replaying delivery", "error", err)
+		http.Error(rw, "error replaying delivery", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, http.StatusOK, newDeliveryJSON(d))
+}
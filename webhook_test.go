@@ -0,0 +1,339 @@
+package newsletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perebaj/newsletter/memory"
+	"github.com/perebaj/newsletter/mongodb"
+	"github.com/perebaj/newsletter/notify"
+)
+
+func TestNewChangeEvent(t *testing.T) {
+	old := mongodb.Page{
+		URL:     "http://blog.test/articles/",
+		Content: "<ul>\n<li><a href=\"first.html\">First</a></li>\n</ul>",
+	}
+	new := mongodb.Page{
+		URL: "http://blog.test/articles/",
+		Content: "<ul>\n<li><a href=\"second.html#top\">Second</a></li>\n<li><a href=\"/articles/first.html\">First</a></li>\n" +
+			"<li><a href=\"mailto:j@blog.test\">Contact</a></li>\n</ul>",
+		ScrapeDatetime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	ev := NewChangeEvent(mongodb.Engineer{Name: "John", URL: old.URL}, old, new)
+	if ev.Event != EventPageChanged || ev.Engineer.Name != "John" || !ev.DetectedAt.Equal(new.ScrapeDatetime) {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if len(ev.Articles) != 1 || ev.Articles[0] != "http://blog.test/articles/second.html" {
+		t.Fatalf("expected the new article only, got %v", ev.Articles)
+	}
+	if ev.Diff.AddedLines != 3 || ev.Diff.RemovedLines != 1 {
+		t.Fatalf("unexpected diff %+v", ev.Diff)
+	}
+}
+
+// hookServer starts a webhook receiver that answers with the statuses in order, the last one for the requests
+// left, and records the requests.
+func hookServer(t *testing.T, statuses ...int) (*httptest.Server, <-chan *http.Request, <-chan []byte) {
+	reqs, bodies := make(chan *http.Request, 10), make(chan []byte, 10)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- r
+		bodies <- body
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(svr.Close)
+	return svr, reqs, bodies
+}
+
+// newTestWebhooks returns the webhooks of s, allowed to reach the loopback servers of the tests
+func newTestWebhooks(s WebhookStorage) *Webhooks {
+	w := NewWebhooks(s)
+	w.AllowPrivateHosts = true
+	return w
+}
+
+// changePage registers a webhook of the endpoint and reports a change of FakeURL to it.
+func changePage(ctx context.Context, t *testing.T, w *Webhooks, endpoint string) mongodb.Webhook {
+	wh, err := w.Register(ctx, "j@gmail.com", endpoint, nil)
+	if err != nil {
+		t.Fatal("error registering webhook", err)
+	}
+	old := mongodb.Page{URL: FakeURL, Content: "Hello"}
+	w.PageChanged(ctx, old, mongodb.Page{URL: FakeURL, Content: "Hello, World!", ScrapeDatetime: time.Now().UTC()})
+	return wh
+}
+
+func deliveries(ctx context.Context, t *testing.T, s *memory.Storage, id string) []mongodb.Delivery {
+	d, err := s.Deliveries(ctx, id, 0)
+	if err != nil {
+		t.Fatal("error getting deliveries", err)
+	}
+	return d
+}
+
+func TestWebhooks_Deliver(t *testing.T) {
+	ctx := context.Background()
+	svr, reqs, bodies := hookServer(t, http.StatusNoContent)
+
+	s := memory.NewStorage()
+	w := newTestWebhooks(s)
+	wh := changePage(ctx, t, w, svr.URL)
+	// A webhook of other pages is not notified.
+	if _, err := w.Register(ctx, "k@gmail.com", svr.URL, []string{"http://other.test"}); err != nil {
+		t.Fatal("error registering webhook", err)
+	}
+
+	if err := w.DeliverPending(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	r, body := <-reqs, <-bodies
+	if err := notify.Verify(wh.Secret, r, body, time.Minute); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	got := deliveries(ctx, t, s, wh.ID)
+	if len(got) != 1 || got[0].Status != mongodb.DeliveryDelivered || len(got[0].Attempts) != 1 {
+		t.Fatalf("expected a single delivered delivery, got %+v", got)
+	}
+	if r.Header.Get(EventHeader) != EventPageChanged || r.Header.Get(DeliveryHeader) != got[0].ID {
+		t.Fatalf("unexpected headers %v", r.Header)
+	}
+
+	var ev ChangeEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		t.Fatal("error decoding event", err)
+	}
+	if ev.URL != FakeURL || ev.Diff.AddedLines != 1 || ev.Diff.RemovedLines != 1 {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if len(reqs) != 0 {
+		t.Fatalf("expected a single request, got %d more", len(reqs))
+	}
+}
+
+func TestWebhooks_RegisterPrivateHost(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	for _, endpoint := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://169.254.169.254/latest"} {
+		_, err := NewWebhooks(s).Register(ctx, "j@gmail.com", endpoint, nil)
+		if !errors.Is(err, notify.ErrPrivateHost) {
+			t.Errorf("%s: expected ErrPrivateHost, got %v", endpoint, err)
+		}
+	}
+	if webhooks, _ := s.Webhooks(ctx); len(webhooks) != 0 {
+		t.Fatalf("expected no webhook, got %v", webhooks)
+	}
+	if _, err := newTestWebhooks(s).Register(ctx, "j@gmail.com", "http://127.0.0.1:8080/hook", nil); err != nil {
+		t.Fatalf("expected the private host to be allowed, got %v", err)
+	}
+}
+
+func TestWebhooks_Retry(t *testing.T) {
+	ctx := context.Background()
+	svr, reqs, _ := hookServer(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+
+	s := memory.NewStorage()
+	w := newTestWebhooks(s)
+	w.MaxAttempts, w.Backoff = 2, time.Millisecond
+	wh := changePage(ctx, t, w, svr.URL)
+
+	if err := w.DeliverPending(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	d := deliveries(ctx, t, s, wh.ID)[0]
+	if d.Status != mongodb.DeliveryPending || !strings.Contains(d.Attempts[0].Error, "status 500") {
+		t.Fatalf("expected the delivery to be retried, got %+v", d)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := w.DeliverPending(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if d = deliveries(ctx, t, s, wh.ID)[0]; d.Status != mongodb.DeliveryFailed || len(d.Attempts) != 2 {
+		t.Fatalf("expected the delivery to fail after 2 attempts, got %+v", d)
+	}
+
+	// A failed delivery is only sent again on replay.
+	if err := w.DeliverPending(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	d, err := w.Replay(ctx, d.ID)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if d.Status != mongodb.DeliveryDelivered || len(d.Attempts) != 3 || len(reqs) != 3 {
+		t.Fatalf("expected the replay to be delivered, got %+v after %d requests", d, len(reqs))
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	ctx := context.Background()
+	hook, _, _ := hookServer(t, http.StatusOK)
+
+	s := memory.NewStorage()
+	w := newTestWebhooks(s)
+	svr := httptest.NewServer(WebhookHandler(w))
+	defer svr.Close()
+
+	resp, err := http.Post(svr.URL+"/webhooks", "application/json",
+		strings.NewReader(`{"user_email":"j@gmail.com","endpoint":"`+hook.URL+`"}`))
+	if err != nil {
+		t.Fatal("error registering webhook", err)
+	}
+	var created webhookJSON
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal("error decoding webhook", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created.Secret == "" {
+		t.Fatalf("expected the webhook with its secret, got %d %+v", resp.StatusCode, created)
+	}
+
+	resp, err = http.Get(svr.URL + "/webhooks?email=j@gmail.com")
+	if err != nil {
+		t.Fatal("error listing webhooks", err)
+	}
+	var list []webhookJSON
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal("error decoding webhooks", err)
+	}
+	_ = resp.Body.Close()
+	if len(list) != 1 || list[0].ID != created.ID || list[0].Secret != "" {
+		t.Fatalf("expected the webhook without its secret, got %+v", list)
+	}
+
+	w.PageChanged(ctx, mongodb.Page{URL: FakeURL}, mongodb.Page{URL: FakeURL, Content: "new"})
+	resp, err = http.Get(svr.URL + "/webhooks/" + created.ID + "/deliveries")
+	if err != nil {
+		t.Fatal("error listing deliveries", err)
+	}
+	var got []deliveryJSON
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal("error decoding deliveries", err)
+	}
+	_ = resp.Body.Close()
+	if len(got) != 1 || got[0].Status != mongodb.DeliveryPending {
+		t.Fatalf("expected a pending delivery, got %+v", got)
+	}
+
+	resp, err = http.Post(svr.URL+"/webhooks/deliveries/"+got[0].ID+"/replay", "", nil)
+	if err != nil {
+		t.Fatal("error replaying delivery", err)
+	}
+	var replayed deliveryJSON
+	if err := json.NewDecoder(resp.Body).Decode(&replayed); err != nil {
+		t.Fatal("error decoding delivery", err)
+	}
+	_ = resp.Body.Close()
+	if replayed.Status != mongodb.DeliveryDelivered || len(replayed.Attempts) != 1 {
+		t.Fatalf("expected the delivery to be delivered, got %+v", replayed)
+	}
+
+	tests := []struct {
+		method, path string
+		body         string
+		want         int
+	}{
+		{http.MethodPost, "/webhooks", `{"user_email":"j@gmail.com","endpoint":"not a url"}`, http.StatusBadRequest},
+		{http.MethodPut, "/webhooks", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/webhooks/deliveries/missing/replay", "", http.StatusNotFound},
+		{http.MethodDelete, "/webhooks/" + created.ID, "", http.StatusNoContent},
+		{http.MethodDelete, "/webhooks/" + created.ID, "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, svr.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("error sending request", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestCrawler_OnChange(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	var changes []string
+	c := NewCrawler(1, time.Hour)
+	c.OnChange = func(_ context.Context, old, new mongodb.Page) {
+		changes = append(changes, old.Content+" -> "+new.Content)
+	}
+
+	// The first version and the unchanged ones are not changes.
+	for _, content := range []string{"first", "first", "second"} {
+		f := func(context.Context, string) (string, error) {
+			return content, nil
+		}
+		if _, err := c.CrawlOnce(ctx, s, FakeURL, f); err != nil {
+			t.Fatal("error crawling", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(changes) != 1 || changes[0] != "first -> second" {
+		t.Fatalf("expected a single change, got %v", changes)
+	}
+}
+
+func TestCrawler_OnChangeErrorStatus(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	status := http.StatusOK
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte("first"))
+		}
+	}))
+	defer svr.Close()
+
+	w := newTestWebhooks(s)
+	wh, err := w.Register(ctx, "j@gmail.com", "https://j.test/hook", nil)
+	if err != nil {
+		t.Fatal("error registering webhook", err)
+	}
+	var changes int
+	c := NewCrawler(1, time.Hour)
+	c.OnChange = func(ctx context.Context, old, new mongodb.Page) {
+		changes++
+		w.PageChanged(ctx, old, new)
+	}
+
+	// A failing crawl between two identical versions is neither a version nor a change.
+	for _, status = range []int{http.StatusOK, http.StatusInternalServerError, http.StatusOK} {
+		_, err := c.CrawlOnce(ctx, s, svr.URL, Fetch)
+		if (err != nil) != (status != http.StatusOK) {
+			t.Fatalf("status %d: unexpected error %v", status, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if changes != 0 {
+		t.Fatalf("expected no change, got %d", changes)
+	}
+	if d, err := s.Deliveries(ctx, wh.ID, 0); err != nil || len(d) != 0 {
+		t.Fatalf("expected no delivery, got %v (%v)", d, err)
+	}
+	if history, err := s.PageHistory(ctx, svr.URL, 0); err != nil || len(history) != 2 || history[0].Content != "first" {
+		t.Fatalf("expected the 2 crawls of the page, got %v (%v)", history, err)
+	}
+}